@@ -2,13 +2,31 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/k3s-io/kine/pkg/breaker"
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/credentials"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/encryption"
 	"github.com/k3s-io/kine/pkg/endpoint"
+	"github.com/k3s-io/kine/pkg/events"
 	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/priority"
+	"github.com/k3s-io/kine/pkg/ratelimit"
+	"github.com/k3s-io/kine/pkg/restore"
+	"github.com/k3s-io/kine/pkg/scaffold"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/service"
+	"github.com/k3s-io/kine/pkg/soak"
+	"github.com/k3s-io/kine/pkg/timetravel"
+	"github.com/k3s-io/kine/pkg/tls"
 	"github.com/k3s-io/kine/pkg/version"
 	"github.com/rancher/wrangler/pkg/signals"
 	"github.com/sirupsen/logrus"
@@ -28,6 +46,7 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:        "listen-address",
+			Usage:       "Address to listen on: host:port, unix://<path>, or npipe:////./pipe/<name> on Windows",
 			Value:       "0.0.0.0:2379",
 			Destination: &config.Listener,
 		},
@@ -41,6 +60,22 @@ func main() {
 			Usage:       "CA cert for DB connection",
 			Destination: &config.BackendTLSConfig.CAFile,
 		},
+		cli.StringFlag{
+			Name:        "ca-dir",
+			Usage:       "Directory of PEM CA certs for DB connection, reloaded periodically",
+			Destination: &config.BackendTLSConfig.CADir,
+		},
+		cli.StringFlag{
+			Name:        "ca-url",
+			Usage:       "HTTPS URL of a PEM CA bundle for DB connection, reloaded periodically",
+			Destination: &config.BackendTLSConfig.CAURL,
+		},
+		cli.DurationFlag{
+			Name:        "ca-refresh-interval",
+			Usage:       "How often to reload CA certs for DB connection when loaded from a directory or URL",
+			Destination: &config.BackendTLSConfig.CARefreshInterval,
+			Value:       tls.DefaultCARefreshInterval,
+		},
 		cli.StringFlag{
 			Name:        "cert-file",
 			Usage:       "Certificate for DB connection",
@@ -56,6 +91,58 @@ func main() {
 			Usage:       "Key file for etcd connection",
 			Destination: &config.ServerTLSConfig.KeyFile,
 		},
+		cli.StringFlag{
+			Name:        "server-key-passphrase-file",
+			Usage:       "File containing the passphrase for an encrypted server key file",
+			Destination: &config.ServerTLSConfig.KeyPassphraseFile,
+		},
+		cli.StringFlag{
+			Name:        "server-key-passphrase",
+			Usage:       "Passphrase for an encrypted server key file. Set via the environment variable to keep it out of process arguments.",
+			EnvVar:      "KINE_SERVER_KEY_PASSPHRASE",
+			Destination: &config.ServerTLSConfig.KeyPassphrase,
+		},
+		cli.StringFlag{
+			Name:        "server-key-pkcs11-module",
+			Usage:       "PKCS#11 module used to access a server private key held in an HSM or TPM, instead of the server key file",
+			Destination: &config.ServerTLSConfig.PKCS11.Module,
+		},
+		cli.StringFlag{
+			Name:        "server-key-pkcs11-token-label",
+			Usage:       "Label of the PKCS#11 token holding the server private key",
+			Destination: &config.ServerTLSConfig.PKCS11.TokenLabel,
+		},
+		cli.IntFlag{
+			Name:        "server-key-pkcs11-slot",
+			Usage:       "Slot of the PKCS#11 token holding the server private key, if no token label is set",
+			Destination: &config.ServerTLSConfig.PKCS11.Slot,
+		},
+		cli.StringFlag{
+			Name:        "server-key-pkcs11-key-label",
+			Usage:       "Label of the server private key on the PKCS#11 token",
+			Destination: &config.ServerTLSConfig.PKCS11.KeyLabel,
+		},
+		cli.StringFlag{
+			Name:        "server-key-pkcs11-pin-file",
+			Usage:       "File containing the PIN for the PKCS#11 token",
+			Destination: &config.ServerTLSConfig.PKCS11.PINFile,
+		},
+		cli.StringFlag{
+			Name:        "server-key-pkcs11-pin",
+			Usage:       "PIN for the PKCS#11 token. Set via the environment variable to keep it out of process arguments.",
+			EnvVar:      "KINE_PKCS11_PIN",
+			Destination: &config.ServerTLSConfig.PKCS11.PIN,
+		},
+		cli.StringFlag{
+			Name:        "auth-jwt-public-key-file",
+			Usage:       "Public key or certificate used to verify etcd JWT auth tokens sent by clients. If set, requests without a valid token are rejected",
+			Destination: &config.Auth.JWTPublicKeyFile,
+		},
+		cli.StringFlag{
+			Name:        "auth-simple-token-file",
+			Usage:       "File of accepted etcd simple auth tokens, one \"<token> <username>\" per line. If set, requests without a valid token are rejected. The file is reloaded when it changes",
+			Destination: &config.Auth.SimpleTokenFile,
+		},
 		cli.IntFlag{
 			Name:        "datastore-max-idle-connections",
 			Usage:       "Maximum number of idle connections retained by datastore. If value = 0, the system default will be used. If value < 0, idle connections will not be reused.",
@@ -68,17 +155,251 @@ func main() {
 			Destination: &config.ConnectionPoolConfig.MaxOpen,
 			Value:       0,
 		},
+		cli.BoolFlag{
+			Name:        "datastore-no-ddl",
+			Usage:       "Never create the database, tables, or indexes, so that the datastore credential only needs DML privileges. The schema must be created beforehand, for example by running kine once with a privileged credential",
+			Destination: &config.DialectConfig.NoDDL,
+		},
+		cli.BoolFlag{
+			Name:        "datastore-dry-run",
+			Usage:       "Log SQL statements that would modify the datastore instead of executing them, failing the request. Pending schema migrations are logged rather than applied. Implies --datastore-no-ddl",
+			Destination: &config.DialectConfig.DryRun,
+		},
+		cli.BoolFlag{
+			Name:        "datastore-explain",
+			Usage:       "Log the query plan of each SQL statement",
+			Destination: &config.DialectConfig.Explain,
+		},
+		cli.IntFlag{
+			Name:        "datastore-key-length",
+			Usage:       "Maximum length in bytes of keys, used when creating the kine table. Indexes on MySQL are limited to 3072 bytes, or 768 characters of text keys",
+			Destination: &config.DialectConfig.KeyLength,
+			Value:       generic.DefaultKeyLength,
+		},
+		cli.BoolFlag{
+			Name:        "datastore-binary-keys",
+			Usage:       "Store keys as binary, ordered and compared byte by byte, so that keys need not be valid text. Used when creating the kine table",
+			Destination: &config.DialectConfig.BinaryKeys,
+		},
+		cli.BoolFlag{
+			Name:        "datastore-ttl-column",
+			Usage:       "Record when keys written with a lease expire in the datastore, and expire them by querying it rather than by tracking every key with a lease in memory. Adds the expires_at column to the kine table",
+			Destination: &config.DialectConfig.TTLColumn,
+		},
+		cli.BoolFlag{
+			Name:        "datastore-checksums",
+			Usage:       "Record a checksum of each row written to the datastore, and verify it when the row is read, to detect rows modified or corrupted outside of kine. Adds the checksum column to the kine table",
+			Destination: &config.DialectConfig.Checksums,
+		},
+		cli.BoolFlag{
+			Name:        "verify-checksums",
+			Usage:       "Verify the checksums of all rows of the datastore in the background at startup, logging and counting rows that do not match",
+			Destination: &config.VerifyChecksums,
+		},
+		cli.BoolFlag{
+			Name:        "mssql-columnstore",
+			Usage:       "Add a nonclustered columnstore index to the kine table, to speed up compaction and listing past revisions on large SQL Server databases. Requires SQL Server 2016 or Azure SQL Database",
+			Destination: &config.DialectConfig.Columnstore,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-drift-check-interval",
+			Usage:       "How often to compare the columns and indexes of the kine table to those expected, after the check at startup. If value <= 0, the schema is only checked at startup",
+			Destination: &config.DialectConfig.DriftCheckInterval,
+		},
+		cli.BoolFlag{
+			Name:        "datastore-fix-drift",
+			Usage:       "Create missing indexes on the kine table when schema drift is found, without blocking writes where the datastore supports it",
+			Destination: &config.DialectConfig.FixDrift,
+		},
+		cli.StringFlag{
+			Name:        "table-name",
+			Usage:       "Name of the kine table, so that kine can share a database with other applications or other kine instances. Supported by the SQL backends",
+			Destination: &config.DialectConfig.TableName,
+			Value:       generic.DefaultTableName,
+		},
+		cli.StringFlag{
+			Name:        "cluster-id",
+			Usage:       "Identifier of the cluster stored by this kine instance, so that many clusters can share one database. Each cluster is stored in its own table, named after the table name and the identifier, with its own revisions and compaction",
+			Destination: &config.DialectConfig.ClusterID,
+		},
+		cli.StringFlag{
+			Name:        "schema-name",
+			Usage:       "Schema that holds the kine table, for SQL datastores whose statements may name a schema, such as SQL Server. If unset, the default schema of the connection is used",
+			Destination: &config.DialectConfig.SchemaName,
+		},
+		cli.UintFlag{
+			Name:        "datastore-retry-attempts",
+			Usage:       "Number of times to try a statement that fails with an error the datastore reports as transient, such as a deadlock or failover",
+			Destination: &config.DialectConfig.RetryAttempts,
+			Value:       generic.DefaultRetryAttempts,
+		},
+		cli.Float64Flag{
+			Name:        "datastore-retry-jitter",
+			Usage:       "Shorten each wait between retries of a statement by a random fraction of it up to this, between 0 and 1, so that clients that fail together do not retry together",
+			Destination: &config.DialectConfig.RetryJitter,
+			Value:       0.2,
+		},
+		cli.Int64Flag{
+			Name:        "datastore-initial-revision",
+			Usage:       "Revision to start a new SQL datastore at, for example above the last revision of the etcd cluster it replaces, so that clients never see revisions go backwards. Ignored if the datastore already holds data",
+			Destination: &config.DialectConfig.InitialRevision,
+		},
+		cli.StringFlag{
+			Name:        "datastore-compression",
+			Usage:       "Compress values written to a SQL datastore with 'zstd' or 'snappy'. Values are read whether or not they are compressed, so it can be changed at any time",
+			Destination: &config.DialectConfig.Compression,
+		},
+		cli.StringFlag{
+			Name:        "datastore-encryption-key-file",
+			Usage:       "File of keys to encrypt values written to a SQL datastore with, one 'name:base64 AES key' per line. New values are encrypted with the first key; the others decrypt values written before a rotation. If unset, keys are read from the comma-separated " + encryption.KeysEnv + " environment variable",
+			Destination: &config.DialectConfig.EncryptionKeyFile,
+		},
+		cli.StringFlag{
+			Name:        "datastore-sql-overrides",
+			Usage:       "YAML or JSON file mapping SQL dialect statements, such as CompactSQL or GetSizeSQL, to statements that replace them. Statements must take the same number of ? placeholders as those they replace",
+			Destination: &config.DialectConfig.SQLOverridesFile,
+		},
 		cli.DurationFlag{
 			Name:        "datastore-connection-max-lifetime",
 			Usage:       "Maximum amount of time a connection may be reused. If value <= 0, then there is no limit.",
 			Destination: &config.ConnectionPoolConfig.MaxLifetime,
 			Value:       0,
 		},
+		cli.DurationFlag{
+			Name:        "datastore-connection-max-idle-time",
+			Usage:       "Maximum amount of time a connection may be idle before it is closed. If value <= 0, then there is no limit.",
+			Destination: &config.ConnectionPoolConfig.MaxIdleTime,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-connection-max-lifetime-jitter",
+			Usage:       "Shorten the lifetime of each connection by a random amount up to this, so that connections are not all replaced at once. Requires --datastore-connection-max-lifetime",
+			Destination: &config.ConnectionPoolConfig.MaxLifetimeJitter,
+		},
+		cli.BoolFlag{
+			Name:        "datastore-connection-check-on-checkout",
+			Usage:       "Ping connections before reusing them, replacing those that fail",
+			Destination: &config.ConnectionPoolConfig.CheckOnCheckout,
+		},
+		cli.BoolFlag{
+			Name:        "datastore-prepared-statements",
+			Usage:       "Prepare statements on each connection the first time they are run on it, rather than parsing them on every call",
+			Destination: &config.ConnectionPoolConfig.PreparedStatements,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-resume-timeout",
+			Usage:       "Maximum amount of time to retry connecting to a datastore that is resuming from a pause, such as an Azure SQL serverless database. If value <= 0, connections are not retried.",
+			Destination: &config.ConnectionPoolConfig.ResumeTimeout,
+			Value:       generic.DefaultResumeTimeout,
+		},
+		cli.BoolFlag{
+			Name:        "datastore-read-pool",
+			Usage:       "Use a separate connection pool for reads, so that slow reads cannot take every connection needed for writes",
+			Destination: &config.ConnectionPoolConfig.ReadPool,
+		},
+		cli.IntFlag{
+			Name:        "datastore-read-pool-max-idle-connections",
+			Usage:       "Maximum number of idle connections retained by the read pool. If value = 0, the system default will be used. If value < 0, idle connections will not be reused.",
+			Destination: &config.ConnectionPoolConfig.ReadMaxIdle,
+		},
+		cli.IntFlag{
+			Name:        "datastore-read-pool-max-open-connections",
+			Usage:       "Maximum number of open connections used by the read pool. If value <= 0, then there is no limit",
+			Destination: &config.ConnectionPoolConfig.ReadMaxOpen,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-startup-timeout",
+			Usage:       "Maximum amount of time to retry connecting to and setting up the datastore at startup, while reporting not ready on /readyz. If value <= 0, startup fails on the first error.",
+			Destination: &config.StartupTimeout,
+			Value:       5 * time.Minute,
+		},
+		cli.BoolFlag{
+			Name:        "warmup",
+			Usage:       "Before reporting ready, open the datastore connection pool, check that the list queries use their indexes, and start watching from the current revision",
+			Destination: &config.Warmup,
+		},
+		cli.DurationFlag{
+			Name:        "warmup-timeout",
+			Usage:       "Maximum amount of time to spend warming up before starting anyway",
+			Destination: &config.WarmupTimeout,
+			Value:       time.Minute,
+		},
 		cli.StringFlag{
 			Name:        "key-file",
 			Usage:       "Key file for DB connection",
 			Destination: &config.BackendTLSConfig.KeyFile,
 		},
+		cli.StringFlag{
+			Name:        "datastore-vault-creds-path",
+			Usage:       "Path of a Vault database secrets engine role to fetch short-lived DB credentials from, for example database/creds/kine",
+			Destination: &config.Credentials.VaultCredsPath,
+		},
+		cli.StringFlag{
+			Name:        "key-passphrase-file",
+			Usage:       "File containing the passphrase for an encrypted DB connection key file",
+			Destination: &config.BackendTLSConfig.KeyPassphraseFile,
+		},
+		cli.StringFlag{
+			Name:        "key-passphrase",
+			Usage:       "Passphrase for an encrypted DB connection key file. Set via the environment variable to keep it out of process arguments.",
+			EnvVar:      "KINE_KEY_PASSPHRASE",
+			Destination: &config.BackendTLSConfig.KeyPassphrase,
+		},
+		cli.StringFlag{
+			Name:        "datastore-password-file",
+			Usage:       "File containing the DB password, which replaces any password in the endpoint. The file is re-read when it changes.",
+			EnvVar:      "KINE_DATASTORE_PASSWORD_FILE",
+			Destination: &config.Credentials.PasswordFile,
+		},
+		cli.StringFlag{
+			Name:        "datastore-password",
+			Usage:       "DB password, which replaces any password in the endpoint. Set via the environment variable to keep it out of process arguments.",
+			EnvVar:      "KINE_DATASTORE_PASSWORD",
+			Destination: &config.Credentials.Password,
+		},
+		cli.StringFlag{
+			Name:        "datastore-secret",
+			Usage:       "Cloud secret holding the DB username and password, or dsn, as aws-secretsmanager://<region>/<secret-id>, gcp-secretmanager://projects/<project>/secrets/<secret>, or azure-keyvault://<vault>/<secret>",
+			Destination: &config.Credentials.Secret,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-secret-refresh-interval",
+			Usage:       "How often to re-read the datastore secret. Connections are recycled within this interval after the secret rotates.",
+			Destination: &config.Credentials.SecretRefreshInterval,
+			Value:       credentials.DefaultSecretRefreshInterval,
+		},
+		cli.BoolFlag{
+			Name:        "datastore-aws-iam-auth",
+			Usage:       "Authenticate to Aurora or RDS MySQL and Postgres with IAM authentication tokens, signed with the AWS credentials of the environment or instance, instead of a password",
+			Destination: &config.Credentials.AWSIAMAuth,
+		},
+		cli.StringFlag{
+			Name:        "datastore-aws-iam-region",
+			Usage:       "AWS region of the database for IAM authentication. Defaults to AWS_REGION, or the region in the endpoint hostname.",
+			Destination: &config.Credentials.AWSIAMRegion,
+		},
+		cli.StringFlag{
+			Name:        "vault-address",
+			Usage:       "Address of the Vault server used for DB credentials",
+			EnvVar:      "VAULT_ADDR",
+			Destination: &config.Credentials.VaultAddress,
+		},
+		cli.StringFlag{
+			Name:        "vault-token",
+			Usage:       "Token used to authenticate to Vault",
+			EnvVar:      "VAULT_TOKEN",
+			Destination: &config.Credentials.VaultToken,
+		},
+		cli.StringFlag{
+			Name:        "vault-token-file",
+			Usage:       "File containing the token used to authenticate to Vault, re-read whenever credentials are fetched",
+			Destination: &config.Credentials.VaultTokenFile,
+		},
+		cli.StringFlag{
+			Name:        "vault-ca-file",
+			Usage:       "CA cert for Vault connection",
+			EnvVar:      "VAULT_CACERT",
+			Destination: &config.Credentials.VaultCAFile,
+		},
 		cli.StringFlag{
 			Name:        "metrics-bind-address",
 			Usage:       "The address the metric endpoint binds to. Default :8080, set 0 to disable metrics serving.",
@@ -91,9 +412,439 @@ func main() {
 			Destination: &metrics.SlowSQLThreshold,
 			Value:       time.Second,
 		},
+		cli.BoolFlag{
+			Name:        "leader-elect",
+			Usage:       "Run in active-passive mode, only accepting writes while holding a leader lease stored in the datastore",
+			Destination: &config.LeaderElection.Enabled,
+		},
+		cli.StringFlag{
+			Name:        "leader-elect-identity",
+			Usage:       "Identity used when holding the leader lease. Defaults to the hostname.",
+			Destination: &config.LeaderElection.Identity,
+		},
+		cli.DurationFlag{
+			Name:        "leader-elect-lease-duration",
+			Usage:       "Duration that a standby waits after the last leader lease renewal before taking over",
+			Destination: &config.LeaderElection.LeaseDuration,
+			Value:       15 * time.Second,
+		},
+		cli.StringFlag{
+			Name:        "emulated-etcd-version",
+			Usage:       "etcd server version to advertise to clients",
+			Destination: &config.Features.EtcdVersion,
+			Value:       server.DefaultEtcdVersion,
+		},
+		cli.StringFlag{
+			Name:        "emulated-etcd-cluster-version",
+			Usage:       "etcd cluster version to advertise to clients. Defaults to the emulated etcd version.",
+			Destination: &config.Features.ClusterVersion,
+		},
+		cli.StringFlag{
+			Name:  "feature-gates",
+			Usage: "Comma-separated list of Name=bool pairs enabling optional etcd behaviors. Supported: " + server.FeatureWatchProgressNotify + ", " + server.FeatureWatchProgressRequest,
+		},
+		cli.DurationFlag{
+			Name:        "watch-progress-notify-interval",
+			Usage:       "Interval between progress notifications sent to idle watches that request them, when " + server.FeatureWatchProgressNotify + " is enabled",
+			Destination: &config.Features.WatchProgressNotifyInterval,
+			Value:       server.DefaultWatchProgressNotifyInterval,
+		},
+		cli.StringFlag{
+			Name:        "cdc-prefix",
+			Usage:       "Only publish change events for keys with this prefix, which must end in a slash",
+			Value:       "/",
+			Destination: &config.CDC.Prefix,
+		},
+		cli.BoolFlag{
+			Name:        "cdc-include-values",
+			Usage:       "Include key values in published change events",
+			Destination: &config.CDC.IncludeValues,
+		},
+		cli.StringFlag{
+			Name:        "cdc-kafka-brokers",
+			Usage:       "Comma-separated list of Kafka brokers to publish change events to. Requires a binary built with \"-tags kafka\"",
+			Destination: &config.CDC.Kafka.Brokers,
+		},
+		cli.StringFlag{
+			Name:        "cdc-kafka-topic",
+			Usage:       "Kafka topic to publish change events to",
+			Value:       "kine",
+			Destination: &config.CDC.Kafka.Topic,
+		},
+		cli.StringFlag{
+			Name:        "cdc-kafka-ca-file",
+			Usage:       "CA cert for Kafka connection",
+			Destination: &config.CDC.Kafka.TLS.CAFile,
+		},
+		cli.StringFlag{
+			Name:        "cdc-kafka-cert-file",
+			Usage:       "Certificate for Kafka connection",
+			Destination: &config.CDC.Kafka.TLS.CertFile,
+		},
+		cli.StringFlag{
+			Name:        "cdc-kafka-key-file",
+			Usage:       "Key file for Kafka connection",
+			Destination: &config.CDC.Kafka.TLS.KeyFile,
+		},
+		cli.StringFlag{
+			Name:        "cdc-nats-url",
+			Usage:       "NATS server URL to publish change events to",
+			Destination: &config.CDC.NATS.URL,
+		},
+		cli.StringFlag{
+			Name:        "cdc-nats-subject-map",
+			Usage:       "Comma-separated list of <key-prefix>=<subject> mappings for NATS change events, for example /registry/secrets/=kine.secrets",
+			Destination: &config.CDC.NATS.SubjectMap,
+		},
+		cli.StringFlag{
+			Name:        "cdc-nats-subject",
+			Usage:       "NATS subject for change events that do not match a subject mapping. If not set, such events are not published",
+			Destination: &config.CDC.NATS.Subject,
+		},
+		cli.StringFlag{
+			Name:        "cdc-nats-ca-file",
+			Usage:       "CA cert for NATS connection",
+			Destination: &config.CDC.NATS.TLS.CAFile,
+		},
+		cli.StringFlag{
+			Name:        "cdc-nats-cert-file",
+			Usage:       "Certificate for NATS connection",
+			Destination: &config.CDC.NATS.TLS.CertFile,
+		},
+		cli.StringFlag{
+			Name:        "cdc-nats-key-file",
+			Usage:       "Key file for NATS connection",
+			Destination: &config.CDC.NATS.TLS.KeyFile,
+		},
+		cli.StringFlag{
+			Name:        "webhook-urls",
+			Usage:       "Comma-separated list of HTTPS endpoints to POST signed JSON change events to",
+			Destination: &config.CDC.Webhook.URLs,
+		},
+		cli.StringFlag{
+			Name:        "webhook-prefixes",
+			Usage:       "Comma-separated list of key prefixes to send webhook change events for, for example /registry/secrets/",
+			Destination: &config.CDC.Webhook.Prefixes,
+		},
+		cli.StringFlag{
+			Name:        "webhook-secret-file",
+			Usage:       "File containing the key used to sign webhook requests with HMAC-SHA256",
+			Destination: &config.CDC.Webhook.SecretFile,
+		},
+		cli.StringFlag{
+			Name:        "webhook-secret",
+			Usage:       "Key used to sign webhook requests with HMAC-SHA256. Set via the environment variable to keep it out of process arguments.",
+			EnvVar:      "KINE_WEBHOOK_SECRET",
+			Destination: &config.CDC.Webhook.Secret,
+		},
+		cli.StringFlag{
+			Name:        "webhook-ca-file",
+			Usage:       "CA cert for webhook connections",
+			Destination: &config.CDC.Webhook.TLS.CAFile,
+		},
+		cli.StringFlag{
+			Name:        "mirror-etcd-endpoints",
+			Usage:       "Comma-separated list of etcd endpoints to asynchronously apply all writes to, for a warm-standby etcd cluster",
+			Destination: &config.CDC.Mirror.Endpoints,
+		},
+		cli.StringFlag{
+			Name:        "mirror-etcd-ca-file",
+			Usage:       "CA cert for etcd mirror connection",
+			Destination: &config.CDC.Mirror.TLS.CAFile,
+		},
+		cli.StringFlag{
+			Name:        "mirror-etcd-cert-file",
+			Usage:       "Certificate for etcd mirror connection",
+			Destination: &config.CDC.Mirror.TLS.CertFile,
+		},
+		cli.StringFlag{
+			Name:        "mirror-etcd-key-file",
+			Usage:       "Key file for etcd mirror connection",
+			Destination: &config.CDC.Mirror.TLS.KeyFile,
+		},
+		cli.StringFlag{
+			Name:        "replica-endpoint",
+			Usage:       "Secondary SQL storage endpoint to asynchronously copy all changes to, for a warm standby. Use the promote command before switching to it",
+			Destination: &config.ReplicaEndpoint,
+		},
+		cli.StringFlag{
+			Name:        "datastore-reader-endpoint",
+			Usage:       "Read replica of the SQL storage endpoint, with its own credentials, to serve serializable reads, counts and polls for changes from. Supported by the mysql, postgres and mssql backends",
+			Destination: &config.ReaderEndpoint,
+		},
+		cli.BoolFlag{
+			Name:        "metrics-etcd-compat",
+			Usage:       "Also expose metrics under the etcd names used by common dashboards and alerts. Do not enable if queries sum across both names",
+			Destination: &config.EtcdCompatMetrics,
+		},
+		cli.Float64Flag{
+			Name:        "event-rate-limit-qps",
+			Usage:       "Maximum rate of Kubernetes event creation per involved object. Events in excess of the limit are dropped. If value <= 0, there is no limit",
+			Destination: &config.EventRateLimit.QPS,
+		},
+		cli.IntFlag{
+			Name:        "event-rate-limit-burst",
+			Usage:       "Number of Kubernetes events per involved object that may be created in a burst above the rate limit",
+			Value:       10,
+			Destination: &config.EventRateLimit.Burst,
+		},
+		cli.DurationFlag{
+			Name:        "event-coalesce-interval",
+			Usage:       "Minimum time between updates to the same Kubernetes event as duplicates are aggregated. Updates within the interval are dropped. If value <= 0, updates are not coalesced",
+			Destination: &config.EventRateLimit.CoalesceInterval,
+		},
+		cli.StringFlag{
+			Name:        "event-rate-limit-prefix",
+			Usage:       "Key prefix of the Kubernetes events to limit",
+			Value:       ratelimit.DefaultEventPrefix,
+			Destination: &config.EventRateLimit.Prefix,
+		},
+		cli.StringFlag{
+			Name:        "events-table",
+			Usage:       "Name of a SQL table to store Kubernetes events in, apart from all other keys, with its own compaction and TTL. If unset, events are stored with all other keys",
+			Destination: &config.Events.Table,
+		},
+		cli.StringFlag{
+			Name:        "events-prefix",
+			Usage:       "Key prefix of the Kubernetes events stored in the events table",
+			Value:       events.DefaultPrefix,
+			Destination: &config.Events.Prefix,
+		},
+		cli.DurationFlag{
+			Name:        "events-ttl",
+			Usage:       "Longest time that a Kubernetes event is kept in the events table, regardless of the TTL requested by the apiserver. If value <= 0, the requested TTL is kept",
+			Destination: &config.Events.TTL,
+		},
+		cli.DurationFlag{
+			Name:        "events-compact-interval",
+			Usage:       "Time between compactions of the events table",
+			Value:       time.Minute,
+			Destination: &config.Events.Compact.Interval,
+		},
+		cli.Int64Flag{
+			Name:        "events-compact-min-retain",
+			Usage:       "Number of most recent revisions of the events table that are never compacted",
+			Value:       100,
+			Destination: &config.Events.Compact.MinRetain,
+		},
+		cli.IntFlag{
+			Name:        "priority-max-in-flight",
+			Usage:       "Number of datastore requests that may be in flight before requests are queued and admitted by priority, lease and health check requests first and lists and event writes last. If value <= 0, requests are not prioritized",
+			Destination: &config.Priority.MaxInFlight,
+		},
+		cli.StringFlag{
+			Name:  "priority-critical-prefixes",
+			Usage: "Comma-separated key prefixes of requests admitted first",
+			Value: strings.Join(priority.DefaultCriticalPrefixes, ","),
+		},
+		cli.StringFlag{
+			Name:  "priority-bulk-prefixes",
+			Usage: "Comma-separated key prefixes of writes admitted last, along with lists",
+			Value: strings.Join(priority.DefaultBulkPrefixes, ","),
+		},
+		cli.IntFlag{
+			Name:        "datastore-breaker-failures",
+			Usage:       "Number of consecutive failed datastore calls after which calls fail fast with Unavailable until a probe succeeds. If value <= 0, calls are never failed fast",
+			Destination: &config.Breaker.Failures,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-breaker-cooldown",
+			Usage:       "How long datastore calls fail fast before a single call is let through to probe the datastore",
+			Value:       breaker.DefaultCooldown,
+			Destination: &config.Breaker.Cooldown,
+		},
+		cli.DurationFlag{
+			Name:        "fault-injection-latency",
+			Usage:       "Latency to add to every datastore call. Requires a binary built with the faultinject tag",
+			Destination: &config.FaultInjection.Latency,
+		},
+		cli.DurationFlag{
+			Name:        "fault-injection-latency-jitter",
+			Usage:       "Upper bound of a random latency to add to every datastore call. Requires a binary built with the faultinject tag",
+			Destination: &config.FaultInjection.LatencyJitter,
+		},
+		cli.Float64Flag{
+			Name:        "fault-injection-error-rate",
+			Usage:       "Fraction of datastore calls, between 0 and 1, to fail. Requires a binary built with the faultinject tag",
+			Destination: &config.FaultInjection.ErrorRate,
+		},
+		cli.Int64Flag{
+			Name:        "fault-injection-seed",
+			Usage:       "Seed for random latency and errors, so that a sequence of faults can be reproduced",
+			Destination: &config.FaultInjection.Seed,
+		},
+		cli.DurationFlag{
+			Name:        "revision-clock-interval",
+			Usage:       "How often to record the current time in the datastore, so that the time-travel command can resolve times to revisions. If value <= 0, the time is not recorded",
+			Value:       timetravel.DefaultInterval,
+			Destination: &config.RevisionClockInterval,
+		},
+		cli.IntFlag{
+			Name:        "watch-buffer-size",
+			Usage:       "Number of event batches buffered for each watcher of a SQL datastore",
+			Value:       broadcaster.DefaultBufferSize,
+			Destination: &config.Watch.BufferSize,
+		},
+		cli.StringFlag{
+			Name:  "watch-buffer-policy",
+			Usage: "What to do when a watcher's buffer is full: 'cancel' closes the watch so that the client re-watches, 'block' delays all watchers until it has room or --watch-buffer-block-timeout expires",
+			Value: string(broadcaster.PolicyCancel),
+		},
+		cli.DurationFlag{
+			Name:        "watch-buffer-block-timeout",
+			Usage:       "How long the 'block' watch buffer policy waits for a watcher before closing the watch. If value <= 0, it waits indefinitely",
+			Destination: &config.Watch.BlockTimeout,
+		},
+		cli.IntFlag{
+			Name:        "write-batch-size",
+			Usage:       "Largest number of concurrent writes to a SQL datastore inserted in one transaction. If value <= 1, writes are not batched",
+			Destination: &config.WriteBatch.MaxSize,
+		},
+		cli.DurationFlag{
+			Name:        "write-batch-latency",
+			Usage:       "How long a batched write waits for others to join its batch. If value <= 0, a batch holds the writes queued while the previous batch was committed",
+			Destination: &config.WriteBatch.MaxLatency,
+		},
+		cli.StringFlag{
+			Name:  "windows-service-name",
+			Usage: "Name of the Windows service and event log source, when run by the service control manager",
+			Value: "kine",
+		},
 		cli.BoolFlag{Name: "debug"},
 	}
 	app.Action = run
+	app.Commands = []cli.Command{
+		{
+			Name:  "repair",
+			Usage: "Detect and fix duplicate rows, broken revision chains, and a stuck compact revision in the datastore",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Report problems without modifying the datastore",
+				},
+			},
+			Action: repair,
+		},
+		{
+			Name:   "promote",
+			Usage:  "Prepare a secondary datastore populated by --replica-endpoint to be used as the primary. Set --endpoint to the secondary, and stop replication to it first",
+			Action: promote,
+		},
+		{
+			Name:  "soak",
+			Usage: "Run a randomized workload against the datastore, continuously verifying revision ordering, read consistency, and watch completeness. Only use a datastore dedicated to testing",
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "duration",
+					Usage: "How long to run for. If value <= 0, runs until interrupted",
+					Value: time.Hour,
+				},
+				cli.IntFlag{
+					Name:  "workers",
+					Usage: "Number of concurrent writers",
+					Value: 8,
+				},
+				cli.IntFlag{
+					Name:  "keys",
+					Usage: "Number of keys written by each worker",
+					Value: 100,
+				},
+				cli.Int64Flag{
+					Name:  "seed",
+					Usage: "Seed for the random workload. If value = 0, the current time is used",
+				},
+				cli.DurationFlag{
+					Name:  "compact-interval",
+					Usage: "How often to compact the datastore. If value <= 0, only the datastore's own compaction runs",
+					Value: time.Minute,
+				},
+				cli.DurationFlag{
+					Name:  "resubscribe-interval",
+					Usage: "How often to restart the watch from the last revision received",
+					Value: 10 * time.Second,
+				},
+				cli.StringFlag{
+					Name:  "prefix",
+					Usage: "Key prefix used by the workload",
+					Value: "/soak/",
+				},
+			},
+			Action: soakTest,
+		},
+		{
+			Name:      "new-driver",
+			Usage:     "Generate the skeleton of a new SQL driver package, registered for endpoint URLs with the driver name as the scheme",
+			ArgsUsage: "<name>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "root",
+					Usage: "Root of the kine source tree",
+					Value: ".",
+				},
+			},
+			Action: newDriver,
+		},
+		{
+			Name:  "time-travel",
+			Usage: "Print the keys as they were at a point in time, as JSON lines, for times within the history retained by compaction and recorded by --revision-clock-interval",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "time",
+					Usage: "Point in time, in RFC 3339 format, for example 2024-05-01T12:00:00Z",
+				},
+				cli.StringFlag{
+					Name:  "prefix",
+					Usage: "Only print keys with the prefix",
+					Value: "/",
+				},
+			},
+			Action: timeTravel,
+		},
+		{
+			Name:  "restore",
+			Usage: "Roll keys back to their values at an earlier revision that has not been compacted, by writing them again as new revisions",
+			Flags: []cli.Flag{
+				cli.Int64Flag{
+					Name:  "to-revision",
+					Usage: "Revision to restore to",
+				},
+				cli.StringFlag{
+					Name:  "prefix",
+					Usage: "Only restore keys with the prefix",
+					Value: "/",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Print the changes that would be made without making them",
+				},
+				cli.BoolFlag{
+					Name:  "yes",
+					Usage: "Make the changes without prompting for confirmation",
+				},
+			},
+			Action: restoreRevision,
+		},
+		{
+			Name:  "clone",
+			Usage: "Copy keys as they were at a revision into another datastore, for example to seed a staging control plane. Revisions are not preserved",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "target-endpoint",
+					Usage: "Storage endpoint to copy keys to. It must not have any keys with the prefix",
+				},
+				cli.Int64Flag{
+					Name:  "revision",
+					Usage: "Revision to copy keys at. If value = 0, the current revision is used",
+				},
+				cli.StringFlag{
+					Name:  "prefix",
+					Usage: "Only copy keys with the prefix",
+					Value: "/",
+				},
+			},
+			Action: cloneKeyspace,
+		},
+	}
 
 	if err := app.Run(os.Args); err != nil {
 		if !errors.Is(err, context.Canceled) {
@@ -106,7 +857,34 @@ func run(c *cli.Context) error {
 	if c.Bool("debug") {
 		logrus.SetLevel(logrus.TraceLevel)
 	}
-	ctx := signals.SetupSignalHandler(context.Background())
+	if err := config.Features.ParseFeatureGates(c.String("feature-gates")); err != nil {
+		return err
+	}
+	policy, err := broadcaster.ParsePolicy(c.String("watch-buffer-policy"))
+	if err != nil {
+		return err
+	}
+	config.Watch.Policy = policy
+	config.Priority.CriticalPrefixes = splitList(c.String("priority-critical-prefixes"))
+	config.Priority.BulkPrefixes = splitList(c.String("priority-bulk-prefixes"))
+	if ok, err := service.Run(c.String("windows-service-name"), serve); ok {
+		return err
+	}
+	return serve(signals.SetupSignalHandler(context.Background()))
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func serve(ctx context.Context) error {
 	metricsConfig.ServerTLSConfig = config.ServerTLSConfig
 	go metrics.Serve(ctx, metricsConfig)
 	config.MetricsRegisterer = metrics.Registry
@@ -117,3 +895,154 @@ func run(c *cli.Context) error {
 	<-ctx.Done()
 	return ctx.Err()
 }
+
+func repair(c *cli.Context) error {
+	if c.GlobalBool("debug") {
+		logrus.SetLevel(logrus.TraceLevel)
+	}
+	ctx := signals.SetupSignalHandler(context.Background())
+	dryRun := c.Bool("dry-run")
+	issues, err := endpoint.Repair(ctx, config, dryRun)
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		logrus.Infof("%s", issue)
+	}
+	logrus.Infof("Found %d problems (dry-run=%v)", len(issues), dryRun)
+	return nil
+}
+
+func promote(c *cli.Context) error {
+	if c.GlobalBool("debug") {
+		logrus.SetLevel(logrus.TraceLevel)
+	}
+	ctx := signals.SetupSignalHandler(context.Background())
+	rev, err := endpoint.Promote(ctx, config)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Promoted datastore at revision %d", rev)
+	return nil
+}
+
+func soakTest(c *cli.Context) error {
+	if c.GlobalBool("debug") {
+		logrus.SetLevel(logrus.TraceLevel)
+	}
+	ctx := signals.SetupSignalHandler(context.Background())
+	soakConfig := soak.Config{
+		Prefix:              c.String("prefix"),
+		Duration:            c.Duration("duration"),
+		Workers:             c.Int("workers"),
+		Keys:                c.Int("keys"),
+		Seed:                c.Int64("seed"),
+		CompactInterval:     c.Duration("compact-interval"),
+		ResubscribeInterval: c.Duration("resubscribe-interval"),
+	}
+	if soakConfig.Seed == 0 {
+		soakConfig.Seed = time.Now().UnixNano()
+	}
+	logrus.Infof("Starting soak test with seed %d", soakConfig.Seed)
+	stats, err := endpoint.Soak(ctx, config, soakConfig)
+	if stats != nil {
+		logrus.Infof("Soak test completed: %s", stats)
+	}
+	if err != nil {
+		return err
+	}
+	logrus.Infof("No invariant violations found")
+	return nil
+}
+
+func newDriver(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected a driver name")
+	}
+	files, err := scaffold.Driver(c.String("root"), c.Args().First())
+	for _, file := range files {
+		logrus.Infof("Created %s", file)
+	}
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Complete the TODOs in the generated files, then run the conformance tests against a test datastore")
+	return nil
+}
+
+func timeTravel(c *cli.Context) error {
+	if c.GlobalBool("debug") {
+		logrus.SetLevel(logrus.TraceLevel)
+	}
+	t, err := time.Parse(time.RFC3339, c.String("time"))
+	if err != nil {
+		return fmt.Errorf("invalid time %q: %v", c.String("time"), err)
+	}
+	ctx := signals.SetupSignalHandler(context.Background())
+	res, kvs, err := endpoint.TimeTravel(ctx, config, t, c.String("prefix"))
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Resolved %s to revision %d, written at %s; revisions up to %d may also have been written by then",
+		t.Format(time.RFC3339), res.Revision, res.Time.Format(time.RFC3339), res.UpperRevision)
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, kv := range kvs {
+		if err := enc.Encode(kv); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Listed %d keys at revision %d", len(kvs), res.Revision)
+	return nil
+}
+
+func restoreRevision(c *cli.Context) error {
+	if c.GlobalBool("debug") {
+		logrus.SetLevel(logrus.TraceLevel)
+	}
+	revision := c.Int64("to-revision")
+	if revision <= 0 {
+		return fmt.Errorf("--to-revision is required")
+	}
+	ctx := signals.SetupSignalHandler(context.Background())
+
+	confirm := func(plan *restore.Plan) bool {
+		for _, change := range plan.Changes {
+			fmt.Println(change)
+		}
+		if c.Bool("dry-run") {
+			return false
+		}
+		if c.Bool("yes") {
+			return true
+		}
+		fmt.Printf("%d keys under %s will be restored to their values at revision %d. Type the revision to confirm: ", len(plan.Changes), plan.Prefix, plan.Revision)
+		var answer string
+		fmt.Scanln(&answer)
+		return answer == strconv.FormatInt(plan.Revision, 10)
+	}
+
+	plan, result, err := endpoint.Restore(ctx, config, revision, c.String("prefix"), confirm)
+	if result != nil {
+		logrus.Infof("Restored %d keys to revision %d, %d keys were not restored as they changed during the restore", result.Applied, revision, len(result.Conflicts))
+	} else if plan != nil {
+		logrus.Infof("No changes made, %d keys differ from revision %d", len(plan.Changes), revision)
+	}
+	return err
+}
+
+func cloneKeyspace(c *cli.Context) error {
+	if c.GlobalBool("debug") {
+		logrus.SetLevel(logrus.TraceLevel)
+	}
+	if c.String("target-endpoint") == "" {
+		return fmt.Errorf("--target-endpoint is required")
+	}
+	ctx := signals.SetupSignalHandler(context.Background())
+	rev, copied, err := endpoint.Clone(ctx, config, c.String("target-endpoint"), c.Int64("revision"), c.String("prefix"))
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Copied %d keys under %s at revision %d", copied, c.String("prefix"), rev)
+	return nil
+}
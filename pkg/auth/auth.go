@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// healthService is exempt from authentication, so that load balancers and
+// probes can check the server without a token.
+const healthService = "/grpc.health.v1.Health/"
+
+var (
+	ErrTokenRequired = rpctypes.ErrGRPCUserEmpty
+	ErrInvalidToken  = rpctypes.ErrGRPCInvalidAuthToken
+)
+
+// Config configures validation of etcd-style auth tokens on incoming RPCs. The
+// tokens are issued by an external identity source; kine does not implement the
+// etcd Auth service and cannot issue tokens itself.
+type Config struct {
+	// JWTPublicKeyFile is a PEM public key or certificate used to verify JWT
+	// tokens, as issued by etcd with --auth-token=jwt. RSA, RSA-PSS, and ECDSA
+	// signatures are supported.
+	JWTPublicKeyFile string
+	// SimpleTokenFile lists accepted simple tokens, one per line as
+	// "<token> <username>". The file is reloaded when it changes.
+	SimpleTokenFile string
+}
+
+// Enabled returns true if any token source is configured.
+func (c Config) Enabled() bool {
+	return c.JWTPublicKeyFile != "" || c.SimpleTokenFile != ""
+}
+
+// Authenticator validates the token sent by etcd clients in the request
+// metadata, rejecting requests without a valid token.
+type Authenticator struct {
+	jwt    *jwtVerifier
+	simple *simpleTokens
+}
+
+func New(config Config) (*Authenticator, error) {
+	a := &Authenticator{}
+	if config.JWTPublicKeyFile != "" {
+		v, err := newJWTVerifier(config.JWTPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = v
+	}
+	if config.SimpleTokenFile != "" {
+		s, err := newSimpleTokens(config.SimpleTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		a.simple = s
+	}
+	return a, nil
+}
+
+// Authenticate returns the username for the token in the context metadata.
+func (a *Authenticator) Authenticate(ctx context.Context) (string, error) {
+	token := tokenFromContext(ctx)
+	if token == "" {
+		return "", ErrTokenRequired
+	}
+
+	// JWTs always contain two dots, which simple tokens issued by etcd do not.
+	if a.jwt != nil && strings.Count(token, ".") == 2 {
+		username, err := a.jwt.verify(token)
+		if err != nil {
+			logrus.Debugf("AUTH invalid JWT: %v", err)
+			return "", ErrInvalidToken
+		}
+		return username, nil
+	}
+
+	if a.simple != nil {
+		if username, ok := a.simple.lookup(token); ok {
+			return username, nil
+		}
+	}
+	return "", ErrInvalidToken
+}
+
+// UnaryServerInterceptor rejects unary RPCs without a valid token.
+func (a *Authenticator) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, healthService) {
+			if _, err := a.Authenticate(ctx); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rejects streaming RPCs without a valid token.
+func (a *Authenticator) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !strings.HasPrefix(info.FullMethod, healthService) {
+			if _, err := a.Authenticate(ss.Context()); err != nil {
+				return err
+			}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// tokenFromContext returns the token from the metadata key used by etcd clients,
+// or from a standard bearer authorization header.
+func tokenFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if ts := md.Get(rpctypes.TokenFieldNameGRPC); len(ts) > 0 {
+		return ts[0]
+	}
+	if ts := md.Get("authorization"); len(ts) > 0 {
+		return strings.TrimPrefix(ts[0], "Bearer ")
+	}
+	return ""
+}
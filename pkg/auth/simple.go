@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// simpleTokens holds the accepted simple tokens, reloading the token file when
+// its modification time or size changes so that tokens can be rotated without
+// restarting kine.
+type simpleTokens struct {
+	sync.RWMutex
+	file    string
+	modTime time.Time
+	size    int64
+	tokens  map[string]string
+}
+
+func newSimpleTokens(file string) (*simpleTokens, error) {
+	s := &simpleTokens{file: file}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *simpleTokens) load() error {
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return err
+	}
+
+	s.RLock()
+	unchanged := s.tokens != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size
+	s.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid entry on line %d of token file %s, expected \"<token> <username>\"", line, s.file)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.tokens = tokens
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return nil
+}
+
+func (s *simpleTokens) lookup(token string) (string, bool) {
+	if err := s.load(); err != nil {
+		logrus.Errorf("Failed to reload token file, continuing to use existing tokens: %v", err)
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	for t, username := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return username, true
+		}
+	}
+	return "", false
+}
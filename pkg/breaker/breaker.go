@@ -0,0 +1,146 @@
+// Package breaker fails calls from kine to the SQL dialect fast while the
+// datastore is down, rather than queueing them on a pool that cannot connect,
+// and probes the datastore to recover once it is back.
+package breaker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultCooldown is how long the breaker stays open before probing the
+// datastore if not configured.
+const DefaultCooldown = 10 * time.Second
+
+// ErrOpen is returned by dialect calls that are not attempted because the
+// breaker is open.
+var ErrOpen = status.Error(codes.Unavailable, "kine: datastore is unavailable")
+
+type Config struct {
+	// Failures is the number of consecutive failed dialect calls that open
+	// the breaker. Zero disables the breaker.
+	Failures int
+	// Cooldown is how long the breaker stays open before a single call is let
+	// through to probe the datastore. Zero means DefaultCooldown.
+	Cooldown time.Duration
+}
+
+// Enabled returns true if the breaker is configured.
+func (c Config) Enabled() bool {
+	return c.Failures > 0
+}
+
+func (c Config) cooldown() time.Duration {
+	if c.Cooldown <= 0 {
+		return DefaultCooldown
+	}
+	return c.Cooldown
+}
+
+type state int
+
+const (
+	stateClosed state = iota
+	stateOpen
+	stateHalfOpen
+)
+
+// breaker counts consecutive failures. It is closed while the datastore
+// answers, open while calls fail fast, and half-open while a single call probes
+// the datastore after the cooldown.
+type breaker struct {
+	config Config
+
+	mu       sync.Mutex
+	state    state
+	failures int
+	openedAt time.Time
+}
+
+// allow returns ErrOpen if a call must fail fast. If the cooldown has passed,
+// the call is let through as the probe.
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case stateClosed:
+		return nil
+	case stateOpen:
+		if time.Since(b.openedAt) < b.config.cooldown() {
+			return ErrOpen
+		}
+		logrus.Infof("Probing datastore after %v with the circuit breaker open", b.config.cooldown())
+		b.state = stateHalfOpen
+		return nil
+	default:
+		// a probe is in flight
+		return ErrOpen
+	}
+}
+
+// done records the outcome of a call that was allowed.
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed(err) {
+		if err != nil && errors.Is(err, context.Canceled) {
+			// the caller gave up, which says nothing of the datastore, so a
+			// cancelled probe lets the next call probe instead
+			if b.state == stateHalfOpen {
+				b.state = stateOpen
+			}
+			return
+		}
+		if b.state != stateClosed {
+			logrus.Infof("Datastore is available, closing the circuit breaker")
+			metrics.BreakerOpen.Set(0)
+		}
+		b.state = stateClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.state == stateHalfOpen:
+		logrus.Warnf("Datastore probe failed, keeping the circuit breaker open: %v", err)
+	case b.state == stateClosed && b.failures >= b.config.Failures:
+		logrus.Errorf("Opening the circuit breaker after %d consecutive datastore failures: %v", b.failures, err)
+		metrics.BreakerOpen.Set(1)
+	default:
+		return
+	}
+	b.state = stateOpen
+	b.openedAt = time.Now()
+}
+
+// failed returns true if an error suggests that the datastore is unavailable.
+// Errors that the datastore returns for requests it has answered, such as
+// conflicts, and writes refused by a read-only or dry-run dialect do not.
+func failed(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, context.Canceled):
+		return false
+	case err == server.ErrKeyExists, err == server.ErrCompacted:
+		return false
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, sql.ErrTxDone):
+		return false
+	case err == generic.ErrReadOnly, err == generic.ErrDryRun:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package breaker
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+// Wrap returns a dialect that fails calls to d fast while the breaker is open.
+func Wrap(d server.Dialect, config Config) server.Dialect {
+	if !config.Enabled() {
+		return d
+	}
+	logrus.Infof("Failing datastore calls fast after %d consecutive failures, probing every %v", config.Failures, config.cooldown())
+	return &dialect{
+		Dialect: d,
+		breaker: &breaker{config: config},
+	}
+}
+
+type dialect struct {
+	server.Dialect
+	breaker *breaker
+}
+
+// Unwrap returns the dialect that the breaker guards.
+func (d *dialect) Unwrap() server.Dialect {
+	return d.Dialect
+}
+
+func (d *dialect) ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted bool) (*sql.Rows, error) {
+	if err := d.breaker.allow(); err != nil {
+		return nil, err
+	}
+	rows, err := d.Dialect.ListCurrent(ctx, prefix, limit, includeDeleted)
+	d.breaker.done(err)
+	return rows, err
+}
+
+func (d *dialect) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (*sql.Rows, error) {
+	if err := d.breaker.allow(); err != nil {
+		return nil, err
+	}
+	rows, err := d.Dialect.List(ctx, prefix, startKey, limit, revision, includeDeleted)
+	d.breaker.done(err)
+	return rows, err
+}
+
+func (d *dialect) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	if err := d.breaker.allow(); err != nil {
+		return 0, 0, err
+	}
+	rev, count, err := d.Dialect.Count(ctx, prefix)
+	d.breaker.done(err)
+	return rev, count, err
+}
+
+func (d *dialect) CurrentRevision(ctx context.Context) (int64, error) {
+	if err := d.breaker.allow(); err != nil {
+		return 0, err
+	}
+	rev, err := d.Dialect.CurrentRevision(ctx)
+	d.breaker.done(err)
+	return rev, err
+}
+
+func (d *dialect) After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error) {
+	if err := d.breaker.allow(); err != nil {
+		return nil, err
+	}
+	rows, err := d.Dialect.After(ctx, prefix, rev, limit)
+	d.breaker.done(err)
+	return rows, err
+}
+
+func (d *dialect) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error) {
+	if err := d.breaker.allow(); err != nil {
+		return 0, err
+	}
+	rev, err := d.Dialect.Insert(ctx, key, create, delete, createRevision, previousRevision, ttl, value, prevValue)
+	d.breaker.done(err)
+	return rev, err
+}
+
+func (d *dialect) GetRevision(ctx context.Context, revision int64) (*sql.Rows, error) {
+	if err := d.breaker.allow(); err != nil {
+		return nil, err
+	}
+	rows, err := d.Dialect.GetRevision(ctx, revision)
+	d.breaker.done(err)
+	return rows, err
+}
+
+func (d *dialect) DeleteRevision(ctx context.Context, revision int64) error {
+	if err := d.breaker.allow(); err != nil {
+		return err
+	}
+	err := d.Dialect.DeleteRevision(ctx, revision)
+	d.breaker.done(err)
+	return err
+}
+
+func (d *dialect) GetCompactRevision(ctx context.Context) (int64, error) {
+	if err := d.breaker.allow(); err != nil {
+		return 0, err
+	}
+	rev, err := d.Dialect.GetCompactRevision(ctx)
+	d.breaker.done(err)
+	return rev, err
+}
+
+func (d *dialect) SetCompactRevision(ctx context.Context, revision int64) error {
+	if err := d.breaker.allow(); err != nil {
+		return err
+	}
+	err := d.Dialect.SetCompactRevision(ctx, revision)
+	d.breaker.done(err)
+	return err
+}
+
+func (d *dialect) Compact(ctx context.Context, revision int64) (int64, error) {
+	if err := d.breaker.allow(); err != nil {
+		return 0, err
+	}
+	deleted, err := d.Dialect.Compact(ctx, revision)
+	d.breaker.done(err)
+	return deleted, err
+}
+
+func (d *dialect) PostCompact(ctx context.Context) error {
+	if err := d.breaker.allow(); err != nil {
+		return err
+	}
+	err := d.Dialect.PostCompact(ctx)
+	d.breaker.done(err)
+	return err
+}
+
+func (d *dialect) Fill(ctx context.Context, revision int64) error {
+	if err := d.breaker.allow(); err != nil {
+		return err
+	}
+	err := d.Dialect.Fill(ctx, revision)
+	d.breaker.done(err)
+	return err
+}
+
+func (d *dialect) BeginTx(ctx context.Context, opts *sql.TxOptions) (server.Transaction, error) {
+	if err := d.breaker.allow(); err != nil {
+		return nil, err
+	}
+	tx, err := d.Dialect.BeginTx(ctx, opts)
+	d.breaker.done(err)
+	return tx, err
+}
+
+func (d *dialect) GetSize(ctx context.Context) (int64, error) {
+	if err := d.breaker.allow(); err != nil {
+		return 0, err
+	}
+	size, err := d.Dialect.GetSize(ctx)
+	d.breaker.done(err)
+	return size, err
+}
@@ -2,13 +2,64 @@ package broadcaster
 
 import (
 	"context"
+	"fmt"
 	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+)
+
+const DefaultBufferSize = 100
+
+// Policy is what happens when an item cannot be sent to a subscriber because
+// its buffer is full.
+type Policy string
+
+const (
+	// PolicyCancel closes the subscription of a slow subscriber, which is then
+	// expected to resubscribe. Other subscribers are not delayed.
+	PolicyCancel Policy = "cancel"
+	// PolicyBlock waits for a slow subscriber, delaying all subscribers, until
+	// the block timeout expires, after which the subscription is closed.
+	PolicyBlock Policy = "block"
 )
 
+// ParsePolicy returns the policy with the given name.
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case PolicyCancel, PolicyBlock:
+		return p, nil
+	case "":
+		return PolicyCancel, nil
+	}
+	return "", fmt.Errorf("unknown watch buffer policy %q, must be %q or %q", name, PolicyCancel, PolicyBlock)
+}
+
+// Config holds the buffering settings of a broadcaster.
+type Config struct {
+	// BufferSize is the number of items buffered for each subscriber. Zero
+	// means DefaultBufferSize.
+	BufferSize int
+	// Policy is what happens when a subscriber's buffer is full. Empty means
+	// PolicyCancel.
+	Policy Policy
+	// BlockTimeout is how long PolicyBlock waits for a slow subscriber. Zero
+	// waits indefinitely.
+	BlockTimeout time.Duration
+}
+
+func (c Config) bufferSize() int {
+	if c.BufferSize <= 0 {
+		return DefaultBufferSize
+	}
+	return c.BufferSize
+}
+
 type ConnectFunc func() (chan interface{}, error)
 
 type Broadcaster struct {
 	sync.Mutex
+	Config  Config
 	running bool
 	subs    map[chan interface{}]struct{}
 }
@@ -23,7 +74,7 @@ func (b *Broadcaster) Subscribe(ctx context.Context, connect ConnectFunc) (<-cha
 		}
 	}
 
-	sub := make(chan interface{}, 100)
+	sub := make(chan interface{}, b.Config.bufferSize())
 	if b.subs == nil {
 		b.subs = map[chan interface{}]struct{}{}
 	}
@@ -63,14 +114,21 @@ func (b *Broadcaster) start(connect ConnectFunc) error {
 func (b *Broadcaster) stream(input chan interface{}) {
 	for item := range input {
 		b.Lock()
+		var usage float64
 		for sub := range b.subs {
+			if u := float64(len(sub)) / float64(cap(sub)); u > usage {
+				usage = u
+			}
 			select {
 			case sub <- item:
 			default:
-				// Slow consumer, drop
-				go b.unsub(sub, true)
+				if !b.block(sub, item) {
+					// Slow consumer, drop
+					go b.unsub(sub, true)
+				}
 			}
 		}
+		metrics.WatchBufferUsage.Observe(usage)
 		b.Unlock()
 	}
 
@@ -81,3 +139,30 @@ func (b *Broadcaster) stream(input chan interface{}) {
 	b.running = false
 	b.Unlock()
 }
+
+// block waits to send an item to a subscriber whose buffer is full, if the
+// policy allows it. It returns false if the subscription must be closed.
+func (b *Broadcaster) block(sub chan interface{}, item interface{}) bool {
+	if b.Config.Policy != PolicyBlock {
+		metrics.WatchSubscribersDroppedTotal.WithLabelValues(string(PolicyCancel)).Inc()
+		return false
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.WatchBlockedSeconds.Add(time.Since(start).Seconds())
+	}()
+	var timeout <-chan time.Time
+	if b.Config.BlockTimeout > 0 {
+		t := time.NewTimer(b.Config.BlockTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case sub <- item:
+		return true
+	case <-timeout:
+		metrics.WatchSubscribersDroppedTotal.WithLabelValues(string(PolicyBlock)).Inc()
+		return false
+	}
+}
@@ -0,0 +1,328 @@
+package cdc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+
+	checkpointKeyPrefix = "cdc_checkpoint/"
+	checkpointInterval  = time.Second
+	maxRetryBackoff     = 30 * time.Second
+	leaderPollInterval  = time.Second
+)
+
+// Event is a committed change to a key, as published to change-data-capture sinks.
+type Event struct {
+	Type           string `json:"type"`
+	Key            string `json:"key"`
+	Revision       int64  `json:"revision"`
+	CreateRevision int64  `json:"createRevision"`
+	PrevRevision   int64  `json:"prevRevision,omitempty"`
+	Lease          int64  `json:"lease,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+}
+
+// Publisher delivers events to an external system. Publish must not return
+// until the events have been durably accepted, as the checkpoint is advanced
+// past them as soon as it returns.
+type Publisher interface {
+	Publish(ctx context.Context, events []Event) error
+	Close() error
+}
+
+type Config struct {
+	// Prefix limits published events to keys with the prefix. It must end in a
+	// slash, and defaults to all keys.
+	Prefix string
+	// IncludeValues includes the value of the key in published events.
+	IncludeValues bool
+	Kafka         KafkaConfig
+	NATS          NATSConfig
+	Webhook       WebhookConfig
+	Mirror        MirrorConfig
+}
+
+// KafkaConfig configures publishing to a Kafka topic. Events are keyed by the
+// etcd key, so that all changes to a key are delivered in order to one partition.
+type KafkaConfig struct {
+	// Brokers is a comma-separated list of broker addresses.
+	Brokers string
+	Topic   string
+	TLS     tls.Config
+}
+
+// Start starts publishing changes to all configured sinks in the background,
+// until the context is cancelled.
+func Start(ctx context.Context, backend server.Backend, config Config) error {
+	if config.Prefix == "" {
+		config.Prefix = "/"
+	}
+	if !strings.HasSuffix(config.Prefix, "/") {
+		return errors.Errorf("change-data-capture prefix %q must end in a slash", config.Prefix)
+	}
+
+	if config.Kafka.Brokers != "" {
+		p, err := newKafkaPublisher(config.Kafka)
+		if err != nil {
+			return errors.Wrap(err, "creating Kafka publisher")
+		}
+		go run(ctx, backend, "kafka", p, config)
+	}
+
+	if config.NATS.URL != "" {
+		p, err := newNATSPublisher(config.NATS)
+		if err != nil {
+			return errors.Wrap(err, "creating NATS publisher")
+		}
+		go run(ctx, backend, "nats", p, config)
+	}
+
+	if config.Webhook.URLs != "" {
+		publishers, err := newWebhookPublishers(config.Webhook)
+		if err != nil {
+			return errors.Wrap(err, "creating webhook publishers")
+		}
+		for sink, p := range publishers {
+			go run(ctx, backend, sink, p, config)
+		}
+	}
+
+	if config.Mirror.Endpoints != "" {
+		p, err := newEtcdPublisher(config.Mirror)
+		if err != nil {
+			return errors.Wrap(err, "creating etcd mirror")
+		}
+		// the mirror always needs values, and all keys
+		mirrorConfig := config
+		mirrorConfig.Prefix = "/"
+		mirrorConfig.IncludeValues = true
+		go run(ctx, backend, "etcd-mirror", p, mirrorConfig)
+	}
+	return nil
+}
+
+// leaderBackend is implemented by backends that only accept writes on one
+// instance; changes are only published by that instance.
+type leaderBackend interface {
+	IsLeader() bool
+}
+
+// run publishes changes to a sink until the context is cancelled. Delivery is
+// at-least-once: the revision of the last published event is checkpointed in
+// the datastore, and publishing resumes after the checkpoint when restarted,
+// possibly repeating events published since the checkpoint was last written.
+func run(ctx context.Context, backend server.Backend, sink string, publisher Publisher, config Config) {
+	defer publisher.Close()
+
+	for {
+		if err := publish(ctx, backend, sink, publisher, config); err != nil {
+			logrus.Errorf("Failed to publish changes to %s: %v", sink, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaderPollInterval):
+		}
+	}
+}
+
+func publish(ctx context.Context, backend server.Backend, sink string, publisher Publisher, config Config) error {
+	if lb, ok := backend.(leaderBackend); ok && !lb.IsLeader() {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cp, err := loadCheckpoint(ctx, backend, sink)
+	if err != nil {
+		return err
+	}
+	if cp.revision == 0 {
+		// nothing has been published yet, so start from the current revision
+		// rather than replaying all retained history
+		if cp.revision, _, err = backend.Count(ctx, config.Prefix); err != nil {
+			return err
+		}
+		logrus.Infof("Publishing changes to %s from revision %d", sink, cp.revision)
+	} else if _, _, err := backend.List(ctx, config.Prefix, "", 1, cp.revision); err == server.ErrCompacted {
+		rev, _, err := backend.Count(ctx, config.Prefix)
+		if err != nil {
+			return err
+		}
+		logrus.Errorf("Changes to %s after revision %d were compacted before they were published, resuming from revision %d", sink, cp.revision, rev)
+		cp.revision = rev
+	} else if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	defer cp.save(context.Background(), backend)
+
+	events := backend.Watch(ctx, config.Prefix, cp.revision+1)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if lb, ok := backend.(leaderBackend); ok && !lb.IsLeader() {
+				logrus.Infof("Stopped publishing changes to %s on loss of leadership", sink)
+				return nil
+			}
+			if err := cp.save(ctx, backend); err != nil {
+				logrus.Errorf("Failed to save %s change-data-capture checkpoint: %v", sink, err)
+			}
+			cp.observeLag(ctx, backend, sink, len(events))
+		case batch, ok := <-events:
+			if !ok {
+				return errors.New("watch closed")
+			}
+			if len(batch) == 0 {
+				continue
+			}
+			if err := publishWithRetry(ctx, sink, publisher, toEvents(batch, config.IncludeValues)); err != nil {
+				return err
+			}
+			cp.revision = batch[len(batch)-1].KV.ModRevision
+			metrics.CDCCheckpointRevision.WithLabelValues(sink).Set(float64(cp.revision))
+		}
+	}
+}
+
+// publishWithRetry publishes events, retrying with exponential backoff until
+// they are accepted or the context is cancelled.
+func publishWithRetry(ctx context.Context, sink string, publisher Publisher, events []Event) error {
+	backoff := 100 * time.Millisecond
+	for {
+		err := publisher.Publish(ctx, events)
+		if err == nil {
+			metrics.CDCEventsTotal.WithLabelValues(sink, metrics.ResultSuccess).Add(float64(len(events)))
+			return nil
+		}
+		metrics.CDCEventsTotal.WithLabelValues(sink, metrics.ResultError).Add(float64(len(events)))
+		logrus.Errorf("Failed to publish %d changes to %s, retrying in %v: %v", len(events), sink, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+func toEvents(batch []*server.Event, includeValues bool) []Event {
+	events := make([]Event, 0, len(batch))
+	for _, e := range batch {
+		event := Event{
+			Type:           EventUpdate,
+			Key:            e.KV.Key,
+			Revision:       e.KV.ModRevision,
+			CreateRevision: e.KV.CreateRevision,
+			Lease:          e.KV.Lease,
+		}
+		switch {
+		case e.Create:
+			event.Type = EventCreate
+		case e.Delete:
+			event.Type = EventDelete
+		}
+		if e.PrevKV != nil {
+			event.PrevRevision = e.PrevKV.ModRevision
+		}
+		if includeValues && !e.Delete {
+			event.Value = e.KV.Value
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// checkpoint is the revision of the last event published to a sink, stored in
+// a key outside of the etcd keyspace.
+type checkpoint struct {
+	key      string
+	revision int64
+	saved    int64
+	modRev   int64
+}
+
+func loadCheckpoint(ctx context.Context, backend server.Backend, sink string) (*checkpoint, error) {
+	cp := &checkpoint{key: checkpointKeyPrefix + sink}
+	_, kv, err := backend.Get(ctx, cp.key, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading %s change-data-capture checkpoint", sink)
+	}
+	if kv == nil {
+		return cp, nil
+	}
+	if cp.revision, err = strconv.ParseInt(string(kv.Value), 10, 64); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s change-data-capture checkpoint", sink)
+	}
+	cp.saved = cp.revision
+	cp.modRev = kv.ModRevision
+	return cp, nil
+}
+
+func (cp *checkpoint) save(ctx context.Context, backend server.Backend) error {
+	if cp.revision == cp.saved {
+		return nil
+	}
+	value := []byte(strconv.FormatInt(cp.revision, 10))
+	if cp.modRev == 0 {
+		rev, err := backend.Create(ctx, cp.key, value, 0)
+		if err != nil {
+			return err
+		}
+		cp.modRev = rev
+	} else {
+		rev, kv, ok, err := backend.Update(ctx, cp.key, value, cp.modRev, 0)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// another instance published while this one was not the leader;
+			// overwrite its checkpoint on the next save
+			if kv != nil {
+				cp.modRev = kv.ModRevision
+			}
+			return errors.New("checkpoint was updated by another instance")
+		}
+		cp.modRev = rev
+	}
+	cp.saved = cp.revision
+	return nil
+}
+
+// observeLag records how many revisions the sink is behind the datastore. Writes
+// to keys outside the prefix do not advance the checkpoint, so the sink is
+// considered caught up when no events are waiting to be published.
+func (cp *checkpoint) observeLag(ctx context.Context, backend server.Backend, sink string, pending int) {
+	var lag int64
+	if pending > 0 {
+		rev, _, err := backend.Get(ctx, cp.key, 0)
+		if err != nil {
+			return
+		}
+		if lag = rev - cp.revision; lag < 0 {
+			lag = 0
+		}
+	}
+	metrics.CDCLagRevisions.WithLabelValues(sink).Set(float64(lag))
+}
@@ -0,0 +1,110 @@
+package cdc
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// maxTxnOps is the default limit on operations in a single etcd transaction.
+const maxTxnOps = 128
+
+// MirrorConfig configures applying every write to a target etcd cluster, which
+// can be used as a warm standby. Revisions in the target will not match kine.
+type MirrorConfig struct {
+	// Endpoints is a comma-separated list of etcd endpoints.
+	Endpoints string
+	TLS       tls.Config
+}
+
+type etcdPublisher struct {
+	client *clientv3.Client
+
+	leasesLock sync.Mutex
+	leases     map[int64]mirrorLease
+}
+
+// mirrorLease is a lease in the target cluster that is shared by all keys with
+// the same TTL written within half the TTL of the lease being granted.
+type mirrorLease struct {
+	id      clientv3.LeaseID
+	granted time.Time
+}
+
+func newEtcdPublisher(config MirrorConfig) (Publisher, error) {
+	tlsConfig, err := config.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(config.Endpoints, ","),
+		DialTimeout: 5 * time.Second,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdPublisher{
+		client: client,
+		leases: map[int64]mirrorLease{},
+	}, nil
+}
+
+// Publish applies the events to the target cluster in order, in transactions of
+// up to the default etcd operation limit.
+func (e *etcdPublisher) Publish(ctx context.Context, events []Event) error {
+	ops := make([]clientv3.Op, 0, len(events))
+	for _, event := range events {
+		if event.Type == EventDelete {
+			ops = append(ops, clientv3.OpDelete(event.Key))
+			continue
+		}
+		var opts []clientv3.OpOption
+		if event.Lease > 0 {
+			id, err := e.lease(ctx, event.Lease)
+			if err != nil {
+				return errors.Wrap(err, "granting lease")
+			}
+			opts = append(opts, clientv3.WithLease(id))
+		}
+		ops = append(ops, clientv3.OpPut(event.Key, string(event.Value), opts...))
+	}
+
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		if _, err := e.client.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+			return err
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// lease returns a lease in the target cluster for keys with the given TTL. Kine
+// stores the TTL in place of a lease ID, so the lease is granted with that TTL.
+func (e *etcdPublisher) lease(ctx context.Context, ttl int64) (clientv3.LeaseID, error) {
+	e.leasesLock.Lock()
+	defer e.leasesLock.Unlock()
+
+	if l, ok := e.leases[ttl]; ok && time.Since(l.granted) < time.Duration(ttl)*time.Second/2 {
+		return l.id, nil
+	}
+	resp, err := e.client.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+	e.leases[ttl] = mirrorLease{id: resp.ID, granted: time.Now()}
+	return resp.ID, nil
+}
+
+func (e *etcdPublisher) Close() error {
+	return e.client.Close()
+}
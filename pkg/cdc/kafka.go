@@ -0,0 +1,60 @@
+//go:build kafka
+// +build kafka
+
+package cdc
+
+// Building with Kafka support requires the kafka-go module, which is not a
+// default dependency: go get github.com/segmentio/kafka-go
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func newKafkaPublisher(config KafkaConfig) (Publisher, error) {
+	if config.Topic == "" {
+		return nil, errors.New("Kafka topic is required")
+	}
+	tlsConfig, err := config.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(config.Brokers, ",")...),
+			Topic:        config.Topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			Transport:    &kafka.Transport{TLS: tlsConfig},
+		},
+	}, nil
+}
+
+// Publish writes the events synchronously, returning once they have been
+// acknowledged by all in-sync replicas.
+func (k *kafkaPublisher) Publish(ctx context.Context, events []Event) error {
+	msgs := make([]kafka.Message, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, kafka.Message{
+			Key:   []byte(event.Key),
+			Value: value,
+		})
+	}
+	return k.writer.WriteMessages(ctx, msgs...)
+}
+
+func (k *kafkaPublisher) Close() error {
+	return k.writer.Close()
+}
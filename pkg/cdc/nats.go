@@ -0,0 +1,121 @@
+package cdc
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// NATSConfig configures publishing to NATS subjects. This is independent of the
+// NATS storage driver, and may use a different server.
+type NATSConfig struct {
+	URL string
+	// SubjectMap is a comma-separated list of <key-prefix>=<subject> mappings.
+	// Events are published to the subject of the longest matching prefix.
+	SubjectMap string
+	// Subject is the subject for events that do not match any mapping. If not
+	// set, such events are not published.
+	Subject string
+	TLS     tls.Config
+}
+
+type subjectMapping struct {
+	prefix  string
+	subject string
+}
+
+type natsPublisher struct {
+	conn     *nats.Conn
+	mappings []subjectMapping
+	subject  string
+}
+
+func newNATSPublisher(config NATSConfig) (Publisher, error) {
+	mappings, err := parseSubjectMap(config.SubjectMap)
+	if err != nil {
+		return nil, err
+	}
+	if len(mappings) == 0 && config.Subject == "" {
+		return nil, errors.New("at least one NATS subject mapping or a default subject is required")
+	}
+
+	opts := []nats.Option{
+		nats.Name("kine change-data-capture"),
+		nats.MaxReconnects(-1),
+	}
+	tlsConfig, err := config.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+
+	conn, err := nats.Connect(config.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{
+		conn:     conn,
+		mappings: mappings,
+		subject:  config.Subject,
+	}, nil
+}
+
+func parseSubjectMap(subjectMap string) ([]subjectMapping, error) {
+	var mappings []subjectMapping
+	for _, m := range strings.Split(subjectMap, ",") {
+		if m = strings.TrimSpace(m); m == "" {
+			continue
+		}
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid NATS subject mapping %q, expected <key-prefix>=<subject>", m)
+		}
+		mappings = append(mappings, subjectMapping{prefix: parts[0], subject: parts[1]})
+	}
+	// longest prefix first, so that the most specific mapping wins
+	sort.Slice(mappings, func(i, j int) bool {
+		return len(mappings[i].prefix) > len(mappings[j].prefix)
+	})
+	return mappings, nil
+}
+
+func (n *natsPublisher) subjectFor(key string) string {
+	for _, m := range n.mappings {
+		if strings.HasPrefix(key, m.prefix) {
+			return m.subject
+		}
+	}
+	return n.subject
+}
+
+// Publish publishes the events and flushes the connection, so that they have
+// been received by the server when it returns. Core NATS does not persist
+// messages, so events are only delivered to subscribers connected at the time.
+func (n *natsPublisher) Publish(ctx context.Context, events []Event) error {
+	for _, event := range events {
+		subject := n.subjectFor(event.Key)
+		if subject == "" {
+			continue
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if err := n.conn.Publish(subject, data); err != nil {
+			return err
+		}
+	}
+	return n.conn.FlushWithContext(ctx)
+}
+
+func (n *natsPublisher) Close() error {
+	n.conn.Close()
+	return nil
+}
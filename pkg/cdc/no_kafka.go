@@ -0,0 +1,10 @@
+//go:build !kafka
+// +build !kafka
+
+package cdc
+
+import "errors"
+
+func newKafkaPublisher(config KafkaConfig) (Publisher, error) {
+	return nil, errors.New(`this binary is built without Kafka support, compile with "-tags kafka"`)
+}
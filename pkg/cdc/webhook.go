@@ -0,0 +1,169 @@
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader holds the hex-encoded HMAC-SHA256 of the request body,
+	// keyed with the webhook secret and prefixed with "sha256=".
+	SignatureHeader = "X-Kine-Signature-256"
+
+	webhookTimeout = 30 * time.Second
+)
+
+// WebhookConfig configures POSTing change events for selected key prefixes to
+// HTTPS endpoints.
+type WebhookConfig struct {
+	// URLs is a comma-separated list of HTTPS endpoints. Each endpoint receives
+	// all matching events, and is checkpointed separately.
+	URLs string
+	// Prefixes is a comma-separated list of key prefixes to send events for.
+	Prefixes string
+	// Secret and SecretFile supply the key used to sign requests. If both are
+	// set, the file takes precedence.
+	Secret     string
+	SecretFile string
+	TLS        tls.Config
+}
+
+type webhookPublisher struct {
+	url      string
+	prefixes []string
+	secret   []byte
+	client   *http.Client
+}
+
+func newWebhookPublishers(config WebhookConfig) (map[string]Publisher, error) {
+	var prefixes []string
+	for _, p := range strings.Split(config.Prefixes, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, errors.New("at least one webhook key prefix is required")
+	}
+
+	secret := []byte(config.Secret)
+	if config.SecretFile != "" {
+		b, err := ioutil.ReadFile(config.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		secret = bytes.TrimRight(b, "\r\n")
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("a webhook secret is required to sign requests")
+	}
+
+	tlsConfig, err := config.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	publishers := map[string]Publisher{}
+	for _, u := range strings.Split(config.URLs, ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		if !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("webhook URL %s must use https", u)
+		}
+		// the sink name is derived from the URL, so that the checkpoint is kept
+		// when endpoints are added or removed
+		sum := sha256.Sum256([]byte(u))
+		publishers["webhook/"+hex.EncodeToString(sum[:4])] = &webhookPublisher{
+			url:      u,
+			prefixes: prefixes,
+			secret:   secret,
+			client:   client,
+		}
+	}
+	return publishers, nil
+}
+
+func (w *webhookPublisher) matches(key string) bool {
+	for _, p := range w.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish POSTs matching events to the endpoint as {"events": [...]}. Server
+// errors and rate limiting are returned so that the request is retried; other
+// client errors are logged and the events dropped, as retrying cannot succeed.
+func (w *webhookPublisher) Publish(ctx context.Context, events []Event) error {
+	var matched []Event
+	for _, event := range events {
+		if w.matches(event.Key) {
+			matched = append(matched, event)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(struct {
+		Events []Event `json:"events"`
+	}{Events: matched})
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusRequestTimeout:
+		return fmt.Errorf("webhook %s returned %s", w.url, resp.Status)
+	default:
+		logrus.Errorf("Webhook %s rejected %d change events with %s, dropping them", w.url, len(matched), resp.Status)
+		return nil
+	}
+}
+
+func (w *webhookPublisher) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,72 @@
+// Package checksum computes the checksums stored with the rows written by SQL
+// backends, so that rows modified or corrupted outside of kine are detected
+// when they are read.
+package checksum
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// ErrMismatch is returned when the checksum stored with a row is not that of
+// its columns.
+var ErrMismatch = errors.New("row checksum mismatch")
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+// Row holds the columns of a row covered by its checksum, as they are stored,
+// so after values are compressed and encrypted. The id of a row is assigned by
+// the database when it is inserted, so it cannot be covered; the previous
+// revision pins the row to its place in the history of its key instead.
+type Row struct {
+	Name           string
+	Created        bool
+	Deleted        bool
+	CreateRevision int64
+	PrevRevision   int64
+	Lease          int64
+	Value          []byte
+	OldValue       []byte
+}
+
+// Sum returns the CRC-32C checksum of a row. Each column is written with its
+// length, so that bytes cannot move between adjacent columns unnoticed.
+func (r Row) Sum() int64 {
+	var buf []byte
+	buf = appendBytes(buf, []byte(r.Name))
+	buf = appendBool(buf, r.Created)
+	buf = appendBool(buf, r.Deleted)
+	buf = appendInt(buf, r.CreateRevision)
+	buf = appendInt(buf, r.PrevRevision)
+	buf = appendInt(buf, r.Lease)
+	buf = appendBytes(buf, r.Value)
+	buf = appendBytes(buf, r.OldValue)
+	return int64(crc32.Checksum(buf, table))
+}
+
+// Verify returns ErrMismatch if sum is not the checksum of the row.
+func (r Row) Verify(sum int64) error {
+	if r.Sum() != sum {
+		return ErrMismatch
+	}
+	return nil
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = appendInt(buf, int64(len(b)))
+	return append(buf, b...)
+}
+
+func appendBool(buf []byte, b bool) []byte {
+	if b {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+func appendInt(buf []byte, i int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(i))
+	return append(buf, b[:]...)
+}
@@ -0,0 +1,57 @@
+// Package clone copies the keyspace of one backend into another, as it was at a
+// chosen revision, for example to seed a staging control plane from production.
+package clone
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const batchSize = 1000
+
+// Copy creates the keys with the prefix in target, with their values in source
+// at revision, or at the current revision if zero. Keys are written as new
+// revisions of the target, so revisions are not preserved. The target must not
+// have any keys with the prefix. It returns the revision copied and the number
+// of keys copied.
+func Copy(ctx context.Context, source, target server.Backend, revision int64, prefix string) (int64, int, error) {
+	_, count, err := target.Count(ctx, prefix)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "counting target keys")
+	}
+	if count != 0 {
+		return 0, 0, fmt.Errorf("target already has %d keys under %s", count, prefix)
+	}
+
+	if revision == 0 {
+		if revision, _, err = source.Count(ctx, prefix); err != nil {
+			return 0, 0, errors.Wrap(err, "getting source revision")
+		}
+	}
+
+	var (
+		copied   int
+		startKey string
+	)
+	for {
+		_, kvs, err := source.List(ctx, prefix, startKey, batchSize, revision)
+		if err != nil {
+			return revision, copied, errors.Wrapf(err, "listing source keys at revision %d", revision)
+		}
+		for _, kv := range kvs {
+			if _, err := target.Create(ctx, kv.Key, kv.Value, kv.Lease); err != nil {
+				return revision, copied, errors.Wrapf(err, "creating %s", kv.Key)
+			}
+			copied++
+		}
+		if len(kvs) < batchSize {
+			return revision, copied, nil
+		}
+		startKey = kvs[len(kvs)-1].Key
+		logrus.Infof("Copied %d keys", copied)
+	}
+}
@@ -0,0 +1,103 @@
+// Package compression compresses the values stored by SQL backends. Compressed
+// values start with a header that names the algorithm, so that compressed and
+// uncompressed rows can be read alike, and values written before compression
+// was enabled, or after it is disabled, keep working.
+package compression
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+type Algorithm string
+
+const (
+	None   Algorithm = ""
+	Zstd   Algorithm = "zstd"
+	Snappy Algorithm = "snappy"
+)
+
+// MinSize is the size below which values are stored uncompressed, as the
+// saving would not be worth the time to compress them.
+const MinSize = 256
+
+// magic starts the header of compressed values, which is followed by a byte
+// that identifies the algorithm. Kubernetes stores values as protobuf, which
+// starts with "k8s", or as JSON, neither of which starts with a zero byte.
+var magic = []byte{0, 'k', 'z'}
+
+const (
+	zstdID   byte = 'z'
+	snappyID byte = 's'
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Parse returns the algorithm with a name, or None for an empty name.
+func Parse(name string) (Algorithm, error) {
+	switch a := Algorithm(name); a {
+	case None, Zstd, Snappy:
+		return a, nil
+	}
+	return None, fmt.Errorf("unsupported compression %q, must be one of %s or %s", name, Zstd, Snappy)
+}
+
+// Compress returns a value compressed with an algorithm, with a header that
+// identifies it. Values that are small or do not shrink are returned as they
+// are.
+func Compress(algorithm Algorithm, value []byte) []byte {
+	if algorithm == None || len(value) < MinSize {
+		return value
+	}
+
+	header := append(append(make([]byte, 0, len(magic)+1), magic...), 0)
+	var compressed []byte
+	switch algorithm {
+	case Zstd:
+		header[len(magic)] = zstdID
+		compressed = zstdEncoder.EncodeAll(value, header)
+	case Snappy:
+		header[len(magic)] = snappyID
+		compressed = append(header, s2.EncodeSnappy(nil, value)...)
+	default:
+		return value
+	}
+	if len(compressed) >= len(value) {
+		return value
+	}
+	return compressed
+}
+
+// Decompress returns a value as it was before it was compressed. Values
+// without a header are returned as they are, as are values with a header that
+// do not decompress, in case an uncompressed value starts like a header.
+func Decompress(value []byte) []byte {
+	if len(value) <= len(magic) || !bytes.HasPrefix(value, magic) {
+		return value
+	}
+
+	var (
+		decompressed []byte
+		err          error
+	)
+	switch value[len(magic)] {
+	case zstdID:
+		decompressed, err = zstdDecoder.DecodeAll(value[len(magic)+1:], nil)
+	case snappyID:
+		decompressed, err = s2.Decode(nil, value[len(magic)+1:])
+	default:
+		return value
+	}
+	if err != nil {
+		logrus.Debugf("Value starts with a compression header but does not decompress, returning it as is: %v", err)
+		return value
+	}
+	return decompressed
+}
@@ -0,0 +1,207 @@
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	awsMetadataURL = "http://169.254.169.254/latest"
+	awsService     = "secretsmanager"
+)
+
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// readAWSSecret reads the current value of a secret from AWS Secrets Manager.
+// The name is <region>/<secret-id>, where the secret ID may be a name or ARN.
+// Requests are signed with credentials from the standard AWS environment
+// variables if set, or otherwise from the EC2 instance metadata service.
+func readAWSSecret(ctx context.Context, name string) (string, error) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid AWS secret %q, expected <region>/<secret-id>", name)
+	}
+	region, secretID := parts[0], parts[1]
+
+	creds, err := awsGetCredentials(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "getting AWS credentials")
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return "", err
+	}
+
+	host := fmt.Sprintf("%s.%s.amazonaws.com", awsService, region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	awsSign(req, body, host, region, creds, time.Now().UTC())
+
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "requesting secret from AWS Secrets Manager")
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		SecretString string `json:"SecretString"`
+		Message      string `json:"message"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrapf(err, "decoding AWS Secrets Manager response with status %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("AWS Secrets Manager returned %s: %s", resp.Status, result.Message)
+	}
+	return result.SecretString, nil
+}
+
+// awsSign adds AWS Signature Version 4 headers to a request.
+func awsSign(req *http.Request, body []byte, host, region string, creds awsCredentials, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	signedHeaders := []string{"content-type", "host", "x-amz-date", "x-amz-target"}
+	if creds.Token != "" {
+		signedHeaders = []string{"content-type", "host", "x-amz-date", "x-amz-security-token", "x-amz-target"}
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		value := req.Header.Get(h)
+		if h == "host" {
+			value = host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		"/",
+		"",
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		sha256Hex(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, awsService, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(creds, date, region, awsService), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// awsSigningKey derives the Signature Version 4 key for a date, region and
+// service.
+func awsSigningKey(creds awsCredentials, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// awsGetCredentials returns credentials from the environment, or from the role
+// attached to the instance via IMDSv2.
+func awsGetCredentials(ctx context.Context) (awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, awsMetadataURL+"/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := awsMetadata(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	get := func(path string) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, awsMetadataURL+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		return awsMetadata(req)
+	}
+
+	role, err := get("/meta-data/iam/security-credentials/")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	data, err := get("/meta-data/iam/security-credentials/" + role)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	creds := awsCredentials{}
+	if err := json.Unmarshal([]byte(data), &creds); err != nil {
+		return awsCredentials{}, errors.Wrap(err, "decoding instance role credentials")
+	}
+	return creds, nil
+}
+
+func awsMetadata(req *http.Request) (string, error) {
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata service returned %s for %s", resp.Status, req.URL.Path)
+	}
+	return string(body), nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
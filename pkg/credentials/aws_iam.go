@@ -0,0 +1,154 @@
+package credentials
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	awsIAMService = "rds-db"
+	// awsIAMTokenTTL is how long RDS accepts an authentication token for new
+	// connections. Connections remain open after the token expires.
+	awsIAMTokenTTL = 15 * time.Minute
+)
+
+// Target is the server and user that credentials are for.
+type Target struct {
+	Host string
+	Port string
+	User string
+}
+
+// targeted is implemented by providers whose credentials are only valid for
+// one server and user.
+type targeted interface {
+	setTarget(target Target)
+}
+
+// SetTarget tells a provider the server and user from the datastore endpoint,
+// for providers that issue credentials for a single server, such as AWS IAM
+// authentication. It does nothing for other providers.
+func SetTarget(p Provider, target Target) {
+	if t, ok := p.(targeted); ok {
+		t.setTarget(target)
+	}
+}
+
+// awsIAMProvider issues IAM authentication tokens for Aurora and RDS databases,
+// which are used as the password. Tokens are signed with credentials from the
+// standard AWS environment variables if set, or otherwise from the EC2 instance
+// metadata service, and are refreshed before they expire.
+type awsIAMProvider struct {
+	*cache
+
+	mu     sync.Mutex
+	region string
+	target Target
+}
+
+func newAWSIAMProvider(region string) *awsIAMProvider {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	p := &awsIAMProvider{region: region}
+	p.cache = newCache("aws-iam", p.fetch)
+	return p
+}
+
+func (p *awsIAMProvider) setTarget(target Target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.target = target
+}
+
+func (p *awsIAMProvider) fetch(ctx context.Context) (Credentials, error) {
+	p.mu.Lock()
+	target, region := p.target, p.region
+	p.mu.Unlock()
+
+	if target.Host == "" || target.User == "" {
+		return Credentials{}, errors.New("AWS IAM authentication requires the datastore endpoint to include the host and username")
+	}
+	if region == "" {
+		region = awsRegionFromHost(target.Host)
+	}
+	if region == "" {
+		return Credentials{}, fmt.Errorf("cannot determine the AWS region of %s; set AWS_REGION", target.Host)
+	}
+
+	creds, err := awsGetCredentials(ctx)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "getting AWS credentials")
+	}
+	token := awsIAMToken(net.JoinHostPort(target.Host, target.Port), region, target.User, creds, time.Now().UTC())
+	return Credentials{
+		Password: token,
+		Token:    true,
+		TTL:      awsIAMTokenTTL,
+	}, nil
+}
+
+// awsRegionFromHost returns the region of an RDS endpoint, such as
+// db.123456789012.us-east-1.rds.amazonaws.com, or an empty string.
+func awsRegionFromHost(host string) string {
+	parts := strings.Split(host, ".")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] == "rds" {
+			return parts[i-1]
+		}
+	}
+	return ""
+}
+
+// awsIAMToken returns an IAM authentication token for a database user, which
+// is a URL for the connect action, presigned with Signature Version 4, without
+// its scheme.
+func awsIAMToken(endpoint, region, user string, creds awsCredentials, now time.Time) string {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := strings.Join([]string{date, region, awsIAMService, "aws4_request"}, "/")
+
+	query := url.Values{}
+	query.Set("Action", "connect")
+	query.Set("DBUser", user)
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", creds.AccessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprint(int(awsIAMTokenTTL.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if creds.Token != "" {
+		query.Set("X-Amz-Security-Token", creds.Token)
+	}
+	// Signature Version 4 encodes spaces as %20 rather than +
+	canonicalQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		"/",
+		canonicalQuery,
+		"host:" + endpoint + "\n",
+		"host",
+		sha256Hex(nil),
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(creds, date, region, awsIAMService), stringToSign))
+
+	return endpoint + "/?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
@@ -0,0 +1,98 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	azureMetadataTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureKeyVaultResource = "https://vault.azure.net"
+	azureKeyVaultVersion  = "7.4"
+)
+
+// readAzureSecret reads the current version of a secret from Azure Key Vault.
+// The name is <vault-name>/<secret-name>. Requests are authorized with the access
+// token in AZURE_KEYVAULT_ACCESS_TOKEN if set, or otherwise with a token for the
+// managed identity of the instance, selected by AZURE_CLIENT_ID if set.
+func readAzureSecret(ctx context.Context, name string) (string, error) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid Azure secret %q, expected <vault-name>/<secret-name>", name)
+	}
+
+	token, err := azureAccessToken(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "getting Azure access token")
+	}
+
+	u := fmt.Sprintf("https://%s.vault.azure.net/secrets/%s?api-version=%s", parts[0], strings.Trim(parts[1], "/"), azureKeyVaultVersion)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "requesting secret from Azure Key Vault")
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		Value string `json:"value"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrapf(err, "decoding Azure Key Vault response with status %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Azure Key Vault returned %s: %s", resp.Status, result.Error.Message)
+	}
+	return result.Value, nil
+}
+
+func azureAccessToken(ctx context.Context) (string, error) {
+	if token := os.Getenv("AZURE_KEYVAULT_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", azureKeyVaultResource)
+	if clientID := os.Getenv("AZURE_CLIENT_ID"); clientID != "" {
+		query.Set("client_id", clientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, azureMetadataTokenURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata service returned %s", resp.Status)
+	}
+
+	result := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.AccessToken, nil
+}
@@ -0,0 +1,54 @@
+package credentials
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cache is a provider that caches credentials from a source, fetching new
+// credentials after two thirds of their TTL has passed. If fetching fails, the
+// cached credentials continue to be used until their TTL expires.
+type cache struct {
+	sync.Mutex
+	source string
+	fetch  func(ctx context.Context) (Credentials, error)
+
+	current Credentials
+	fetched time.Time
+}
+
+func newCache(source string, fetch func(ctx context.Context) (Credentials, error)) *cache {
+	return &cache{
+		source: source,
+		fetch:  fetch,
+	}
+}
+
+func (c *cache) Get(ctx context.Context) (Credentials, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.fetched.IsZero() && (c.current.TTL <= 0 || time.Since(c.fetched) < c.current.TTL*2/3) {
+		return c.current, nil
+	}
+
+	creds, err := c.fetch(ctx)
+	if err != nil {
+		if !c.fetched.IsZero() && time.Since(c.fetched) < c.current.TTL {
+			logrus.Warnf("Failed to refresh datastore credentials from %s, using existing credentials: %v", c.source, err)
+			return c.current, nil
+		}
+		return Credentials{}, err
+	}
+
+	// tokens are expected to change every time they are refreshed
+	if !c.fetched.IsZero() && creds != c.current && !creds.Token {
+		logrus.Infof("Datastore credentials from %s have changed, connections will be recycled within %s", c.source, creds.ConnMaxLifetime(0))
+	}
+	c.current = creds
+	c.fetched = time.Now()
+	return c.current, nil
+}
@@ -0,0 +1,88 @@
+package credentials
+
+import (
+	"context"
+	"time"
+)
+
+// Credentials are the username and password used to connect to the datastore.
+type Credentials struct {
+	// Username overrides the username in the datastore endpoint, if set.
+	Username string
+	// Password overrides the password in the datastore endpoint.
+	Password string
+	// DataSourceName replaces the datastore endpoint address, if set. The driver
+	// name is always taken from the configured endpoint.
+	DataSourceName string
+	// TTL is how long the credentials remain valid after they are issued, or
+	// zero if they do not expire.
+	TTL time.Duration
+	// Token is true if the password is a short-lived authentication token,
+	// which some servers require to be sent in clear text over TLS.
+	Token bool
+}
+
+// ConnMaxLifetime returns the maximum lifetime for connections opened with these
+// credentials, so that connections are replaced with ones using fresh credentials
+// before the old credentials expire. The configured lifetime is returned
+// unchanged if it is already short enough.
+func (c Credentials) ConnMaxLifetime(configured time.Duration) time.Duration {
+	if c.TTL <= 0 {
+		return configured
+	}
+	// credentials are refreshed after two thirds of their TTL, so a connection
+	// opened just before that must be closed within the remaining third
+	lifetime := c.TTL / 3
+	if configured > 0 && configured < lifetime {
+		return configured
+	}
+	return lifetime
+}
+
+// Provider supplies the current datastore credentials. Implementations cache
+// credentials and refresh them as needed; Get is called for every new connection.
+type Provider interface {
+	Get(ctx context.Context) (Credentials, error)
+}
+
+type Config struct {
+	VaultAddress   string
+	VaultToken     string
+	VaultTokenFile string
+	VaultCAFile    string
+	VaultCredsPath string
+
+	Secret                string
+	SecretRefreshInterval time.Duration
+
+	PasswordFile string
+	Password     string
+
+	AWSIAMAuth   bool
+	AWSIAMRegion string
+}
+
+// New returns a credentials provider for the given configuration, or nil if
+// credentials should be taken from the datastore endpoint as-is.
+func New(ctx context.Context, config Config) (Provider, error) {
+	if config.AWSIAMAuth {
+		return newAWSIAMProvider(config.AWSIAMRegion), nil
+	}
+	if config.VaultCredsPath != "" {
+		v, err := newVaultProvider(config)
+		if err != nil {
+			return nil, err
+		}
+		return newCache("vault", v.fetch), nil
+	}
+	if config.Secret != "" {
+		return newSecretProvider(config)
+	}
+	if config.PasswordFile != "" {
+		return newFileProvider(config.PasswordFile), nil
+	}
+	if config.Password != "" {
+		return staticProvider{Password: config.Password}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,63 @@
+package credentials
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// fileProvider reads the datastore password from a file, such as a mounted
+// Kubernetes secret. The file is checked for changes whenever a new connection is
+// opened, so a rotated password is used without restarting kine.
+type fileProvider struct {
+	sync.Mutex
+	path string
+
+	modTime time.Time
+	size    int64
+	current Credentials
+}
+
+func newFileProvider(path string) *fileProvider {
+	return &fileProvider{path: path}
+}
+
+func (f *fileProvider) Get(ctx context.Context) (Credentials, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "reading datastore password file")
+	}
+	if !f.modTime.IsZero() && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.current, nil
+	}
+
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "reading datastore password file")
+	}
+	password := strings.TrimRight(string(b), "\r\n")
+	if !f.modTime.IsZero() && password != f.current.Password {
+		logrus.Infof("Datastore password file %s has changed, new connections will use the new password", f.path)
+	}
+
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.current = Credentials{Password: password}
+	return f.current, nil
+}
+
+// staticProvider returns fixed credentials.
+type staticProvider Credentials
+
+func (s staticProvider) Get(ctx context.Context) (Credentials, error) {
+	return Credentials(s), nil
+}
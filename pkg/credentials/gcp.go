@@ -0,0 +1,96 @@
+package credentials
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcpSecretManagerURL = "https://secretmanager.googleapis.com/v1/"
+)
+
+// readGCPSecret reads a secret version from GCP Secret Manager. The name is the
+// full resource name of the version, such as
+// projects/<project>/secrets/<secret>/versions/latest. Requests are authorized
+// with the access token in GOOGLE_OAUTH_ACCESS_TOKEN if set, or otherwise with a
+// token for the default service account from the metadata server.
+func readGCPSecret(ctx context.Context, name string) (string, error) {
+	if !strings.Contains(name, "/versions/") {
+		name = strings.TrimSuffix(name, "/") + "/versions/latest"
+	}
+
+	token, err := gcpAccessToken(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "getting GCP access token")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpSecretManagerURL+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "requesting secret from GCP Secret Manager")
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrapf(err, "decoding GCP Secret Manager response with status %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GCP Secret Manager returned %s: %s", resp.Status, result.Error.Message)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(result.Payload.Data)
+	if err != nil {
+		return "", errors.Wrap(err, "decoding secret payload")
+	}
+	return string(data), nil
+}
+
+func gcpAccessToken(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+
+	result := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.AccessToken, nil
+}
@@ -0,0 +1,87 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	AWSSecretsManagerScheme = "aws-secretsmanager"
+	GCPSecretManagerScheme  = "gcp-secretmanager"
+	AzureKeyVaultScheme     = "azure-keyvault"
+
+	DefaultSecretRefreshInterval = 5 * time.Minute
+	secretRequestTimeout         = 10 * time.Second
+)
+
+var secretClient = &http.Client{Timeout: secretRequestTimeout}
+
+// secretValue is the JSON form of a secret, as used by AWS Secrets Manager for
+// database credentials. Fields other than these are ignored.
+type secretValue struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	DSN      string `json:"dsn"`
+}
+
+// newSecretProvider returns a provider that reads credentials from a cloud secret
+// manager, refreshing them at the configured interval. Secrets are addressed as
+//
+//	aws-secretsmanager://<region>/<secret-id>
+//	gcp-secretmanager://projects/<project>/secrets/<secret>/versions/<version>
+//	azure-keyvault://<vault-name>/<secret-name>
+func newSecretProvider(config Config) (Provider, error) {
+	parts := strings.SplitN(config.Secret, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid datastore secret %q, expected <scheme>://<secret>", config.Secret)
+	}
+
+	var read func(ctx context.Context, name string) (string, error)
+	switch parts[0] {
+	case AWSSecretsManagerScheme:
+		read = readAWSSecret
+	case GCPSecretManagerScheme:
+		read = readGCPSecret
+	case AzureKeyVaultScheme:
+		read = readAzureSecret
+	default:
+		return nil, fmt.Errorf("unsupported datastore secret scheme %s", parts[0])
+	}
+
+	interval := config.SecretRefreshInterval
+	if interval <= 0 {
+		interval = DefaultSecretRefreshInterval
+	}
+
+	name := parts[1]
+	return newCache(parts[0], func(ctx context.Context) (Credentials, error) {
+		value, err := read(ctx, name)
+		if err != nil {
+			return Credentials{}, err
+		}
+		creds := parseSecret(value)
+		// Secret managers do not say how long the previous value remains valid after
+		// rotation, so refresh at the configured interval, which also bounds the
+		// lifetime of connections opened with the previous value.
+		creds.TTL = interval * 3 / 2
+		return creds, nil
+	}), nil
+}
+
+// parseSecret parses a secret value that is either a JSON object with
+// username, password, and/or dsn fields, or a plain password.
+func parseSecret(value string) Credentials {
+	secret := secretValue{}
+	if err := json.Unmarshal([]byte(value), &secret); err != nil {
+		return Credentials{Password: strings.TrimSpace(value)}
+	}
+	return Credentials{
+		Username:       secret.Username,
+		Password:       secret.Password,
+		DataSourceName: secret.DSN,
+	}
+}
@@ -0,0 +1,111 @@
+package credentials
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const vaultRequestTimeout = 10 * time.Second
+
+// vaultProvider fetches dynamic credentials from a HashiCorp Vault database
+// secrets engine role, such as database/creds/kine. The TTL of the credentials is
+// the lease duration, so new credentials are fetched after two thirds of the lease
+// has passed, and connections opened with the old credentials are retired before
+// the lease expires, at which point Vault revokes them.
+type vaultProvider struct {
+	client    *http.Client
+	address   string
+	path      string
+	token     string
+	tokenFile string
+}
+
+type vaultSecret struct {
+	LeaseID       string `json:"lease_id"`
+	LeaseDuration int64  `json:"lease_duration"`
+	Data          struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+func newVaultProvider(config Config) (*vaultProvider, error) {
+	if config.VaultAddress == "" {
+		return nil, errors.New("vault address is required to fetch datastore credentials from vault")
+	}
+	if config.VaultToken == "" && config.VaultTokenFile == "" {
+		return nil, errors.New("vault token or token file is required to fetch datastore credentials from vault")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.VaultCAFile != "" {
+		pem, err := ioutil.ReadFile(config.VaultCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading vault CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in vault CA file %s", config.VaultCAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &vaultProvider{
+		client:    &http.Client{Transport: transport, Timeout: vaultRequestTimeout},
+		address:   strings.TrimSuffix(config.VaultAddress, "/"),
+		path:      strings.Trim(config.VaultCredsPath, "/"),
+		token:     config.VaultToken,
+		tokenFile: config.VaultTokenFile,
+	}, nil
+}
+
+func (v *vaultProvider) fetch(ctx context.Context) (Credentials, error) {
+	token := v.token
+	if v.tokenFile != "" {
+		// re-read the token each time, as it may be rotated by a vault agent
+		b, err := ioutil.ReadFile(v.tokenFile)
+		if err != nil {
+			return Credentials{}, errors.Wrap(err, "reading vault token file")
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.address+"/v1/"+v.path, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "requesting credentials from vault")
+	}
+	defer resp.Body.Close()
+
+	secret := vaultSecret{}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return Credentials{}, errors.Wrapf(err, "decoding vault response with status %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Credentials{}, fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(secret.Errors, "; "))
+	}
+	if secret.Data.Username == "" || secret.Data.Password == "" {
+		return Credentials{}, fmt.Errorf("vault response for %s does not contain a username and password", v.path)
+	}
+
+	return Credentials{
+		Username: secret.Data.Username,
+		Password: secret.Data.Password,
+		TTL:      time.Duration(secret.LeaseDuration) * time.Second,
+	}, nil
+}
@@ -0,0 +1,636 @@
+//go:build badger
+// +build badger
+
+package badger
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPath = "./db/badger"
+
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+	compactBatchSize = 1000
+	pollBatchSize    = 500
+
+	// vlogDiscardRatio is the fraction of a value log file that must be stale
+	// for garbage collection to rewrite it.
+	vlogDiscardRatio = 0.5
+)
+
+var (
+	// keyPrefix holds a version of each key at each revision it was written,
+	// with no value, and deletes as badger deletes.
+	keyPrefix = []byte("k")
+	// logPrefix holds the events by revision.
+	logPrefix  = []byte("l")
+	compactKey = []byte("mcompact")
+
+	errCorrupt = errors.New("corrupt event in badger database")
+)
+
+// Badger is a log stored in BadgerDB, an LSM tree that suits write heavy single
+// node deployments better than a B-tree. Badger runs in managed mode, where
+// the version of each key is the revision that wrote it, so reading at a
+// revision is a read at that version. Writes are serialized in the process to
+// commit revisions in order, and compaction lets badger discard versions up
+// to the compact revision, then reclaims the value log.
+type Badger struct {
+	db          *badger.DB
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	notify      chan int64
+	compactor   sync.Once
+
+	// mu serializes commits, and guards advancing the revisions
+	mu       sync.Mutex
+	revision int64
+	compact  int64
+	// polled is the last revision delivered to watchers
+	polled int64
+}
+
+// New opens the badger database in the directory in the endpoint, creating it
+// if it does not exist, for example badger:///var/lib/kine/badger.
+func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
+	path := dataSourceName
+	if path == "" {
+		path = defaultPath
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := badger.OpenManaged(badger.DefaultOptions(path).WithLogger(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Badger{
+		db:     db,
+		notify: make(chan int64, 1024),
+	}
+	if err := b.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return logstructured.New(b), nil
+}
+
+// load reads the current revision from the last event in the log, which is
+// never compacted, and the compact revision.
+func (b *Badger) load() error {
+	txn := b.db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: logPrefix, Reverse: true})
+	defer it.Close()
+	if it.Seek(logKey(math.MaxInt64)); it.ValidForPrefix(logPrefix) {
+		b.revision = revisionOf(it.Item().Key())
+	}
+
+	item, err := txn.Get(compactKey)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil || len(v) != 8 {
+		return errCorrupt
+	}
+	b.compact = int64(binary.BigEndian.Uint64(v))
+	return nil
+}
+
+func (b *Badger) Start(ctx context.Context) error {
+	b.ctx = ctx
+	go func() {
+		<-ctx.Done()
+		b.db.Close()
+	}()
+	return nil
+}
+
+func encodeRevision(rev int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(rev))
+	return k
+}
+
+func logKey(rev int64) []byte {
+	return append(append([]byte(nil), logPrefix...), encodeRevision(rev)...)
+}
+
+func revisionOf(logKey []byte) int64 {
+	return int64(binary.BigEndian.Uint64(logKey[len(logPrefix):]))
+}
+
+func nameKey(name string) []byte {
+	return append(append([]byte(nil), keyPrefix...), name...)
+}
+
+func (b *Badger) CurrentRevision(ctx context.Context) (int64, error) {
+	return atomic.LoadInt64(&b.revision), nil
+}
+
+func (b *Badger) CompactRevision(ctx context.Context) (int64, error) {
+	return atomic.LoadInt64(&b.compact), nil
+}
+
+// read returns a read only transaction at the current revision, or at the
+// given revision if it is not compacted.
+func (b *Badger) read(revision int64) (*badger.Txn, int64, error) {
+	rev := atomic.LoadInt64(&b.revision)
+	if revision > 0 {
+		if revision < atomic.LoadInt64(&b.compact) {
+			return nil, rev, server.ErrCompacted
+		}
+		rev = revision
+	}
+	return b.db.NewTransactionAt(uint64(rev), false), rev, nil
+}
+
+func (b *Badger) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	txn, rev, err := b.read(revision)
+	if err != nil {
+		return rev, nil, err
+	}
+	defer txn.Discard()
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+	seek := nameKey(prefix)
+	if checkPrefix && startKey != "" {
+		seek = nameKey(startKey)
+	}
+
+	// every version is needed to see deletes, which are skipped otherwise, and
+	// the first version of each key is the latest at the revision
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: nameKey(prefix), AllVersions: true})
+	defer it.Close()
+
+	var (
+		events []*server.Event
+		last   []byte
+	)
+	for it.Seek(seek); it.Valid(); it.Next() {
+		item := it.Item()
+		if string(item.Key()) == string(last) {
+			continue
+		}
+		last = item.KeyCopy(last[:0])
+		if !checkPrefix && string(last[len(keyPrefix):]) != prefix {
+			break
+		}
+		if item.IsDeletedOrExpired() && !includeDeleted {
+			continue
+		}
+
+		event, err := getEvent(txn, int64(item.Version()))
+		if err == badger.ErrKeyNotFound {
+			// a compacted delete, that badger has not discarded yet
+			continue
+		} else if err != nil {
+			return rev, nil, err
+		}
+		events = append(events, event)
+		if limit > 0 && int64(len(events)) >= limit {
+			break
+		}
+	}
+	return rev, events, nil
+}
+
+func getEvent(txn *badger.Txn, rev int64) (*server.Event, error) {
+	item, err := txn.Get(logKey(rev))
+	if err != nil {
+		return nil, err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	return decode(rev, v)
+}
+
+func (b *Badger) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	checkPrefix := strings.HasSuffix(prefix, "/")
+	return b.after(revision, limit, func(name string) bool {
+		return (checkPrefix && strings.HasPrefix(name, prefix)) || name == prefix
+	})
+}
+
+// after returns the current revision and the events after a revision that
+// match, up to a limit.
+func (b *Badger) after(revision, limit int64, match func(name string) bool) (int64, []*server.Event, error) {
+	txn, rev, err := b.read(0)
+	if err != nil {
+		return rev, nil, err
+	}
+	defer txn.Discard()
+	if revision > 0 && revision < atomic.LoadInt64(&b.compact) {
+		return rev, nil, server.ErrCompacted
+	}
+
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: logPrefix, PrefetchValues: true})
+	defer it.Close()
+
+	var events []*server.Event
+	for it.Seek(logKey(revision + 1)); it.Valid(); it.Next() {
+		item := it.Item()
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return rev, nil, err
+		}
+		event, err := decode(revisionOf(item.Key()), v)
+		if err != nil {
+			return rev, nil, err
+		}
+		if match(event.KV.Key) {
+			events = append(events, event)
+			if limit > 0 && int64(len(events)) >= limit {
+				break
+			}
+		}
+	}
+	return rev, events, nil
+}
+
+func (b *Badger) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	rev, events, err := b.List(ctx, prefix, "", 0, 0, false)
+	return rev, int64(len(events)), err
+}
+
+// Append writes an event at the next revision, if the latest revision of its
+// key is the previous revision of the event, or the event creates a key that
+// does not exist.
+func (b *Badger) Append(ctx context.Context, event *server.Event) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current := b.revision
+	txn := b.db.NewTransactionAt(uint64(current), true)
+	defer txn.Discard()
+
+	var prevRevision int64
+	if event.PrevKV != nil {
+		prevRevision = event.PrevKV.ModRevision
+	}
+	latest := latestRevision(txn, event.KV.Key)
+	if (latest != 0 && latest != prevRevision) || (latest == 0 && !event.Create) {
+		return 0, server.ErrKeyExists
+	}
+
+	rev := current + 1
+	// store the actual previous revision of the key, as a create passes the
+	// current revision when the key has none, and compaction deletes it
+	if err := txn.Set(logKey(rev), encode(event, latest)); err != nil {
+		return 0, err
+	}
+	var err error
+	if event.Delete {
+		err = txn.Delete(nameKey(event.KV.Key))
+	} else {
+		err = txn.Set(nameKey(event.KV.Key), nil)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := txn.CommitAt(uint64(rev), nil); err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&b.revision, rev)
+
+	select {
+	case b.notify <- rev:
+	default:
+	}
+	return rev, nil
+}
+
+// latestRevision returns the latest revision of a key, including a delete, or
+// 0 if it has none.
+func latestRevision(txn *badger.Txn, name string) int64 {
+	key := nameKey(name)
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: key, AllVersions: true})
+	defer it.Close()
+	for it.Seek(key); it.Valid(); it.Next() {
+		item := it.Item()
+		if string(item.Key()) != string(key) {
+			break
+		}
+		return int64(item.Version())
+	}
+	return 0
+}
+
+func (b *Badger) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	values, err := b.broadcaster.Subscribe(ctx, b.startWatch)
+	if err != nil {
+		return nil
+	}
+	res := make(chan []*server.Event, cap(values))
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			events, ok := filter(i, checkPrefix, prefix)
+			if ok {
+				res <- events
+			}
+		}
+	}()
+
+	return res
+}
+
+func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Event, bool) {
+	eventList := events.([]*server.Event)
+	filteredEventList := make([]*server.Event, 0, len(eventList))
+
+	for _, event := range eventList {
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+			filteredEventList = append(filteredEventList, event)
+		}
+	}
+
+	return filteredEventList, len(filteredEventList) > 0
+}
+
+func (b *Badger) startWatch() (chan interface{}, error) {
+	pollStart, err := b.CompactRevision(b.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan interface{})
+	b.compactor.Do(func() {
+		go b.compactLoop()
+	})
+	go b.poll(ch, pollStart)
+	return ch, nil
+}
+
+// WatchRevision returns the last revision delivered to watchers, or zero if no
+// watch has been started.
+func (b *Badger) WatchRevision() int64 {
+	return atomic.LoadInt64(&b.polled)
+}
+
+// poll reads new events from the log whenever an append notifies it, and every
+// second in case a notification was dropped because the channel was full.
+func (b *Badger) poll(result chan interface{}, pollStart int64) {
+	wait := time.NewTicker(time.Second)
+	defer wait.Stop()
+	defer close(result)
+
+	last := pollStart
+	atomic.StoreInt64(&b.polled, last)
+	waitForMore := true
+	all := func(string) bool { return true }
+
+	for {
+		if waitForMore {
+			select {
+			case <-b.ctx.Done():
+				return
+			case check := <-b.notify:
+				if check <= last {
+					continue
+				}
+			case <-wait.C:
+			}
+		}
+
+		rev, events, err := b.after(last, pollBatchSize, all)
+		if err != nil {
+			logrus.Errorf("fail to list latest changes: %v", err)
+			waitForMore = true
+			continue
+		}
+		waitForMore = len(events) < pollBatchSize
+		if !waitForMore {
+			rev = events[len(events)-1].KV.ModRevision
+		}
+		if rev <= last {
+			continue
+		}
+		last = rev
+		atomic.StoreInt64(&b.polled, last)
+		if len(events) > 0 {
+			result <- events
+		}
+	}
+}
+
+// compactLoop periodically advances the compact revision, keeping the most
+// recent revisions. Superseded events and deletes are removed from the log in
+// batches, and badger is told it may discard the versions of keys up to the
+// compact revision, which it does as it compacts its LSM tree. Space in the
+// value log is only reclaimed by garbage collection, which is run until it
+// finds no file worth rewriting.
+func (b *Badger) compactLoop() {
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		current := atomic.LoadInt64(&b.revision)
+		target := current - compactMinRetain
+		for {
+			done, err := b.compactBatch(target)
+			if err != nil {
+				logrus.Errorf("Compact failed: %v", err)
+				break
+			}
+			if done {
+				logrus.Debugf("COMPACT compacted to %d/%d", target, current)
+				break
+			}
+		}
+		b.db.SetDiscardTs(uint64(atomic.LoadInt64(&b.compact)))
+
+		for b.ctx.Err() == nil {
+			if err := b.db.RunValueLogGC(vlogDiscardRatio); err != nil {
+				if err != badger.ErrNoRewrite {
+					logrus.Errorf("Value log GC failed: %v", err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// compactBatch compacts up to compactBatchSize revisions toward the target, and
+// returns true once the target is reached. The removals are committed at the
+// current revision, which is why appends are blocked while it runs.
+func (b *Badger) compactBatch(target int64) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	compact, current := b.compact, b.revision
+	if compact >= target {
+		return true, nil
+	}
+	to, done := compact+compactBatchSize, false
+	if to >= target {
+		to, done = target, true
+	}
+
+	txn := b.db.NewTransactionAt(uint64(current), true)
+	defer txn.Discard()
+
+	var events []*server.Event
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: logPrefix, PrefetchValues: true})
+	for it.Seek(logKey(compact + 1)); it.Valid(); it.Next() {
+		item := it.Item()
+		rev := revisionOf(item.Key())
+		if rev > to {
+			break
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			it.Close()
+			return false, err
+		}
+		event, err := decode(rev, v)
+		if err != nil {
+			it.Close()
+			return false, err
+		}
+		events = append(events, event)
+	}
+	it.Close()
+
+	for _, event := range events {
+		if event.PrevKV != nil && event.PrevKV.ModRevision > 0 {
+			if err := txn.Delete(logKey(event.PrevKV.ModRevision)); err != nil {
+				return false, err
+			}
+		}
+		if event.Delete {
+			if err := txn.Delete(logKey(event.KV.ModRevision)); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := txn.Set(compactKey, encodeRevision(to)); err != nil {
+		return false, err
+	}
+	if err := txn.CommitAt(uint64(current), nil); err != nil {
+		return false, err
+	}
+	atomic.StoreInt64(&b.compact, to)
+	return done, nil
+}
+
+// DbSize returns the size of the LSM tree and value log.
+func (b *Badger) DbSize(ctx context.Context) (int64, error) {
+	lsm, vlog := b.db.Size()
+	return lsm + vlog, nil
+}
+
+// encode returns an event without its revision, as flags followed by the
+// create revision, previous revision and lease as varints, and the key, value
+// and previous value, each prefixed by its length.
+func encode(event *server.Event, prevRevision int64) []byte {
+	var (
+		flags    byte
+		oldValue []byte
+	)
+	if event.Create {
+		flags |= 1
+	}
+	if event.Delete {
+		flags |= 2
+	}
+	if event.PrevKV != nil {
+		oldValue = event.PrevKV.Value
+	}
+
+	buf := make([]byte, 1, 1+6*binary.MaxVarintLen64+len(event.KV.Key)+len(event.KV.Value)+len(oldValue))
+	buf[0] = flags
+	for _, n := range []int64{event.KV.CreateRevision, prevRevision, event.KV.Lease} {
+		buf = appendVarint(buf, n)
+	}
+	for _, b := range [][]byte{[]byte(event.KV.Key), event.KV.Value, oldValue} {
+		buf = appendVarint(buf, int64(len(b)))
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func appendVarint(buf []byte, n int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], n)]...)
+}
+
+func decode(rev int64, buf []byte) (*server.Event, error) {
+	if len(buf) == 0 {
+		return nil, errCorrupt
+	}
+	flags := buf[0]
+	buf = buf[1:]
+
+	var ints [3]int64
+	for i := range ints {
+		n, size := binary.Varint(buf)
+		if size <= 0 {
+			return nil, errCorrupt
+		}
+		ints[i], buf = n, buf[size:]
+	}
+	var fields [3][]byte
+	for i := range fields {
+		n, size := binary.Varint(buf)
+		if size <= 0 || int64(len(buf)-size) < n {
+			return nil, errCorrupt
+		}
+		buf = buf[size:]
+		fields[i], buf = buf[:n:n], buf[n:]
+	}
+
+	event := &server.Event{
+		Create: flags&1 != 0,
+		Delete: flags&2 != 0,
+		KV: &server.KeyValue{
+			Key:            string(fields[0]),
+			CreateRevision: ints[0],
+			ModRevision:    rev,
+			Value:          fields[1],
+			Lease:          ints[2],
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: ints[1],
+			Value:       fields[2],
+		},
+	}
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event, nil
+}
@@ -0,0 +1,15 @@
+//go:build !badger
+// +build !badger
+
+package badger
+
+import (
+	"context"
+	"errors"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
+	return nil, errors.New(`this binary is built without BadgerDB support, compile with "-tags badger"`)
+}
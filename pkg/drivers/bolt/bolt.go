@@ -0,0 +1,586 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	defaultPath = "./db/state.bolt"
+
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+	compactBatchSize = 1000
+	pollBatchSize    = 500
+)
+
+var (
+	// logBucket holds the events by revision, and its sequence is the current
+	// revision.
+	logBucket = []byte("log")
+	// keysBucket indexes the revisions of each key, as the key, a zero byte and
+	// the revision, with no value.
+	keysBucket = []byte("keys")
+	metaBucket = []byte("meta")
+	compactKey = []byte("compact")
+
+	errCorrupt = errors.New("corrupt event in bolt database")
+)
+
+// Bolt is a log stored in a bbolt file, for single node deployments that do not
+// want a CGO dependency. Bolt serializes writes and gives each read a
+// consistent snapshot, so revisions are committed in order and without gaps.
+// Appends notify a goroutine that reads new events from the log and broadcasts
+// them to watches, and compaction runs in the same process.
+type Bolt struct {
+	db          *bbolt.DB
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	notify      chan int64
+	compactor   sync.Once
+	// polled is the last revision delivered to watchers
+	polled int64
+}
+
+// New opens the bbolt file at the path in the endpoint, creating it if it does
+// not exist, for example bolt:///var/lib/kine/state.bolt.
+func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
+	path := dataSourceName
+	if path == "" {
+		path = defaultPath
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{logBucket, keysBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return logstructured.New(&Bolt{
+		db:     db,
+		notify: make(chan int64, 1024),
+	}), nil
+}
+
+func (b *Bolt) Start(ctx context.Context) error {
+	b.ctx = ctx
+	go func() {
+		<-ctx.Done()
+		b.db.Close()
+	}()
+	return nil
+}
+
+func revKey(rev int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(rev))
+	return k
+}
+
+// nameKey returns the key of a revision of a key in the keys bucket.
+func nameKey(name string, rev int64) []byte {
+	return append(append([]byte(name), 0), revKey(rev)...)
+}
+
+// splitNameKey returns the name and revision of a key in the keys bucket.
+func splitNameKey(k []byte) (string, int64) {
+	return string(k[:len(k)-9]), int64(binary.BigEndian.Uint64(k[len(k)-8:]))
+}
+
+func currentRevision(tx *bbolt.Tx) int64 {
+	return int64(tx.Bucket(logBucket).Sequence())
+}
+
+func compactRevision(tx *bbolt.Tx) int64 {
+	v := tx.Bucket(metaBucket).Get(compactKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+func (b *Bolt) CurrentRevision(ctx context.Context) (rev int64, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		rev = currentRevision(tx)
+		return nil
+	})
+	return
+}
+
+func (b *Bolt) CompactRevision(ctx context.Context) (rev int64, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		rev = compactRevision(tx)
+		return nil
+	})
+	return
+}
+
+func (b *Bolt) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (rev int64, events []*server.Event, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		rev = currentRevision(tx)
+		if revision > 0 && revision < compactRevision(tx) {
+			return server.ErrCompacted
+		}
+		if revision > 0 {
+			rev = revision
+		}
+
+		log := tx.Bucket(logBucket)
+		c := tx.Bucket(keysBucket).Cursor()
+
+		seek := []byte(prefix)
+		if strings.HasSuffix(prefix, "/") && startKey != "" {
+			seek = []byte(startKey)
+		}
+		var (
+			latestName string
+			latestRev  int64
+		)
+		// flush adds the latest revision of the last name scanned, and returns
+		// true once the limit is reached
+		flush := func() (bool, error) {
+			if latestRev == 0 {
+				return false, nil
+			}
+			event, err := decode(latestRev, log.Get(revKey(latestRev)))
+			latestRev = 0
+			if err != nil {
+				return false, err
+			}
+			if includeDeleted || !event.Delete {
+				events = append(events, event)
+			}
+			return limit > 0 && int64(len(events)) >= limit, nil
+		}
+
+		for k, _ := c.Seek(seek); k != nil; k, _ = c.Next() {
+			name, kRev := splitNameKey(k)
+			if !strings.HasPrefix(name, prefix) || (!strings.HasSuffix(prefix, "/") && name != prefix) {
+				break
+			}
+			if name != latestName {
+				if done, err := flush(); err != nil || done {
+					return err
+				}
+				latestName = name
+			}
+			if kRev <= rev {
+				latestRev = kRev
+			}
+		}
+		_, err := flush()
+		return err
+	})
+	if err == server.ErrCompacted {
+		return rev, nil, err
+	}
+	return
+}
+
+func (b *Bolt) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	checkPrefix := strings.HasSuffix(prefix, "/")
+	rev, events, err := b.after(revision, limit, func(name string) bool {
+		return (checkPrefix && strings.HasPrefix(name, prefix)) || name == prefix
+	})
+	if err == server.ErrCompacted {
+		return rev, nil, err
+	}
+	return rev, events, err
+}
+
+// after returns the current revision and the events after a revision that
+// match, up to a limit.
+func (b *Bolt) after(revision, limit int64, match func(name string) bool) (rev int64, events []*server.Event, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		rev = currentRevision(tx)
+		if revision > 0 && revision < compactRevision(tx) {
+			return server.ErrCompacted
+		}
+		c := tx.Bucket(logBucket).Cursor()
+		for k, v := c.Seek(revKey(revision + 1)); k != nil; k, v = c.Next() {
+			event, err := decode(int64(binary.BigEndian.Uint64(k)), v)
+			if err != nil {
+				return err
+			}
+			if match(event.KV.Key) {
+				events = append(events, event)
+				if limit > 0 && int64(len(events)) >= limit {
+					break
+				}
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (b *Bolt) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	rev, events, err := b.List(ctx, prefix, "", 0, 0, false)
+	return rev, int64(len(events)), err
+}
+
+// Append writes an event at the next revision, if the latest revision of its
+// key is the previous revision of the event, or the event creates a key that
+// does not exist.
+func (b *Bolt) Append(ctx context.Context, event *server.Event) (rev int64, err error) {
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		keys := tx.Bucket(keysBucket)
+		log := tx.Bucket(logBucket)
+
+		var prevRevision int64
+		if event.PrevKV != nil {
+			prevRevision = event.PrevKV.ModRevision
+		}
+		latest := latestRevision(keys.Cursor(), event.KV.Key)
+		if (latest != 0 && latest != prevRevision) || (latest == 0 && !event.Create) {
+			return server.ErrKeyExists
+		}
+
+		seq, err := log.NextSequence()
+		if err != nil {
+			return err
+		}
+		rev = int64(seq)
+		// store the actual previous revision of the key, as a create passes the
+		// current revision when the key has none, and compaction deletes it
+		if err := log.Put(revKey(rev), encode(event, latest)); err != nil {
+			return err
+		}
+		return keys.Put(nameKey(event.KV.Key, rev), nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case b.notify <- rev:
+	default:
+	}
+	return rev, nil
+}
+
+// latestRevision returns the latest revision of a key, or 0 if it has none.
+func latestRevision(c *bbolt.Cursor, name string) int64 {
+	prefix := append([]byte(name), 0)
+	// seek past the last revision of the key, and step back to it
+	k, _ := c.Seek(nameKey(name, -1))
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	if k == nil || !bytes.HasPrefix(k, prefix) || len(k) != len(prefix)+8 {
+		return 0
+	}
+	_, rev := splitNameKey(k)
+	return rev
+}
+
+func (b *Bolt) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	values, err := b.broadcaster.Subscribe(ctx, b.startWatch)
+	if err != nil {
+		return nil
+	}
+	res := make(chan []*server.Event, cap(values))
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			events, ok := filter(i, checkPrefix, prefix)
+			if ok {
+				res <- events
+			}
+		}
+	}()
+
+	return res
+}
+
+func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Event, bool) {
+	eventList := events.([]*server.Event)
+	filteredEventList := make([]*server.Event, 0, len(eventList))
+
+	for _, event := range eventList {
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+			filteredEventList = append(filteredEventList, event)
+		}
+	}
+
+	return filteredEventList, len(filteredEventList) > 0
+}
+
+func (b *Bolt) startWatch() (chan interface{}, error) {
+	pollStart, err := b.CompactRevision(b.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan interface{})
+	b.compactor.Do(func() {
+		go b.compact()
+	})
+	go b.poll(ch, pollStart)
+	return ch, nil
+}
+
+// WatchRevision returns the last revision delivered to watchers, or zero if no
+// watch has been started.
+func (b *Bolt) WatchRevision() int64 {
+	return atomic.LoadInt64(&b.polled)
+}
+
+// poll reads new events from the log whenever an append notifies it, and every
+// second in case a notification was dropped because the channel was full.
+func (b *Bolt) poll(result chan interface{}, pollStart int64) {
+	wait := time.NewTicker(time.Second)
+	defer wait.Stop()
+	defer close(result)
+
+	last := pollStart
+	atomic.StoreInt64(&b.polled, last)
+	waitForMore := true
+	all := func(string) bool { return true }
+
+	for {
+		if waitForMore {
+			select {
+			case <-b.ctx.Done():
+				return
+			case check := <-b.notify:
+				if check <= last {
+					continue
+				}
+			case <-wait.C:
+			}
+		}
+
+		rev, events, err := b.after(last, pollBatchSize, all)
+		if err != nil {
+			logrus.Errorf("fail to list latest changes: %v", err)
+			waitForMore = true
+			continue
+		}
+		waitForMore = len(events) < pollBatchSize
+		if !waitForMore {
+			rev = events[len(events)-1].KV.ModRevision
+		}
+		if rev <= last {
+			continue
+		}
+		last = rev
+		atomic.StoreInt64(&b.polled, last)
+		if len(events) > 0 {
+			result <- events
+		}
+	}
+}
+
+// compact periodically advances the compact revision, keeping the most recent
+// revisions, and removes the revisions up to it that have been superseded, and
+// deleted keys, in batches so that writes are not blocked for long.
+func (b *Bolt) compact() {
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		current, err := b.CurrentRevision(b.ctx)
+		if err != nil {
+			logrus.Errorf("Compact failed to get current revision: %v", err)
+			continue
+		}
+		target := current - compactMinRetain
+		for {
+			done, err := b.compactBatch(target)
+			if err != nil {
+				logrus.Errorf("Compact failed: %v", err)
+				break
+			}
+			if done {
+				logrus.Debugf("COMPACT compacted to %d/%d", target, current)
+				break
+			}
+		}
+	}
+}
+
+// compactBatch compacts up to compactBatchSize revisions toward the target, and
+// returns true once the target is reached.
+func (b *Bolt) compactBatch(target int64) (done bool, err error) {
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		compact := compactRevision(tx)
+		if compact >= target {
+			done = true
+			return nil
+		}
+		to := compact + compactBatchSize
+		if to >= target {
+			to, done = target, true
+		}
+
+		log := tx.Bucket(logBucket)
+		keys := tx.Bucket(keysBucket)
+		remove := func(name string, rev int64) error {
+			if err := log.Delete(revKey(rev)); err != nil {
+				return err
+			}
+			return keys.Delete(nameKey(name, rev))
+		}
+
+		// deleting while iterating skips entries, so collect the events first
+		var events []*server.Event
+		c := log.Cursor()
+		for k, v := c.Seek(revKey(compact + 1)); k != nil; k, v = c.Next() {
+			rev := int64(binary.BigEndian.Uint64(k))
+			if rev > to {
+				break
+			}
+			event, err := decode(rev, v)
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		for _, event := range events {
+			if event.PrevKV != nil && event.PrevKV.ModRevision > 0 {
+				if err := remove(event.KV.Key, event.PrevKV.ModRevision); err != nil {
+					return err
+				}
+			}
+			if event.Delete {
+				if err := remove(event.KV.Key, event.KV.ModRevision); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Bucket(metaBucket).Put(compactKey, revKey(to))
+	})
+	return
+}
+
+// DbSize returns the size of the bolt file.
+func (b *Bolt) DbSize(ctx context.Context) (size int64, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return
+}
+
+// encode returns an event without its revision, as flags followed by the
+// create revision, previous revision and lease as varints, and the key, value
+// and previous value, each prefixed by its length.
+func encode(event *server.Event, prevRevision int64) []byte {
+	var (
+		flags    byte
+		oldValue []byte
+	)
+	if event.Create {
+		flags |= 1
+	}
+	if event.Delete {
+		flags |= 2
+	}
+	if event.PrevKV != nil {
+		oldValue = event.PrevKV.Value
+	}
+
+	buf := make([]byte, 1, 1+6*binary.MaxVarintLen64+len(event.KV.Key)+len(event.KV.Value)+len(oldValue))
+	buf[0] = flags
+	for _, n := range []int64{event.KV.CreateRevision, prevRevision, event.KV.Lease} {
+		buf = appendVarint(buf, n)
+	}
+	for _, b := range [][]byte{[]byte(event.KV.Key), event.KV.Value, oldValue} {
+		buf = appendVarint(buf, int64(len(b)))
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func appendVarint(buf []byte, n int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], n)]...)
+}
+
+func decode(rev int64, buf []byte) (*server.Event, error) {
+	if len(buf) == 0 {
+		return nil, errCorrupt
+	}
+	flags := buf[0]
+	buf = buf[1:]
+
+	var ints [3]int64
+	for i := range ints {
+		n, size := binary.Varint(buf)
+		if size <= 0 {
+			return nil, errCorrupt
+		}
+		ints[i], buf = n, buf[size:]
+	}
+	var fields [3][]byte
+	for i := range fields {
+		n, size := binary.Varint(buf)
+		if size <= 0 || int64(len(buf)-size) < n {
+			return nil, errCorrupt
+		}
+		buf = buf[size:]
+		// copy, as bolt's memory is only valid during the transaction
+		fields[i] = append([]byte(nil), buf[:n]...)
+		buf = buf[n:]
+	}
+
+	event := &server.Event{
+		Create: flags&1 != 0,
+		Delete: flags&2 != 0,
+		KV: &server.KeyValue{
+			Key:            string(fields[0]),
+			CreateRevision: ints[0],
+			ModRevision:    rev,
+			Value:          fields[1],
+			Lease:          ints[2],
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: ints[1],
+			Value:       fields[2],
+		},
+	}
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event, nil
+}
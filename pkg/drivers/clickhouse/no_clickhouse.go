@@ -0,0 +1,16 @@
+//go:build !clickhouse
+// +build !clickhouse
+
+package clickhouse
+
+import (
+	"context"
+	"errors"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+)
+
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server.Backend, error) {
+	return nil, errors.New(`this binary is built without ClickHouse support, compile with "-tags clickhouse"`)
+}
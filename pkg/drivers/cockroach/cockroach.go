@@ -0,0 +1,145 @@
+package cockroach
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/k3s-io/kine/pkg/credentials"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/drivers/pgsql"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultDSN = "root@localhost:26257/"
+
+	// retryableCode is returned for transactions that must be retried because
+	// they conflicted with another transaction.
+	retryableCode = "40001"
+)
+
+// New connects to CockroachDB over the Postgres protocol. Statements that fail
+// with a serialization error under contention are retried by kine, and the kine
+// table is created with hash-sharded indexes so that writes of increasing
+// revisions are spread over ranges rather than all landing on the last one.
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, credsProvider credentials.Provider, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	if dataSourceName == "" {
+		dataSourceName = defaultDSN
+	}
+	parsedDSN, dsn, err := pgsql.DSNFunc(dataSourceName, tlsInfo, credsProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	initialDSN, err := dsn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.SkipDDL() {
+		if err := createDBIfNotExist(initialDSN); err != nil {
+			return nil, err
+		}
+	}
+
+	var dialect *generic.Generic
+	if credsProvider != nil {
+		var creds credentials.Credentials
+		if creds, err = credsProvider.Get(ctx); err != nil {
+			return nil, err
+		}
+		connPoolConfig.MaxLifetime = creds.ConnMaxLifetime(connPoolConfig.MaxLifetime)
+		dialect, err = generic.OpenWithDSNFunc(ctx, "postgres", dsn, connPoolConfig, "$", true, metricsRegisterer)
+	} else {
+		dialect, err = generic.Open(ctx, "postgres", parsedDSN, connPoolConfig, "$", true, metricsRegisterer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dialect.ApplyConfig(config)
+	dialect.GetSizeSQL = `
+		SELECT COALESCE(SUM(range_size), 0)
+		FROM crdb_internal.ranges
+		WHERE database_name = current_database() AND table_name = 'kine'`
+	dialect.PromoteSQL = `SELECT setval('kine_id_seq', (SELECT MAX(id) FROM kine))`
+	dialect.CompactSQL = `
+		DELETE FROM kine AS kv
+		WHERE
+			kv.id IN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= $1
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= $2
+			)`
+	dialect.FullScan = regexp.MustCompile(`FULL SCAN`).MatchString
+	dialect.ColumnsSQL = `
+		SELECT column_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'kine'`
+	dialect.IndexesSQL = `
+		SELECT i.relname, ix.indisunique
+		FROM pg_index AS ix
+		JOIN pg_class AS i ON i.oid = ix.indexrelid
+		JOIN pg_class AS t ON t.oid = ix.indrelid
+		JOIN pg_namespace AS n ON n.oid = t.relnamespace
+		WHERE
+			t.relname = 'kine' AND
+			n.nspname = current_schema()`
+	// schema changes are online, and do not block writes
+	dialect.CreateIndexSQL = `CREATE %sINDEX IF NOT EXISTS %s ON kine (%s)`
+	dialect.RetryPolicy.Retryable = func(err error) bool {
+		if err, ok := err.(*pq.Error); ok {
+			return err.Code == retryableCode
+		}
+		return false
+	}
+	dialect.TranslateErr = func(err error) error {
+		if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		if err, ok := err.(*pq.Error); ok {
+			return string(err.Code)
+		}
+		return err.Error()
+	}
+
+	if config.SkipDDL() {
+		if config.DryRun {
+			// setup only logs the schema migrations that would be applied
+			if err := setup(dialect.DB, config); err != nil && err != generic.ErrDDLDisabled {
+				dialect.Close()
+				return nil, err
+			}
+		}
+		if err := dialect.CheckSchema(ctx); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	} else {
+		if err := setup(dialect.DB, config); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	}
+	go dialect.MonitorDrift(ctx, config.DriftCheckInterval)
+	return logstructured.New(sqllog.New(dialect)), nil
+}
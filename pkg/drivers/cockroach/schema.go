@@ -0,0 +1,134 @@
+//go:build !noddl
+// +build !noddl
+
+package cockroach
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// Revisions must be dense, so ids are taken from an uncached sequence
+	// rather than unique_rowid(), which serial columns default to. The indexes
+	// led by the id are hash-sharded, as they are otherwise written to one range
+	// at a time. Strings are compared byte by byte, so no collation is needed.
+	schema = []string{
+		`CREATE SEQUENCE IF NOT EXISTS kine_id_seq CACHE 1`,
+		`CREATE TABLE IF NOT EXISTS kine
+			(
+				id INT8 NOT NULL DEFAULT nextval('kine_id_seq'),
+				name %s,
+				created INT8,
+				deleted INT8,
+				create_revision INT8,
+				prev_revision INT8,
+				lease INT8,
+				value BYTES,
+				old_value BYTES,
+				PRIMARY KEY (id) USING HASH
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_id_index ON kine (name,id)`,
+		`CREATE INDEX IF NOT EXISTS kine_id_deleted_index ON kine (id,deleted) USING HASH`,
+		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+	}
+	expirySchema = []string{
+		`ALTER TABLE kine ADD COLUMN IF NOT EXISTS expires_at INT8`,
+		`CREATE INDEX IF NOT EXISTS kine_expires_at_index ON kine (expires_at)`,
+	}
+	checksumSchema = `ALTER TABLE kine ADD COLUMN IF NOT EXISTS checksum INT8`
+)
+
+// nameColumn returns the type of the name column.
+func nameColumn(config generic.Config) string {
+	if config.BinaryKeys {
+		return fmt.Sprintf("BYTES CHECK (length(name) <= %d)", config.KeyColumnLength())
+	}
+	return fmt.Sprintf("VARCHAR(%d)", config.KeyColumnLength())
+}
+
+// migrations returns the migrations of the kine table, in order. Migrations
+// that have been released must not be changed.
+func migrations(config generic.Config) []generic.Migration {
+	stmts := make([]string, len(schema))
+	for i, stmt := range schema {
+		if strings.Contains(stmt, "%s") {
+			stmt = fmt.Sprintf(stmt, nameColumn(config))
+		}
+		stmts[i] = stmt
+	}
+	return []generic.Migration{
+		{
+			Version:     1,
+			Description: "create the kine table and its indexes",
+			Statements:  stmts,
+		},
+	}
+}
+
+func setup(db *sql.DB, config generic.Config) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	table, err := config.Table()
+	if err != nil {
+		return err
+	}
+
+	migrator := &generic.Migrator{
+		DB:         db,
+		Table:      table,
+		Migrations: migrations(config),
+		DryRun:     config.DryRun,
+	}
+	if err := migrator.Run(); err != nil || config.DryRun {
+		return err
+	}
+
+	var stmts []string
+	if config.TTLColumn {
+		stmts = append(stmts, expirySchema...)
+	}
+	if config.Checksums {
+		stmts = append(stmts, checksumSchema)
+	}
+	for _, stmt := range stmts {
+		stmt = table.SQL(stmt)
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+// createDBIfNotExist creates the database named in the data source. CockroachDB
+// accepts connections to databases that do not exist yet.
+func createDBIfNotExist(dataSourceName string) error {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return err
+	}
+	dbName := strings.TrimPrefix(u.Path, "/")
+
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stmt := "CREATE DATABASE IF NOT EXISTS " + pq.QuoteIdentifier(dbName)
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+	_, err = db.Exec(stmt)
+	return err
+}
@@ -0,0 +1,100 @@
+//go:build cosmosdb
+// +build cosmosdb
+
+package cosmosdb
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/sirupsen/logrus"
+)
+
+const feedRangeRefreshInterval = 10 * time.Second
+
+// readChangeFeed sends the revisions and gaps written to the container from now
+// on, as read from the change feed of each of its feed ranges. Feed ranges that
+// appear later, as partitions are split, are read from the time they were
+// found. Failures are logged and the feed range is abandoned, as revisions that
+// are not delivered by the change feed are queried from the container.
+func (c *CosmosDB) readChangeFeed(docs chan<- *document) {
+	readers := map[string]bool{}
+	start := time.Now()
+
+	t := time.NewTicker(feedRangeRefreshInterval)
+	defer t.Stop()
+
+	for {
+		ranges, err := c.container.GetFeedRanges(c.ctx)
+		if err != nil {
+			logrus.Errorf("Failed to get feed ranges of container %s: %v", c.name, err)
+		}
+		for _, feedRange := range ranges {
+			id := feedRange.MinInclusive + "-" + feedRange.MaxExclusive
+			if readers[id] {
+				continue
+			}
+			readers[id] = true
+			go c.readFeedRange(feedRange, start, docs)
+		}
+		start = time.Now()
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (c *CosmosDB) readFeedRange(feedRange azcosmos.FeedRange, start time.Time, docs chan<- *document) {
+	opts := &azcosmos.ChangeFeedOptions{
+		MaxItemCount: pollBatchSize,
+		FeedRange:    &feedRange,
+		StartFrom:    &start,
+	}
+	for {
+		resp, err := c.container.GetChangeFeed(c.ctx, opts)
+		if err != nil {
+			if c.ctx.Err() == nil {
+				logrus.Errorf("Failed to read change feed of range %s-%s: %v", feedRange.MinInclusive, feedRange.MaxExclusive, err)
+			}
+			return
+		}
+		for _, item := range resp.Documents {
+			d := &document{}
+			if err := json.Unmarshal(item, d); err != nil {
+				logrus.Errorf("Failed to decode change feed document: %v", err)
+				continue
+			}
+			// only revisions and gaps are delivered, not heads or counters
+			if d.Type != typeRev && d.Type != typeGap {
+				continue
+			}
+			select {
+			case <-c.ctx.Done():
+				return
+			case docs <- d:
+			}
+		}
+
+		continuation, err := resp.GetCompositeContinuationToken()
+		if err != nil {
+			logrus.Errorf("Failed to read change feed of range %s-%s: %v", feedRange.MinInclusive, feedRange.MaxExclusive, err)
+			return
+		}
+		opts = &azcosmos.ChangeFeedOptions{
+			MaxItemCount: pollBatchSize,
+			Continuation: &continuation,
+		}
+
+		if len(resp.Documents) == 0 {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+}
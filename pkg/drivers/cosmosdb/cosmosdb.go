@@ -0,0 +1,928 @@
+//go:build cosmosdb
+// +build cosmosdb
+
+package cosmosdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDatabase  = "kine"
+	defaultContainer = "kine"
+
+	// metaPartition holds the revision counters, and the revisions that were
+	// allocated but not written. Keys written through the etcd API start with a
+	// slash, so no key is stored in it.
+	metaPartition   = "kine"
+	revisionCounter = "revision"
+	compactCounter  = "compact"
+
+	// partitionDepth is the number of path segments of a key that make its
+	// partition key, so that /registry/pods/default/a is stored in the
+	// partition /registry/pods along with all other pods.
+	partitionDepth = 2
+
+	typeCounter = "counter"
+	typeHead    = "head"
+	typeRev     = "rev"
+	typeGap     = "gap"
+
+	appendRetries    = 20
+	appendTimeout    = 10 * time.Second
+	gapTimeout       = time.Minute
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+	pollInterval     = time.Second
+	pollBatchSize    = 500
+)
+
+// document is an item of the container. Each revision of a key is stored as a
+// rev document, and the latest revision is also copied to the head document of
+// the key, both in the partition of the key. Revisions that were allocated but
+// never written are recorded as gap documents in the meta partition.
+type document struct {
+	ID             string `json:"id"`
+	PK             string `json:"pk"`
+	Type           string `json:"type"`
+	Name           string `json:"name,omitempty"`
+	Rev            int64  `json:"rev"`
+	Created        bool   `json:"created,omitempty"`
+	Deleted        bool   `json:"deleted,omitempty"`
+	CreateRevision int64  `json:"create_revision,omitempty"`
+	PrevRevision   int64  `json:"prev_revision,omitempty"`
+	Lease          int64  `json:"lease,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+	OldValue       []byte `json:"old_value,omitempty"`
+	// Counter is set on counters.
+	Counter int64 `json:"counter,omitempty"`
+}
+
+// CosmosDB is a log stored in a single Azure Cosmos DB (SQL API) container,
+// partitioned on the leading segments of key names. Revisions are allocated
+// from a counter document, which is advanced with optimistic concurrency on its
+// etag, and the revision and the head of its key are then written in a
+// transactional batch in the partition of the key, which replaces the head only
+// if its etag is the one read when checking the previous revision, or creates
+// it if the key had no head. Watches are notified by the change feed of the
+// container, and read revisions that the feed has not delivered by querying
+// them.
+//
+// Writes to different partitions are not atomic with the counter, so a
+// revision that is allocated for a write that then fails is recorded as a gap,
+// and a revision that is still missing after gapTimeout is recorded as a gap by
+// watchers, so that a writer that crashed does not stall them.
+type CosmosDB struct {
+	container   *azcosmos.ContainerClient
+	database    string
+	name        string
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	compactor   sync.Once
+	// watched is the last revision delivered to watchers
+	watched int64
+}
+
+// New connects to Cosmos DB. The endpoint is the host of the account, followed
+// by the database and container names, and an optional key query parameter,
+// for example cosmosdb://myaccount.documents.azure.com/kine/kine?key=... If
+// the key is not set, it is read from the COSMOS_KEY environment variable, and
+// otherwise the credentials are loaded from the default Azure credential chain.
+// The database and container are created if they do not exist.
+func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
+	endpoint, database, container, key, err := parseDSN(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		key = os.Getenv("COSMOS_KEY")
+	}
+
+	var client *azcosmos.Client
+	if key != "" {
+		cred, err := azcosmos.NewKeyCredential(key)
+		if err != nil {
+			return nil, err
+		}
+		client, err = azcosmos.NewClientWithKey(endpoint, cred, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, err
+		}
+		client, err = azcosmos.NewClient(endpoint, cred, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := setup(ctx, client, database, container); err != nil {
+		return nil, fmt.Errorf("setting up container %s/%s: %v", database, container, err)
+	}
+	c := &CosmosDB{database: database, name: container}
+	if c.container, err = client.NewContainer(database, container); err != nil {
+		return nil, err
+	}
+	return logstructured.New(c), nil
+}
+
+func parseDSN(dataSourceName string) (endpoint, database, container, key string, err error) {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	if u.Host == "" {
+		return "", "", "", "", errors.New("cosmosdb endpoint must include the host of the account")
+	}
+	database, container = defaultDatabase, defaultContainer
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) > 0 && parts[0] != "" {
+		database = parts[0]
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		container = parts[1]
+	}
+	return "https://" + u.Host + "/", database, container, u.Query().Get("key"), nil
+}
+
+// setup creates the database and container if they do not exist.
+func setup(ctx context.Context, client *azcosmos.Client, database, container string) error {
+	_, err := client.CreateDatabase(ctx, azcosmos.DatabaseProperties{ID: database}, nil)
+	if err != nil && !isStatus(err, http.StatusConflict) {
+		return err
+	}
+	db, err := client.NewDatabase(database)
+	if err != nil {
+		return err
+	}
+	_, err = db.CreateContainer(ctx, azcosmos.ContainerProperties{
+		ID: container,
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+			Paths: []string{"/pk"},
+		},
+	}, nil)
+	if err != nil && !isStatus(err, http.StatusConflict) {
+		return err
+	}
+	return nil
+}
+
+func isStatus(err error, code int) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == code
+}
+
+func (c *CosmosDB) Start(ctx context.Context) error {
+	c.ctx = ctx
+	for _, id := range []string{revisionCounter, compactCounter} {
+		if err := c.create(ctx, &document{ID: id, PK: metaPartition, Type: typeCounter}); err != nil && !isStatus(err, http.StatusConflict) {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitionOf returns the partition key of a key name, which is the name up to
+// the slash that ends its first partitionDepth segments, or the whole name if
+// it has fewer segments.
+func partitionOf(name string) string {
+	slashes := 0
+	for i := 0; i < len(name); i++ {
+		if name[i] != '/' {
+			continue
+		}
+		if slashes == partitionDepth && i > 0 {
+			return name[:i]
+		}
+		slashes++
+	}
+	return name
+}
+
+// prefixPartition returns the partition key of all keys with the prefix, or
+// false if they may be in different partitions.
+func prefixPartition(prefix string) (string, bool) {
+	pk := partitionOf(prefix)
+	if pk == prefix {
+		return "", false
+	}
+	return pk, true
+}
+
+// headID returns the ID of the head of a key. Key names may contain characters
+// that are not allowed in IDs, and be longer than IDs may be.
+func headID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "h-" + hex.EncodeToString(sum[:])
+}
+
+func revID(rev int64) string {
+	return fmt.Sprintf("r-%020d", rev)
+}
+
+func gapID(rev int64) string {
+	return fmt.Sprintf("g-%020d", rev)
+}
+
+func (c *CosmosDB) create(ctx context.Context, doc *document) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = c.container.CreateItem(ctx, azcosmos.NewPartitionKeyString(doc.PK), b, nil)
+	return err
+}
+
+// read returns a document and its etag, or nil if it does not exist.
+func (c *CosmosDB) read(ctx context.Context, pk, id string) (*document, azcore.ETag, error) {
+	resp, err := c.container.ReadItem(ctx, azcosmos.NewPartitionKeyString(pk), id, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	doc := &document{}
+	return doc, resp.ETag, json.Unmarshal(resp.Value, doc)
+}
+
+// query returns the documents matching a query in a partition, or in all
+// partitions if pk is empty.
+func (c *CosmosDB) query(ctx context.Context, pk, query string, params ...azcosmos.QueryParameter) ([]*document, error) {
+	partitionKey := azcosmos.NewPartitionKey()
+	if pk != "" {
+		partitionKey = azcosmos.NewPartitionKeyString(pk)
+	}
+	pager := c.container.NewQueryItemsPager(query, partitionKey, &azcosmos.QueryOptions{QueryParameters: params})
+
+	var result []*document
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			doc := &document{}
+			if err := json.Unmarshal(item, doc); err != nil {
+				return nil, err
+			}
+			result = append(result, doc)
+		}
+	}
+	return result, nil
+}
+
+func (c *CosmosDB) counter(ctx context.Context, id string) (int64, azcore.ETag, error) {
+	doc, etag, err := c.read(ctx, metaPartition, id)
+	if err != nil {
+		return 0, "", err
+	}
+	if doc == nil {
+		return 0, "", fmt.Errorf("counter %s does not exist", id)
+	}
+	return doc.Counter, etag, nil
+}
+
+// advance sets a counter to a value if it is still at the etag it was read at.
+func (c *CosmosDB) advance(ctx context.Context, id string, etag azcore.ETag, value int64) error {
+	b, err := json.Marshal(&document{ID: id, PK: metaPartition, Type: typeCounter, Counter: value})
+	if err != nil {
+		return err
+	}
+	_, err = c.container.ReplaceItem(ctx, azcosmos.NewPartitionKeyString(metaPartition), id, b, &azcosmos.ItemOptions{IfMatchEtag: &etag})
+	return err
+}
+
+func (c *CosmosDB) CurrentRevision(ctx context.Context) (int64, error) {
+	rev, _, err := c.counter(ctx, revisionCounter)
+	return rev, err
+}
+
+func (c *CosmosDB) CompactRevision(ctx context.Context) (int64, error) {
+	rev, _, err := c.counter(ctx, compactCounter)
+	return rev, err
+}
+
+// checkCompacted returns server.ErrCompacted if the revision has been compacted,
+// and otherwise the compact revision.
+func (c *CosmosDB) checkCompacted(ctx context.Context, revision int64) (int64, error) {
+	compact, err := c.CompactRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if revision > 0 && revision < compact {
+		return compact, server.ErrCompacted
+	}
+	return compact, nil
+}
+
+// prefixEnd returns the first key after all keys with the prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\xff"
+}
+
+// matches returns true if the key is the prefix, or has the prefix if it ends
+// in a slash, as the SQL backends do.
+func matches(prefix, key string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(key, prefix)
+	}
+	return key == prefix
+}
+
+func (c *CosmosDB) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	rev, err := c.CurrentRevision(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := c.checkCompacted(ctx, revision); err != nil {
+		return rev, nil, err
+	}
+	if revision > 0 {
+		rev = revision
+	}
+
+	var heads []*document
+	if strings.HasSuffix(prefix, "/") {
+		if startKey == "" || startKey == prefix {
+			startKey = prefix
+		}
+		heads, err = c.heads(ctx, prefix, startKey, prefixEnd(prefix))
+	} else {
+		var head *document
+		if head, _, err = c.read(ctx, partitionOf(prefix), headID(prefix)); head != nil {
+			heads = append(heads, head)
+		}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var events []*server.Event
+	for _, head := range heads {
+		d := head
+		if head.Rev > rev {
+			// the key has changed since the revision, so read the revision it was at
+			if d, err = c.revisionAt(ctx, head.Name, rev); err != nil {
+				return 0, nil, err
+			}
+			if d == nil {
+				continue
+			}
+		}
+		if d.Deleted && !includeDeleted {
+			continue
+		}
+		events = append(events, toEvent(d))
+		if limit > 0 && int64(len(events)) >= limit {
+			break
+		}
+	}
+	return rev, events, nil
+}
+
+// heads returns the heads of the keys with the prefix from start up to but not
+// including end, in order. The heads are read from the partition of the prefix,
+// or from all partitions if the prefix spans several, which the SDK cannot
+// order, so they are sorted here.
+func (c *CosmosDB) heads(ctx context.Context, prefix, start, end string) ([]*document, error) {
+	pk, _ := prefixPartition(prefix)
+	heads, err := c.query(ctx, pk,
+		"SELECT * FROM c WHERE c.type = @type AND c.name >= @start AND c.name < @end",
+		azcosmos.QueryParameter{Name: "@type", Value: typeHead},
+		azcosmos.QueryParameter{Name: "@start", Value: start},
+		azcosmos.QueryParameter{Name: "@end", Value: end},
+	)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(heads, func(i, j int) bool {
+		return heads[i].Name < heads[j].Name
+	})
+	return heads, nil
+}
+
+// revisionAt returns the revision of a key at a revision, or nil if the key did
+// not exist then.
+func (c *CosmosDB) revisionAt(ctx context.Context, name string, revision int64) (*document, error) {
+	docs, err := c.query(ctx, partitionOf(name),
+		"SELECT TOP 1 * FROM c WHERE c.type = @type AND c.name = @name AND c.rev <= @rev ORDER BY c.rev DESC",
+		azcosmos.QueryParameter{Name: "@type", Value: typeRev},
+		azcosmos.QueryParameter{Name: "@name", Value: name},
+		azcosmos.QueryParameter{Name: "@rev", Value: revision},
+	)
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+// After returns the revisions of keys matching the prefix after a revision. The
+// result ends before the first revision that has not been written yet, and the
+// returned revision is the last one covered, so that watches read the rest
+// from the change feed.
+func (c *CosmosDB) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	compact, err := c.checkCompacted(ctx, revision)
+	if err != nil {
+		return 0, nil, err
+	}
+	// revisions up to the compact revision may have been removed
+	last := revision
+	if last < compact {
+		last = compact
+	}
+	if limit <= 0 {
+		current, err := c.CurrentRevision(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		limit = current - last
+	}
+
+	last, docs, err := c.contiguousAfter(ctx, last, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	var events []*server.Event
+	for _, d := range docs {
+		if matches(prefix, d.Name) {
+			events = append(events, toEvent(d))
+		}
+	}
+	return last, events, nil
+}
+
+// contiguousAfter returns the revisions written in the limit revisions after a
+// revision, up to the first that is neither written nor recorded as a gap, and
+// the last revision covered.
+func (c *CosmosDB) contiguousAfter(ctx context.Context, revision, limit int64) (int64, []*document, error) {
+	docs, err := c.revisionsBetween(ctx, revision, revision+limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	last := revision
+	var result []*document
+	for _, d := range docs {
+		if d.Rev != last+1 {
+			break
+		}
+		last = d.Rev
+		if d.Type == typeRev {
+			result = append(result, d)
+		}
+	}
+	return last, result, nil
+}
+
+// revisionsBetween returns the revisions and gaps after start up to and
+// including end, in order. They are spread over all partitions, so they are
+// read with a query across partitions, and sorted here.
+func (c *CosmosDB) revisionsBetween(ctx context.Context, start, end int64) ([]*document, error) {
+	docs, err := c.query(ctx, "",
+		"SELECT * FROM c WHERE (c.type = @rev OR c.type = @gap) AND c.rev > @start AND c.rev <= @end",
+		azcosmos.QueryParameter{Name: "@rev", Value: typeRev},
+		azcosmos.QueryParameter{Name: "@gap", Value: typeGap},
+		azcosmos.QueryParameter{Name: "@start", Value: start},
+		azcosmos.QueryParameter{Name: "@end", Value: end},
+	)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].Rev < docs[j].Rev
+	})
+	return docs, nil
+}
+
+func (c *CosmosDB) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	rev, events, err := c.List(ctx, prefix, "", 0, 0, false)
+	return rev, int64(len(events)), err
+}
+
+// Append writes an event at the next revision, if the head of its key is at the
+// previous revision of the event, or the event creates a key that has no head.
+// The revision is allocated by advancing the revision counter if its etag has
+// not changed, retrying if another write advanced it first. The revision and
+// head are then written in a batch that fails if the etag of the head changed
+// since it was checked, or the head was created, in which case another write to
+// the key won the race, and the revision is recorded as a gap.
+func (c *CosmosDB) Append(ctx context.Context, event *server.Event) (int64, error) {
+	var prevRevision int64
+	if event.PrevKV != nil {
+		prevRevision = event.PrevKV.ModRevision
+	}
+	pk := partitionOf(event.KV.Key)
+	head, etag, err := c.read(ctx, pk, headID(event.KV.Key))
+	if err != nil {
+		return 0, err
+	}
+	var latest int64
+	if head != nil {
+		latest = head.Rev
+	}
+	if (latest != 0 && latest != prevRevision) || (latest == 0 && !event.Create) {
+		return 0, server.ErrKeyExists
+	}
+
+	rev, err := c.allocate(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	d := &document{
+		ID:             revID(rev),
+		PK:             pk,
+		Type:           typeRev,
+		Name:           event.KV.Key,
+		Rev:            rev,
+		Created:        event.Create,
+		Deleted:        event.Delete,
+		CreateRevision: event.KV.CreateRevision,
+		// store the actual previous revision of the key, as a create passes the
+		// current revision when the key has none, and compaction deletes it
+		PrevRevision: latest,
+		Lease:        event.KV.Lease,
+		Value:        event.KV.Value,
+	}
+	if event.PrevKV != nil {
+		d.OldValue = event.PrevKV.Value
+	}
+	if err := c.write(ctx, d, head != nil, etag); err != nil {
+		if gapErr := c.create(c.ctx, &document{ID: gapID(rev), PK: metaPartition, Type: typeGap, Rev: rev}); gapErr != nil && !isStatus(gapErr, http.StatusConflict) {
+			logrus.Errorf("Failed to record gap at revision %d: %v", rev, gapErr)
+		}
+		return 0, err
+	}
+	return rev, nil
+}
+
+// allocate advances the revision counter and returns the new revision.
+func (c *CosmosDB) allocate(ctx context.Context) (int64, error) {
+	for i := 0; i < appendRetries; i++ {
+		current, etag, err := c.counter(ctx, revisionCounter)
+		if err != nil {
+			return 0, err
+		}
+		err = c.advance(ctx, revisionCounter, etag, current+1)
+		if err == nil {
+			return current + 1, nil
+		}
+		if !isStatus(err, http.StatusPreconditionFailed) {
+			return 0, err
+		}
+		logrus.Tracef("APPEND conflicted allocating revision %d, retrying", current+1)
+	}
+	return 0, fmt.Errorf("failed to allocate a revision after %d attempts", appendRetries)
+}
+
+// write writes a revision and the head of its key in a batch. If the key has a
+// head, it is replaced if it is still at the etag, and otherwise it is created.
+// The batch must complete before watchers treat the revision as a gap, so it
+// is given much less time than that.
+func (c *CosmosDB) write(ctx context.Context, d *document, replace bool, etag azcore.ETag) error {
+	ctx, cancel := context.WithTimeout(ctx, appendTimeout)
+	defer cancel()
+
+	revItem, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	head := *d
+	head.ID = headID(d.Name)
+	head.Type = typeHead
+	headItem, err := json.Marshal(&head)
+	if err != nil {
+		return err
+	}
+
+	batch := c.container.NewTransactionalBatch(azcosmos.NewPartitionKeyString(d.PK))
+	batch.CreateItem(revItem, nil)
+	if replace {
+		batch.ReplaceItem(head.ID, headItem, &azcosmos.TransactionalBatchItemOptions{IfMatchETag: &etag})
+	} else {
+		batch.CreateItem(headItem, nil)
+	}
+	resp, err := c.container.ExecuteTransactionalBatch(ctx, batch, nil)
+	if err != nil {
+		return err
+	}
+	if resp.Success {
+		return nil
+	}
+	for _, result := range resp.OperationResults {
+		switch result.StatusCode {
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return server.ErrKeyExists
+		}
+	}
+	return fmt.Errorf("failed to write revision %d of %s", d.Rev, d.Name)
+}
+
+func (c *CosmosDB) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	values, err := c.broadcaster.Subscribe(ctx, c.startWatch)
+	if err != nil {
+		return nil
+	}
+	res := make(chan []*server.Event, cap(values))
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			events, ok := filter(i, checkPrefix, prefix)
+			if ok {
+				res <- events
+			}
+		}
+	}()
+
+	return res
+}
+
+func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Event, bool) {
+	eventList := events.([]*server.Event)
+	filteredEventList := make([]*server.Event, 0, len(eventList))
+
+	for _, event := range eventList {
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+			filteredEventList = append(filteredEventList, event)
+		}
+	}
+
+	return filteredEventList, len(filteredEventList) > 0
+}
+
+func (c *CosmosDB) startWatch() (chan interface{}, error) {
+	start, err := c.CompactRevision(c.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.compactor.Do(func() {
+		go c.compact()
+	})
+
+	docs := make(chan *document, pollBatchSize)
+	go c.readChangeFeed(docs)
+
+	result := make(chan interface{})
+	go c.watch(result, docs, start)
+	return result, nil
+}
+
+// watch delivers revisions in order, starting after the given revision. The
+// change feed delivers revisions of different partitions from different feed
+// ranges, so they may arrive out of order, and may not have all revisions, so
+// revisions that have not arrived are queried. A revision that is missing for
+// longer than gapTimeout is recorded as a gap, so that a failed write does not
+// stall watchers.
+func (c *CosmosDB) watch(result chan interface{}, docs <-chan *document, last int64) {
+	defer close(result)
+	atomic.StoreInt64(&c.watched, last)
+
+	tick := time.NewTicker(pollInterval)
+	defer tick.Stop()
+
+	pending := map[int64]*document{}
+	var missingSince time.Time
+	for {
+		poll := false
+		select {
+		case <-c.ctx.Done():
+			return
+		case d := <-docs:
+			if d.Rev > last {
+				pending[d.Rev] = d
+			}
+		case <-tick.C:
+			poll = true
+		}
+
+		var events []*server.Event
+		for d, ok := pending[last+1]; ok; d, ok = pending[last+1] {
+			delete(pending, d.Rev)
+			last = d.Rev
+			if d.Type == typeRev {
+				events = append(events, toEvent(d))
+			}
+		}
+
+		if poll {
+			current, err := c.CurrentRevision(c.ctx)
+			if err != nil {
+				logrus.Errorf("Failed to get current revision: %v", err)
+			} else if current > last {
+				rev, polled, err := c.contiguousAfter(c.ctx, last, pollBatchSize)
+				if err != nil {
+					logrus.Errorf("Failed to list latest changes: %v", err)
+				}
+				for _, d := range polled {
+					events = append(events, toEvent(d))
+				}
+				for r := last + 1; r <= rev; r++ {
+					delete(pending, r)
+				}
+				if rev > last {
+					last = rev
+					missingSince = time.Time{}
+				} else if err == nil {
+					if missingSince.IsZero() {
+						missingSince = time.Now()
+					} else if time.Since(missingSince) > gapTimeout {
+						logrus.Warnf("Revision %d was not written after %v, skipping it", last+1, gapTimeout)
+						if err := c.create(c.ctx, &document{ID: gapID(last + 1), PK: metaPartition, Type: typeGap, Rev: last + 1}); err != nil && !isStatus(err, http.StatusConflict) {
+							logrus.Errorf("Failed to record gap at revision %d: %v", last+1, err)
+						}
+						missingSince = time.Time{}
+					}
+				}
+			}
+		}
+
+		if len(events) > 0 {
+			atomic.StoreInt64(&c.watched, last)
+			result <- events
+		}
+	}
+}
+
+// WatchRevision returns the last revision delivered to watchers, or zero if no
+// watch has been started.
+func (c *CosmosDB) WatchRevision() int64 {
+	return atomic.LoadInt64(&c.watched)
+}
+
+// compact periodically advances the compact revision, keeping the most recent
+// revisions, and deletes the revisions up to it that have been superseded,
+// deleted keys, and gaps. The compact revision is advanced first, so that reads
+// at revisions being compacted fail rather than see partial results.
+func (c *CosmosDB) compact() {
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		compact, etag, err := c.counter(c.ctx, compactCounter)
+		if err != nil {
+			logrus.Errorf("Compact failed to get compact revision: %v", err)
+			continue
+		}
+		// only compact revisions that watchers have seen, so that a revision
+		// being written is not compacted before it is recorded as a gap
+		target := c.WatchRevision()
+		current, err := c.CurrentRevision(c.ctx)
+		if err != nil {
+			logrus.Errorf("Compact failed to get current revision: %v", err)
+			continue
+		}
+		if current-compactMinRetain < target {
+			target = current - compactMinRetain
+		}
+		if target <= compact {
+			continue
+		}
+		if err := c.compactTo(compact, target, etag); err != nil {
+			logrus.Errorf("Compact failed: %v", err)
+			continue
+		}
+		logrus.Debugf("COMPACT compacted to %d/%d", target, current)
+	}
+}
+
+func (c *CosmosDB) compactTo(compact, target int64, etag azcore.ETag) error {
+	err := c.advance(c.ctx, compactCounter, etag, target)
+	if isStatus(err, http.StatusPreconditionFailed) {
+		// another instance compacted first
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	docs, err := c.revisionsBetween(c.ctx, compact, target)
+	if err != nil {
+		return err
+	}
+	for _, d := range docs {
+		if d.Type == typeGap {
+			if err := c.delete(metaPartition, d.ID, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if d.PrevRevision > 0 {
+			if err := c.delete(d.PK, revID(d.PrevRevision), nil); err != nil {
+				return err
+			}
+		}
+		if d.Deleted {
+			if err := c.delete(d.PK, d.ID, nil); err != nil {
+				return err
+			}
+			// remove the head unless the key has since been recreated
+			head, etag, err := c.read(c.ctx, d.PK, headID(d.Name))
+			if err != nil {
+				return err
+			}
+			if head != nil && head.Rev == d.Rev {
+				if err := c.delete(d.PK, head.ID, &etag); err != nil && !isStatus(err, http.StatusPreconditionFailed) {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// delete deletes a document, if it is at the etag if one is given, and ignores
+// documents that do not exist.
+func (c *CosmosDB) delete(pk, id string, etag *azcore.ETag) error {
+	var opts *azcosmos.ItemOptions
+	if etag != nil {
+		opts = &azcosmos.ItemOptions{IfMatchEtag: etag}
+	}
+	_, err := c.container.DeleteItem(c.ctx, azcosmos.NewPartitionKeyString(pk), id, opts)
+	if isStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// DbSize returns the size of the documents in the container, as reported by
+// its quota usage, which Cosmos DB updates periodically.
+func (c *CosmosDB) DbSize(ctx context.Context) (int64, error) {
+	resp, err := c.container.Read(ctx, &azcosmos.ReadContainerOptions{PopulateQuotaInfo: true})
+	if err != nil {
+		return 0, err
+	}
+	// the usage is a list of quotas, in kilobytes for sizes, such as
+	// documentsSize=12;documentsCount=34
+	for _, quota := range strings.Split(resp.RawResponse.Header.Get("x-ms-resource-usage"), ";") {
+		if kb := strings.TrimPrefix(quota, "documentsSize="); kb != quota {
+			size, err := strconv.ParseInt(kb, 10, 64)
+			return size * 1024, err
+		}
+	}
+	return 0, nil
+}
+
+func toEvent(d *document) *server.Event {
+	event := &server.Event{
+		Create: d.Created,
+		Delete: d.Deleted,
+		KV: &server.KeyValue{
+			Key:            d.Name,
+			CreateRevision: d.CreateRevision,
+			ModRevision:    d.Rev,
+			Value:          d.Value,
+			Lease:          d.Lease,
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: d.PrevRevision,
+			Value:       d.OldValue,
+		},
+	}
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event
+}
@@ -0,0 +1,15 @@
+//go:build !cosmosdb
+// +build !cosmosdb
+
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
+	return nil, errors.New(`this binary is built without Cosmos DB support, compile with "-tags cosmosdb"`)
+}
@@ -39,8 +39,23 @@ type opts struct {
 	peers    []client.NodeInfo
 	peerFile string
 	dsn      string
+
+	// nodeAddress is the address of a dqlite node to run in this process, with
+	// its data in nodeDir
+	nodeAddress string
+	nodeDir     string
+	nodeID      uint64
+	// leave removes the node from the cluster on shutdown
+	leave bool
 }
 
+const (
+	// errIOErrNotLeader and errIOErrLeadershipLost are returned while the
+	// cluster elects a new leader, after which the statement may be retried.
+	errIOErrNotLeader      = 10250
+	errIOErrLeadershipLost = 10506
+)
+
 func AddPeers(ctx context.Context, nodeStore client.NodeStore, additionalPeers ...client.NodeInfo) error {
 	existing, err := nodeStore.Get(ctx)
 	if err != nil {
@@ -69,7 +84,7 @@ outer:
 	return nil
 }
 
-func New(ctx context.Context, datasourceName string, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+func New(ctx context.Context, datasourceName string, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
 	opts, err := parseOpts(datasourceName)
 	if err != nil {
 		return nil, err
@@ -89,6 +104,13 @@ func New(ctx context.Context, datasourceName string, connPoolConfig generic.Conn
 		return nil, errors.Wrap(err, "add peers")
 	}
 
+	var id uint64
+	if opts.nodeAddress != "" {
+		if id, err = startNode(ctx, opts, nodeStore); err != nil {
+			return nil, err
+		}
+	}
+
 	d, err := driver.New(nodeStore,
 		driver.WithLogFunc(Logger),
 		driver.WithContext(ctx),
@@ -98,18 +120,22 @@ func New(ctx context.Context, datasourceName string, connPoolConfig generic.Conn
 	}
 
 	sql.Register("dqlite", d)
-	backend, generic, err := sqlite.NewVariant(ctx, "dqlite", opts.dsn, connPoolConfig, metricsRegisterer)
+	backend, generic, err := sqlite.NewVariant(ctx, "dqlite", opts.dsn, connPoolConfig, config, metricsRegisterer)
 	if err != nil {
 		return nil, errors.Wrap(err, "sqlite client")
 	}
-	if err := migrate(ctx, generic.DB); err != nil {
+	if err := migrate(ctx, generic.DB, generic.Table()); err != nil {
 		return nil, errors.Wrap(err, "failed to migrate DB from sqlite")
 	}
 
 	generic.LockWrites = true
-	generic.Retry = func(err error) bool {
+	// the driver connects to the new leader when the statement is retried
+	generic.RetryPolicy.Retryable = func(err error) bool {
+		if err == driver.ErrNoAvailableLeader {
+			return true
+		}
 		if err, ok := err.(driver.Error); ok {
-			return err.Code == driver.ErrBusy
+			return err.Code == driver.ErrBusy || err.Code == errIOErrNotLeader || err.Code == errIOErrLeadershipLost
 		}
 		return false
 	}
@@ -120,11 +146,15 @@ func New(ctx context.Context, datasourceName string, connPoolConfig generic.Conn
 		return err
 	}
 
-	return backend, nil
+	return &Backend{
+		Backend:   backend,
+		nodeStore: nodeStore,
+		id:        id,
+	}, nil
 }
 
-func migrate(ctx context.Context, newDB *sql.DB) (exitErr error) {
-	row := newDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM kine")
+func migrate(ctx context.Context, newDB *sql.DB, table *generic.Table) (exitErr error) {
+	row := newDB.QueryRowContext(ctx, table.SQL("SELECT COUNT(*) FROM kine"))
 	var count int64
 	if err := row.Scan(&count); err != nil {
 		return err
@@ -178,7 +208,7 @@ func migrate(ctx context.Context, newDB *sql.DB) (exitErr error) {
 			return err
 		}
 
-		if _, err := newDB.ExecContext(ctx, "INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value) values(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		if _, err := newDB.ExecContext(ctx, table.SQL("INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value) values(?, ?, ?, ?, ?, ?, ?, ?, ?)"),
 			row...); err != nil {
 			return err
 		}
@@ -193,7 +223,8 @@ func migrate(ctx context.Context, newDB *sql.DB) (exitErr error) {
 
 func parseOpts(dsn string) (opts, error) {
 	result := opts{
-		dsn: dsn,
+		dsn:   dsn,
+		leave: true,
 	}
 
 	parts := strings.SplitN(dsn, "?", 2)
@@ -231,6 +262,26 @@ func parseOpts(dsn string) (opts, error) {
 		case "peer-file":
 			result.peerFile = vs[0]
 			delete(values, k)
+		case "node-address":
+			result.nodeAddress = vs[0]
+			delete(values, k)
+		case "node-dir":
+			result.nodeDir = vs[0]
+			delete(values, k)
+		case "node-id":
+			id, err := strconv.ParseUint(vs[0], 10, 64)
+			if err != nil {
+				return result, errors.Wrapf(err, "failed to parse node-id %s", vs[0])
+			}
+			result.nodeID = id
+			delete(values, k)
+		case "leave-on-shutdown":
+			leave, err := strconv.ParseBool(vs[0])
+			if err != nil {
+				return result, errors.Wrapf(err, "failed to parse leave-on-shutdown %s", vs[0])
+			}
+			result.leave = leave
+			delete(values, k)
 		}
 	}
 
@@ -0,0 +1,220 @@
+//go:build dqlite
+// +build dqlite
+
+package dqlite
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+
+	"github.com/canonical/go-dqlite"
+	"github.com/canonical/go-dqlite/client"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultNodeDir = "./db/dqlite"
+
+	joinRetryInterval = time.Second
+	leaveTimeout      = 10 * time.Second
+	memberPingTimeout = 2 * time.Second
+)
+
+// nodeID returns the ID of the node, from the options if set. Otherwise the
+// first node of a cluster takes the bootstrap ID, which makes it create the
+// cluster, and nodes that join take an ID derived from their address, so that
+// they keep it across restarts.
+func nodeID(opts opts) uint64 {
+	if opts.nodeID != 0 {
+		return opts.nodeID
+	}
+	if len(otherPeers(opts)) == 0 {
+		return dqlite.BootstrapID
+	}
+	h := fnv.New64a()
+	h.Write([]byte(opts.nodeAddress))
+	return h.Sum64()
+}
+
+// otherPeers returns the peers that are not this node.
+func otherPeers(opts opts) []client.NodeInfo {
+	var peers []client.NodeInfo
+	for _, peer := range opts.peers {
+		if peer.Address != opts.nodeAddress {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// startNode runs a dqlite node in this process, and adds it to the cluster of
+// its peers if it is not already a member. If leave is set, the node removes
+// itself from the cluster when the context is cancelled, unless it is the
+// leader, as the leader cannot remove itself.
+func startNode(ctx context.Context, opts opts, nodeStore client.NodeStore) (uint64, error) {
+	id := nodeID(opts)
+	dir := opts.nodeDir
+	if dir == "" {
+		dir = defaultNodeDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+
+	node, err := dqlite.New(id, opts.nodeAddress, dir, dqlite.WithBindAddress(opts.nodeAddress))
+	if err != nil {
+		return 0, errors.Wrap(err, "new dqlite node")
+	}
+	if err := node.Start(); err != nil {
+		return 0, errors.Wrap(err, "start dqlite node")
+	}
+	logrus.Infof("Started dqlite node %x at %s", id, opts.nodeAddress)
+
+	self := client.NodeInfo{ID: id, Address: opts.nodeAddress}
+	if err := AddPeers(ctx, nodeStore, self); err != nil {
+		node.Close()
+		return 0, errors.Wrap(err, "add self to peers")
+	}
+	if id != dqlite.BootstrapID {
+		if err := join(ctx, nodeStore, self); err != nil {
+			node.Close()
+			return 0, err
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		if opts.leave {
+			leave(nodeStore, id)
+		}
+		if err := node.Close(); err != nil {
+			logrus.Errorf("Failed to stop dqlite node: %v", err)
+		}
+	}()
+	return id, nil
+}
+
+// join adds a node to the cluster through the leader, retrying until there is
+// a leader or the context is cancelled.
+func join(ctx context.Context, nodeStore client.NodeStore, self client.NodeInfo) error {
+	for {
+		err := func() error {
+			cli, err := client.FindLeader(ctx, nodeStore, client.WithDialFunc(Dialer), client.WithLogFunc(Logger))
+			if err != nil {
+				return err
+			}
+			defer cli.Close()
+
+			nodes, err := cli.Cluster(ctx)
+			if err != nil {
+				return err
+			}
+			for _, node := range nodes {
+				if node.ID == self.ID {
+					return nil
+				}
+			}
+			logrus.Infof("Joining dqlite node %x at %s to the cluster", self.ID, self.Address)
+			return cli.Add(ctx, self)
+		}()
+		if err == nil {
+			return nil
+		}
+		logrus.Errorf("Failed to join dqlite cluster: %v", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(joinRetryInterval):
+		}
+	}
+}
+
+// leave removes a node from the cluster through the leader.
+func leave(nodeStore client.NodeStore, id uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), leaveTimeout)
+	defer cancel()
+
+	cli, err := client.FindLeader(ctx, nodeStore, client.WithDialFunc(Dialer), client.WithLogFunc(Logger))
+	if err != nil {
+		logrus.Errorf("Failed to find dqlite leader to leave the cluster: %v", err)
+		return
+	}
+	defer cli.Close()
+
+	leader, err := cli.Leader(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to find dqlite leader to leave the cluster: %v", err)
+		return
+	}
+	if leader.ID == id {
+		logrus.Warnf("Not removing dqlite node %x from the cluster, as it is the leader", id)
+		return
+	}
+	if err := cli.Remove(ctx, id); err != nil {
+		logrus.Errorf("Failed to leave dqlite cluster: %v", err)
+		return
+	}
+	logrus.Infof("Removed dqlite node %x from the cluster", id)
+}
+
+// Backend wraps the SQL backend of a dqlite cluster to report the state of the
+// cluster.
+type Backend struct {
+	server.Backend
+	nodeStore client.NodeStore
+	// id is the ID of the node run by this process, or zero if there is none
+	id uint64
+}
+
+// Unwrap returns the wrapped backend.
+func (b *Backend) Unwrap() server.Backend {
+	return b.Backend
+}
+
+// ClusterStatus returns the leader of the cluster, and an error for each
+// member that cannot be reached.
+func (b *Backend) ClusterStatus(ctx context.Context) (*server.ClusterStatus, error) {
+	cli, err := client.FindLeader(ctx, b.nodeStore, client.WithDialFunc(Dialer), client.WithLogFunc(Logger))
+	if err != nil {
+		return nil, errors.Wrap(err, "no dqlite leader")
+	}
+	defer cli.Close()
+
+	leader, err := cli.Leader(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "no dqlite leader")
+	}
+	nodes, err := cli.Cluster(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &server.ClusterStatus{
+		MemberID: b.id,
+		Leader:   leader.ID,
+	}
+	for _, node := range nodes {
+		if node.ID == leader.ID {
+			continue
+		}
+		if err := ping(ctx, node.Address); err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("dqlite node %x at %s is unreachable: %v", node.ID, node.Address, err))
+		}
+	}
+	return status, nil
+}
+
+func ping(ctx context.Context, address string) error {
+	ctx, cancel := context.WithTimeout(ctx, memberPingTimeout)
+	defer cancel()
+	cli, err := client.New(ctx, address, client.WithDialFunc(Dialer), client.WithLogFunc(Logger))
+	if err != nil {
+		return err
+	}
+	return cli.Close()
+}
@@ -0,0 +1,222 @@
+//go:build duckdb
+// +build duckdb
+
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	// duckdb db driver
+	_ "github.com/marcboeker/go-duckdb"
+)
+
+const (
+	defaultDSN            = "./db/state.duckdb"
+	defaultExportInterval = 5 * time.Minute
+)
+
+var (
+	// conflictError matches the errors returned for transactions that conflict
+	// with a concurrent transaction, which succeed if retried.
+	conflictError = regexp.MustCompile(`(?i)\bconflict\b`)
+	// errorType matches the type that DuckDB prefixes its error messages with,
+	// such as "Constraint Error".
+	errorType = regexp.MustCompile(`^(\w+ Error):`)
+)
+
+// New returns an experimental backend for a DuckDB database, for read-heavy
+// clusters with a single kine writing to the database. DuckDB stores the table
+// in columns, which suits scans of the history of the cluster, and its indexes
+// only speed up point lookups, so lists are slower than with SQLite.
+//
+// If the export_dir parameter of the data source name is set, the database is
+// exported to export_dir/latest every export_interval, five minutes by
+// default, as Parquet files with the statements to load them, so that the
+// state of the cluster can be analysed offline without stopping kine.
+func New(ctx context.Context, dataSourceName string, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	logrus.Warnf("DuckDB support is experimental")
+
+	dataSourceName, exportDir, exportInterval, err := parseExport(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if dataSourceName == "" {
+		if err := os.MkdirAll("./db", 0700); err != nil {
+			return nil, err
+		}
+		dataSourceName = defaultDSN
+	}
+
+	dialect, err := generic.Open(ctx, "duckdb", dataSourceName, connPoolConfig, "?", false, metricsRegisterer)
+	if err != nil {
+		return nil, err
+	}
+
+	dialect.ApplyConfig(config)
+	// DuckDB allows a single writer, and fails transactions that conflict
+	// rather than waiting for them
+	dialect.LockWrites = true
+	dialect.GetSizeSQL = `
+		SELECT total_blocks * block_size
+		FROM pragma_database_size()
+		WHERE database_name = current_database()`
+	dialect.CompactSQL = `
+		DELETE FROM kine AS kv
+		WHERE
+			kv.id IN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= ?
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= ?
+			)`
+	// FullScan is not set, as DuckDB plans sequential scans of the columns for
+	// most queries whether or not an index could be used
+	dialect.ColumnsSQL = `
+		SELECT column_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'kine'`
+	dialect.IndexesSQL = `
+		SELECT index_name, is_unique
+		FROM duckdb_indexes()
+		WHERE schema_name = current_schema() AND table_name = 'kine'`
+	dialect.CreateIndexSQL = `CREATE %sINDEX IF NOT EXISTS %s ON kine (%s)`
+	dialect.RetryPolicy.Retryable = func(err error) bool {
+		return conflictError.MatchString(err.Error())
+	}
+	dialect.TranslateErr = func(err error) error {
+		if strings.HasPrefix(err.Error(), "Constraint Error:") && strings.Contains(err.Error(), dialect.Table().IndexName("kine_name_prev_revision_uindex")) {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		if m := errorType.FindStringSubmatch(err.Error()); m != nil {
+			return m[1]
+		}
+		return err.Error()
+	}
+
+	switch {
+	case config.DryRun:
+		// setup only logs the schema migrations that would be applied
+		if err = setup(dialect.DB, config); err == nil || err == generic.ErrDDLDisabled {
+			err = dialect.CheckSchema(ctx)
+		}
+	case config.SkipDDL():
+		err = dialect.CheckSchema(ctx)
+	default:
+		err = setup(dialect.DB, config)
+	}
+	if err != nil {
+		dialect.Close()
+		return nil, err
+	}
+
+	if exportDir != "" {
+		go exportLoop(ctx, dialect.DB, exportDir, exportInterval)
+	}
+	go dialect.MonitorDrift(ctx, config.DriftCheckInterval)
+	return logstructured.New(sqllog.New(dialect)), nil
+}
+
+// parseExport removes the export parameters from a data source name, and
+// returns the remaining data source name, the export directory and the export
+// interval. The other parameters are DuckDB configuration options.
+func parseExport(dataSourceName string) (string, string, time.Duration, error) {
+	i := strings.IndexRune(dataSourceName, '?')
+	if i < 0 {
+		return dataSourceName, "", 0, nil
+	}
+	params, err := url.ParseQuery(dataSourceName[i+1:])
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	dir := params.Get("export_dir")
+	interval := defaultExportInterval
+	if v := params.Get("export_interval"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+			return "", "", 0, fmt.Errorf("invalid duckdb export_interval %q", v)
+		}
+	}
+	params.Del("export_dir")
+	params.Del("export_interval")
+
+	dataSourceName = dataSourceName[:i]
+	if len(params) > 0 {
+		dataSourceName += "?" + params.Encode()
+	}
+	return dataSourceName, dir, interval, nil
+}
+
+// exportLoop exports the database at an interval until the context is
+// cancelled.
+func exportLoop(ctx context.Context, db *sql.DB, dir string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := export(ctx, db, dir); err != nil && ctx.Err() == nil {
+			logrus.Errorf("Failed to export database to %s: %v", dir, err)
+		}
+	}
+}
+
+// export exports the database with EXPORT DATABASE to a new directory, which
+// then replaces dir/latest, so that the latest export is always complete.
+func export(ctx context.Context, db *sql.DB, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, fmt.Sprintf(".export-%d", time.Now().UnixNano()))
+	stmt := fmt.Sprintf(`EXPORT DATABASE '%s' (FORMAT PARQUET)`, strings.ReplaceAll(tmp, "'", "''"))
+	if _, err := db.ExecContext(ctx, stmt); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	latest := filepath.Join(dir, "latest")
+	old := latest + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(latest, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp, latest); err != nil {
+		return err
+	}
+	logrus.Debugf("Exported database to %s", latest)
+	return os.RemoveAll(old)
+}
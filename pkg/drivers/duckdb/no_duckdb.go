@@ -0,0 +1,17 @@
+//go:build !duckdb
+// +build !duckdb
+
+package duckdb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func New(ctx context.Context, dataSourceName string, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	return nil, errors.New(`this binary is built without DuckDB support, compile with "-tags duckdb"`)
+}
@@ -0,0 +1,14 @@
+//go:build duckdb && noddl
+// +build duckdb,noddl
+
+package duckdb
+
+import (
+	"database/sql"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+func setup(db *sql.DB, config generic.Config) error {
+	return generic.ErrDDLDisabled
+}
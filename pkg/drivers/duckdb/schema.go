@@ -0,0 +1,84 @@
+//go:build duckdb && !noddl
+// +build duckdb,!noddl
+
+package duckdb
+
+import (
+	"database/sql"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	migrations = []generic.Migration{
+		{
+			Version:     1,
+			Description: "create the kine table and its indexes",
+			Statements:  schema,
+		},
+	}
+	// ids are taken from a sequence, which is not rolled back with the
+	// transaction, so failed inserts leave gaps that kine fills.
+	schema = []string{
+		`CREATE SEQUENCE IF NOT EXISTS kine_id_seq`,
+		`CREATE TABLE IF NOT EXISTS kine
+			(
+				id BIGINT PRIMARY KEY DEFAULT nextval('kine_id_seq'),
+				name VARCHAR,
+				created INTEGER,
+				deleted INTEGER,
+				create_revision BIGINT,
+				prev_revision BIGINT,
+				lease BIGINT,
+				value BLOB,
+				old_value BLOB
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_id_index ON kine (name,id)`,
+		`CREATE INDEX IF NOT EXISTS kine_id_deleted_index ON kine (id,deleted)`,
+		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+	}
+	expirySchema = []string{
+		`ALTER TABLE kine ADD COLUMN IF NOT EXISTS expires_at BIGINT`,
+		`CREATE INDEX IF NOT EXISTS kine_expires_at_index ON kine (expires_at)`,
+	}
+)
+
+// setup creates the kine table. Keys are stored as text, which DuckDB compares
+// byte by byte and does not limit in length, so the key options do not apply.
+func setup(db *sql.DB, config generic.Config) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	table, err := config.Table()
+	if err != nil {
+		return err
+	}
+
+	migrator := &generic.Migrator{
+		DB:         db,
+		Table:      table,
+		Migrations: migrations,
+		DryRun:     config.DryRun,
+	}
+	if err := migrator.Run(); err != nil || config.DryRun {
+		return err
+	}
+
+	var stmts []string
+	if config.TTLColumn {
+		stmts = append(stmts, expirySchema...)
+	}
+	for _, stmt := range stmts {
+		stmt = table.SQL(stmt)
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
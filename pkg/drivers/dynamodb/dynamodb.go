@@ -0,0 +1,874 @@
+//go:build dynamodb
+// +build dynamodb
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTable = "kine"
+
+	// revisionCounter and compactCounter are the items holding the current and
+	// compact revisions. Keys written through the etcd API start with a slash.
+	revisionCounter = "kine_revision_counter"
+	compactCounter  = "kine_compact_counter"
+
+	// logPartition and headBucket are the partition key values of the indexes
+	// of revisions by revision and of keys by name.
+	logPartition = "0"
+	headBucket   = "0"
+	byRevIndex   = "kine_rev_index"
+	byNameIndex  = "kine_name_index"
+
+	appendRetries    = 20
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+	pollInterval     = time.Second
+	pollBatchSize    = 500
+)
+
+// record is an item of the table. Each revision of a key is stored under the
+// key and its revision, and the latest revision is also copied to the head of
+// the key, stored at revision zero, which is indexed by name for listing.
+type record struct {
+	Name           string `dynamodbav:"name"`
+	Rev            int64  `dynamodbav:"rev"`
+	Created        bool   `dynamodbav:"created"`
+	Deleted        bool   `dynamodbav:"deleted"`
+	CreateRevision int64  `dynamodbav:"create_revision"`
+	PrevRevision   int64  `dynamodbav:"prev_revision"`
+	Lease          int64  `dynamodbav:"lease"`
+	Value          []byte `dynamodbav:"value"`
+	OldValue       []byte `dynamodbav:"old_value"`
+	// Log is set on revisions, to index them by revision.
+	Log string `dynamodbav:"log,omitempty"`
+	// Bucket and Latest are set on heads, to index keys by name.
+	Bucket string `dynamodbav:"bucket,omitempty"`
+	Latest int64  `dynamodbav:"latest,omitempty"`
+}
+
+// DynamoDB is a log stored in a single DynamoDB table keyed on name and
+// revision. Revisions are allocated from a counter item in the same
+// transaction that writes the revision and the head of its key, so they are
+// committed in order and without gaps, and writes are conditional on the head
+// being at the previous revision. Watches are notified by the table's stream,
+// and read revisions that the stream has not delivered from the index of
+// revisions.
+//
+// Listing keys by prefix reads a global secondary index, which is eventually
+// consistent, so a list may briefly miss the most recent writes. Reads of a
+// single key are strongly consistent.
+type DynamoDB struct {
+	client      *dynamodb.Client
+	streams     *dynamodbstreams.Client
+	table       string
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	compactor   sync.Once
+	// watched is the last revision delivered to watchers
+	watched int64
+}
+
+// New connects to DynamoDB. The endpoint is the name of the table, followed by
+// optional region and endpoint query parameters, for example
+// dynamodb://kine?region=us-east-1. Credentials are loaded from the default
+// AWS credential chain.
+func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
+	table, region, endpoint, err := parseDSN(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DynamoDB{table: table}
+	if endpoint != "" {
+		d.client = dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+			o.EndpointResolver = dynamodb.EndpointResolverFromURL(endpoint)
+		})
+		d.streams = dynamodbstreams.NewFromConfig(cfg, func(o *dynamodbstreams.Options) {
+			o.EndpointResolver = dynamodbstreams.EndpointResolverFromURL(endpoint)
+		})
+	} else {
+		d.client = dynamodb.NewFromConfig(cfg)
+		d.streams = dynamodbstreams.NewFromConfig(cfg)
+	}
+	return logstructured.New(d), nil
+}
+
+func parseDSN(dataSourceName string) (table, region, endpoint string, err error) {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return "", "", "", err
+	}
+	table = strings.Trim(u.Host+u.Path, "/")
+	if table == "" {
+		table = defaultTable
+	}
+	query := u.Query()
+	return table, query.Get("region"), query.Get("endpoint"), nil
+}
+
+func (d *DynamoDB) Start(ctx context.Context) error {
+	d.ctx = ctx
+	if err := d.setup(ctx); err != nil {
+		return fmt.Errorf("setting up table %s: %v", d.table, err)
+	}
+	return nil
+}
+
+// setup creates the table with its indexes and stream, and the counters.
+func (d *DynamoDB) setup(ctx context.Context) error {
+	_, err := d.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(d.table)})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		logrus.Infof("Creating table %s, this may take a moment...", d.table)
+		_, err = d.client.CreateTable(ctx, &dynamodb.CreateTableInput{
+			TableName:   aws.String(d.table),
+			BillingMode: types.BillingModePayPerRequest,
+			AttributeDefinitions: []types.AttributeDefinition{
+				{AttributeName: aws.String("name"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("rev"), AttributeType: types.ScalarAttributeTypeN},
+				{AttributeName: aws.String("log"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String("bucket"), AttributeType: types.ScalarAttributeTypeS},
+			},
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String("name"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("rev"), KeyType: types.KeyTypeRange},
+			},
+			GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+				{
+					IndexName: aws.String(byRevIndex),
+					KeySchema: []types.KeySchemaElement{
+						{AttributeName: aws.String("log"), KeyType: types.KeyTypeHash},
+						{AttributeName: aws.String("rev"), KeyType: types.KeyTypeRange},
+					},
+					Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+				},
+				{
+					IndexName: aws.String(byNameIndex),
+					KeySchema: []types.KeySchemaElement{
+						{AttributeName: aws.String("bucket"), KeyType: types.KeyTypeHash},
+						{AttributeName: aws.String("name"), KeyType: types.KeyTypeRange},
+					},
+					Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+				},
+			},
+			StreamSpecification: &types.StreamSpecification{
+				StreamEnabled:  aws.Bool(true),
+				StreamViewType: types.StreamViewTypeNewImage,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		waiter := dynamodb.NewTableExistsWaiter(d.client)
+		if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(d.table)}, 5*time.Minute); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for _, name := range []string{revisionCounter, compactCounter} {
+		_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(d.table),
+			Item: map[string]types.AttributeValue{
+				"name":    &types.AttributeValueMemberS{Value: name},
+				"rev":     &types.AttributeValueMemberN{Value: "0"},
+				"counter": &types.AttributeValueMemberN{Value: "0"},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(#n)"),
+			ExpressionAttributeNames: map[string]string{
+				"#n": "name",
+			},
+		})
+		var failed *types.ConditionalCheckFailedException
+		if err != nil && !errors.As(err, &failed) {
+			return err
+		}
+	}
+	return nil
+}
+
+func key(name string, rev int64) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"name": &types.AttributeValueMemberS{Value: name},
+		"rev":  &types.AttributeValueMemberN{Value: strconv.FormatInt(rev, 10)},
+	}
+}
+
+func number(n int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+func (d *DynamoDB) counter(ctx context.Context, name string) (int64, error) {
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            key(name, 0),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, err
+	}
+	var c struct {
+		Counter int64 `dynamodbav:"counter"`
+	}
+	err = attributevalue.UnmarshalMap(out.Item, &c)
+	return c.Counter, err
+}
+
+func (d *DynamoDB) CurrentRevision(ctx context.Context) (int64, error) {
+	return d.counter(ctx, revisionCounter)
+}
+
+func (d *DynamoDB) CompactRevision(ctx context.Context) (int64, error) {
+	return d.counter(ctx, compactCounter)
+}
+
+// checkCompacted returns server.ErrCompacted if the revision has been compacted,
+// and otherwise the compact revision.
+func (d *DynamoDB) checkCompacted(ctx context.Context, revision int64) (int64, error) {
+	compact, err := d.CompactRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if revision > 0 && revision < compact {
+		return compact, server.ErrCompacted
+	}
+	return compact, nil
+}
+
+// prefixEnd returns the first key after all keys with the prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\xff"
+}
+
+// matches returns true if the key is the prefix, or has the prefix if it ends
+// in a slash, as the SQL backends do.
+func matches(prefix, key string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(key, prefix)
+	}
+	return key == prefix
+}
+
+func (d *DynamoDB) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	rev, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := d.checkCompacted(ctx, revision); err != nil {
+		return rev, nil, err
+	}
+	if revision > 0 {
+		rev = revision
+	}
+
+	var heads []*record
+	if strings.HasSuffix(prefix, "/") {
+		if startKey == "" || startKey == prefix {
+			startKey = prefix
+		}
+		heads, err = d.heads(ctx, startKey, prefixEnd(prefix))
+	} else {
+		var head *record
+		if head, err = d.head(ctx, prefix); head != nil {
+			heads = append(heads, head)
+		}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var events []*server.Event
+	for _, head := range heads {
+		r := head
+		if head.Latest > rev {
+			// the key has changed since the revision, so read the revision it was at
+			if r, err = d.revisionAt(ctx, head.Name, rev); err != nil {
+				return 0, nil, err
+			}
+			if r == nil {
+				continue
+			}
+		}
+		if r.Deleted && !includeDeleted {
+			continue
+		}
+		events = append(events, toEvent(r))
+		if limit > 0 && int64(len(events)) >= limit {
+			break
+		}
+	}
+	return rev, events, nil
+}
+
+// head returns the head of a key, or nil if it does not exist.
+func (d *DynamoDB) head(ctx context.Context, name string) (*record, error) {
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            key(name, 0),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || out.Item == nil {
+		return nil, err
+	}
+	r := &record{}
+	return r, attributevalue.UnmarshalMap(out.Item, r)
+}
+
+// heads returns the heads of the keys from start up to but not including end,
+// in order.
+func (d *DynamoDB) heads(ctx context.Context, start, end string) ([]*record, error) {
+	var (
+		result    []*record
+		startFrom map[string]types.AttributeValue
+	)
+	for {
+		out, err := d.client.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(d.table),
+			IndexName:              aws.String(byNameIndex),
+			KeyConditionExpression: aws.String("#b = :b AND #n BETWEEN :start AND :end"),
+			ExpressionAttributeNames: map[string]string{
+				"#b": "bucket",
+				"#n": "name",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":b":     &types.AttributeValueMemberS{Value: headBucket},
+				":start": &types.AttributeValueMemberS{Value: start},
+				":end":   &types.AttributeValueMemberS{Value: end},
+			},
+			ExclusiveStartKey: startFrom,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var page []*record
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, r := range page {
+			// BETWEEN includes the end, which is not part of the prefix
+			if r.Name != end {
+				result = append(result, r)
+			}
+		}
+		if out.LastEvaluatedKey == nil {
+			return result, nil
+		}
+		startFrom = out.LastEvaluatedKey
+	}
+}
+
+// revisionAt returns the revision of a key at a revision, or nil if the key did
+// not exist then.
+func (d *DynamoDB) revisionAt(ctx context.Context, name string, revision int64) (*record, error) {
+	out, err := d.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(d.table),
+		KeyConditionExpression: aws.String("#n = :n AND #r BETWEEN :one AND :rev"),
+		ExpressionAttributeNames: map[string]string{
+			"#n": "name",
+			"#r": "rev",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":n":   &types.AttributeValueMemberS{Value: name},
+			":one": number(1),
+			":rev": number(revision),
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(1),
+		ConsistentRead:   aws.Bool(true),
+	})
+	if err != nil || len(out.Items) == 0 {
+		return nil, err
+	}
+	r := &record{}
+	return r, attributevalue.UnmarshalMap(out.Items[0], r)
+}
+
+// After returns the revisions of keys matching the prefix after a revision. The
+// index of revisions is eventually consistent, so the result ends before the
+// first revision that is not yet visible, and the returned revision is the last
+// one covered, so that watches read the rest from the stream.
+func (d *DynamoDB) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	compact, err := d.checkCompacted(ctx, revision)
+	if err != nil {
+		return 0, nil, err
+	}
+	// revisions up to the compact revision may have been removed
+	last := revision
+	if last < compact {
+		last = compact
+	}
+
+	last, records, err := d.contiguousAfter(ctx, last, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	var events []*server.Event
+	for _, r := range records {
+		if matches(prefix, r.Name) {
+			events = append(events, toEvent(r))
+		}
+	}
+	return last, events, nil
+}
+
+// contiguousAfter returns the revisions after a revision that are visible in the
+// index of revisions, up to the first that is not, and the last revision
+// returned. Revisions are allocated without gaps, so a missing revision has not
+// yet been replicated to the index.
+func (d *DynamoDB) contiguousAfter(ctx context.Context, revision, limit int64) (int64, []*record, error) {
+	records, err := d.revisionsAfter(ctx, revision, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	last := revision
+	for i, r := range records {
+		if r.Rev != last+1 {
+			return last, records[:i], nil
+		}
+		last = r.Rev
+	}
+	return last, records, nil
+}
+
+// revisionsAfter returns the revisions after a revision in order, up to limit if
+// it is positive.
+func (d *DynamoDB) revisionsAfter(ctx context.Context, revision, limit int64) ([]*record, error) {
+	var (
+		result    []*record
+		startFrom map[string]types.AttributeValue
+	)
+	for {
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(d.table),
+			IndexName:              aws.String(byRevIndex),
+			KeyConditionExpression: aws.String("#l = :l AND #r > :rev"),
+			ExpressionAttributeNames: map[string]string{
+				"#l": "log",
+				"#r": "rev",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":l":   &types.AttributeValueMemberS{Value: logPartition},
+				":rev": number(revision),
+			},
+			ExclusiveStartKey: startFrom,
+		}
+		if limit > 0 {
+			input.Limit = aws.Int32(int32(limit - int64(len(result))))
+		}
+		out, err := d.client.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		var page []*record
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		result = append(result, page...)
+		if out.LastEvaluatedKey == nil || (limit > 0 && int64(len(result)) >= limit) {
+			return result, nil
+		}
+		startFrom = out.LastEvaluatedKey
+	}
+}
+
+func (d *DynamoDB) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	rev, events, err := d.List(ctx, prefix, "", 0, 0, false)
+	return rev, int64(len(events)), err
+}
+
+// Append writes an event at the next revision, in a transaction that advances
+// the revision counter if it has not moved, and replaces the head of the key if
+// it is at the previous revision of the event. The transaction is retried if
+// another write advanced the counter first, and fails with server.ErrKeyExists
+// if another write to the key won the race.
+func (d *DynamoDB) Append(ctx context.Context, event *server.Event) (int64, error) {
+	e := *event
+	if e.KV == nil {
+		e.KV = &server.KeyValue{}
+	}
+	if e.PrevKV == nil {
+		e.PrevKV = &server.KeyValue{}
+	}
+
+	headCondition := "#l = :prev"
+	if e.Create {
+		// a key being created has no head, or the head of its deletion
+		headCondition = "attribute_not_exists(#l) OR #l = :prev"
+	}
+
+	for i := 0; i < appendRetries; i++ {
+		current, err := d.CurrentRevision(ctx)
+		if err != nil {
+			return 0, err
+		}
+		rev := current + 1
+
+		r := record{
+			Name:           e.KV.Key,
+			Rev:            rev,
+			Created:        e.Create,
+			Deleted:        e.Delete,
+			CreateRevision: e.KV.CreateRevision,
+			PrevRevision:   e.PrevKV.ModRevision,
+			Lease:          e.KV.Lease,
+			Value:          e.KV.Value,
+			OldValue:       e.PrevKV.Value,
+			Log:            logPartition,
+		}
+		item, err := attributevalue.MarshalMap(r)
+		if err != nil {
+			return 0, err
+		}
+		head := r
+		head.Rev = 0
+		head.Log = ""
+		head.Bucket = headBucket
+		head.Latest = rev
+		headItem, err := attributevalue.MarshalMap(head)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = d.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{
+				{
+					Update: &types.Update{
+						TableName:                aws.String(d.table),
+						Key:                      key(revisionCounter, 0),
+						UpdateExpression:         aws.String("SET #c = :next"),
+						ConditionExpression:      aws.String("#c = :current"),
+						ExpressionAttributeNames: map[string]string{"#c": "counter"},
+						ExpressionAttributeValues: map[string]types.AttributeValue{
+							":current": number(current),
+							":next":    number(rev),
+						},
+					},
+				},
+				{
+					Put: &types.Put{
+						TableName:                aws.String(d.table),
+						Item:                     item,
+						ConditionExpression:      aws.String("attribute_not_exists(#n)"),
+						ExpressionAttributeNames: map[string]string{"#n": "name"},
+					},
+				},
+				{
+					Put: &types.Put{
+						TableName:                 aws.String(d.table),
+						Item:                      headItem,
+						ConditionExpression:       aws.String(headCondition),
+						ExpressionAttributeNames:  map[string]string{"#l": "latest"},
+						ExpressionAttributeValues: map[string]types.AttributeValue{":prev": number(e.PrevKV.ModRevision)},
+					},
+				},
+			},
+		})
+		if err == nil {
+			return rev, nil
+		}
+
+		var canceled *types.TransactionCanceledException
+		if !errors.As(err, &canceled) {
+			return 0, err
+		}
+		if reasons := canceled.CancellationReasons; len(reasons) == 3 && aws.ToString(reasons[2].Code) == "ConditionalCheckFailed" {
+			return 0, server.ErrKeyExists
+		}
+		logrus.Tracef("APPEND %s conflicted at revision %d, retrying: %v", e.KV.Key, rev, err)
+	}
+	return 0, fmt.Errorf("failed to append to %s after %d attempts", e.KV.Key, appendRetries)
+}
+
+func (d *DynamoDB) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	values, err := d.broadcaster.Subscribe(ctx, d.startWatch)
+	if err != nil {
+		return nil
+	}
+	res := make(chan []*server.Event, cap(values))
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			events, ok := filter(i, checkPrefix, prefix)
+			if ok {
+				res <- events
+			}
+		}
+	}()
+
+	return res
+}
+
+func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Event, bool) {
+	eventList := events.([]*server.Event)
+	filteredEventList := make([]*server.Event, 0, len(eventList))
+
+	for _, event := range eventList {
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+			filteredEventList = append(filteredEventList, event)
+		}
+	}
+
+	return filteredEventList, len(filteredEventList) > 0
+}
+
+func (d *DynamoDB) startWatch() (chan interface{}, error) {
+	start, err := d.CompactRevision(d.ctx)
+	if err != nil {
+		return nil, err
+	}
+	out, err := d.client.DescribeTable(d.ctx, &dynamodb.DescribeTableInput{TableName: aws.String(d.table)})
+	if err != nil {
+		return nil, err
+	}
+	if out.Table.LatestStreamArn == nil {
+		return nil, fmt.Errorf("table %s has no stream", d.table)
+	}
+
+	d.compactor.Do(func() {
+		go d.compact()
+	})
+
+	records := make(chan *record, pollBatchSize)
+	go d.readStream(aws.ToString(out.Table.LatestStreamArn), records)
+
+	c := make(chan interface{})
+	go d.watch(c, records, start)
+	return c, nil
+}
+
+// watch delivers revisions in order, starting after the given revision. The
+// stream delivers revisions of different keys from different shards, so they
+// may arrive out of order, and the stream may not have all revisions, so
+// revisions that have not arrived are read from the index of revisions.
+func (d *DynamoDB) watch(result chan interface{}, records <-chan *record, last int64) {
+	defer close(result)
+	atomic.StoreInt64(&d.watched, last)
+
+	tick := time.NewTicker(pollInterval)
+	defer tick.Stop()
+
+	pending := map[int64]*record{}
+	for {
+		poll := false
+		select {
+		case <-d.ctx.Done():
+			return
+		case r := <-records:
+			if r.Rev > last {
+				pending[r.Rev] = r
+			}
+		case <-tick.C:
+			poll = true
+		}
+
+		var events []*server.Event
+		for r, ok := pending[last+1]; ok; r, ok = pending[last+1] {
+			delete(pending, r.Rev)
+			last = r.Rev
+			events = append(events, toEvent(r))
+		}
+
+		if poll {
+			current, err := d.CurrentRevision(d.ctx)
+			if err != nil {
+				logrus.Errorf("Failed to get current revision: %v", err)
+			} else if current > last {
+				rev, polled, err := d.contiguousAfter(d.ctx, last, pollBatchSize)
+				if err != nil {
+					logrus.Errorf("Failed to list latest changes: %v", err)
+				}
+				for _, r := range polled {
+					delete(pending, r.Rev)
+					events = append(events, toEvent(r))
+				}
+				if rev > last {
+					last = rev
+				}
+			}
+		}
+
+		if len(events) > 0 {
+			atomic.StoreInt64(&d.watched, last)
+			result <- events
+		}
+	}
+}
+
+// WatchRevision returns the last revision delivered to watchers, or zero if no
+// watch has been started.
+func (d *DynamoDB) WatchRevision() int64 {
+	return atomic.LoadInt64(&d.watched)
+}
+
+// compact periodically advances the compact revision, keeping the most recent
+// revisions, and deletes the revisions up to it that have been superseded, and
+// deleted keys. The compact revision is advanced first, so that reads at
+// revisions being compacted fail rather than see partial results.
+func (d *DynamoDB) compact() {
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		compact, err := d.CompactRevision(d.ctx)
+		if err != nil {
+			logrus.Errorf("Compact failed to get compact revision: %v", err)
+			continue
+		}
+		current, err := d.CurrentRevision(d.ctx)
+		if err != nil {
+			logrus.Errorf("Compact failed to get current revision: %v", err)
+			continue
+		}
+		target := current - compactMinRetain
+		if target <= compact {
+			continue
+		}
+		if err := d.compactTo(compact, target); err != nil {
+			logrus.Errorf("Compact failed: %v", err)
+			continue
+		}
+		logrus.Debugf("COMPACT compacted to %d/%d", target, current)
+	}
+}
+
+func (d *DynamoDB) compactTo(compact, target int64) error {
+	_, err := d.client.UpdateItem(d.ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(d.table),
+		Key:                      key(compactCounter, 0),
+		UpdateExpression:         aws.String("SET #c = :target"),
+		ConditionExpression:      aws.String("#c < :target"),
+		ExpressionAttributeNames: map[string]string{"#c": "counter"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":target": number(target),
+		},
+	})
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		// another instance compacted first
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	records, err := d.revisionsAfter(d.ctx, compact, target-compact)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.PrevRevision > 0 {
+			if err := d.deleteItem(key(r.Name, r.PrevRevision), "", nil); err != nil {
+				return err
+			}
+		}
+		if r.Deleted {
+			if err := d.deleteItem(key(r.Name, r.Rev), "", nil); err != nil {
+				return err
+			}
+			// remove the head unless the key has since been recreated
+			err := d.deleteItem(key(r.Name, 0), "#l = :rev", map[string]types.AttributeValue{":rev": number(r.Rev)})
+			if err != nil && !errors.As(err, &failed) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *DynamoDB) deleteItem(key map[string]types.AttributeValue, condition string, values map[string]types.AttributeValue) error {
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.table),
+		Key:       key,
+	}
+	if condition != "" {
+		input.ConditionExpression = aws.String(condition)
+		input.ExpressionAttributeNames = map[string]string{"#l": "latest"}
+		input.ExpressionAttributeValues = values
+	}
+	_, err := d.client.DeleteItem(d.ctx, input)
+	return err
+}
+
+// DbSize returns the size of the table, which DynamoDB updates every few hours.
+func (d *DynamoDB) DbSize(ctx context.Context) (int64, error) {
+	out, err := d.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(d.table)})
+	if err != nil {
+		return 0, err
+	}
+	return aws.ToInt64(out.Table.TableSizeBytes), nil
+}
+
+func toEvent(r *record) *server.Event {
+	modRevision := r.Rev
+	if modRevision == 0 {
+		modRevision = r.Latest
+	}
+	event := &server.Event{
+		Create: r.Created,
+		Delete: r.Deleted,
+		KV: &server.KeyValue{
+			Key:            r.Name,
+			CreateRevision: r.CreateRevision,
+			ModRevision:    modRevision,
+			Value:          r.Value,
+			Lease:          r.Lease,
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: r.PrevRevision,
+			Value:       r.OldValue,
+		},
+	}
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event
+}
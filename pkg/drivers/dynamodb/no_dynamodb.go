@@ -0,0 +1,15 @@
+//go:build !dynamodb
+// +build !dynamodb
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
+	return nil, errors.New(`this binary is built without DynamoDB support, compile with "-tags dynamodb"`)
+}
@@ -0,0 +1,129 @@
+//go:build dynamodb
+// +build dynamodb
+
+package dynamodb
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodbstreams/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+	"github.com/sirupsen/logrus"
+)
+
+const shardRefreshInterval = 10 * time.Second
+
+// readStream sends the revisions inserted into the table from now on, as read
+// from each shard of its stream. Shards that are opened later, as the stream
+// is resharded, are read from their start. Failures are logged and the shard
+// is abandoned, as revisions that are not delivered by the stream are polled
+// from the table.
+func (d *DynamoDB) readStream(arn string, records chan<- *record) {
+	readers := map[string]bool{}
+	first := true
+
+	t := time.NewTicker(shardRefreshInterval)
+	defer t.Stop()
+
+	for {
+		shards, err := d.shards(arn)
+		if err != nil {
+			logrus.Errorf("Failed to describe stream: %v", err)
+		}
+		for _, shard := range shards {
+			id := aws.ToString(shard.ShardId)
+			if readers[id] || (shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil && first) {
+				continue
+			}
+			readers[id] = true
+			iteratorType := types.ShardIteratorTypeTrimHorizon
+			if first {
+				iteratorType = types.ShardIteratorTypeLatest
+			}
+			go d.readShard(arn, id, iteratorType, records)
+		}
+		if err == nil {
+			first = false
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (d *DynamoDB) shards(arn string) ([]types.Shard, error) {
+	var (
+		shards []types.Shard
+		start  *string
+	)
+	for {
+		out, err := d.streams.DescribeStream(d.ctx, &dynamodbstreams.DescribeStreamInput{
+			StreamArn:             aws.String(arn),
+			ExclusiveStartShardId: start,
+		})
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, out.StreamDescription.Shards...)
+		if out.StreamDescription.LastEvaluatedShardId == nil {
+			return shards, nil
+		}
+		start = out.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+func (d *DynamoDB) readShard(arn, id string, iteratorType types.ShardIteratorType, records chan<- *record) {
+	out, err := d.streams.GetShardIterator(d.ctx, &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(arn),
+		ShardId:           aws.String(id),
+		ShardIteratorType: iteratorType,
+	})
+	if err != nil {
+		logrus.Errorf("Failed to read stream shard %s: %v", id, err)
+		return
+	}
+
+	iterator := out.ShardIterator
+	for iterator != nil {
+		out, err := d.streams.GetRecords(d.ctx, &dynamodbstreams.GetRecordsInput{ShardIterator: iterator})
+		if err != nil {
+			if d.ctx.Err() == nil {
+				logrus.Errorf("Failed to read stream shard %s: %v", id, err)
+			}
+			return
+		}
+		for _, rec := range out.Records {
+			if rec.EventName != types.OperationTypeInsert || rec.Dynamodb == nil {
+				continue
+			}
+			r := &record{}
+			if err := attributevalue.UnmarshalMap(rec.Dynamodb.NewImage, r); err != nil {
+				logrus.Errorf("Failed to decode stream record: %v", err)
+				continue
+			}
+			// only revisions are indexed in the log, not heads or counters
+			if r.Log == "" {
+				continue
+			}
+			select {
+			case <-d.ctx.Done():
+				return
+			case records <- r:
+			}
+		}
+		iterator = out.NextShardIterator
+
+		if len(out.Records) == 0 {
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+}
@@ -0,0 +1,421 @@
+// Package etcdproxy provides a backend that forwards to an etcd cluster, so that
+// kine can be put in front of an existing cluster, recording its own metrics and
+// optionally mirroring writes to another backend, to compare them side by side
+// while migrating between etcd and kine.
+package etcdproxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+)
+
+var _ server.Backend = (*Proxy)(nil)
+
+// Config configures the etcd cluster that requests are forwarded to.
+type Config struct {
+	// Endpoints are the client URLs of the etcd cluster.
+	Endpoints []string
+	TLS       tls.Config
+	// Compact compacts the etcd cluster, keeping the most recent revisions as
+	// kine does. It must be disabled if the cluster is compacted otherwise, as
+	// kine does not forward compaction requests.
+	Compact bool
+	// Mirror is a backend that writes are also applied to, or nil.
+	Mirror server.Backend
+}
+
+// Proxy is a backend that forwards every request to an etcd cluster. Kine
+// stores the TTL of a lease in place of its ID, so keys written with a lease
+// are attached to an etcd lease granted with that TTL, which is shared by keys
+// with the same TTL written within half of it, and the TTL is reported in place
+// of the etcd lease ID.
+type Proxy struct {
+	client  *clientv3.Client
+	config  Config
+	mirror  *mirror
+	compact int64
+
+	leasesLock sync.Mutex
+	leases     map[int64]proxyLease
+	ttls       map[clientv3.LeaseID]int64
+}
+
+type proxyLease struct {
+	id      clientv3.LeaseID
+	granted time.Time
+}
+
+// New connects to the etcd cluster.
+func New(ctx context.Context, config Config) (*Proxy, error) {
+	tlsConfig, err := config.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Context:     ctx,
+		Endpoints:   config.Endpoints,
+		DialTimeout: 5 * time.Second,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		client: client,
+		config: config,
+		leases: map[int64]proxyLease{},
+		ttls:   map[clientv3.LeaseID]int64{},
+	}
+	if config.Mirror != nil {
+		p.mirror = newMirror(config.Mirror)
+	}
+	return p, nil
+}
+
+func (p *Proxy) Start(ctx context.Context) error {
+	if _, err := p.client.Status(ctx, p.config.Endpoints[0]); err != nil {
+		return fmt.Errorf("connecting to etcd: %v", err)
+	}
+	if p.mirror != nil {
+		if err := p.config.Mirror.Start(ctx); err != nil {
+			return fmt.Errorf("starting mirror: %v", err)
+		}
+		go p.mirror.run(ctx)
+	}
+	if p.config.Compact {
+		go p.compactor(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		p.client.Close()
+	}()
+	return nil
+}
+
+// observe records the duration and result of a request.
+func observe(operation string, start time.Time, err error) {
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultError
+	}
+	metrics.EtcdProxyRequestsTotal.WithLabelValues(operation, result).Inc()
+	metrics.EtcdProxyRequestSeconds.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// translateErr returns the kine error for an etcd error.
+func translateErr(err error) error {
+	if err == rpctypes.ErrCompacted {
+		return server.ErrCompacted
+	}
+	return err
+}
+
+// lease returns an etcd lease for keys with the given TTL.
+func (p *Proxy) lease(ctx context.Context, ttl int64) (clientv3.LeaseID, error) {
+	p.leasesLock.Lock()
+	defer p.leasesLock.Unlock()
+
+	if l, ok := p.leases[ttl]; ok && time.Since(l.granted) < time.Duration(ttl)*time.Second/2 {
+		return l.id, nil
+	}
+	resp, err := p.client.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+	p.leases[ttl] = proxyLease{id: resp.ID, granted: time.Now()}
+	p.ttls[resp.ID] = ttl
+	return resp.ID, nil
+}
+
+// ttl returns the TTL an etcd lease was granted with, looking it up for leases
+// granted by another instance or before a restart.
+func (p *Proxy) ttl(ctx context.Context, id clientv3.LeaseID) int64 {
+	if id == 0 {
+		return 0
+	}
+	p.leasesLock.Lock()
+	ttl, ok := p.ttls[id]
+	p.leasesLock.Unlock()
+	if ok {
+		return ttl
+	}
+
+	resp, err := p.client.TimeToLive(ctx, id)
+	if err != nil || resp.GrantedTTL <= 0 {
+		// the lease has expired, and the key is about to be deleted
+		return 1
+	}
+	p.leasesLock.Lock()
+	p.ttls[id] = resp.GrantedTTL
+	p.leasesLock.Unlock()
+	return resp.GrantedTTL
+}
+
+func (p *Proxy) putOptions(ctx context.Context, lease int64) ([]clientv3.OpOption, error) {
+	if lease <= 0 {
+		return nil, nil
+	}
+	id, err := p.lease(ctx, lease)
+	if err != nil {
+		return nil, err
+	}
+	return []clientv3.OpOption{clientv3.WithLease(id)}, nil
+}
+
+func (p *Proxy) toKeyValue(ctx context.Context, kv *mvccpb.KeyValue) *server.KeyValue {
+	if kv == nil {
+		return nil
+	}
+	return &server.KeyValue{
+		Key:            string(kv.Key),
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Value:          kv.Value,
+		Lease:          p.ttl(ctx, clientv3.LeaseID(kv.Lease)),
+	}
+}
+
+func (p *Proxy) Get(ctx context.Context, key string, revision int64) (rev int64, kv *server.KeyValue, err error) {
+	defer func(start time.Time) { observe("get", start, err) }(time.Now())
+
+	resp, err := p.client.Get(ctx, key, clientv3.WithRev(revision))
+	if err != nil {
+		return 0, nil, translateErr(err)
+	}
+	if len(resp.Kvs) > 0 {
+		kv = p.toKeyValue(ctx, resp.Kvs[0])
+	}
+	return resp.Header.Revision, kv, nil
+}
+
+func (p *Proxy) Create(ctx context.Context, key string, value []byte, lease int64) (rev int64, err error) {
+	defer func(start time.Time) { observe("create", start, err) }(time.Now())
+
+	opts, err := p.putOptions(ctx, lease)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(value), opts...)).
+		Commit()
+	if err != nil {
+		return 0, translateErr(err)
+	}
+	if !resp.Succeeded {
+		return resp.Header.Revision, server.ErrKeyExists
+	}
+	p.mirror.create(key, value, lease)
+	return resp.Header.Revision, nil
+}
+
+func (p *Proxy) Delete(ctx context.Context, key string, revision int64) (rev int64, kv *server.KeyValue, deleted bool, err error) {
+	defer func(start time.Time) { observe("delete", start, err) }(time.Now())
+
+	var cmps []clientv3.Cmp
+	if revision != 0 {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", revision))
+	}
+	resp, err := p.client.Txn(ctx).
+		If(cmps...).
+		Then(clientv3.OpDelete(key, clientv3.WithPrevKV())).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return 0, nil, false, translateErr(err)
+	}
+	if !resp.Succeeded {
+		if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+			kv = p.toKeyValue(ctx, kvs[0])
+		}
+		return resp.Header.Revision, kv, false, nil
+	}
+	if prevKvs := resp.Responses[0].GetResponseDeleteRange().PrevKvs; len(prevKvs) > 0 {
+		kv = p.toKeyValue(ctx, prevKvs[0])
+		p.mirror.delete(key)
+	}
+	return resp.Header.Revision, kv, true, nil
+}
+
+func (p *Proxy) Update(ctx context.Context, key string, value []byte, revision, lease int64) (rev int64, kv *server.KeyValue, updated bool, err error) {
+	defer func(start time.Time) { observe("update", start, err) }(time.Now())
+
+	opts, err := p.putOptions(ctx, lease)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	resp, err := p.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+		Then(clientv3.OpPut(key, string(value), opts...), clientv3.OpGet(key)).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return 0, nil, false, translateErr(err)
+	}
+	kvs := resp.Responses[len(resp.Responses)-1].GetResponseRange().Kvs
+	if len(kvs) > 0 {
+		kv = p.toKeyValue(ctx, kvs[0])
+	}
+	if !resp.Succeeded {
+		return resp.Header.Revision, kv, false, nil
+	}
+	p.mirror.update(key, value, lease)
+	return resp.Header.Revision, kv, true, nil
+}
+
+func (p *Proxy) List(ctx context.Context, prefix, startKey string, limit, revision int64) (rev int64, kvs []*server.KeyValue, err error) {
+	defer func(start time.Time) { observe("list", start, err) }(time.Now())
+
+	key := prefix
+	opts := []clientv3.OpOption{clientv3.WithRev(revision), clientv3.WithLimit(limit)}
+	if strings.HasSuffix(prefix, "/") {
+		if startKey != "" {
+			key = startKey
+		}
+		opts = append(opts, clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)))
+	}
+	resp, err := p.client.Get(ctx, key, opts...)
+	if err != nil {
+		return 0, nil, translateErr(err)
+	}
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, p.toKeyValue(ctx, kv))
+	}
+	return resp.Header.Revision, kvs, nil
+}
+
+func (p *Proxy) Count(ctx context.Context, prefix string) (rev int64, count int64, err error) {
+	defer func(start time.Time) { observe("count", start, err) }(time.Now())
+
+	opts := []clientv3.OpOption{clientv3.WithCountOnly()}
+	if strings.HasSuffix(prefix, "/") {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	resp, err := p.client.Get(ctx, prefix, opts...)
+	if err != nil {
+		return 0, 0, translateErr(err)
+	}
+	return resp.Header.Revision, resp.Count, nil
+}
+
+// Watch forwards a watch from the revision, or from the current revision if
+// zero. The channel is closed if the revision has been compacted.
+func (p *Proxy) Watch(ctx context.Context, key string, revision int64) <-chan []*server.Event {
+	opts := []clientv3.OpOption{clientv3.WithPrevKV(), clientv3.WithRev(revision)}
+	if strings.HasSuffix(key, "/") {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	metrics.EtcdProxyRequestsTotal.WithLabelValues("watch", metrics.ResultSuccess).Inc()
+
+	result := make(chan []*server.Event, 100)
+	go func() {
+		defer close(result)
+		for resp := range p.client.Watch(clientv3.WithRequireLeader(ctx), key, opts...) {
+			if resp.CompactRevision > 0 {
+				p.setCompactRevision(resp.CompactRevision)
+			}
+			if err := resp.Err(); err != nil {
+				logrus.Errorf("Watch of %s at revision %d failed: %v", key, revision, err)
+				return
+			}
+			events := make([]*server.Event, 0, len(resp.Events))
+			for _, ev := range resp.Events {
+				events = append(events, p.toEvent(ctx, ev))
+			}
+			if len(events) > 0 {
+				result <- events
+			}
+		}
+	}()
+	return result
+}
+
+func (p *Proxy) toEvent(ctx context.Context, ev *clientv3.Event) *server.Event {
+	event := &server.Event{
+		Create: ev.IsCreate(),
+		Delete: ev.Type == clientv3.EventTypeDelete,
+		KV:     p.toKeyValue(ctx, ev.Kv),
+		PrevKV: p.toKeyValue(ctx, ev.PrevKv),
+	}
+	if event.Delete && event.PrevKV != nil {
+		// etcd reports deleted keys without their value
+		event.KV.CreateRevision = event.PrevKV.CreateRevision
+		event.KV.Value = event.PrevKV.Value
+		event.KV.Lease = event.PrevKV.Lease
+	}
+	return event
+}
+
+// DbSize returns the size of the database of the first etcd endpoint.
+func (p *Proxy) DbSize(ctx context.Context) (int64, error) {
+	resp, err := p.client.Status(ctx, p.config.Endpoints[0])
+	if err != nil {
+		return 0, err
+	}
+	return resp.DbSize, nil
+}
+
+// CompactRevision returns the latest revision the cluster is known to have been
+// compacted to, by this proxy or as reported to a watch.
+func (p *Proxy) CompactRevision(ctx context.Context) (int64, error) {
+	return atomic.LoadInt64(&p.compact), nil
+}
+
+func (p *Proxy) setCompactRevision(rev int64) {
+	for {
+		compact := atomic.LoadInt64(&p.compact)
+		if rev <= compact || atomic.CompareAndSwapInt64(&p.compact, compact, rev) {
+			return
+		}
+	}
+}
+
+// compactor periodically compacts the cluster, keeping the most recent
+// revisions.
+func (p *Proxy) compactor(ctx context.Context) {
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		resp, err := p.client.Status(ctx, p.config.Endpoints[0])
+		if err != nil {
+			logrus.Errorf("Compact failed to get current revision: %v", err)
+			continue
+		}
+		target := resp.Header.Revision - compactMinRetain
+		if target <= atomic.LoadInt64(&p.compact) {
+			continue
+		}
+		if _, err := p.client.Compact(ctx, target); err != nil && err != rpctypes.ErrCompacted {
+			logrus.Errorf("Compact failed: %v", err)
+			metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+			continue
+		}
+		p.setCompactRevision(target)
+		metrics.CompactTotal.WithLabelValues(metrics.ResultSuccess).Inc()
+		logrus.Debugf("COMPACT compacted to %d/%d", target, resp.Header.Revision)
+	}
+}
@@ -0,0 +1,123 @@
+package etcdproxy
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const mirrorQueueSize = 1000
+
+// Results of applying a write to the mirror, in addition to success and error.
+// A mismatch is a write that found the key in a different state in the mirror
+// than in etcd, and was applied anyway to bring the mirror back in line. A drop
+// is a write that was not applied because the queue was full.
+const (
+	mirrorMismatch = "mismatch"
+	mirrorDropped  = "dropped"
+)
+
+type mirrorOp struct {
+	key    string
+	value  []byte
+	lease  int64
+	create bool
+	delete bool
+}
+
+// mirror applies the writes made to etcd to another backend, in order, in the
+// background. Revisions in the mirror do not match etcd, so writes are applied
+// by key, and differences between the state of the key in the mirror and in
+// etcd are counted, so that the backends can be compared before switching.
+type mirror struct {
+	backend server.Backend
+	ops     chan mirrorOp
+}
+
+func newMirror(backend server.Backend) *mirror {
+	return &mirror{
+		backend: backend,
+		ops:     make(chan mirrorOp, mirrorQueueSize),
+	}
+}
+
+func (m *mirror) create(key string, value []byte, lease int64) {
+	m.enqueue(mirrorOp{key: key, value: value, lease: lease, create: true})
+}
+
+func (m *mirror) update(key string, value []byte, lease int64) {
+	m.enqueue(mirrorOp{key: key, value: value, lease: lease})
+}
+
+func (m *mirror) delete(key string) {
+	m.enqueue(mirrorOp{key: key, delete: true})
+}
+
+// enqueue queues a write, if the proxy has a mirror.
+func (m *mirror) enqueue(op mirrorOp) {
+	if m == nil {
+		return
+	}
+	select {
+	case m.ops <- op:
+	default:
+		metrics.EtcdProxyMirrorTotal.WithLabelValues(mirrorDropped).Inc()
+	}
+}
+
+func (m *mirror) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case op := <-m.ops:
+			result, err := m.apply(ctx, op)
+			if err != nil {
+				logrus.Errorf("Failed to mirror write to %s: %v", op.key, err)
+				result = metrics.ResultError
+			} else if result == mirrorMismatch {
+				logrus.Warnf("Mirror did not match etcd when writing %s", op.key)
+			}
+			metrics.EtcdProxyMirrorTotal.WithLabelValues(result).Inc()
+		}
+	}
+}
+
+// apply applies a write to the mirror, returning mirrorMismatch if the key was
+// not in the state the write expected.
+func (m *mirror) apply(ctx context.Context, op mirrorOp) (string, error) {
+	_, kv, err := m.backend.Get(ctx, op.key, 0)
+	if err != nil {
+		return "", err
+	}
+
+	result := metrics.ResultSuccess
+	switch {
+	case op.delete:
+		if kv == nil {
+			return mirrorMismatch, nil
+		}
+		_, _, deleted, err := m.backend.Delete(ctx, op.key, kv.ModRevision)
+		if err == nil && !deleted {
+			result = mirrorMismatch
+		}
+		return result, err
+	case kv == nil:
+		if !op.create {
+			result = mirrorMismatch
+		}
+		_, err := m.backend.Create(ctx, op.key, op.value, op.lease)
+		return result, err
+	default:
+		if op.create {
+			result = mirrorMismatch
+		}
+		_, _, updated, err := m.backend.Update(ctx, op.key, op.value, kv.ModRevision, op.lease)
+		if err == nil && !updated {
+			result = mirrorMismatch
+		}
+		return result, err
+	}
+}
@@ -0,0 +1,853 @@
+//go:build foundationdb
+// +build foundationdb
+
+package foundationdb
+
+import (
+	"context"
+	"encoding/binary"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	apiVersion       = 710
+	defaultDirectory = "kine"
+
+	// chunkSize is the largest part of a value stored in a single FDB value,
+	// which is limited to 100kB.
+	chunkSize = 90000
+	// pageSize is the number of keys read in each transaction when scanning,
+	// so that scans stay well within the 5 second transaction limit.
+	pageSize = 1000
+
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+	compactBatchSize = 500
+	pollBatchSize    = 500
+)
+
+var (
+	initOnce sync.Once
+	initErr  error
+)
+
+// entry is a revision of a key, as stored under the key without its value.
+type entry struct {
+	name           string
+	vs             tuple.Versionstamp
+	created        bool
+	deleted        bool
+	createRevision int64
+	prevRevision   int64
+	lease          int64
+}
+
+// FDB is a log stored in a FoundationDB directory. Revisions are the commit
+// versions of the transactions that append them, taken from their
+// versionstamps, so they increase but are not contiguous. Every append reads
+// and writes the current revision key, so no two appends commit at the same
+// version.
+//
+// The directory holds the subspaces:
+//
+//	kv   (name, versionstamp) => (created, deleted, create_revision, prev_revision, lease)
+//	val  (name, versionstamp, chunk) => part of the value
+//	log  (versionstamp) => (name)
+//	meta ("revision") => (versionstamp), ("compact") => little endian revision
+type FDB struct {
+	db          fdb.Database
+	dir         directory.DirectorySubspace
+	kv          subspace.Subspace
+	val         subspace.Subspace
+	log         subspace.Subspace
+	revKey      fdb.Key
+	compactKey  fdb.Key
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	compactor   sync.Once
+	// polled is the last revision delivered to watchers
+	polled int64
+}
+
+// New opens a FoundationDB database. The endpoint is the path of the cluster
+// file, or empty for the default cluster file, and the directory holding kine's
+// data can be set with the directory parameter, for example
+// foundationdb:///etc/foundationdb/fdb.cluster?directory=kine/cluster1. TLS is
+// configured from the backend TLS files for the whole process, as FDB requires.
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server.Backend, error) {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	path := []string{defaultDirectory}
+	if d := u.Query().Get("directory"); d != "" {
+		path = strings.Split(strings.Trim(d, "/"), "/")
+	}
+
+	if err := initNetwork(tlsInfo); err != nil {
+		return nil, err
+	}
+	var db fdb.Database
+	if clusterFile := u.Host + u.Path; clusterFile != "" {
+		db, err = fdb.OpenDatabase(clusterFile)
+	} else {
+		db, err = fdb.OpenDefault()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := directory.CreateOrOpen(db, path, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening directory")
+	}
+	meta := dir.Sub("meta")
+	return logstructured.New(&FDB{
+		db:         db,
+		dir:        dir,
+		kv:         dir.Sub("kv"),
+		val:        dir.Sub("val"),
+		log:        dir.Sub("log"),
+		revKey:     meta.Pack(tuple.Tuple{"revision"}),
+		compactKey: meta.Pack(tuple.Tuple{"compact"}),
+	}), nil
+}
+
+// initNetwork selects the API version and configures TLS, which can only be
+// done once per process.
+func initNetwork(tlsInfo tls.Config) error {
+	initOnce.Do(func() {
+		if initErr = fdb.APIVersion(apiVersion); initErr != nil {
+			return
+		}
+		options := fdb.Options()
+		if tlsInfo.CertFile != "" {
+			if initErr = options.SetTLSCertPath(tlsInfo.CertFile); initErr != nil {
+				return
+			}
+		}
+		if tlsInfo.KeyFile != "" {
+			if initErr = options.SetTLSKeyPath(tlsInfo.KeyFile); initErr != nil {
+				return
+			}
+		}
+		if tlsInfo.CAFile != "" {
+			initErr = options.SetTLSCaPath(tlsInfo.CAFile)
+		}
+	})
+	return initErr
+}
+
+func (f *FDB) Start(ctx context.Context) error {
+	f.ctx = ctx
+	return nil
+}
+
+// revisionOf returns the revision of a versionstamp, which is its commit
+// version.
+func revisionOf(vs tuple.Versionstamp) int64 {
+	return int64(binary.BigEndian.Uint64(vs.TransactionVersion[:8]))
+}
+
+// versionstamps returns the first and last versionstamps of a revision.
+func versionstamps(rev int64) (tuple.Versionstamp, tuple.Versionstamp) {
+	first := tuple.Versionstamp{}
+	binary.BigEndian.PutUint64(first.TransactionVersion[:8], uint64(rev))
+	last := first
+	last.TransactionVersion[8], last.TransactionVersion[9] = 0xff, 0xff
+	last.UserVersion = 0xffff
+	return first, last
+}
+
+// revisionRange returns the keys of a subspace under a name at a revision.
+func revisionRange(sub subspace.Subspace, name string, rev int64) fdb.KeyRange {
+	first, last := versionstamps(rev)
+	return fdb.KeyRange{
+		Begin: sub.Pack(tuple.Tuple{name, first}),
+		End:   append(sub.Pack(tuple.Tuple{name, last}), 0xff),
+	}
+}
+
+// logRange returns the keys of the log after a revision, up to and including
+// another.
+func (f *FDB) logRange(after, upTo int64) fdb.KeyRange {
+	first, _ := versionstamps(after + 1)
+	_, last := versionstamps(upTo)
+	return fdb.KeyRange{
+		Begin: f.log.Pack(tuple.Tuple{first}),
+		End:   append(f.log.Pack(tuple.Tuple{last}), 0xff),
+	}
+}
+
+func (f *FDB) currentRevision(tr fdb.ReadTransaction) (int64, error) {
+	v, err := tr.Get(f.revKey).Get()
+	if err != nil || v == nil {
+		return 0, err
+	}
+	t, err := tuple.Unpack(v)
+	if err != nil {
+		return 0, err
+	}
+	return revisionOf(t[0].(tuple.Versionstamp)), nil
+}
+
+func (f *FDB) CurrentRevision(ctx context.Context) (int64, error) {
+	rev, err := f.db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+		return f.currentRevision(tr)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rev.(int64), nil
+}
+
+func (f *FDB) CompactRevision(ctx context.Context) (int64, error) {
+	v, err := f.db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+		return tr.Get(f.compactKey).Get()
+	})
+	if err != nil || len(v.([]byte)) != 8 {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(v.([]byte))), nil
+}
+
+func (f *FDB) checkCompacted(ctx context.Context, revision int64) error {
+	compact, err := f.CompactRevision(ctx)
+	if err != nil {
+		return err
+	}
+	if revision > 0 && revision < compact {
+		return server.ErrCompacted
+	}
+	return nil
+}
+
+func (f *FDB) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	rev, err := f.CurrentRevision(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := f.checkCompacted(ctx, revision); err != nil {
+		return rev, nil, err
+	}
+	if revision > 0 {
+		rev = revision
+	}
+
+	// names are packed as a type code, the name and a terminator, so trimming
+	// the terminator gives the prefix of the keys of every name with the prefix
+	var r fdb.KeyRange
+	if strings.HasSuffix(prefix, "/") {
+		packed := f.kv.Pack(tuple.Tuple{prefix})
+		if r, err = fdb.PrefixRange(packed[:len(packed)-1]); err != nil {
+			return 0, nil, err
+		}
+		if startKey != "" && startKey != prefix {
+			r.Begin = f.kv.Pack(tuple.Tuple{startKey})
+		}
+	} else if r, err = fdb.PrefixRange(f.kv.Pack(tuple.Tuple{prefix})); err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		entries []*entry
+		latest  *entry
+	)
+	// flush keeps the latest revision of the last name scanned, and returns
+	// true once the limit is reached
+	flush := func() bool {
+		if latest != nil && (includeDeleted || !latest.deleted) {
+			entries = append(entries, latest)
+		}
+		latest = nil
+		return limit > 0 && int64(len(entries)) >= limit
+	}
+
+	begin := r.Begin
+scan:
+	for {
+		kvs, err := f.getRange(fdb.KeyRange{Begin: begin, End: r.End}, pageSize)
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, kv := range kvs {
+			e, err := f.decodeEntry(kv)
+			if err != nil {
+				return 0, nil, err
+			}
+			if revisionOf(e.vs) > rev {
+				continue
+			}
+			if latest != nil && latest.name != e.name && flush() {
+				break scan
+			}
+			latest = e
+		}
+		if len(kvs) < pageSize {
+			flush()
+			break
+		}
+		begin = append(kvs[len(kvs)-1].Key, 0x00)
+	}
+
+	events, err := f.events(entries, false)
+	return rev, events, err
+}
+
+func (f *FDB) getRange(r fdb.KeyRange, limit int) ([]fdb.KeyValue, error) {
+	kvs, err := f.db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+		return tr.GetRange(r, fdb.RangeOptions{Limit: limit}).GetSliceWithError()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kvs.([]fdb.KeyValue), nil
+}
+
+func (f *FDB) decodeEntry(kv fdb.KeyValue) (*entry, error) {
+	k, err := f.kv.Unpack(kv.Key)
+	if err != nil {
+		return nil, err
+	}
+	v, err := tuple.Unpack(kv.Value)
+	if err != nil {
+		return nil, err
+	}
+	return &entry{
+		name:           k[0].(string),
+		vs:             k[1].(tuple.Versionstamp),
+		created:        v[0].(bool),
+		deleted:        v[1].(bool),
+		createRevision: v[2].(int64),
+		prevRevision:   v[3].(int64),
+		lease:          v[4].(int64),
+	}, nil
+}
+
+// events reads the values of entries, and optionally the values of their
+// previous revisions, in batches of transactions.
+func (f *FDB) events(entries []*entry, withPrevious bool) ([]*server.Event, error) {
+	events := make([]*server.Event, 0, len(entries))
+	for len(entries) > 0 {
+		n := compactBatchSize
+		if n > len(entries) {
+			n = len(entries)
+		}
+		batch, err := f.db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+			batch := make([]*server.Event, 0, n)
+			for _, e := range entries[:n] {
+				value, err := f.value(tr, e.name, e.vs)
+				if err != nil {
+					return nil, err
+				}
+				event := e.event(value)
+				if withPrevious && event.PrevKV != nil && event.PrevKV.ModRevision > 0 {
+					if event.PrevKV.Value, err = f.valueAt(tr, e.name, event.PrevKV.ModRevision); err != nil {
+						return nil, err
+					}
+				}
+				batch = append(batch, event)
+			}
+			return batch, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, batch.([]*server.Event)...)
+		entries = entries[n:]
+	}
+	return events, nil
+}
+
+// value reads the chunks of the value of a revision of a key.
+func (f *FDB) value(tr fdb.ReadTransaction, name string, vs tuple.Versionstamp) ([]byte, error) {
+	r, err := fdb.PrefixRange(f.val.Pack(tuple.Tuple{name, vs}))
+	if err != nil {
+		return nil, err
+	}
+	kvs, err := tr.GetRange(r, fdb.RangeOptions{}).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	for _, kv := range kvs {
+		value = append(value, kv.Value...)
+	}
+	return value, nil
+}
+
+// valueAt reads the value of a key at a revision, or nil if the revision has
+// been compacted.
+func (f *FDB) valueAt(tr fdb.ReadTransaction, name string, rev int64) ([]byte, error) {
+	kvs, err := tr.GetRange(revisionRange(f.kv, name, rev), fdb.RangeOptions{Limit: 1}).GetSliceWithError()
+	if err != nil || len(kvs) == 0 {
+		return nil, err
+	}
+	e, err := f.decodeEntry(kvs[0])
+	if err != nil {
+		return nil, err
+	}
+	return f.value(tr, name, e.vs)
+}
+
+func (e *entry) event(value []byte) *server.Event {
+	event := &server.Event{
+		Create: e.created,
+		Delete: e.deleted,
+		KV: &server.KeyValue{
+			Key:            e.name,
+			CreateRevision: e.createRevision,
+			ModRevision:    revisionOf(e.vs),
+			Value:          value,
+			Lease:          e.lease,
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: e.prevRevision,
+		},
+	}
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event
+}
+
+func (f *FDB) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	rev, err := f.CurrentRevision(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := f.checkCompacted(ctx, revision); err != nil {
+		return rev, nil, err
+	}
+
+	events, err := f.after(revision, rev, limit, prefix)
+	return rev, events, err
+}
+
+// after returns the events with a prefix after a revision up to another, so
+// that later pages do not return events committed after the first was read.
+// An empty prefix matches every key.
+func (f *FDB) after(revision, upTo, limit int64, prefix string) ([]*server.Event, error) {
+	if upTo <= revision {
+		return nil, nil
+	}
+	checkPrefix := strings.HasSuffix(prefix, "/")
+	r := f.logRange(revision, upTo)
+
+	var entries []*entry
+	for limit <= 0 || int64(len(entries)) < limit {
+		kvs, err := f.getRange(r, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		var keys []fdb.Key
+		for _, kv := range kvs {
+			k, err := f.log.Unpack(kv.Key)
+			if err != nil {
+				return nil, err
+			}
+			v, err := tuple.Unpack(kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			name := v[0].(string)
+			if prefix == "" || (checkPrefix && strings.HasPrefix(name, prefix)) || name == prefix {
+				keys = append(keys, f.kv.Pack(tuple.Tuple{name, k[0]}))
+			}
+		}
+		page, err := f.entries(keys)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, page...)
+		if len(kvs) < pageSize {
+			break
+		}
+		r.Begin = append(kvs[len(kvs)-1].Key, 0x00)
+	}
+	if limit > 0 && int64(len(entries)) > limit {
+		entries = entries[:limit]
+	}
+	return f.events(entries, true)
+}
+
+// entries reads the entries stored under keys of the kv subspace, skipping
+// those that have been compacted.
+func (f *FDB) entries(keys []fdb.Key) ([]*entry, error) {
+	entries, err := f.db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+		futures := make([]fdb.FutureByteSlice, len(keys))
+		for i, key := range keys {
+			futures[i] = tr.Get(key)
+		}
+		entries := make([]*entry, 0, len(keys))
+		for i, future := range futures {
+			header, err := future.Get()
+			if err != nil {
+				return nil, err
+			}
+			if header == nil {
+				continue
+			}
+			e, err := f.decodeEntry(fdb.KeyValue{Key: keys[i], Value: header})
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		}
+		return entries, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries.([]*entry), nil
+}
+
+func (f *FDB) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	rev, events, err := f.List(ctx, prefix, "", 0, 0, false)
+	return rev, int64(len(events)), err
+}
+
+// Append writes an event at the commit version of its transaction. The latest
+// revision of the key must be the previous revision of the event, or the key
+// must not exist, otherwise server.ErrKeyExists is returned. Concurrent
+// appends to the same key conflict on the keys they read, and are retried by
+// FDB and then fail this check.
+func (f *FDB) Append(ctx context.Context, event *server.Event) (int64, error) {
+	e := *event
+	if e.KV == nil {
+		e.KV = &server.KeyValue{}
+	}
+	if e.PrevKV == nil {
+		e.PrevKV = &server.KeyValue{}
+	}
+
+	vs, err := f.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+		if err := tr.AddReadConflictKey(f.revKey); err != nil {
+			return nil, err
+		}
+		r, err := fdb.PrefixRange(f.kv.Pack(tuple.Tuple{e.KV.Key}))
+		if err != nil {
+			return nil, err
+		}
+		kvs, err := tr.GetRange(r, fdb.RangeOptions{Limit: 1, Reverse: true}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+		if len(kvs) > 0 {
+			latest, err := f.decodeEntry(kvs[0])
+			if err != nil {
+				return nil, err
+			}
+			if revisionOf(latest.vs) != e.PrevKV.ModRevision {
+				return nil, server.ErrKeyExists
+			}
+		} else if !e.Create {
+			return nil, server.ErrKeyExists
+		}
+
+		incomplete := tuple.IncompleteVersionstamp(0)
+		key, err := f.kv.PackWithVersionstamp(tuple.Tuple{e.KV.Key, incomplete})
+		if err != nil {
+			return nil, err
+		}
+		tr.SetVersionstampedKey(key, tuple.Tuple{e.Create, e.Delete, e.KV.CreateRevision, e.PrevKV.ModRevision, e.KV.Lease}.Pack())
+		for i := 0; i*chunkSize < len(e.KV.Value); i++ {
+			end := (i + 1) * chunkSize
+			if end > len(e.KV.Value) {
+				end = len(e.KV.Value)
+			}
+			key, err := f.val.PackWithVersionstamp(tuple.Tuple{e.KV.Key, incomplete, i})
+			if err != nil {
+				return nil, err
+			}
+			tr.SetVersionstampedKey(key, e.KV.Value[i*chunkSize:end])
+		}
+
+		key, err = f.log.PackWithVersionstamp(tuple.Tuple{incomplete})
+		if err != nil {
+			return nil, err
+		}
+		tr.SetVersionstampedKey(key, tuple.Tuple{e.KV.Key}.Pack())
+
+		rev, err := tuple.Tuple{incomplete}.PackWithVersionstamp(nil)
+		if err != nil {
+			return nil, err
+		}
+		tr.SetVersionstampedValue(f.revKey, rev)
+		return tr.GetVersionstamp(), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := vs.(fdb.FutureKey).Get()
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(key[:8])), nil
+}
+
+func (f *FDB) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	values, err := f.broadcaster.Subscribe(ctx, f.startWatch)
+	if err != nil {
+		return nil
+	}
+	res := make(chan []*server.Event, cap(values))
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			events, ok := filter(i, checkPrefix, prefix)
+			if ok {
+				res <- events
+			}
+		}
+	}()
+
+	return res
+}
+
+func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Event, bool) {
+	eventList := events.([]*server.Event)
+	filteredEventList := make([]*server.Event, 0, len(eventList))
+
+	for _, event := range eventList {
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+			filteredEventList = append(filteredEventList, event)
+		}
+	}
+
+	return filteredEventList, len(filteredEventList) > 0
+}
+
+func (f *FDB) startWatch() (chan interface{}, error) {
+	pollStart, err := f.CompactRevision(f.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan interface{})
+	f.compactor.Do(func() {
+		go f.compact()
+	})
+	go f.poll(ch, pollStart)
+	return ch, nil
+}
+
+// WatchRevision returns the last revision delivered to watchers, or zero if no
+// watch has been started.
+func (f *FDB) WatchRevision() int64 {
+	return atomic.LoadInt64(&f.polled)
+}
+
+// poll reads the log in order. When it has caught up, it waits on an FDB watch
+// of the current revision key, set in the same transaction that found nothing
+// new so that no append is missed.
+func (f *FDB) poll(result chan interface{}, pollStart int64) {
+	defer close(result)
+	last := pollStart
+	atomic.StoreInt64(&f.polled, last)
+
+	for {
+		w, err := f.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+			current, err := f.currentRevision(tr)
+			if err != nil || current > last {
+				return nil, err
+			}
+			return tr.Watch(f.revKey), nil
+		})
+		if err == nil && w != nil {
+			if !f.wait(w.(fdb.FutureNil)) {
+				return
+			}
+			continue
+		}
+
+		var (
+			current int64
+			events  []*server.Event
+		)
+		if err == nil {
+			if current, err = f.CurrentRevision(f.ctx); err == nil {
+				events, err = f.after(last, current, pollBatchSize, "")
+			}
+		}
+		if err != nil {
+			logrus.Errorf("Failed to read latest changes: %v", err)
+			select {
+			case <-f.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		if len(events) < pollBatchSize {
+			last = current
+		} else {
+			last = events[len(events)-1].KV.ModRevision
+		}
+		atomic.StoreInt64(&f.polled, last)
+		if len(events) > 0 {
+			result <- events
+		}
+	}
+}
+
+// wait waits for an FDB watch to fire, returning false if the context is done.
+func (f *FDB) wait(w fdb.FutureNil) bool {
+	done := make(chan struct{})
+	go func() {
+		w.Get()
+		close(done)
+	}()
+	select {
+	case <-f.ctx.Done():
+		w.Cancel()
+		return false
+	case <-done:
+		return true
+	}
+}
+
+// compact periodically advances the compact revision to keep the most recent
+// revisions, and clears the revisions up to it that have been superseded, and
+// deleted keys, along with their entries in the log.
+func (f *FDB) compact() {
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		target, err := f.compactTarget()
+		if err != nil {
+			logrus.Errorf("Compact failed to find target revision: %v", err)
+			continue
+		}
+		compact, err := f.CompactRevision(f.ctx)
+		if err != nil {
+			logrus.Errorf("Compact failed to get compact revision: %v", err)
+			continue
+		}
+		if target <= compact {
+			continue
+		}
+		if err := f.compactTo(target); err != nil {
+			logrus.Errorf("Compact failed: %v", err)
+			continue
+		}
+		logrus.Debugf("COMPACT compacted to %d", target)
+	}
+}
+
+// compactTarget returns the revision that keeps compactMinRetain revisions in
+// the log after it, or zero if there are not that many.
+func (f *FDB) compactTarget() (int64, error) {
+	kvs, err := f.db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+		return tr.GetRange(f.log, fdb.RangeOptions{Limit: compactMinRetain + 1, Reverse: true}).GetSliceWithError()
+	})
+	if err != nil || len(kvs.([]fdb.KeyValue)) <= compactMinRetain {
+		return 0, err
+	}
+	k, err := f.log.Unpack(kvs.([]fdb.KeyValue)[compactMinRetain].Key)
+	if err != nil {
+		return 0, err
+	}
+	return revisionOf(k[0].(tuple.Versionstamp)), nil
+}
+
+func (f *FDB) compactTo(target int64) error {
+	var param [8]byte
+	binary.LittleEndian.PutUint64(param[:], uint64(target))
+	if _, err := f.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+		tr.Max(f.compactKey, param[:])
+		return nil, nil
+	}); err != nil {
+		return err
+	}
+
+	r := f.logRange(0, target)
+	for {
+		done, err := f.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+			kvs, err := tr.GetRange(r, fdb.RangeOptions{Limit: compactBatchSize}).GetSliceWithError()
+			if err != nil {
+				return nil, err
+			}
+			for _, kv := range kvs {
+				k, err := f.log.Unpack(kv.Key)
+				if err != nil {
+					return nil, err
+				}
+				v, err := tuple.Unpack(kv.Value)
+				if err != nil {
+					return nil, err
+				}
+				name := v[0].(string)
+				key := f.kv.Pack(tuple.Tuple{name, k[0]})
+				header, err := tr.Get(key).Get()
+				if err != nil {
+					return nil, err
+				}
+				if header != nil {
+					e, err := f.decodeEntry(fdb.KeyValue{Key: key, Value: header})
+					if err != nil {
+						return nil, err
+					}
+					if e.prevRevision > 0 {
+						f.clearRevision(tr, name, e.prevRevision)
+					}
+					if e.deleted {
+						f.clearRevision(tr, name, revisionOf(e.vs))
+					}
+				}
+				tr.Clear(kv.Key)
+			}
+			return len(kvs) < compactBatchSize, nil
+		})
+		if err != nil {
+			return err
+		}
+		if done.(bool) {
+			return nil
+		}
+	}
+}
+
+func (f *FDB) clearRevision(tr fdb.Transaction, name string, rev int64) {
+	tr.ClearRange(revisionRange(f.kv, name, rev))
+	tr.ClearRange(revisionRange(f.val, name, rev))
+}
+
+// DbSize returns FDB's estimate of the size of the directory.
+func (f *FDB) DbSize(ctx context.Context) (int64, error) {
+	size, err := f.db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+		return tr.GetEstimatedRangeSizeBytes(f.dir).Get()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size.(int64), nil
+}
@@ -0,0 +1,123 @@
+package generic
+
+import (
+	"context"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/checksum"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// verifyBatchSize is the number of rows read by each query of VerifyChecksums.
+const verifyBatchSize = 1000
+
+// rows written before checksums were enabled, fill rows, and rows modified in
+// place have no checksum, and are not verified
+var verifyChecksumsSQL = `
+		SELECT kv.id, kv.name, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value, kv.checksum
+		FROM kine AS kv
+		WHERE
+			kv.id > ? AND
+			kv.checksum IS NOT NULL
+		ORDER BY kv.id ASC`
+
+// enableChecksums switches inserts to record the checksum of each row, and
+// reads to return it so that rows are verified when they are read.
+func (d *Generic) enableChecksums() {
+	d.Checksums = true
+	d.setInsertSQL()
+	d.SelectChecksums()
+}
+
+// SelectChecksums adds the checksum column after the value columns of the
+// statements that read rows in the standard column layout. Drivers that
+// replace those statements after ApplyConfig call it again.
+func (d *Generic) SelectChecksums() {
+	for _, sql := range []*string{
+		&d.GetRevisionSQL,
+		&d.GetCurrentSQL,
+		&d.ListRevisionStartSQL,
+		&d.GetRevisionAfterSQL,
+		&d.AfterSQL,
+		&d.ExpiredSQL,
+	} {
+		if *sql != "" && !strings.Contains(*sql, "kv.checksum") {
+			*sql = strings.Replace(*sql, "kv.old_value", "kv.old_value, kv.checksum", 1)
+		}
+	}
+}
+
+// rowChecksum returns the checksum of a row to be inserted, over its values as
+// stored. The compact_rev_key row has none, as compaction updates its previous
+// revision in place.
+func rowChecksum(key string, create, delete bool, createRevision, previousRevision, ttl int64, value, prevValue []byte) interface{} {
+	if key == "compact_rev_key" {
+		return nil
+	}
+	return checksum.Row{
+		Name:           key,
+		Created:        create,
+		Deleted:        delete,
+		CreateRevision: createRevision,
+		PrevRevision:   previousRevision,
+		Lease:          ttl,
+		Value:          value,
+		OldValue:       prevValue,
+	}.Sum()
+}
+
+// relinkSQL returns the statement that updates the previous revision of a row.
+// The checksum of the row is cleared, as it no longer matches.
+func (d *Generic) relinkSQL() string {
+	if d.Checksums {
+		return d.q(strings.Replace(updatePrevRevisionSQL, "SET prev_revision = ?", "SET prev_revision = ?, checksum = NULL", 1))
+	}
+	return d.q(updatePrevRevisionSQL)
+}
+
+// VerifyChecksums reads every row that has a checksum and verifies it, in
+// batches so that the scan does not hold a long-running query on the datastore.
+// Mismatches are logged and counted. It returns the number of rows checked and
+// the number that did not match.
+func (d *Generic) VerifyChecksums(ctx context.Context) (checked, mismatched int64, err error) {
+	var last int64
+	for {
+		n, err := d.verifyChecksumsAfter(ctx, &last, &checked, &mismatched)
+		if err != nil {
+			return checked, mismatched, err
+		}
+		if n < verifyBatchSize {
+			return checked, mismatched, nil
+		}
+	}
+}
+
+// verifyChecksumsAfter verifies a batch of rows after the last one verified,
+// and returns the number of rows read.
+func (d *Generic) verifyChecksumsAfter(ctx context.Context, last, checked, mismatched *int64) (int, error) {
+	rows, err := d.query(ctx, d.limit(d.q(verifyChecksumsSQL), verifyBatchSize), *last)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var (
+			row checksum.Row
+			sum int64
+		)
+		if err := rows.Scan(last, &row.Name, &row.Created, &row.Deleted, &row.CreateRevision, &row.PrevRevision, &row.Lease, &row.Value, &row.OldValue, &sum); err != nil {
+			return n, err
+		}
+		n++
+		*checked++
+		if err := row.Verify(sum); err != nil {
+			*mismatched++
+			metrics.ChecksumMismatchTotal.WithLabelValues(metrics.ChecksumSourceScan).Inc()
+			logrus.Warnf("Checksum scan: revision %d for key %s: %v", *last, row.Name, err)
+		}
+	}
+	return n, rows.Err()
+}
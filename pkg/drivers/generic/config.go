@@ -0,0 +1,283 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/compression"
+	"github.com/k3s-io/kine/pkg/encryption"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrDDLDisabled is returned by drivers built with the noddl tag when asked to
+// create the database or schema.
+var ErrDDLDisabled = errors.New(`this binary is built without schema management support, run with --datastore-no-ddl`)
+
+// ErrDryRun is returned in place of executing a statement that would modify the
+// datastore when running in dry-run mode.
+var ErrDryRun = errors.New("statement not executed in dry-run mode")
+
+// ErrReadOnly is returned in place of executing a statement that would modify
+// a datastore that is a read-only copy of another.
+var ErrReadOnly = errors.New("datastore is read-only")
+
+// DefaultKeyLength is the maximum length of keys if not configured.
+const DefaultKeyLength = 630
+
+// Config holds the settings for the SQL dialect that are shared by all SQL drivers.
+type Config struct {
+	// NoDDL prevents kine from creating the database, tables, or indexes, or
+	// migrating data from old tables, so that it can run with a credential that is
+	// only granted DML. The schema must be created beforehand, for example by
+	// running kine once with a privileged credential.
+	NoDDL bool
+	// DryRun logs statements that would modify the datastore instead of executing
+	// them, and fails the request. Reads are executed as normal. It implies NoDDL,
+	// but the schema migrations that would be applied are logged.
+	DryRun bool
+	// Explain logs the query plan of each statement before it is executed, or in
+	// place of executing it in dry-run mode.
+	Explain bool
+	// KeyLength is the maximum length in bytes of keys, used when creating the
+	// kine table. Zero means DefaultKeyLength. SQLite does not limit key length.
+	KeyLength int
+	// BinaryKeys stores keys as binary strings when creating the kine table, so
+	// that they may contain any bytes and are ordered and compared byte by byte,
+	// regardless of the collation of the database. SQLite always compares keys
+	// byte by byte.
+	BinaryKeys bool
+	// TTLColumn records when keys written with a lease expire in the
+	// expires_at column, so that expired keys are found by querying the
+	// datastore rather than tracked in memory by watching all keys.
+	TTLColumn bool
+	// Checksums records a checksum of each row in the checksum column when it
+	// is written, and verifies it when the row is read, to detect rows that
+	// were modified or corrupted outside of kine. Rows written before it was
+	// enabled are not verified.
+	Checksums bool
+	// Columnstore adds a nonclustered columnstore index on the columns of the
+	// kine table other than the values when creating it, to speed up the scans
+	// of compaction and of listing past revisions on large tables. Only SQL
+	// Server supports it.
+	Columnstore bool
+	// DriftCheckInterval is how often the columns and indexes of the kine table
+	// are compared to those expected, after the check at startup. Zero only
+	// checks at startup.
+	DriftCheckInterval time.Duration
+	// FixDrift creates missing indexes, without blocking writes where the
+	// database supports it.
+	FixDrift bool
+	// TableName is the name of the kine table, so that kine can share a
+	// database with other applications, or with other kine instances each
+	// storing a cluster in its own table. Empty means DefaultTableName.
+	TableName string
+	// SchemaName is the schema that holds the kine table, for datastores whose
+	// statements may name a schema, such as SQL Server. Empty means the default
+	// schema of the connection.
+	SchemaName string
+	// ClusterID identifies the cluster stored by this kine instance, for
+	// datastores shared by many clusters. Each cluster is stored in its own
+	// table, named after TableName and the identifier, so that keys,
+	// revisions and compaction are isolated per cluster. A column identifying
+	// the cluster in a shared table would not do, as revisions are the ids of
+	// the rows, and the ids of other clusters would be gaps to fill.
+	ClusterID string
+	// InitialRevision is the revision of a new datastore, so that clients
+	// migrated from another datastore never see revisions go backwards. It is
+	// ignored if the datastore already holds data.
+	InitialRevision int64
+	// RetryAttempts is the number of times a statement that fails with an
+	// error the driver reports as retryable is tried. Zero means
+	// DefaultRetryAttempts.
+	RetryAttempts uint
+	// RetryJitter shortens each wait between retries by a random fraction of
+	// it up to this, between zero and one.
+	RetryJitter float64
+	// SQLOverridesFile is a YAML or JSON file of statements that replace those
+	// of the dialect, by the name of the dialect field that holds them.
+	SQLOverridesFile string
+	// Compression compresses values and previous values when they are
+	// written, with zstd or snappy. Values are read whether or not they are
+	// compressed, so it can be enabled or disabled at any time.
+	Compression string
+	// EncryptionKeyFile is a file of key encryption keys that values are
+	// encrypted with, one per line, the first of which encrypts new values. If
+	// it is empty, keys are read from encryption.KeysEnv, and values are not
+	// encrypted if that is empty too.
+	EncryptionKeyFile string
+}
+
+// KeyColumnLength returns the maximum length in bytes of keys.
+func (c Config) KeyColumnLength() int {
+	if c.KeyLength <= 0 {
+		return DefaultKeyLength
+	}
+	return c.KeyLength
+}
+
+// SkipDDL returns true if the database and schema must not be created or migrated.
+func (c Config) SkipDDL() bool {
+	return c.NoDDL || c.DryRun
+}
+
+// ApplyConfig applies the settings that change how statements are executed.
+func (d *Generic) ApplyConfig(config Config) {
+	d.DryRun = config.DryRun
+	d.Explain = config.Explain
+	d.BinaryKeys = config.BinaryKeys
+	d.FixDrift = config.FixDrift && !config.SkipDDL()
+	d.InitialRevision = config.InitialRevision
+	d.RetryPolicy.MaxAttempts = config.RetryAttempts
+	d.RetryPolicy.Jitter = config.RetryJitter
+	// the compression is validated before the driver is opened
+	d.Compression, _ = compression.Parse(config.Compression)
+	// as are the encryption keys
+	d.Keyring, _ = encryption.Load(config.EncryptionKeyFile)
+	if d.Keyring != nil {
+		logrus.Infof("Encrypting values with key %s, %d keys available to decrypt", d.Keyring.Primary(), d.Keyring.Keys())
+	}
+	// the table is validated before the driver is opened
+	d.table, _ = config.Table()
+	if config.TTLColumn {
+		d.enableExpiry()
+	}
+	if config.Checksums {
+		d.enableChecksums()
+	}
+}
+
+// Table returns the kine table as configured, which is the default table if
+// the configuration has not been applied.
+func (d *Generic) Table() *Table {
+	if d.table == nil {
+		return &Table{Name: DefaultTableName}
+	}
+	return d.table
+}
+
+// keyArg returns a key as a statement argument, as bytes if keys are stored as
+// binary so that the driver does not send them as text.
+func (d *Generic) keyArg(key string) interface{} {
+	if d.BinaryKeys {
+		return []byte(key)
+	}
+	return key
+}
+
+// CheckSchema verifies that the kine table exists and can be read, for use in
+// place of schema setup when DDL is disabled.
+func (d *Generic) CheckSchema(ctx context.Context) error {
+	var id int64
+	checkSQL := "SELECT COUNT(*) FROM kine WHERE id = 0"
+	if d.TTLColumn {
+		checkSQL += " AND expires_at = 0"
+	}
+	if d.Checksums {
+		checkSQL += " AND checksum = 0"
+	}
+	if err := d.queryRow(ctx, checkSQL).Scan(&id); err != nil {
+		return fmt.Errorf("kine table is not readable, it must be created before running without DDL: %v", err)
+	}
+	return nil
+}
+
+// IsReadOnly returns true if the datastore is a read-only copy of another, so
+// that kine must not write to it.
+func (d *Generic) IsReadOnly() bool {
+	return d.ReadOnly
+}
+
+// checkWrite returns ErrReadOnly if the datastore is read-only, and otherwise
+// logs a statement that would modify the datastore and returns ErrDryRun if
+// running in dry-run mode.
+func (d *Generic) checkWrite(ctx context.Context, sql string, args ...interface{}) error {
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	if !d.DryRun {
+		return nil
+	}
+	logrus.Infof("DRY RUN %v : %s", args, util.Stripped(sql))
+	d.explain(ctx, sql, args...)
+	return ErrDryRun
+}
+
+// explain logs the query plan of a statement, if enabled and supported by the
+// dialect. The plan is requested outside of any transaction, and does not
+// execute the statement.
+func (d *Generic) explain(ctx context.Context, query string, args ...interface{}) {
+	if !d.Explain || d.ExplainSQL == "" {
+		return
+	}
+	plan, err := d.queryPlan(ctx, query, args...)
+	if err != nil {
+		logrus.Errorf("Failed to explain %s: %v", util.Stripped(query), err)
+		return
+	}
+	logrus.Infof("EXPLAIN %v : %s\n%s", args, util.Stripped(query), strings.Join(plan, "\n"))
+}
+
+// queryPlan returns the query plan of a statement, one line per row with the
+// columns separated by " | ".
+func (d *Generic) queryPlan(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := d.DB.QueryContext(ctx, d.ExplainSQL+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var plan []string
+	for rows.Next() {
+		values := make([]sql.RawBytes, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		fields := make([]string, len(values))
+		for i, v := range values {
+			fields[i] = string(v)
+		}
+		plan = append(plan, strings.Join(fields, " | "))
+	}
+	return plan, rows.Err()
+}
+
+// Seed starts an empty datastore at the initial revision, by writing the
+// compact revision key at that revision and marking all earlier revisions as
+// compacted. It does nothing if no initial revision is configured.
+func (d *Generic) Seed(ctx context.Context) (bool, error) {
+	if d.InitialRevision <= 0 {
+		return false, nil
+	}
+	rev, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return false, err
+	}
+	if rev > 0 {
+		logrus.Warnf("Ignoring initial revision %d, as the datastore is already at revision %d", d.InitialRevision, rev)
+		return false, nil
+	}
+	if _, err := d.execute(ctx, d.FillSQL, d.InitialRevision, d.keyArg("compact_rev_key"), 1, 0, 0, d.InitialRevision, 0, []byte(""), nil); err != nil {
+		return false, err
+	}
+	// advance sequences that are not moved by inserting an explicit id
+	if d.PromoteSQL != "" {
+		if _, err := d.execute(ctx, d.PromoteSQL); err != nil {
+			return false, err
+		}
+	}
+	logrus.Infof("Started datastore at revision %d", d.InitialRevision)
+	return true, nil
+}
@@ -0,0 +1,109 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DSNFunc returns the data source name to use for a new connection. It is called
+// each time the pool opens a connection, which allows credentials to be rotated
+// without restarting kine.
+type DSNFunc func(ctx context.Context) (string, error)
+
+// dsnConnector is a database/sql connector that resolves the data source name
+// for every connection, instead of once when the pool is created.
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    DSNFunc
+}
+
+func (c *dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	dataSourceName, err := c.dsn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dc, ok := c.driver.(driver.DriverContext); ok {
+		connector, err := dc.OpenConnector(dataSourceName)
+		if err != nil {
+			return nil, err
+		}
+		return connector.Connect(ctx)
+	}
+	return c.driver.Open(dataSourceName)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// OpenWithDSNFunc is like Open, but resolves the data source name for each new
+// connection by calling the provided function.
+func OpenWithDSNFunc(ctx context.Context, driverName string, dsn DSNFunc, connPoolConfig ConnectionPoolConfig, paramCharacter string, numbered bool, metricsRegisterer prometheus.Registerer) (*Generic, error) {
+	drv, err := lookupDriver(driverName)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenWithConnector(ctx, driverName, &dsnConnector{driver: drv, dsn: dsn}, connPoolConfig, paramCharacter, numbered, metricsRegisterer)
+}
+
+// OpenWithConnector is like Open, but opens connections with the provided
+// connector, for drivers that are configured with more than a data source name.
+// The driver name is only used to label metrics.
+func OpenWithConnector(ctx context.Context, driverName string, connector driver.Connector, connPoolConfig ConnectionPoolConfig, paramCharacter string, numbered bool, metricsRegisterer prometheus.Registerer) (*Generic, error) {
+	connector = connPoolConfig.wrapConnector(connector)
+	openDB := func() (*sql.DB, error) {
+		return sql.OpenDB(connector), nil
+	}
+	return open(ctx, driverName, openDB, connPoolConfig, paramCharacter, numbered, metricsRegisterer)
+}
+
+// OpenReadPoolWithConnector replaces the pool for reads outside of transactions
+// with one that opens connections with the provided connector, for datastores
+// that can serve reads from other servers than the one that takes writes.
+func (d *Generic) OpenReadPoolWithConnector(driverName string, connector driver.Connector, connPoolConfig ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) error {
+	connector = connPoolConfig.wrapConnector(connector)
+	openDB := func() (*sql.DB, error) {
+		return sql.OpenDB(connector), nil
+	}
+	readDB, err := openReadPool(openDB, "read", driverName, connPoolConfig, metricsRegisterer)
+	if err != nil {
+		return err
+	}
+	if d.ReadDB != nil && d.ReadDB != d.DB {
+		d.ReadDB.Close()
+	}
+	d.ReadDB = readDB
+	return nil
+}
+
+// OpenReplicaPool opens the pool on a replica with a data source name, with the
+// read pool settings.
+func (d *Generic) OpenReplicaPool(driverName, dataSourceName string, connPoolConfig ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) error {
+	connector, err := constantConnector(driverName, dataSourceName)
+	if err != nil {
+		return err
+	}
+	return d.OpenReplicaPoolWithConnector(driverName, connector, connPoolConfig, metricsRegisterer)
+}
+
+// OpenReplicaPoolWithConnector opens the pool on a replica with the provided
+// connector, with the read pool settings.
+func (d *Generic) OpenReplicaPoolWithConnector(driverName string, connector driver.Connector, connPoolConfig ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) error {
+	connector = connPoolConfig.wrapConnector(connector)
+	openDB := func() (*sql.DB, error) {
+		return sql.OpenDB(connector), nil
+	}
+	replicaDB, err := openReadPool(openDB, "replica", driverName, connPoolConfig, metricsRegisterer)
+	if err != nil {
+		return err
+	}
+	if d.ReplicaDB != nil {
+		d.ReplicaDB.Close()
+	}
+	d.ReplicaDB = replicaDB
+	return nil
+}
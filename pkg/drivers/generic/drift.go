@@ -0,0 +1,214 @@
+package generic
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Index is an index expected on the kine table.
+type Index struct {
+	Name    string
+	Columns string
+	Unique  bool
+}
+
+var (
+	columnNames = []string{"id", "name", "created", "deleted", "create_revision", "prev_revision", "lease", "value", "old_value"}
+
+	indexes = []Index{
+		{Name: "kine_name_index", Columns: "name"},
+		{Name: "kine_name_id_index", Columns: "name,id"},
+		{Name: "kine_id_deleted_index", Columns: "id,deleted"},
+		{Name: "kine_prev_revision_index", Columns: "prev_revision"},
+		{Name: "kine_name_prev_revision_uindex", Columns: "name, prev_revision", Unique: true},
+	}
+
+	expiryIndex = Index{Name: "kine_expires_at_index", Columns: "expires_at"}
+)
+
+// Drift is the difference between the schema of the kine table and the schema
+// expected by the driver.
+type Drift struct {
+	MissingColumns []string
+	MissingIndexes []Index
+	// NotUniqueIndexes are indexes that exist, but do not enforce uniqueness.
+	NotUniqueIndexes []Index
+}
+
+// Empty returns true if the schema is as expected.
+func (d *Drift) Empty() bool {
+	return len(d.MissingColumns) == 0 && len(d.MissingIndexes) == 0 && len(d.NotUniqueIndexes) == 0
+}
+
+func (d *Generic) expectedColumns() []string {
+	columns := columnNames[:len(columnNames):len(columnNames)]
+	if d.TTLColumn {
+		columns = append(columns, "expires_at")
+	}
+	if d.Checksums {
+		columns = append(columns, "checksum")
+	}
+	return columns
+}
+
+func (d *Generic) expectedIndexes() []Index {
+	if d.TTLColumn {
+		return append(indexes[:len(indexes):len(indexes)], expiryIndex)
+	}
+	return indexes
+}
+
+// CheckDrift compares the columns and indexes of the kine table to those the
+// driver expects. It returns nil if the dialect cannot list them.
+func (d *Generic) CheckDrift(ctx context.Context) (*Drift, error) {
+	if d.ColumnsSQL == "" || d.IndexesSQL == "" {
+		return nil, nil
+	}
+
+	columns := map[string]bool{}
+	rows, err := d.query(ctx, d.ColumnsSQL)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		columns[strings.ToLower(name)] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	unique := map[string]bool{}
+	rows, err = d.query(ctx, d.IndexesSQL)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			name     string
+			isUnique bool
+		)
+		if err := rows.Scan(&name, &isUnique); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		unique[strings.ToLower(name)] = isUnique
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	drift := &Drift{}
+	for _, column := range d.expectedColumns() {
+		if !columns[column] {
+			drift.MissingColumns = append(drift.MissingColumns, column)
+		}
+	}
+	for _, index := range d.expectedIndexes() {
+		isUnique, ok := unique[d.table.IndexName(index.Name)]
+		switch {
+		case !ok:
+			drift.MissingIndexes = append(drift.MissingIndexes, index)
+		case index.Unique && !isUnique:
+			drift.NotUniqueIndexes = append(drift.NotUniqueIndexes, index)
+		}
+	}
+	return drift, nil
+}
+
+// MonitorDrift checks the schema for drift at startup and then every interval,
+// until the context is cancelled. Drift is logged and reported in the
+// kine_schema_drift metric and, if enabled, missing indexes are created.
+func (d *Generic) MonitorDrift(ctx context.Context, interval time.Duration) {
+	for {
+		d.checkDrift(ctx)
+		if interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (d *Generic) checkDrift(ctx context.Context) {
+	drift, err := d.CheckDrift(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			logrus.Errorf("Failed to check schema for drift: %v", err)
+		}
+		return
+	}
+	if drift == nil {
+		return
+	}
+
+	metrics.SchemaDrift.Reset()
+	for _, column := range drift.MissingColumns {
+		metrics.SchemaDrift.WithLabelValues("missing_column", column).Set(1)
+		logrus.Errorf("Schema drift: the kine table is missing the %s column", column)
+	}
+	for _, index := range drift.NotUniqueIndexes {
+		name := d.table.IndexName(index.Name)
+		metrics.SchemaDrift.WithLabelValues("not_unique_index", name).Set(1)
+		logrus.Errorf("Schema drift: index %s on the kine table is not unique; it must be dropped and recreated", name)
+	}
+	for _, index := range drift.MissingIndexes {
+		name := d.table.IndexName(index.Name)
+		if d.FixDrift {
+			err := d.createIndex(ctx, index)
+			if err == nil {
+				continue
+			}
+			logrus.Errorf("Failed to create missing index %s: %v", name, err)
+		}
+		metrics.SchemaDrift.WithLabelValues("missing_index", name).Set(1)
+		logrus.Errorf("Schema drift: the kine table is missing index %s", name)
+	}
+}
+
+// createIndex creates a missing index, without blocking writes where the
+// dialect supports it. Creating a unique index fails if the table holds
+// duplicate rows, which the repair command removes.
+func (d *Generic) createIndex(ctx context.Context, index Index) error {
+	if d.CreateIndexSQL == "" {
+		return fmt.Errorf("creating indexes is not supported by this dialect")
+	}
+	unique := ""
+	if index.Unique {
+		unique = "UNIQUE "
+	}
+
+	var stmts []string
+	if d.DropIndexSQL != "" {
+		// remove any invalid index left behind by a failed online build
+		stmts = append(stmts, fmt.Sprintf(d.DropIndexSQL, index.Name))
+	}
+	stmts = append(stmts, fmt.Sprintf(d.CreateIndexSQL, unique, index.Name, index.Columns))
+
+	name := d.table.IndexName(index.Name)
+	logrus.Infof("Creating missing index %s, this may take a moment...", name)
+	for _, stmt := range stmts {
+		stmt = d.table.SQL(stmt)
+		logrus.Tracef("DRIFT EXEC : %v", util.Stripped(stmt))
+		if _, err := d.DB.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Created missing index %s", name)
+	return nil
+}
@@ -0,0 +1,75 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+var (
+	expiredSQL = fmt.Sprintf(`
+		SELECT (%s), (%s), %s
+		FROM kine AS kv
+		WHERE
+			kv.expires_at > 0 AND
+			kv.expires_at <= ? AND
+			kv.deleted = 0 AND
+			kv.id = (
+				SELECT MAX(mkv.id) AS id
+				FROM kine AS mkv
+				WHERE mkv.name = kv.name)
+		ORDER BY kv.expires_at ASC`, revSQL, compactRevSQL, columns)
+
+	// keys written before the column was added expire a full lease after
+	// it is backfilled, as the time they were written is not known
+	backfillExpirySQL = `
+		UPDATE kine
+		SET expires_at = ? + lease
+		WHERE
+			lease > 0 AND
+			deleted = 0 AND
+			expires_at IS NULL`
+)
+
+// enableExpiry switches inserts to record the expiry time of keys with a lease.
+func (d *Generic) enableExpiry() {
+	d.TTLColumn = true
+	d.setInsertSQL()
+	d.ExpiredSQL = q(expiredSQL, d.paramCharacter, d.numbered)
+	d.BackfillExpirySQL = q(backfillExpirySQL, d.paramCharacter, d.numbered)
+}
+
+// expiresAt returns the time at which a key written with a lease expires, or
+// zero if it does not.
+func expiresAt(delete bool, ttl int64) int64 {
+	if ttl > 0 && !delete {
+		return time.Now().Unix() + ttl
+	}
+	return 0
+}
+
+// TracksExpiry returns true if the expiry time of keys is recorded.
+func (d *Generic) TracksExpiry() bool {
+	return d.TTLColumn
+}
+
+// Expired returns the current rows of keys that expired at or before now, in the
+// order they expired.
+func (d *Generic) Expired(ctx context.Context, now time.Time, limit int64) (*sql.Rows, error) {
+	sql := d.ExpiredSQL
+	if limit > 0 {
+		sql = d.limit(sql, limit)
+	}
+	return d.query(ctx, sql, now.Unix())
+}
+
+// BackfillExpiry records an expiry time for keys with a lease that were written
+// before the expiry time was recorded.
+func (d *Generic) BackfillExpiry(ctx context.Context, now time.Time) (int64, error) {
+	res, err := d.execute(ctx, d.BackfillExpirySQL, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
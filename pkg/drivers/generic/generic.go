@@ -11,13 +11,11 @@ import (
 	"sync"
 	"time"
 
-	"github.com/Rican7/retry/backoff"
-	"github.com/Rican7/retry/strategy"
-	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/compression"
+	"github.com/k3s-io/kine/pkg/encryption"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -39,6 +37,8 @@ var (
 		FROM kine AS crkv
 		WHERE crkv.name = 'compact_rev_key'`
 
+	insertColumns = []string{"name", "created", "deleted", "create_revision", "prev_revision", "lease", "value", "old_value"}
+
 	idOfKey = `
 		AND
 		mkv.id <= ? AND
@@ -78,6 +78,35 @@ type ConnectionPoolConfig struct {
 	MaxIdle     int           // zero means defaultMaxIdleConns; negative means 0
 	MaxOpen     int           // <= 0 means unlimited
 	MaxLifetime time.Duration // maximum amount of time a connection may be reused
+	MaxIdleTime time.Duration // maximum amount of time a connection may be idle; <= 0 means unlimited
+	// MaxLifetimeJitter shortens the lifetime of each connection by a random
+	// amount up to this, so that connections opened together are not all
+	// replaced at once.
+	MaxLifetimeJitter time.Duration
+	// CheckOnCheckout pings connections before they are reused, replacing those
+	// that fail.
+	CheckOnCheckout bool
+	// ReadPool uses a separate pool for reads outside of transactions, so that
+	// slow reads cannot take every connection needed for writes.
+	ReadPool    bool
+	ReadMaxIdle int // as MaxIdle, for the read pool
+	ReadMaxOpen int // as MaxOpen, for the read pool
+	// ReaderDSN is the data source name of a reader, such as a read replica,
+	// for drivers that support one. Serializable reads, counts and polls for
+	// changes are served by the reader, with the read pool settings.
+	ReaderDSN string
+	// PreparedStatements prepares statements on each connection the first time
+	// they are run on it, so that they are not parsed and planned on every
+	// call.
+	PreparedStatements bool
+	// ResumeTimeout is how long new connections wait for a datastore that is
+	// resuming from a pause, such as a serverless database, if the driver sets
+	// Resuming.
+	ResumeTimeout time.Duration
+	// Resuming returns true for connection errors returned while the datastore
+	// resumes, which are retried until ResumeTimeout. Other errors are fatal at
+	// startup rather than retried. It is set by drivers.
+	Resuming func(error) bool
 }
 
 type Generic struct {
@@ -86,6 +115,7 @@ type Generic struct {
 	LockWrites            bool
 	LastInsertID          bool
 	DB                    *sql.DB
+	ReadDB                *sql.DB
 	GetCurrentSQL         string
 	GetRevisionSQL        string
 	RevisionSQL           string
@@ -97,13 +127,51 @@ type Generic struct {
 	CompactSQL            string
 	UpdateCompactSQL      string
 	PostCompactSQL        string
+	CompactBatchSize      int64
 	InsertSQL             string
 	FillSQL               string
 	InsertLastInsertIDSQL string
 	GetSizeSQL            string
-	Retry                 ErrRetry
-	TranslateErr          TranslateErr
-	ErrCode               ErrCode
+	PromoteSQL            string
+	ExplainSQL            string
+	DryRun                bool
+	Explain               bool
+	BinaryKeys            bool
+	TTLColumn             bool
+	Checksums             bool
+	Compression           compression.Algorithm
+	Keyring               *encryption.Keyring
+	ExpiredSQL            string
+	BackfillExpirySQL     string
+	ColumnsSQL            string
+	IndexesSQL            string
+	CreateIndexSQL        string
+	DropIndexSQL          string
+	FixDrift              bool
+	InitialRevision       int64
+	// LimitSQL is the format that limits the rows returned by a query, given
+	// the query and the limit. The queries it is applied to are ordered.
+	LimitSQL string
+	// ReplicaDB is a pool on a replica that lags behind the datastore, such as
+	// a readable secondary. Lists at a past revision are served by it once it
+	// has caught up to that revision, and serializable lists are served by it.
+	// Counts and polls for changes are served by it unless it fails.
+	ReplicaDB *sql.DB
+	// ReadOnly rejects statements that would modify the datastore, for
+	// datastores that are replicated copies of another.
+	ReadOnly bool
+	// FullScan returns true if a line of a query plan scans the whole table.
+	FullScan func(planLine string) bool
+	// RetryPolicy decides which statements run outside of transactions are
+	// retried when they fail. Drivers set the errors that are retryable.
+	RetryPolicy  RetryPolicy
+	TranslateErr TranslateErr
+	ErrCode      ErrCode
+
+	paramCharacter string
+	numbered       bool
+	table          *Table
+	stmts          *stmtCache
 }
 
 func q(sql, param string, numbered bool) string {
@@ -122,6 +190,11 @@ func q(sql, param string, numbered bool) string {
 	})
 }
 
+// q rewrites the placeholders in a statement to suit the driver's parameter style.
+func (d *Generic) q(sql string) string {
+	return q(sql, d.paramCharacter, d.numbered)
+}
+
 func (d *Generic) Migrate(ctx context.Context) {
 	var (
 		count     = 0
@@ -156,14 +229,15 @@ func configureConnectionPooling(connPoolConfig ConnectionPoolConfig, db *sql.DB,
 		connPoolConfig.MaxIdle = defaultMaxIdleConns
 	}
 
-	logrus.Infof("Configuring %s database connection pooling: maxIdleConns=%d, maxOpenConns=%d, connMaxLifetime=%s", driverName, connPoolConfig.MaxIdle, connPoolConfig.MaxOpen, connPoolConfig.MaxLifetime)
+	logrus.Infof("Configuring %s database connection pooling: maxIdleConns=%d, maxOpenConns=%d, connMaxLifetime=%s, connMaxIdleTime=%s", driverName, connPoolConfig.MaxIdle, connPoolConfig.MaxOpen, connPoolConfig.MaxLifetime, connPoolConfig.MaxIdleTime)
 	db.SetMaxIdleConns(connPoolConfig.MaxIdle)
 	db.SetMaxOpenConns(connPoolConfig.MaxOpen)
 	db.SetConnMaxLifetime(connPoolConfig.MaxLifetime)
+	db.SetConnMaxIdleTime(connPoolConfig.MaxIdleTime)
 }
 
-func openAndTest(driverName, dataSourceName string) (*sql.DB, error) {
-	db, err := sql.Open(driverName, dataSourceName)
+func openAndTest(openDB func() (*sql.DB, error)) (*sql.DB, error) {
+	db, err := openDB()
 	if err != nil {
 		return nil, err
 	}
@@ -179,16 +253,35 @@ func openAndTest(driverName, dataSourceName string) (*sql.DB, error) {
 }
 
 func Open(ctx context.Context, driverName, dataSourceName string, connPoolConfig ConnectionPoolConfig, paramCharacter string, numbered bool, metricsRegisterer prometheus.Registerer) (*Generic, error) {
+	openDB := func() (*sql.DB, error) {
+		return sql.Open(driverName, dataSourceName)
+	}
+	if connPoolConfig.wrapsConnector() {
+		connector, err := constantConnector(driverName, dataSourceName)
+		if err != nil {
+			return nil, err
+		}
+		openDB = func() (*sql.DB, error) {
+			return sql.OpenDB(connPoolConfig.wrapConnector(connector)), nil
+		}
+	}
+	return open(ctx, driverName, openDB, connPoolConfig, paramCharacter, numbered, metricsRegisterer)
+}
+
+func open(ctx context.Context, driverName string, openDB func() (*sql.DB, error), connPoolConfig ConnectionPoolConfig, paramCharacter string, numbered bool, metricsRegisterer prometheus.Registerer) (*Generic, error) {
 	var (
 		db  *sql.DB
 		err error
 	)
 
 	for i := 0; i < 300; i++ {
-		db, err = openAndTest(driverName, dataSourceName)
+		db, err = openAndTest(openDB)
 		if err == nil {
 			break
 		}
+		if connPoolConfig.Resuming != nil && !connPoolConfig.Resuming(err) {
+			return nil, err
+		}
 
 		logrus.Errorf("failed to ping connection: %v", err)
 		select {
@@ -197,15 +290,36 @@ func Open(ctx context.Context, driverName, dataSourceName string, connPoolConfig
 		case <-time.After(time.Second):
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	configureConnectionPooling(connPoolConfig, db, driverName)
+	if err := registerDBStats(metricsRegisterer, db, "kine", driverName); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	if metricsRegisterer != nil {
-		metricsRegisterer.MustRegister(collectors.NewDBStatsCollector(db, "kine"))
+	readDB := db
+	if connPoolConfig.ReadPool {
+		if readDB, err = openReadPool(openDB, "read", driverName, connPoolConfig, metricsRegisterer); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	var stmts *stmtCache
+	if connPoolConfig.PreparedStatements {
+		stmts = newStmtCache()
 	}
 
 	return &Generic{
-		DB: db,
+		DB:     db,
+		ReadDB: readDB,
+
+		paramCharacter: paramCharacter,
+		numbered:       numbered,
+		stmts:          stmts,
 
 		GetRevisionSQL: q(fmt.Sprintf(`
 			SELECT
@@ -248,44 +362,100 @@ func Open(ctx context.Context, driverName, dataSourceName string, connPoolConfig
 
 		FillSQL: q(`INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
 			values(?, ?, ?, ?, ?, ?, ?, ?, ?)`, paramCharacter, numbered),
+
+		ExplainSQL: "EXPLAIN ",
+		LimitSQL:   "%s LIMIT %d",
 	}, err
 }
 
 func (d *Generic) query(ctx context.Context, sql string, args ...interface{}) (result *sql.Rows, err error) {
+	return d.queryOn(ctx, d.readDB(), sql, args...)
+}
+
+func (d *Generic) queryOn(ctx context.Context, db *sql.DB, sql string, args ...interface{}) (result *sql.Rows, err error) {
+	sql = d.table.SQL(sql)
 	logrus.Tracef("QUERY %v : %s", args, util.Stripped(sql))
+	d.explain(ctx, sql, args...)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args)
+		observeSQL(startTime, d.ErrCode(err), sql, args, -1)
 	}()
-	return d.DB.QueryContext(ctx, sql, args...)
+	return d.queryContext(ctx, db, sql, args...)
 }
 
 func (d *Generic) queryRow(ctx context.Context, sql string, args ...interface{}) (result *sql.Row) {
+	return d.queryRowOn(ctx, d.readDB(), sql, args...)
+}
+
+// insertRow runs a statement that writes and returns a row on the write pool.
+func (d *Generic) insertRow(ctx context.Context, sql string, args ...interface{}) (result *sql.Row) {
+	return d.queryRowOn(ctx, d.DB, sql, args...)
+}
+
+func (d *Generic) queryRowOn(ctx context.Context, db *sql.DB, sql string, args ...interface{}) (result *sql.Row) {
+	sql = d.table.SQL(sql)
 	logrus.Tracef("QUERY ROW %v : %s", args, util.Stripped(sql))
+	d.explain(ctx, sql, args...)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, d.ErrCode(result.Err()), util.Stripped(sql), args)
+		observeSQL(startTime, d.ErrCode(result.Err()), sql, args, -1)
 	}()
-	return d.DB.QueryRowContext(ctx, sql, args...)
+	return d.queryRowContext(ctx, db, sql, args...)
+}
+
+// readDB returns the pool for reads outside of transactions.
+func (d *Generic) readDB() *sql.DB {
+	if d.ReadDB != nil {
+		return d.ReadDB
+	}
+	return d.DB
+}
+
+// serializableDB returns the replica pool for reads that may be served from
+// stale state, and the pool for reads otherwise.
+func (d *Generic) serializableDB(ctx context.Context) *sql.DB {
+	if d.ReplicaDB != nil && server.IsSerializable(ctx) {
+		return d.ReplicaDB
+	}
+	return d.readDB()
+}
+
+// replicaDBAt returns the replica pool if the replica has caught up to a
+// revision, and the pool for reads otherwise.
+func (d *Generic) replicaDBAt(ctx context.Context, revision int64) *sql.DB {
+	if d.ReplicaDB == nil {
+		return d.readDB()
+	}
+	var id int64
+	if err := d.queryRowOn(ctx, d.ReplicaDB, revSQL).Scan(&id); err != nil {
+		logrus.Debugf("Failed to get replica revision, reading from primary: %v", err)
+		return d.readDB()
+	}
+	if id < revision {
+		return d.readDB()
+	}
+	return d.ReplicaDB
 }
 
 func (d *Generic) execute(ctx context.Context, sql string, args ...interface{}) (result sql.Result, err error) {
+	sql = d.table.SQL(sql)
+	if err := d.checkWrite(ctx, sql, args...); err != nil {
+		return nil, err
+	}
+
 	if d.LockWrites {
 		d.Lock()
 		defer d.Unlock()
 	}
 
-	wait := strategy.Backoff(backoff.Linear(100 + time.Millisecond))
-	for i := uint(0); i < 20; i++ {
+	for i := uint(0); i < d.RetryPolicy.attempts(); i++ {
 		logrus.Tracef("EXEC (try: %d) %v : %s", i, args, util.Stripped(sql))
 		startTime := time.Now()
-		result, err = d.DB.ExecContext(ctx, sql, args...)
-		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args)
-		if err != nil && d.Retry != nil && d.Retry(err) {
-			wait(i)
-			continue
+		result, err = d.execContext(ctx, d.DB, sql, args...)
+		observeSQL(startTime, d.ErrCode(err), sql, args, rowsAffected(result, err))
+		if !d.RetryPolicy.retryable(err) || d.RetryPolicy.wait(ctx, i) != nil {
+			return result, err
 		}
-		return result, err
 	}
 	return
 }
@@ -315,6 +485,12 @@ func (d *Generic) Compact(ctx context.Context, revision int64) (int64, error) {
 	return res.RowsAffected()
 }
 
+// GetCompactBatchSize returns the number of revisions to compact in each
+// transaction, or zero for the default.
+func (d *Generic) GetCompactBatchSize() int64 {
+	return d.CompactBatchSize
+}
+
 func (d *Generic) PostCompact(ctx context.Context) error {
 	logrus.Trace("POSTCOMPACT")
 	if d.PostCompactSQL != "" {
@@ -334,37 +510,55 @@ func (d *Generic) DeleteRevision(ctx context.Context, revision int64) error {
 	return err
 }
 
+// limit returns a query that returns at most limit rows.
+func (d *Generic) limit(sql string, limit int64) string {
+	return fmt.Sprintf(d.LimitSQL, sql, limit)
+}
+
 func (d *Generic) ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted bool) (*sql.Rows, error) {
 	sql := d.GetCurrentSQL
 	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+		sql = d.limit(sql, limit)
 	}
-	return d.query(ctx, sql, prefix, includeDeleted)
+	return d.queryOn(ctx, d.serializableDB(ctx), sql, d.keyArg(prefix), includeDeleted)
 }
 
 func (d *Generic) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (*sql.Rows, error) {
 	if startKey == "" {
 		sql := d.ListRevisionStartSQL
 		if limit > 0 {
-			sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+			sql = d.limit(sql, limit)
 		}
-		return d.query(ctx, sql, prefix, revision, includeDeleted)
+		return d.queryOn(ctx, d.replicaDBAt(ctx, revision), sql, d.keyArg(prefix), revision, includeDeleted)
 	}
 
 	sql := d.GetRevisionAfterSQL
 	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+		sql = d.limit(sql, limit)
 	}
-	return d.query(ctx, sql, prefix, revision, startKey, revision, includeDeleted)
+	return d.queryOn(ctx, d.replicaDBAt(ctx, revision), sql, d.keyArg(prefix), revision, d.keyArg(startKey), revision, includeDeleted)
 }
 
 func (d *Generic) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	// counts are served by the replica, which only delays them, unless it
+	// fails
+	if d.ReplicaDB != nil {
+		rev, count, err := d.countOn(ctx, d.ReplicaDB, prefix)
+		if err == nil {
+			return rev, count, nil
+		}
+		logrus.Debugf("Failed to count on replica, counting on primary: %v", err)
+	}
+	return d.countOn(ctx, d.readDB(), prefix)
+}
+
+func (d *Generic) countOn(ctx context.Context, db *sql.DB, prefix string) (int64, int64, error) {
 	var (
 		rev sql.NullInt64
 		id  int64
 	)
 
-	row := d.queryRow(ctx, d.CountSQL, prefix, false)
+	row := d.queryRowOn(ctx, db, d.CountSQL, d.keyArg(prefix), false)
 	err := row.Scan(&rev, &id)
 	return rev.Int64, id, err
 }
@@ -382,13 +576,22 @@ func (d *Generic) CurrentRevision(ctx context.Context) (int64, error) {
 func (d *Generic) After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error) {
 	sql := d.AfterSQL
 	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+		sql = d.limit(sql, limit)
+	}
+	// changes after a revision are polled from the replica, which only delays
+	// them, unless it fails
+	if d.ReplicaDB != nil && rev > 0 {
+		rows, err := d.queryOn(ctx, d.ReplicaDB, sql, d.keyArg(prefix), rev)
+		if err == nil {
+			return rows, nil
+		}
+		logrus.Debugf("Failed to poll replica, reading from primary: %v", err)
 	}
-	return d.query(ctx, sql, prefix, rev)
+	return d.query(ctx, sql, d.keyArg(prefix), rev)
 }
 
 func (d *Generic) Fill(ctx context.Context, revision int64) error {
-	_, err := d.execute(ctx, d.FillSQL, revision, fmt.Sprintf("gap-%d", revision), 0, 1, 0, 0, 0, nil, nil)
+	_, err := d.execute(ctx, d.FillSQL, revision, d.keyArg(fmt.Sprintf("gap-%d", revision)), 0, 1, 0, 0, 0, nil, nil)
 	return err
 }
 
@@ -405,6 +608,24 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 		}()
 	}
 
+	args, err := d.insertArgs(key, create, delete, createRevision, previousRevision, ttl, value, prevValue)
+	if err != nil {
+		return 0, err
+	}
+	if d.LastInsertID {
+		row, err := d.execute(ctx, d.InsertLastInsertIDSQL, args...)
+		if err != nil {
+			return 0, err
+		}
+		return row.LastInsertId()
+	}
+
+	return d.insertReturning(ctx, d.InsertSQL, args...)
+}
+
+// insertArgs returns the arguments of the statement that inserts a row, with
+// the values encoded and the expiry time of the key if it is recorded.
+func (d *Generic) insertArgs(key string, create, delete bool, createRevision, previousRevision, ttl int64, value, prevValue []byte) ([]interface{}, error) {
 	cVal := 0
 	dVal := 0
 	if create {
@@ -413,18 +634,89 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 	if delete {
 		dVal = 1
 	}
+	value, err := d.encodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	prevValue, err = d.encodeValue(prevValue)
+	if err != nil {
+		return nil, err
+	}
+	args := []interface{}{d.keyArg(key), cVal, dVal, createRevision, previousRevision, ttl, value, prevValue}
+	if d.TTLColumn {
+		args = append(args, expiresAt(delete, ttl))
+	}
+	if d.Checksums {
+		args = append(args, rowChecksum(key, create, delete, createRevision, previousRevision, ttl, value, prevValue))
+	}
+	return args, nil
+}
 
-	if d.LastInsertID {
-		row, err := d.execute(ctx, d.InsertLastInsertIDSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
-		if err != nil {
-			return 0, err
+// InsertColumns returns the columns set by the statements that insert a row,
+// in the order of the arguments returned by insertArgs.
+func (d *Generic) InsertColumns() []string {
+	columns := insertColumns[:len(insertColumns):len(insertColumns)]
+	if d.TTLColumn {
+		columns = append(columns, "expires_at")
+	}
+	if d.Checksums {
+		columns = append(columns, "checksum")
+	}
+	return columns
+}
+
+// setInsertSQL builds the statements that insert a row from the columns that
+// are recorded.
+func (d *Generic) setInsertSQL() {
+	columns := d.InsertColumns()
+	names := strings.Join(columns, ", ")
+	params := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	d.InsertLastInsertIDSQL = d.q(`INSERT INTO kine(` + names + `)
+			values(` + params + `)`)
+	d.InsertSQL = d.q(`INSERT INTO kine(` + names + `)
+			values(` + params + `) RETURNING id`)
+}
+
+// encodeValue compresses a value and then encrypts it, as configured.
+func (d *Generic) encodeValue(value []byte) ([]byte, error) {
+	value = compression.Compress(d.Compression, value)
+	if d.Keyring != nil {
+		return d.Keyring.Encrypt(value)
+	}
+	return value, nil
+}
+
+// DecodeValue returns a value as it was before it was encoded to be stored.
+// Values are decoded whether or not they were encoded, and however the
+// dialect is configured, so that encoding can be changed at any time; only
+// encrypted values need the key they were encrypted with.
+func (d *Generic) DecodeValue(value []byte) ([]byte, error) {
+	if d.Keyring != nil {
+		var err error
+		if value, err = d.Keyring.Decrypt(value); err != nil {
+			return nil, err
 		}
-		return row.LastInsertId()
+	} else if encryption.IsEncrypted(value) {
+		return nil, encryption.ErrNoKeys
 	}
+	return compression.Decompress(value), nil
+}
 
-	row := d.queryRow(ctx, d.InsertSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
-	err = row.Scan(&id)
-	return id, err
+// insertReturning runs an insert that returns the id of the new row, retrying
+// errors that the dialect reports as retryable as execute does.
+func (d *Generic) insertReturning(ctx context.Context, sql string, args ...interface{}) (id int64, err error) {
+	sql = d.table.SQL(sql)
+	if err := d.checkWrite(ctx, sql, args...); err != nil {
+		return 0, err
+	}
+
+	for i := uint(0); i < d.RetryPolicy.attempts(); i++ {
+		err = d.insertRow(ctx, sql, args...).Scan(&id)
+		if !d.RetryPolicy.retryable(err) || d.RetryPolicy.wait(ctx, i) != nil {
+			return id, err
+		}
+	}
+	return
 }
 
 func (d *Generic) GetSize(ctx context.Context) (int64, error) {
@@ -0,0 +1,188 @@
+package generic
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// versionTableSQL creates the table that records the migrations applied to the
+// kine table. It is named after the kine table, so that each kine table in a
+// shared database has its own version.
+var versionTableSQL = `
+		CREATE TABLE IF NOT EXISTS kine_schema_version
+			(
+				version INTEGER NOT NULL PRIMARY KEY,
+				description VARCHAR(255),
+				applied_at BIGINT
+			)`
+
+var (
+	schemaVersionSQL    = `SELECT COALESCE(MAX(version), 0) FROM kine_schema_version`
+	insertSchemaVersion = `INSERT INTO kine_schema_version (version, description, applied_at) VALUES (%d, '%s', %d)`
+)
+
+// Migration is a versioned change to the schema of the kine table. The first
+// migration of each driver creates the table and its indexes, and is also
+// applied to tables created before migrations were recorded, so its statements
+// must succeed on such tables.
+type Migration struct {
+	// Version is the version of the schema after the migration. Versions of
+	// the migrations of a driver start at 1 and increase by 1.
+	Version int
+	// Description says what the migration changes, for the logs.
+	Description string
+	// Statements are executed in order, for the configured table as Table.SQL
+	// rewrites them.
+	Statements []string
+	// Apply, if set, is called in place of executing Statements, for changes
+	// that depend on the current schema.
+	Apply func(db *sql.DB, table *Table) error
+	// IgnoreErr returns true for errors of statements that are ignored, such
+	// as those of creating an index that exists on a table created before
+	// migrations were recorded, for datastores that cannot create an index
+	// only if it is missing.
+	IgnoreErr func(err error) bool
+}
+
+// Migrator applies the migrations of a driver that the kine table has not had
+// yet, and records each in the version table.
+type Migrator struct {
+	DB         *sql.DB
+	Table      *Table
+	Migrations []Migration
+	// VersionTableSQL creates the version table if it does not exist, for
+	// datastores without CREATE TABLE IF NOT EXISTS. Empty means the standard
+	// statement.
+	VersionTableSQL string
+	// DryRun logs the migrations that would be applied instead of applying
+	// them.
+	DryRun bool
+}
+
+// Run applies the pending migrations in order. It returns an error without
+// changing anything if the kine table has a version newer than the last known
+// migration, as it was migrated by a newer version of kine whose schema this
+// one may not work with.
+func (m *Migrator) Run() error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	latest := m.Migrations[len(m.Migrations)-1].Version
+
+	if !m.DryRun {
+		stmt := m.VersionTableSQL
+		if stmt == "" {
+			stmt = versionTableSQL
+		}
+		if err := m.exec(stmt, nil); err != nil {
+			return err
+		}
+	}
+	current, err := m.version()
+	if err != nil {
+		if !m.DryRun {
+			return err
+		}
+		// the version table is not created in dry-run mode
+		logrus.Debugf("Failed to read the schema version, assuming no migrations have been applied: %v", err)
+		current = 0
+	}
+	if current > latest {
+		return fmt.Errorf("the %s table has schema version %d, which is newer than version %d, the latest known to this version of kine", m.Table.QualifiedName(), current, latest)
+	}
+	if current == latest {
+		logrus.Infof("Schema of the %s table is at version %d", m.Table.QualifiedName(), current)
+		return nil
+	}
+
+	for _, migration := range m.Migrations[current:] {
+		if m.DryRun {
+			m.plan(migration)
+			continue
+		}
+		if err := m.apply(migration); err != nil {
+			return fmt.Errorf("schema migration %d (%s) failed: %v", migration.Version, migration.Description, err)
+		}
+	}
+	return nil
+}
+
+// validate returns an error if the versions of the migrations are not 1, 2, 3
+// and so on, which would be a bug in the driver.
+func (m *Migrator) validate() error {
+	if len(m.Migrations) == 0 {
+		return fmt.Errorf("no schema migrations")
+	}
+	for i, migration := range m.Migrations {
+		if migration.Version != i+1 {
+			return fmt.Errorf("schema migration %d has version %d, expected %d", i, migration.Version, i+1)
+		}
+	}
+	return nil
+}
+
+// version returns the latest migration applied to the kine table, or zero if
+// none has been recorded.
+func (m *Migrator) version() (int, error) {
+	var version int
+	err := m.DB.QueryRow(m.Table.SQL(schemaVersionSQL)).Scan(&version)
+	return version, err
+}
+
+// plan logs the statements of a migration that would be applied.
+func (m *Migrator) plan(migration Migration) {
+	logrus.Infof("DRY RUN : schema migration %d: %s", migration.Version, migration.Description)
+	if migration.Apply != nil {
+		return
+	}
+	for _, stmt := range migration.Statements {
+		logrus.Infof("DRY RUN : %s", util.Stripped(m.Table.SQL(stmt)))
+	}
+}
+
+// apply applies a migration and records it. Statements are not executed in a
+// transaction, as most datastores commit DDL implicitly, so a migration that
+// fails part way is applied again from the start; its statements must succeed
+// if they have already been executed. If another kine instance records the
+// migration first, it is not recorded again.
+func (m *Migrator) apply(migration Migration) error {
+	logrus.Infof("Applying schema migration %d: %s; this may take a moment...", migration.Version, migration.Description)
+	if migration.Apply != nil {
+		if err := migration.Apply(m.DB, m.Table); err != nil {
+			return err
+		}
+	} else {
+		for _, stmt := range migration.Statements {
+			if err := m.exec(stmt, migration.IgnoreErr); err != nil {
+				return err
+			}
+		}
+	}
+
+	description := strings.ReplaceAll(migration.Description, "'", "''")
+	stmt := fmt.Sprintf(insertSchemaVersion, migration.Version, description, time.Now().Unix())
+	if err := m.exec(stmt, nil); err != nil {
+		if current, verr := m.version(); verr != nil || current < migration.Version {
+			return err
+		}
+	}
+	logrus.Infof("Applied schema migration %d", migration.Version)
+	return nil
+}
+
+// exec executes a statement for the configured table, unless it fails with an
+// error that is ignored.
+func (m *Migrator) exec(stmt string, ignoreErr func(error) bool) error {
+	stmt = m.Table.SQL(stmt)
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+	_, err := m.DB.Exec(stmt)
+	if err != nil && ignoreErr != nil && ignoreErr(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package generic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// LoadSQLOverrides reads statements that replace those of the dialect from a
+// YAML or JSON file that maps the names of dialect fields, such as CompactSQL,
+// to statements.
+func LoadSQLOverrides(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	overrides := map[string]string{}
+	if err := yaml.Unmarshal(b, &overrides); err != nil {
+		return nil, errors.Wrapf(err, "parsing SQL overrides %s", path)
+	}
+	return overrides, nil
+}
+
+// overridableSQL returns the statements that may be overridden, by name.
+// Statements that create or inspect the schema are not, as they are run before
+// overrides are applied.
+func (d *Generic) overridableSQL() map[string]*string {
+	return map[string]*string{
+		"GetCurrentSQL":         &d.GetCurrentSQL,
+		"GetRevisionSQL":        &d.GetRevisionSQL,
+		"ListRevisionStartSQL":  &d.ListRevisionStartSQL,
+		"GetRevisionAfterSQL":   &d.GetRevisionAfterSQL,
+		"CountSQL":              &d.CountSQL,
+		"AfterSQL":              &d.AfterSQL,
+		"DeleteSQL":             &d.DeleteSQL,
+		"CompactSQL":            &d.CompactSQL,
+		"UpdateCompactSQL":      &d.UpdateCompactSQL,
+		"PostCompactSQL":        &d.PostCompactSQL,
+		"InsertSQL":             &d.InsertSQL,
+		"InsertLastInsertIDSQL": &d.InsertLastInsertIDSQL,
+		"FillSQL":               &d.FillSQL,
+		"GetSizeSQL":            &d.GetSizeSQL,
+		"ExpiredSQL":            &d.ExpiredSQL,
+	}
+}
+
+// OverrideSQL replaces statements of the dialect, so that operators can add
+// index hints or vendor-specific syntax without rebuilding kine. Statements
+// may use ? placeholders, which are rewritten to suit the driver, and must take
+// as many arguments as the statements they replace. Nothing is replaced if any
+// statement is invalid.
+func (d *Generic) OverrideSQL(overrides map[string]string) error {
+	fields := d.overridableSQL()
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	replaced := map[string]string{}
+	for _, name := range names {
+		field, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("SQL override %s is not a statement that can be overridden", name)
+		}
+		sql := d.q(strings.TrimSpace(overrides[name]))
+		if sql == "" {
+			return fmt.Errorf("SQL override %s is empty", name)
+		}
+		if got, want := d.placeholders(sql), d.placeholders(*field); got != want {
+			return fmt.Errorf("SQL override %s takes %d arguments, the statement it replaces takes %d", name, got, want)
+		}
+		replaced[name] = sql
+	}
+
+	for _, name := range names {
+		*fields[name] = replaced[name]
+		logrus.Infof("Overriding %s with: %s", name, util.Stripped(replaced[name]))
+	}
+	return nil
+}
+
+// placeholders returns the number of arguments a statement takes. Numbered
+// placeholders may be repeated, so for those it is the highest number.
+func (d *Generic) placeholders(sql string) int {
+	if !d.numbered {
+		return strings.Count(sql, d.paramCharacter)
+	}
+	n := 0
+	re := regexp.MustCompile(regexp.QuoteMeta(d.paramCharacter) + `(\d+)`)
+	for _, m := range re.FindAllStringSubmatch(sql, -1) {
+		if i, err := strconv.Atoi(m[1]); err == nil && i > n {
+			n = i
+		}
+	}
+	return n
+}
@@ -0,0 +1,276 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultResumeTimeout is how long connections wait for a datastore to resume
+// by default. Azure SQL serverless databases take up to a minute to resume.
+const DefaultResumeTimeout = 2 * time.Minute
+
+// wrapsConns returns true if connections must be wrapped to apply the pool
+// settings that database/sql does not support itself.
+func (c ConnectionPoolConfig) wrapsConns() bool {
+	return (c.MaxLifetime > 0 && c.MaxLifetimeJitter > 0) || c.CheckOnCheckout
+}
+
+// waitsForResume returns true if connections are retried while the datastore
+// resumes from a pause.
+func (c ConnectionPoolConfig) waitsForResume() bool {
+	return c.Resuming != nil && c.ResumeTimeout > 0
+}
+
+// wrapsConnector returns true if the connector must be wrapped to apply the
+// pool settings.
+func (c ConnectionPoolConfig) wrapsConnector() bool {
+	return c.wrapsConns() || c.waitsForResume()
+}
+
+// wrapConnector returns the connector wrapped to apply the pool settings that
+// database/sql does not support itself.
+func (c ConnectionPoolConfig) wrapConnector(connector driver.Connector) driver.Connector {
+	connector = c.WaitForResume(connector)
+	if c.wrapsConns() {
+		connector = &lifecycleConnector{Connector: connector, config: c}
+	}
+	return connector
+}
+
+// WaitForResume returns the connector wrapped to retry connections while the
+// datastore resumes, for connections that drivers open outside of the pool.
+func (c ConnectionPoolConfig) WaitForResume(connector driver.Connector) driver.Connector {
+	if c.waitsForResume() {
+		return &resumingConnector{Connector: connector, resuming: c.Resuming, timeout: c.ResumeTimeout}
+	}
+	return connector
+}
+
+// resumingConnector retries connections that fail while the datastore resumes
+// from a pause, waiting longer between each attempt, until the timeout.
+type resumingConnector struct {
+	driver.Connector
+	resuming func(error) bool
+	timeout  time.Duration
+}
+
+func (c *resumingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	deadline := time.Now().Add(c.timeout)
+	wait := 250 * time.Millisecond
+	for {
+		conn, err := c.Connector.Connect(ctx)
+		if err == nil || !c.resuming(err) || time.Now().Add(wait).After(deadline) {
+			return conn, err
+		}
+		logrus.Infof("Datastore is resuming, retrying connection in %v: %v", wait, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > 5*time.Second {
+			wait = 5 * time.Second
+		}
+	}
+}
+
+// registerDBStats registers a collector for the pool statistics, such as the
+// open, in use and idle connections and the time spent waiting for one,
+// labelled with the pool name and driver. It replaces the collector for any
+// pool left over from a previous failed startup attempt.
+func registerDBStats(metricsRegisterer prometheus.Registerer, db *sql.DB, name, driverName string) error {
+	if metricsRegisterer == nil {
+		return nil
+	}
+	metricsRegisterer = prometheus.WrapRegistererWith(prometheus.Labels{"driver": driverName}, metricsRegisterer)
+	collector := collectors.NewDBStatsCollector(db, name)
+	if err := metricsRegisterer.Register(collector); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return err
+		}
+		metricsRegisterer.Unregister(are.ExistingCollector)
+		metricsRegisterer.MustRegister(collector)
+	}
+	return nil
+}
+
+// openReadPool opens a pool for reads outside of transactions, with the read
+// pool settings. The name tells the pool apart in logs and metrics.
+func openReadPool(openDB func() (*sql.DB, error), name, driverName string, connPoolConfig ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (*sql.DB, error) {
+	readDB, err := openAndTest(openDB)
+	if err != nil {
+		return nil, err
+	}
+	readConfig := connPoolConfig
+	readConfig.MaxIdle = connPoolConfig.ReadMaxIdle
+	readConfig.MaxOpen = connPoolConfig.ReadMaxOpen
+	configureConnectionPooling(readConfig, readDB, driverName+" "+name)
+	if err := registerDBStats(metricsRegisterer, readDB, "kine_"+name, driverName); err != nil {
+		readDB.Close()
+		return nil, err
+	}
+	return readDB, nil
+}
+
+// lookupDriver returns the registered driver with a name. database/sql does not
+// expose registered drivers by name, so it is looked up through a pool that is
+// never connected.
+func lookupDriver(driverName string) (driver.Driver, error) {
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return db.Driver(), nil
+}
+
+// constantConnector returns a connector for a fixed data source name.
+func constantConnector(driverName, dataSourceName string) (driver.Connector, error) {
+	drv, err := lookupDriver(driverName)
+	if err != nil {
+		return nil, err
+	}
+	if dc, ok := drv.(driver.DriverContext); ok {
+		return dc.OpenConnector(dataSourceName)
+	}
+	return &dsnConnector{driver: drv, dsn: func(context.Context) (string, error) {
+		return dataSourceName, nil
+	}}, nil
+}
+
+// lifecycleConnector wraps the connections from another connector to expire
+// them after a jittered lifetime, and to check them before they are reused.
+type lifecycleConnector struct {
+	driver.Connector
+	config ConnectionPoolConfig
+}
+
+func (c *lifecycleConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lc := &lifecycleConn{Conn: conn, check: c.config.CheckOnCheckout}
+	if c.config.MaxLifetime > 0 && c.config.MaxLifetimeJitter > 0 {
+		jitter := time.Duration(rand.Int63n(int64(c.config.MaxLifetimeJitter)))
+		lc.expires = time.Now().Add(c.config.MaxLifetime - jitter)
+	}
+	return lc, nil
+}
+
+// lifecycleConn forwards to the wrapped connection, falling back to the
+// behavior of database/sql where the wrapped connection does not implement an
+// optional interface.
+type lifecycleConn struct {
+	driver.Conn
+	expires time.Time
+	check   bool
+}
+
+var (
+	_ driver.QueryerContext     = (*lifecycleConn)(nil)
+	_ driver.ExecerContext      = (*lifecycleConn)(nil)
+	_ driver.ConnPrepareContext = (*lifecycleConn)(nil)
+	_ driver.ConnBeginTx        = (*lifecycleConn)(nil)
+	_ driver.Pinger             = (*lifecycleConn)(nil)
+	_ driver.NamedValueChecker  = (*lifecycleConn)(nil)
+	_ driver.SessionResetter    = (*lifecycleConn)(nil)
+	_ driver.Validator          = (*lifecycleConn)(nil)
+)
+
+func (c *lifecycleConn) expired() bool {
+	return !c.expires.IsZero() && time.Now().After(c.expires)
+}
+
+// IsValid is called before the connection is returned to the pool.
+func (c *lifecycleConn) IsValid() bool {
+	if c.expired() {
+		return false
+	}
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// ResetSession is called before the connection is reused.
+func (c *lifecycleConn) ResetSession(ctx context.Context) error {
+	if c.expired() {
+		return driver.ErrBadConn
+	}
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		if err := r.ResetSession(ctx); err != nil {
+			return err
+		}
+	}
+	if c.check {
+		if err := c.Ping(ctx); err != nil {
+			return driver.ErrBadConn
+		}
+	}
+	return nil
+}
+
+func (c *lifecycleConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *lifecycleConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *lifecycleConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *lifecycleConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *lifecycleConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *lifecycleConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// Close closes the connection pools.
+func (d *Generic) Close() error {
+	if d.stmts != nil {
+		d.stmts.close()
+	}
+	if d.ReadDB != nil && d.ReadDB != d.DB {
+		d.ReadDB.Close()
+	}
+	if d.ReplicaDB != nil {
+		d.ReplicaDB.Close()
+	}
+	return d.DB.Close()
+}
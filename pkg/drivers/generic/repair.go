@@ -0,0 +1,262 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	duplicateRowsSQL = `
+		SELECT kv.id, kv.name
+		FROM kine AS kv
+		JOIN (
+			SELECT dkv.name, dkv.prev_revision, MIN(dkv.id) AS id
+			FROM kine AS dkv
+			WHERE dkv.name != 'compact_rev_key'
+			GROUP BY dkv.name, dkv.prev_revision
+			HAVING COUNT(*) > 1) AS dup
+			ON kv.name = dup.name AND kv.prev_revision = dup.prev_revision AND kv.id > dup.id
+		ORDER BY kv.id ASC`
+
+	danglingRowsSQL = `
+		SELECT kv.id, kv.name
+		FROM kine AS kv
+		WHERE
+			kv.created = 0 AND
+			kv.id > ? AND
+			kv.name != 'compact_rev_key' AND
+			kv.name NOT LIKE 'gap-%' AND
+			NOT EXISTS (
+				SELECT 1
+				FROM kine AS pkv
+				WHERE pkv.id = kv.prev_revision)
+		ORDER BY kv.id ASC`
+
+	previousRowSQL = `
+		SELECT MAX(pkv.id)
+		FROM kine AS pkv
+		WHERE
+			pkv.name = ? AND
+			pkv.id < ?`
+
+	updatePrevRevisionSQL = `
+		UPDATE kine
+		SET prev_revision = ?
+		WHERE id = ?`
+
+	compactRowsSQL = `
+		SELECT ckv.id, ckv.prev_revision
+		FROM kine AS ckv
+		WHERE ckv.name = 'compact_rev_key'
+		ORDER BY ckv.id ASC`
+)
+
+// RepairIssue describes a single problem found by Repair, and the action taken
+// (or that would have been taken, for a dry run) to fix it.
+type RepairIssue struct {
+	Problem string
+	ID      int64
+	Name    string
+	Action  string
+}
+
+func (i RepairIssue) String() string {
+	return fmt.Sprintf("%s: id=%d name=%s => %s", i.Problem, i.ID, i.Name, i.Action)
+}
+
+// Repair detects and fixes the known forms of corruption in the kine table:
+// rows that duplicate the name and prev_revision of an earlier row, rows whose
+// prev_revision references a row that does not exist, and duplicate or
+// out-of-range compact_rev_key rows. If dryRun is true, the problems are
+// reported but the database is not modified.
+func (d *Generic) Repair(ctx context.Context, dryRun bool) (issues []RepairIssue, rerr error) {
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tx{x: tx, d: d}
+	defer func() {
+		if rerr != nil || dryRun {
+			t.MustRollback()
+		} else {
+			rerr = t.Commit()
+		}
+	}()
+
+	for _, repair := range []func(context.Context, *Tx, bool) ([]RepairIssue, error){
+		d.repairCompactRows,
+		d.repairDuplicateRows,
+		d.repairDanglingRows,
+	} {
+		found, err := repair(ctx, t, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		issues = append(issues, found...)
+	}
+
+	return issues, nil
+}
+
+// repairCompactRows removes all but the most advanced compact_rev_key row, and
+// resets the compact revision if it is ahead of the current revision.
+func (d *Generic) repairCompactRows(ctx context.Context, t *Tx, dryRun bool) ([]RepairIssue, error) {
+	var (
+		issues  []RepairIssue
+		keepID  int64
+		keepRev int64
+		ids     []int64
+	)
+
+	rows, err := t.query(ctx, compactRowsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, rev int64
+		if err := rows.Scan(&id, &rev); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+		if keepID == 0 || rev > keepRev {
+			keepID, keepRev = id, rev
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if id == keepID {
+			continue
+		}
+		issues = append(issues, RepairIssue{
+			Problem: "duplicate compact revision row",
+			ID:      id,
+			Name:    "compact_rev_key",
+			Action:  "delete",
+		})
+		if !dryRun {
+			if err := t.DeleteRevision(ctx, id); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	currentRev, err := t.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if keepID != 0 && keepRev > currentRev {
+		issues = append(issues, RepairIssue{
+			Problem: fmt.Sprintf("compact revision %d ahead of current revision", keepRev),
+			ID:      keepID,
+			Name:    "compact_rev_key",
+			Action:  fmt.Sprintf("set compact revision to %d", currentRev),
+		})
+		if !dryRun {
+			if err := t.SetCompactRevision(ctx, currentRev); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return issues, nil
+}
+
+// repairDuplicateRows deletes rows that share a name and prev_revision with an
+// earlier row. The earliest row is the one that should have won; the unique index
+// on (name, prev_revision) would have rejected the others had it been present.
+func (d *Generic) repairDuplicateRows(ctx context.Context, t *Tx, dryRun bool) ([]RepairIssue, error) {
+	found, err := scanIDNames(t.query(ctx, duplicateRowsSQL))
+	if err != nil {
+		return nil, err
+	}
+
+	issues := make([]RepairIssue, 0, len(found))
+	for _, row := range found {
+		issues = append(issues, RepairIssue{
+			Problem: "duplicate name and prev_revision",
+			ID:      row.id,
+			Name:    row.name,
+			Action:  "delete",
+		})
+		if !dryRun {
+			if err := t.DeleteRevision(ctx, row.id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return issues, nil
+}
+
+// repairDanglingRows relinks rows whose prev_revision references a missing row
+// to the most recent earlier row for the same key. Created rows are excluded, as
+// a create of a new key legitimately records an unrelated revision.
+func (d *Generic) repairDanglingRows(ctx context.Context, t *Tx, dryRun bool) ([]RepairIssue, error) {
+	compactRev, err := t.GetCompactRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := scanIDNames(t.query(ctx, d.q(danglingRowsSQL), compactRev))
+	if err != nil {
+		return nil, err
+	}
+
+	issues := make([]RepairIssue, 0, len(found))
+	for _, row := range found {
+		var prev sql.NullInt64
+		if err := t.queryRow(ctx, d.q(previousRowSQL), d.keyArg(row.name), row.id).Scan(&prev); err != nil {
+			return nil, err
+		}
+
+		issue := RepairIssue{
+			Problem: "prev_revision references missing row",
+			ID:      row.id,
+			Name:    row.name,
+		}
+		if !prev.Valid {
+			issue.Action = "none, no earlier revision exists"
+			issues = append(issues, issue)
+			continue
+		}
+
+		issue.Action = fmt.Sprintf("set prev_revision to %d", prev.Int64)
+		issues = append(issues, issue)
+		if !dryRun {
+			if _, err := t.execute(ctx, d.relinkSQL(), prev.Int64, row.id); err != nil {
+				logrus.Errorf("Failed to relink revision %d for key %s: %v", row.id, row.name, err)
+				return nil, err
+			}
+		}
+	}
+	return issues, nil
+}
+
+type idName struct {
+	id   int64
+	name string
+}
+
+func scanIDNames(rows *sql.Rows, err error) ([]idName, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []idName
+	for rows.Next() {
+		var row idName
+		if err := rows.Scan(&row.id, &row.name); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
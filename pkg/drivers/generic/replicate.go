@@ -0,0 +1,149 @@
+package generic
+
+import (
+	"context"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	replicateBatchSize = 1000
+	replicateInterval  = time.Second
+)
+
+var (
+	rowsAfterSQL = `
+		SELECT kv.id, kv.name, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value
+		FROM kine AS kv
+		WHERE kv.id > ?
+		ORDER BY kv.id ASC
+		LIMIT ?`
+
+	maxIDSQL = `
+		SELECT COALESCE(MAX(mkv.id), 0)
+		FROM kine AS mkv`
+)
+
+type replicaRow struct {
+	id             int64
+	name           string
+	created        int64
+	deleted        int64
+	createRevision int64
+	prevRevision   int64
+	lease          int64
+	value          []byte
+	oldValue       []byte
+}
+
+// Replicate copies rows from the primary to the secondary until the context is
+// cancelled, preserving their revisions so that the secondary can be promoted
+// without invalidating client resource versions. Replication resumes after the
+// highest revision in the secondary, so it is safe to restart at any time. The
+// compact revision is copied once the secondary has caught up to it.
+func Replicate(ctx context.Context, primary, secondary *Generic) {
+	var compacted int64
+	for {
+		n, err := primary.replicateTo(ctx, secondary, &compacted)
+		if err != nil {
+			logrus.Errorf("Failed to replicate to secondary datastore: %v", err)
+		}
+		if n == replicateBatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicateInterval):
+		}
+	}
+}
+
+// replicateTo copies one batch of rows, and the compact revision, to the
+// secondary. It returns the number of rows copied.
+func (d *Generic) replicateTo(ctx context.Context, secondary *Generic, compacted *int64) (int, error) {
+	var last int64
+	if err := secondary.queryRow(ctx, maxIDSQL).Scan(&last); err != nil {
+		return 0, err
+	}
+
+	rows, err := d.query(ctx, d.q(rowsAfterSQL), last, replicateBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var batch []replicaRow
+	for rows.Next() {
+		var r replicaRow
+		if err := rows.Scan(&r.id, &r.name, &r.created, &r.deleted, &r.createRevision, &r.prevRevision, &r.lease, &r.value, &r.oldValue); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(batch) > 0 {
+		tx, err := secondary.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+		for _, r := range batch {
+			if _, err := tx.ExecContext(ctx, secondary.table.SQL(secondary.FillSQL), r.id, secondary.keyArg(r.name), r.created, r.deleted, r.createRevision, r.prevRevision, r.lease, r.value, r.oldValue); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+		last = batch[len(batch)-1].id
+	}
+
+	current, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return len(batch), err
+	}
+	metrics.ReplicaLagRevisions.Set(float64(current - last))
+
+	return len(batch), d.replicateCompaction(ctx, secondary, last, compacted)
+}
+
+// replicateCompaction compacts the secondary to the compact revision of the
+// primary, once all rows up to that revision have been copied. The compact
+// revision stored in the secondary cannot be relied upon, as the row holding it
+// is updated in place in the primary and so may be copied after compaction, so
+// the last revision compacted by this process is tracked instead.
+func (d *Generic) replicateCompaction(ctx context.Context, secondary *Generic, last int64, compacted *int64) error {
+	compactRev, err := d.GetCompactRevision(ctx)
+	if err != nil || compactRev == 0 || compactRev > last || compactRev <= *compacted {
+		return err
+	}
+
+	logrus.Infof("Compacting secondary datastore to revision %d", compactRev)
+	if _, err := secondary.Compact(ctx, compactRev); err != nil {
+		return err
+	}
+	if err := secondary.SetCompactRevision(ctx, compactRev); err != nil {
+		return err
+	}
+	*compacted = compactRev
+	return secondary.PostCompact(ctx)
+}
+
+// Promote prepares a secondary datastore that was populated by Replicate to be
+// used as the primary, and returns its current revision.
+func (d *Generic) Promote(ctx context.Context) (int64, error) {
+	if d.PromoteSQL != "" {
+		// rows were inserted with explicit revisions, which does not advance the
+		// revision sequence in all databases
+		if _, err := d.execute(ctx, d.PromoteSQL); err != nil {
+			return 0, err
+		}
+	}
+	return d.CurrentRevision(ctx)
+}
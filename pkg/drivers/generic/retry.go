@@ -0,0 +1,69 @@
+package generic
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/Rican7/retry/backoff"
+)
+
+// DefaultRetryAttempts is the number of times a statement is tried if not
+// configured.
+const DefaultRetryAttempts = 20
+
+// RetryPolicy decides which statements that fail are retried, how many times,
+// and how long to wait between attempts.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a statement is tried, including the
+	// first. Zero means DefaultRetryAttempts.
+	MaxAttempts uint
+	// Backoff returns how long to wait before each retry after the first,
+	// which is immediate. If it is nil, the wait grows linearly by 100ms.
+	Backoff backoff.Algorithm
+	// Jitter shortens each wait by a random fraction of it up to this, between
+	// zero and one, so that clients that fail together do not retry together.
+	Jitter float64
+	// Retryable returns true for errors that succeed if retried, such as
+	// deadlocks or failovers. It is set by drivers; if it is nil, statements
+	// are not retried.
+	Retryable ErrRetry
+}
+
+// attempts returns the number of times a statement is tried.
+func (p RetryPolicy) attempts() uint {
+	if p.MaxAttempts == 0 {
+		return DefaultRetryAttempts
+	}
+	return p.MaxAttempts
+}
+
+// retryable returns true if a statement that failed with an error is retried.
+func (p RetryPolicy) retryable(err error) bool {
+	return err != nil && p.Retryable != nil && p.Retryable(err)
+}
+
+// wait waits before the retry that follows a failed attempt, or returns an
+// error if the context is done first.
+func (p RetryPolicy) wait(ctx context.Context, attempt uint) error {
+	if attempt == 0 {
+		return nil
+	}
+	algorithm := p.Backoff
+	if algorithm == nil {
+		algorithm = backoff.Linear(100 * time.Millisecond)
+	}
+	wait := algorithm(attempt)
+	if p.Jitter > 0 {
+		wait -= time.Duration(rand.Float64() * p.Jitter * float64(wait))
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,77 @@
+package generic
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// statementKinds are the kinds statements are labeled with in metrics, by
+// their first keyword. Other statements, such as the batches of T-SQL run by
+// some drivers, are labeled as other.
+var statementKinds = map[string]bool{
+	"select": true,
+	"insert": true,
+	"update": true,
+	"delete": true,
+}
+
+// observeSQL records the outcome and duration of a statement, and logs it if
+// it ran for longer than metrics.SlowSQLThreshold. The arguments are logged as
+// a hash, so that repeated statements can be told apart without logging the
+// values they write. rows is the number of rows the statement affected, or -1
+// if it is not known, as for queries, whose rows are read after they return.
+func observeSQL(start time.Time, errCode, sql string, args []interface{}, rows int64) {
+	duration := time.Since(start)
+	kind := statementKind(sql)
+	metrics.ObserveSQL(duration, errCode, kind)
+	if metrics.SlowSQLThreshold <= 0 || duration < metrics.SlowSQLThreshold {
+		return
+	}
+	count := "unknown"
+	if rows >= 0 {
+		count = fmt.Sprint(rows)
+	}
+	logrus.Infof("Slow SQL (kind: %s) (started: %v) (total time: %v) (rows: %s) (args hash: %s): %s", kind, start, duration, count, argsHash(args), util.Stripped(sql))
+}
+
+// statementKind returns the kind of a statement, by its first keyword.
+func statementKind(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return "other"
+	}
+	kind := strings.ToLower(fields[0])
+	if !statementKinds[kind] {
+		return "other"
+	}
+	return kind
+}
+
+// argsHash returns a hash of the arguments of a statement.
+func argsHash(args []interface{}) string {
+	h := fnv.New64a()
+	for _, arg := range args {
+		fmt.Fprintf(h, "%T:%v;", arg, arg)
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// rowsAffected returns the number of rows affected by a statement, or -1 if it
+// failed or the driver does not report it.
+func rowsAffected(result sql.Result, err error) int64 {
+	if err != nil || result == nil {
+		return -1
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,117 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxPreparedStatements limits the statements prepared on each pool. Queries
+// are formatted with their limit, so the number of distinct statements is not
+// bounded; those beyond the limit are run without being prepared.
+const maxPreparedStatements = 64
+
+// stmtKey identifies a statement prepared on a pool.
+type stmtKey struct {
+	db  *sql.DB
+	sql string
+}
+
+// stmtCache holds the statements prepared on each pool. database/sql prepares
+// a statement on each connection of the pool the first time it is run there,
+// and again on connections that replace it, so a statement prepared once on a
+// pool is parsed once per connection rather than on every call.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[stmtKey]*sql.Stmt
+	count map[*sql.DB]int
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{
+		stmts: map[stmtKey]*sql.Stmt{},
+		count: map[*sql.DB]int{},
+	}
+}
+
+// get returns the statement prepared on a pool, preparing it if it has not
+// been, or nil if it cannot be prepared or the pool has too many statements.
+func (c *stmtCache) get(ctx context.Context, db *sql.DB, query string) *sql.Stmt {
+	key := stmtKey{db: db, sql: query}
+	c.mu.Lock()
+	stmt, ok := c.stmts[key]
+	full := c.count[db] >= maxPreparedStatements
+	c.mu.Unlock()
+	if ok {
+		return stmt
+	}
+	if full {
+		return nil
+	}
+
+	// statements are prepared without holding the lock, as preparing one
+	// waits for the datastore
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		// statements that cannot be prepared, such as some that hold
+		// several statements, are run as they are
+		logrus.Debugf("Failed to prepare statement, running it unprepared: %v", err)
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prepared, ok := c.stmts[key]; ok {
+		stmt.Close()
+		return prepared
+	}
+	if c.count[db] >= maxPreparedStatements {
+		stmt.Close()
+		return nil
+	}
+	c.stmts[key] = stmt
+	c.count[db]++
+	return stmt
+}
+
+// close closes the prepared statements.
+func (c *stmtCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, stmt := range c.stmts {
+		stmt.Close()
+		delete(c.stmts, key)
+	}
+	c.count = map[*sql.DB]int{}
+}
+
+// stmt returns the prepared statement for a statement on a pool, or nil if
+// statements are not prepared.
+func (d *Generic) stmt(ctx context.Context, db *sql.DB, query string) *sql.Stmt {
+	if d.stmts == nil {
+		return nil
+	}
+	return d.stmts.get(ctx, db, query)
+}
+
+func (d *Generic) queryContext(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	if stmt := d.stmt(ctx, db, query); stmt != nil {
+		return stmt.QueryContext(ctx, args...)
+	}
+	return db.QueryContext(ctx, query, args...)
+}
+
+func (d *Generic) queryRowContext(ctx context.Context, db *sql.DB, query string, args ...interface{}) *sql.Row {
+	if stmt := d.stmt(ctx, db, query); stmt != nil {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+	return db.QueryRowContext(ctx, query, args...)
+}
+
+func (d *Generic) execContext(ctx context.Context, db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	if stmt := d.stmt(ctx, db, query); stmt != nil {
+		return stmt.ExecContext(ctx, args...)
+	}
+	return db.ExecContext(ctx, query, args...)
+}
@@ -0,0 +1,124 @@
+package generic
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// DefaultTableName is the name of the kine table if not configured.
+const DefaultTableName = "kine"
+
+var (
+	// tableReference matches the table in statements written for the kine
+	// table: a string literal naming it, or the identifier. Other names that
+	// start with kine_ are not matched, except those of the indexes on the
+	// table, of the sequence of its ids, and of its schema version table.
+	// Everything is matched in a single pass, so that names are never rewritten
+	// twice.
+	tableReference = regexp.MustCompile(`'kine'|\bkine\b|\bkine_(\w+_u?index|id_seq|schema_version)\b`)
+	identifier     = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+	clusterID      = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+// maxTableNameLength is the length of the longest table name whose indexes have
+// names that fit in a PostgreSQL identifier, which is at most 63 bytes.
+const maxTableNameLength = 63 - len("_name_prev_revision_uindex")
+
+// Table is the kine table as configured.
+type Table struct {
+	// Schema is the schema that holds the table, or empty for the default
+	// schema of the connection.
+	Schema string
+	// Name is the name of the table.
+	Name string
+	// KeepIndexNames leaves the names of indexes as they are written, for
+	// datastores whose index names are unique per table. Otherwise indexes are
+	// named after the table, as in most datastores index names are unique per
+	// schema, so tables sharing one would otherwise share indexes too.
+	KeepIndexNames bool
+
+	statements sync.Map
+}
+
+// Table returns the configured kine table, or an error if the schema or table
+// name is not a lowercase identifier, which are the same in every datastore
+// whether or not they are quoted. The table of a cluster sharing the datastore
+// is named after the table name and the cluster ID.
+func (c Config) Table() (*Table, error) {
+	t := &Table{Schema: c.SchemaName, Name: c.TableName}
+	if t.Name == "" {
+		t.Name = DefaultTableName
+	}
+	if !identifier.MatchString(t.Name) {
+		return nil, fmt.Errorf("invalid table name %q, must be lowercase letters, digits and underscores", t.Name)
+	}
+	if c.ClusterID != "" {
+		if !clusterID.MatchString(c.ClusterID) {
+			return nil, fmt.Errorf("invalid cluster ID %q, must be lowercase letters, digits and underscores", c.ClusterID)
+		}
+		t.Name += "_" + c.ClusterID
+	}
+	if len(t.Name) > maxTableNameLength {
+		return nil, fmt.Errorf("table name %q is too long, must be at most %d characters", t.Name, maxTableNameLength)
+	}
+	if t.Schema != "" && !identifier.MatchString(t.Schema) {
+		return nil, fmt.Errorf("invalid schema name %q, must be lowercase letters, digits and underscores", t.Schema)
+	}
+	return t, nil
+}
+
+// QualifiedName returns the name of the table with its schema, if set.
+func (t *Table) QualifiedName() string {
+	if t.Schema == "" {
+		return t.Name
+	}
+	return t.Schema + "." + t.Name
+}
+
+// IsDefault returns true if the table is kine in the default schema.
+func (t *Table) IsDefault() bool {
+	return t == nil || (t.Schema == "" && t.Name == DefaultTableName)
+}
+
+// IndexName returns the name of an index on the table, given its name on the
+// kine table. The sequence of ids and the schema version table are always named
+// after the table, as their names are unique per schema.
+func (t *Table) IndexName(name string) string {
+	if t.IsDefault() || (t.KeepIndexNames && strings.HasSuffix(name, "index")) {
+		return name
+	}
+	return t.Name + strings.TrimPrefix(name, DefaultTableName)
+}
+
+// SQL returns a statement written for the kine table with the configured
+// table in its place. Both the identifier and string literals naming the table,
+// as passed to functions such as OBJECT_ID, are replaced with the qualified
+// name, and indexes are renamed as IndexName does. Statements are rewritten
+// once and then cached.
+func (t *Table) SQL(stmt string) string {
+	if t.IsDefault() {
+		return stmt
+	}
+	if rewritten, ok := t.statements.Load(stmt); ok {
+		return rewritten.(string)
+	}
+	name := t.QualifiedName()
+	rewritten := tableReference.ReplaceAllStringFunc(stmt, func(ref string) string {
+		switch {
+		case ref[0] == '\'':
+			return "'" + name + "'"
+		case strings.HasSuffix(ref, "_schema_version") && t.Schema != "":
+			return t.Schema + "." + t.IndexName(ref)
+		case ref != DefaultTableName:
+			return t.IndexName(ref)
+		}
+		return name
+	})
+	t.statements.Store(stmt, rewritten)
+	// rewritten statements are returned as they are, should they be passed
+	// through again
+	t.statements.Store(rewritten, rewritten)
+	return rewritten
+}
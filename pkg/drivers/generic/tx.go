@@ -5,7 +5,6 @@ import (
 	"database/sql"
 	"time"
 
-	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/util"
 	"github.com/sirupsen/logrus"
@@ -90,6 +89,38 @@ func (t *Tx) DeleteRevision(ctx context.Context, revision int64) error {
 	return err
 }
 
+// Insert inserts a row in the transaction and returns its revision. Unlike
+// inserts outside of a transaction, it is not retried, as the transaction
+// must be retried as a whole.
+func (t *Tx) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (id int64, err error) {
+	logrus.Tracef("TX INSERT %s", key)
+	if t.d.TranslateErr != nil {
+		defer func() {
+			if err != nil {
+				err = t.d.TranslateErr(err)
+			}
+		}()
+	}
+
+	args, err := t.d.insertArgs(key, create, delete, createRevision, previousRevision, ttl, value, prevValue)
+	if err != nil {
+		return 0, err
+	}
+	if t.d.LastInsertID {
+		row, err := t.execute(ctx, t.d.InsertLastInsertIDSQL, args...)
+		if err != nil {
+			return 0, err
+		}
+		return row.LastInsertId()
+	}
+
+	if err := t.d.checkWrite(ctx, t.d.table.SQL(t.d.InsertSQL), args...); err != nil {
+		return 0, err
+	}
+	err = t.queryRow(ctx, t.d.InsertSQL, args...).Scan(&id)
+	return id, err
+}
+
 func (t *Tx) CurrentRevision(ctx context.Context) (int64, error) {
 	var id int64
 	row := t.queryRow(ctx, revSQL)
@@ -101,28 +132,34 @@ func (t *Tx) CurrentRevision(ctx context.Context) (int64, error) {
 }
 
 func (t *Tx) query(ctx context.Context, sql string, args ...interface{}) (result *sql.Rows, err error) {
+	sql = t.d.table.SQL(sql)
 	logrus.Tracef("TX QUERY %v : %s", args, util.Stripped(sql))
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(err), util.Stripped(sql), args)
+		observeSQL(startTime, t.d.ErrCode(err), sql, args, -1)
 	}()
 	return t.x.QueryContext(ctx, sql, args...)
 }
 
 func (t *Tx) queryRow(ctx context.Context, sql string, args ...interface{}) (result *sql.Row) {
+	sql = t.d.table.SQL(sql)
 	logrus.Tracef("TX QUERY ROW %v : %s", args, util.Stripped(sql))
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(result.Err()), util.Stripped(sql), args)
+		observeSQL(startTime, t.d.ErrCode(result.Err()), sql, args, -1)
 	}()
 	return t.x.QueryRowContext(ctx, sql, args...)
 }
 
 func (t *Tx) execute(ctx context.Context, sql string, args ...interface{}) (result sql.Result, err error) {
+	sql = t.d.table.SQL(sql)
 	logrus.Tracef("TX EXEC %v : %s", args, util.Stripped(sql))
+	if err := t.d.checkWrite(ctx, sql, args...); err != nil {
+		return nil, err
+	}
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(err), util.Stripped(sql), args)
+		observeSQL(startTime, t.d.ErrCode(err), sql, args, rowsAffected(result, err))
 	}()
 	return t.x.ExecContext(ctx, sql, args...)
 }
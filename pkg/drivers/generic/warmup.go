@@ -0,0 +1,99 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// minPlanCheckRevision is the revision below which query plans are not checked,
+// as planners scan small tables regardless of the indexes on them.
+const minPlanCheckRevision = 10000
+
+// Warmup opens connections until each pool holds the given number, so that the
+// first requests do not wait to connect, and checks that the queries that serve
+// lists and watches use the indexes on the kine table. Plans that scan the
+// whole table are logged as warnings.
+func (d *Generic) Warmup(ctx context.Context, connections int) error {
+	for _, db := range d.pools() {
+		if err := warmPool(ctx, db, connections); err != nil {
+			return err
+		}
+	}
+	return d.checkPlans(ctx)
+}
+
+func (d *Generic) pools() []*sql.DB {
+	pools := []*sql.DB{d.DB}
+	if d.ReadDB != nil && d.ReadDB != d.DB {
+		pools = append(pools, d.ReadDB)
+	}
+	if d.ReplicaDB != nil {
+		pools = append(pools, d.ReplicaDB)
+	}
+	return pools
+}
+
+// warmPool holds the connections open together, so that the pool opens a new
+// connection for each, and then returns them to the pool as idle connections.
+func warmPool(ctx context.Context, db *sql.DB, connections int) error {
+	conns := make([]*sql.Conn, 0, connections)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < connections; i++ {
+		c, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, c)
+		if err := c.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Generic) checkPlans(ctx context.Context) error {
+	if d.ExplainSQL == "" || d.FullScan == nil {
+		return nil
+	}
+	rev, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+	if rev < minPlanCheckRevision {
+		logrus.Debugf("Not checking query plans at revision %d", rev)
+		return nil
+	}
+
+	queries := []struct {
+		name string
+		sql  string
+		args []interface{}
+	}{
+		{"list", d.ListRevisionStartSQL, []interface{}{d.keyArg("/registry/pods/%"), rev, false}},
+		{"list from key", d.GetRevisionAfterSQL, []interface{}{d.keyArg("/registry/pods/%"), rev, d.keyArg("/registry/pods/"), rev, false}},
+		{"get", d.GetCurrentSQL, []interface{}{d.keyArg("/registry/health"), false}},
+		{"after", d.AfterSQL, []interface{}{d.keyArg("%"), rev}},
+	}
+	for _, q := range queries {
+		plan, err := d.queryPlan(ctx, q.sql, q.args...)
+		if err != nil {
+			return fmt.Errorf("explaining %s query: %v", q.name, err)
+		}
+		for _, line := range plan {
+			if d.FullScan(line) {
+				logrus.Warnf("The %s query scans the whole kine table, check that its indexes exist: %s\n%s", q.name, util.Stripped(q.sql), strings.Join(plan, "\n"))
+				break
+			}
+		}
+	}
+	return nil
+}
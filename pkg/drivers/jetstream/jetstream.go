@@ -2,6 +2,7 @@ package jetstream
 
 import (
 	"context"
+	cryptotls "crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -191,12 +192,33 @@ func parseNatsConnection(dsn string, tlsInfo tls.Config) (*Config, error) {
 		return jsConfig, fmt.Errorf("when using context endpoint no host should be provided")
 	}
 
-	if tlsInfo.KeyFile != "" && tlsInfo.CertFile != "" {
-		jsConfig.options = append(jsConfig.options, nats.ClientCert(tlsInfo.CertFile, tlsInfo.KeyFile))
-	}
+	if tlsInfo.CADir != "" || tlsInfo.CAURL != "" {
+		// refreshed CAs are verified by the TLS config from the shared client configuration
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return jsConfig, err
+		}
+		tlsConfig.MinVersion = cryptotls.VersionTLS12
+		jsConfig.options = append(jsConfig.options, nats.Secure(tlsConfig))
+	} else {
+		if tlsInfo.KeyFile != "" && tlsInfo.CertFile != "" {
+			if tlsInfo.KeyPassphrase != "" || tlsInfo.KeyPassphraseFile != "" {
+				cert, err := tlsInfo.Certificate()
+				if err != nil {
+					return jsConfig, err
+				}
+				jsConfig.options = append(jsConfig.options, nats.Secure(&cryptotls.Config{
+					Certificates: []cryptotls.Certificate{cert},
+					MinVersion:   cryptotls.VersionTLS12,
+				}))
+			} else {
+				jsConfig.options = append(jsConfig.options, nats.ClientCert(tlsInfo.CertFile, tlsInfo.KeyFile))
+			}
+		}
 
-	if tlsInfo.CAFile != "" {
-		jsConfig.options = append(jsConfig.options, nats.RootCAs(tlsInfo.CAFile))
+		if tlsInfo.CAFile != "" {
+			jsConfig.options = append(jsConfig.options, nats.RootCAs(tlsInfo.CAFile))
+		}
 	}
 
 	if hasContext {
@@ -649,41 +671,6 @@ func (j *JetStream) List(ctx context.Context, prefix, startKey string, limit, re
 	return rev, kvs, nil
 }
 
-func (j *JetStream) listAfter(ctx context.Context, prefix string, revision int64) (revRet int64, eventRet []*server.Event, errRet error) {
-
-	entries, err := j.getKeyValues(ctx, prefix, false)
-
-	if err != nil {
-		return 0, nil, err
-	}
-
-	rev, err := j.currentRevision()
-	if err != nil {
-		return 0, nil, err
-	}
-	if revision != 0 {
-		rev = revision
-	}
-	events := make([]*server.Event, 0)
-	for _, e := range entries {
-		kv, err := decode(e)
-		if err == nil && int64(e.Revision()) > revision {
-			event := server.Event{
-				Delete: kv.Delete,
-				Create: kv.Create,
-				KV:     kv.KV,
-				PrevKV: &server.KeyValue{},
-			}
-			if _, prevKV, err := j.Get(ctx, kv.KV.Key, kv.PrevRevision); err == nil && prevKV != nil {
-				event.PrevKV = prevKV
-			}
-
-			events = append(events, &event)
-		}
-	}
-	return rev, events, nil
-}
-
 // Count returns an exact count of the number of matching keys and the current revision of the database
 func (j *JetStream) Count(ctx context.Context, prefix string) (revRet int64, count int64, err error) {
 	start := time.Now()
@@ -784,72 +771,50 @@ func (j *JetStream) Update(ctx context.Context, key string, value []byte, revisi
 
 }
 
+// Watch returns the events for keys matching the prefix from a revision on. The
+// revisions are read in order by an ordered consumer on the stream of the
+// bucket, so that every revision retained by the bucket history is delivered,
+// not only the latest revision of each key.
 func (j *JetStream) Watch(ctx context.Context, prefix string, revision int64) <-chan []*server.Event {
+	result := make(chan []*server.Event, 100)
 
-	watcher, err := j.kvBucket.(*kv.EncodedKV).Watch(prefix, nats.IgnoreDeletes(), nats.Context(ctx))
-
-	if revision > 0 {
-		revision--
+	if revision < 0 {
+		revision = 0
 	}
-	_, events, err := j.listAfter(ctx, prefix, revision)
-
+	watcher, err := j.kvBucket.(*kv.EncodedKV).WatchFrom(ctx, j.jetStream, prefix, uint64(revision))
 	if err != nil {
-		logrus.Errorf("failed to create watcher %s for revision %d", prefix, revision)
+		logrus.Errorf("failed to create watcher %s for revision %d: %v", prefix, revision, err)
+		close(result)
+		return result
 	}
 
-	result := make(chan []*server.Event, 100)
-
 	go func() {
-
-		if len(events) > 0 {
-			result <- events
-			revision = events[len(events)-1].KV.ModRevision
-		}
-
+		defer close(result)
 		for {
 			select {
 			case i := <-watcher.Updates():
-				if i != nil {
-					if int64(i.Revision()) > revision {
-						events := make([]*server.Event, 1)
-						var err error
-						value := JSValue{
-							KV:           &server.KeyValue{},
-							PrevRevision: 0,
-							Create:       false,
-							Delete:       false,
-						}
-						prevValue := JSValue{
-							KV:           &server.KeyValue{},
-							PrevRevision: 0,
-							Create:       false,
-							Delete:       false,
-						}
-						lastEntry := &i
-
-						value, err = decode(*lastEntry)
-						if err != nil {
-							logrus.Warnf("watch event: could not decode %s seq %d", i.Key(), i.Revision())
-						}
-						if _, prevEntry, prevErr := j.get(ctx, i.Key(), value.PrevRevision, false); prevErr == nil {
-							if prevEntry != nil {
-								prevValue = *prevEntry
-							}
-						}
-						if err == nil {
-							event := &server.Event{
-								Create: value.Create,
-								Delete: value.Delete,
-								KV:     value.KV,
-								PrevKV: prevValue.KV,
-							}
-							events[0] = event
-							result <- events
-						} else {
-							logrus.Warnf("error decoding %s event %v", i.Key(), err)
-							continue
-						}
-					}
+				// deletes are written as a revision before the key is removed
+				if i == nil || i.Operation() != nats.KeyValuePut {
+					continue
+				}
+				value, err := decode(i)
+				if err != nil {
+					logrus.Warnf("error decoding %s event %v", i.Key(), err)
+					continue
+				}
+				prevKV := &server.KeyValue{}
+				if _, prevEntry, prevErr := j.get(ctx, i.Key(), value.PrevRevision, false); prevErr == nil && prevEntry != nil {
+					prevKV = prevEntry.KV
+				}
+				event := &server.Event{
+					Create: value.Create,
+					Delete: value.Delete,
+					KV:     value.KV,
+					PrevKV: prevKV,
+				}
+				select {
+				case result <- []*server.Event{event}:
+				case <-ctx.Done():
 				}
 			case <-ctx.Done():
 				logrus.Infof("watcher: %s context cancelled", prefix)
@@ -949,6 +914,16 @@ func (j *JetStream) compactRevision() (int64, error) {
 	return int64(status.(*nats.KeyValueBucketStatus).StreamInfo().State.FirstSeq), nil
 }
 
+// CompactRevision returns the revision before the first one retained by the
+// bucket, to match the semantics of compaction in the SQL backends.
+func (j *JetStream) CompactRevision(ctx context.Context) (int64, error) {
+	firstRev, err := j.compactRevision()
+	if err != nil || firstRev == 0 {
+		return 0, err
+	}
+	return firstRev - 1, nil
+}
+
 // getKeyValues returns a []nats.KeyValueEntry matching prefix
 func (j *JetStream) getKeyValues(ctx context.Context, prefix string, sortResults bool) ([]nats.KeyValueEntry, error) {
 	watcher, err := j.kvBucket.Watch(prefix, nats.IgnoreDeletes(), nats.Context(ctx))
@@ -0,0 +1,121 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	kvOperationHeader = "KV-Operation"
+	kvOperationDelete = "DEL"
+	kvOperationPurge  = "PURGE"
+)
+
+type streamWatcher struct {
+	sub     *nats.Subscription
+	updates chan nats.KeyValueEntry
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (w *streamWatcher) Context() context.Context           { return w.ctx }
+func (w *streamWatcher) Updates() <-chan nats.KeyValueEntry { return w.updates }
+func (w *streamWatcher) Stop() error {
+	w.cancel()
+	return w.sub.Unsubscribe()
+}
+
+// msgEntry is an entry of the bucket read from a message of its stream.
+type msgEntry struct {
+	bucket    string
+	key       string
+	value     []byte
+	revision  uint64
+	created   time.Time
+	delta     uint64
+	operation nats.KeyValueOp
+}
+
+func (e *msgEntry) Bucket() string             { return e.bucket }
+func (e *msgEntry) Key() string                { return e.key }
+func (e *msgEntry) Value() []byte              { return e.value }
+func (e *msgEntry) Revision() uint64           { return e.revision }
+func (e *msgEntry) Created() time.Time         { return e.created }
+func (e *msgEntry) Delta() uint64              { return e.delta }
+func (e *msgEntry) Operation() nats.KeyValueOp { return e.operation }
+
+// WatchFrom watches every revision of the keys from a revision on, in order,
+// using an ordered consumer on the stream of the bucket, or only the revisions
+// written from now on if the revision is zero. Unlike Watch, which starts with
+// the latest revision of each key, no revision after the start is skipped.
+func (e *EncodedKV) WatchFrom(ctx context.Context, js nats.JetStreamContext, keys string, revision uint64) (nats.KeyWatcher, error) {
+	ek, err := e.keyCodec.EncodeRange(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := e.bucket.Bucket()
+	subjectPrefix := "$KV." + bucket + "."
+	w := &streamWatcher{
+		updates: make(chan nats.KeyValueEntry, 32),
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+
+	opts := []nats.SubOpt{nats.BindStream("KV_" + bucket), nats.OrderedConsumer()}
+	if revision > 0 {
+		opts = append(opts, nats.StartSequence(revision))
+	} else {
+		opts = append(opts, nats.DeliverNew())
+	}
+
+	w.sub, err = js.Subscribe(subjectPrefix+ek, func(m *nats.Msg) {
+		meta, err := m.Metadata()
+		if err != nil {
+			logrus.Warnf("could not read metadata of %s: %v", m.Subject, err)
+			return
+		}
+		ent := &msgEntry{
+			bucket:    bucket,
+			value:     m.Data,
+			revision:  meta.Sequence.Stream,
+			created:   meta.Timestamp,
+			delta:     meta.NumPending,
+			operation: nats.KeyValuePut,
+		}
+		switch m.Header.Get(kvOperationHeader) {
+		case kvOperationDelete:
+			ent.operation = nats.KeyValueDelete
+		case kvOperationPurge:
+			ent.operation = nats.KeyValuePurge
+		}
+		ent.key, err = e.keyCodec.Decode(strings.TrimPrefix(m.Subject, subjectPrefix))
+		if err != nil {
+			logrus.Warnf("could not decode key %s: %v", m.Subject, err)
+			return
+		}
+		if len(ent.value) > 0 {
+			buf := new(bytes.Buffer)
+			if err := e.valueCodec.Decode(bytes.NewBuffer(ent.value), buf); err != nil {
+				logrus.Warnf("could not decode value for %s: %v", ent.key, err)
+				return
+			}
+			ent.value = buf.Bytes()
+		}
+
+		select {
+		case w.updates <- ent:
+		case <-w.ctx.Done():
+		}
+	}, opts...)
+	if err != nil {
+		w.cancel()
+		return nil, err
+	}
+
+	return w, nil
+}
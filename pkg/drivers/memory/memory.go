@@ -0,0 +1,445 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+	compactBatchSize = 1000
+	pollBatchSize    = 500
+)
+
+// revision is a revision of a key. Events are built from it on every read, so
+// that callers cannot modify the stored history.
+type revision struct {
+	name           string
+	rev            int64
+	create         bool
+	delete         bool
+	createRevision int64
+	prevRevision   int64
+	lease          int64
+	value          []byte
+	oldValue       []byte
+}
+
+func (r *revision) size() int64 {
+	return int64(len(r.name) + len(r.value) + len(r.oldValue))
+}
+
+func (r *revision) toEvent() *server.Event {
+	event := &server.Event{
+		Create: r.create,
+		Delete: r.delete,
+		KV: &server.KeyValue{
+			Key:            r.name,
+			CreateRevision: r.createRevision,
+			ModRevision:    r.rev,
+			Value:          r.value,
+			Lease:          r.lease,
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: r.prevRevision,
+			Value:       r.oldValue,
+		},
+	}
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event
+}
+
+// Memory is a log held entirely in memory, for tests and ephemeral clusters
+// that do not need their data to outlive the process. The log is a slice of
+// the revisions after the compact revision, in order, and a map from each key
+// to its revisions that have not been compacted, with a sorted slice of the
+// keys for listing by prefix.
+type Memory struct {
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	notify      chan int64
+	compactor   sync.Once
+
+	// mu guards the log, the keys and the revisions
+	mu       sync.RWMutex
+	log      []*revision
+	keys     map[string][]*revision
+	names    []string
+	revision int64
+	compact  int64
+	size     int64
+	// polled is the last revision delivered to watchers
+	polled int64
+}
+
+// New returns an empty in-memory backend. The endpoint has no address, for
+// example memory://.
+func New(ctx context.Context) server.Backend {
+	return logstructured.New(&Memory{
+		keys:   map[string][]*revision{},
+		notify: make(chan int64, 1024),
+	})
+}
+
+func (m *Memory) Start(ctx context.Context) error {
+	m.ctx = ctx
+	return nil
+}
+
+func (m *Memory) CurrentRevision(ctx context.Context) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.revision, nil
+}
+
+func (m *Memory) CompactRevision(ctx context.Context) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.compact, nil
+}
+
+// at returns the latest revision of a key at a revision, or nil if it has none.
+// It must be called with the lock held.
+func (m *Memory) at(name string, rev int64) *revision {
+	history := m.keys[name]
+	i := sort.Search(len(history), func(i int) bool {
+		return history[i].rev > rev
+	})
+	if i == 0 {
+		return nil
+	}
+	return history[i-1]
+}
+
+func (m *Memory) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rev := m.revision
+	if revision > 0 {
+		if revision < m.compact {
+			return rev, nil, server.ErrCompacted
+		}
+		rev = revision
+	}
+
+	var names []string
+	if strings.HasSuffix(prefix, "/") {
+		seek := prefix
+		if startKey != "" {
+			seek = startKey
+		}
+		for i := sort.SearchStrings(m.names, seek); i < len(m.names) && strings.HasPrefix(m.names[i], prefix); i++ {
+			names = append(names, m.names[i])
+		}
+	} else if _, ok := m.keys[prefix]; ok {
+		names = append(names, prefix)
+	}
+
+	var events []*server.Event
+	for _, name := range names {
+		r := m.at(name, rev)
+		if r == nil || (r.delete && !includeDeleted) {
+			continue
+		}
+		events = append(events, r.toEvent())
+		if limit > 0 && int64(len(events)) >= limit {
+			break
+		}
+	}
+	return rev, events, nil
+}
+
+func (m *Memory) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	checkPrefix := strings.HasSuffix(prefix, "/")
+	return m.after(revision, limit, func(name string) bool {
+		return (checkPrefix && strings.HasPrefix(name, prefix)) || name == prefix
+	})
+}
+
+// after returns the current revision and the events after a revision that
+// match, up to a limit.
+func (m *Memory) after(revision, limit int64, match func(name string) bool) (int64, []*server.Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if revision > 0 && revision < m.compact {
+		return m.revision, nil, server.ErrCompacted
+	}
+	// the log holds the revisions after the compact revision, without gaps
+	start := revision - m.compact
+	if start < 0 {
+		start = 0
+	} else if start > int64(len(m.log)) {
+		start = int64(len(m.log))
+	}
+
+	var events []*server.Event
+	for _, r := range m.log[start:] {
+		if !match(r.name) {
+			continue
+		}
+		events = append(events, r.toEvent())
+		if limit > 0 && int64(len(events)) >= limit {
+			break
+		}
+	}
+	return m.revision, events, nil
+}
+
+func (m *Memory) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	rev, events, err := m.List(ctx, prefix, "", 0, 0, false)
+	return rev, int64(len(events)), err
+}
+
+// Append writes an event at the next revision, if the latest revision of its
+// key is the previous revision of the event, or the event creates a key that
+// does not exist.
+func (m *Memory) Append(ctx context.Context, event *server.Event) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var prevRevision int64
+	if event.PrevKV != nil {
+		prevRevision = event.PrevKV.ModRevision
+	}
+	var latest int64
+	history := m.keys[event.KV.Key]
+	if len(history) > 0 {
+		latest = history[len(history)-1].rev
+	}
+	if (latest != 0 && latest != prevRevision) || (latest == 0 && !event.Create) {
+		return 0, server.ErrKeyExists
+	}
+
+	m.revision++
+	r := &revision{
+		name:           event.KV.Key,
+		rev:            m.revision,
+		create:         event.Create,
+		delete:         event.Delete,
+		createRevision: event.KV.CreateRevision,
+		// store the actual previous revision of the key, as a create passes the
+		// current revision when the key has none, and compaction deletes it
+		prevRevision: latest,
+		lease:        event.KV.Lease,
+		value:        append([]byte(nil), event.KV.Value...),
+	}
+	if event.PrevKV != nil {
+		r.oldValue = append([]byte(nil), event.PrevKV.Value...)
+	}
+
+	if len(history) == 0 {
+		i := sort.SearchStrings(m.names, r.name)
+		m.names = append(m.names, "")
+		copy(m.names[i+1:], m.names[i:])
+		m.names[i] = r.name
+	}
+	m.keys[r.name] = append(history, r)
+	m.log = append(m.log, r)
+	m.size += r.size()
+
+	select {
+	case m.notify <- r.rev:
+	default:
+	}
+	return r.rev, nil
+}
+
+func (m *Memory) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	values, err := m.broadcaster.Subscribe(ctx, m.startWatch)
+	if err != nil {
+		return nil
+	}
+	res := make(chan []*server.Event, cap(values))
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			events, ok := filter(i, checkPrefix, prefix)
+			if ok {
+				res <- events
+			}
+		}
+	}()
+
+	return res
+}
+
+func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Event, bool) {
+	eventList := events.([]*server.Event)
+	filteredEventList := make([]*server.Event, 0, len(eventList))
+
+	for _, event := range eventList {
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+			filteredEventList = append(filteredEventList, event)
+		}
+	}
+
+	return filteredEventList, len(filteredEventList) > 0
+}
+
+func (m *Memory) startWatch() (chan interface{}, error) {
+	pollStart, err := m.CompactRevision(m.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan interface{})
+	m.compactor.Do(func() {
+		go m.compactLoop()
+	})
+	go m.poll(ch, pollStart)
+	return ch, nil
+}
+
+// WatchRevision returns the last revision delivered to watchers, or zero if no
+// watch has been started.
+func (m *Memory) WatchRevision() int64 {
+	return atomic.LoadInt64(&m.polled)
+}
+
+// poll reads new events from the log whenever an append notifies it, and every
+// second in case a notification was dropped because the channel was full.
+func (m *Memory) poll(result chan interface{}, pollStart int64) {
+	wait := time.NewTicker(time.Second)
+	defer wait.Stop()
+	defer close(result)
+
+	last := pollStart
+	atomic.StoreInt64(&m.polled, last)
+	waitForMore := true
+	all := func(string) bool { return true }
+
+	for {
+		if waitForMore {
+			select {
+			case <-m.ctx.Done():
+				return
+			case check := <-m.notify:
+				if check <= last {
+					continue
+				}
+			case <-wait.C:
+			}
+		}
+
+		rev, events, err := m.after(last, pollBatchSize, all)
+		if err != nil {
+			logrus.Errorf("fail to list latest changes: %v", err)
+			waitForMore = true
+			continue
+		}
+		waitForMore = len(events) < pollBatchSize
+		if !waitForMore {
+			rev = events[len(events)-1].KV.ModRevision
+		}
+		if rev <= last {
+			continue
+		}
+		last = rev
+		atomic.StoreInt64(&m.polled, last)
+		if len(events) > 0 {
+			result <- events
+		}
+	}
+}
+
+// compactLoop periodically advances the compact revision, keeping the most
+// recent revisions, and removes the revisions up to it that have been
+// superseded, and deleted keys, in batches so that writes are not blocked for
+// long.
+func (m *Memory) compactLoop() {
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		current, _ := m.CurrentRevision(m.ctx)
+		target := current - compactMinRetain
+		for done := false; !done; {
+			done = m.compactBatch(target)
+		}
+		logrus.Debugf("COMPACT compacted to %d/%d", target, current)
+	}
+}
+
+// compactBatch compacts up to compactBatchSize revisions toward the target, and
+// returns true once the target is reached.
+func (m *Memory) compactBatch(target int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.compact >= target {
+		return true
+	}
+	n := target - m.compact
+	if n > compactBatchSize {
+		n = compactBatchSize
+	}
+
+	for _, r := range m.log[:n] {
+		if r.prevRevision > 0 {
+			m.remove(r.name, r.prevRevision)
+		}
+		if r.delete {
+			m.remove(r.name, r.rev)
+		}
+	}
+	// release the compacted revisions to the garbage collector
+	for i := range m.log[:n] {
+		m.log[i] = nil
+	}
+	m.log = m.log[n:]
+	m.compact += n
+	return m.compact >= target
+}
+
+// remove removes a revision of a key, and the key once it has no revisions. It
+// must be called with the lock held.
+func (m *Memory) remove(name string, rev int64) {
+	history := m.keys[name]
+	i := sort.Search(len(history), func(i int) bool {
+		return history[i].rev >= rev
+	})
+	if i == len(history) || history[i].rev != rev {
+		return
+	}
+	m.size -= history[i].size()
+	history = append(history[:i], history[i+1:]...)
+	if len(history) > 0 {
+		m.keys[name] = history
+		return
+	}
+
+	delete(m.keys, name)
+	j := sort.SearchStrings(m.names, name)
+	m.names = append(m.names[:j], m.names[j+1:]...)
+}
+
+// DbSize returns the size of the keys and values held.
+func (m *Memory) DbSize(ctx context.Context) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size, nil
+}
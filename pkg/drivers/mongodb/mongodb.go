@@ -0,0 +1,537 @@
+//go:build mongodb
+// +build mongodb
+
+package mongodb
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+const (
+	defaultDatabase = "kubernetes"
+	revisionID      = "revision"
+	compactID       = "compact"
+
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+)
+
+// record is a revision of a key, with the fields of a row of the kine table.
+// Revisions that have been superseded by a later revision of the same key are
+// marked, so that compaction does not need to look them up.
+type record struct {
+	ID             int64      `bson:"_id"`
+	Name           string     `bson:"name"`
+	Created        bool       `bson:"created"`
+	Deleted        bool       `bson:"deleted"`
+	CreateRevision int64      `bson:"create_revision"`
+	PrevRevision   int64      `bson:"prev_revision"`
+	Lease          int64      `bson:"lease"`
+	Value          []byte     `bson:"value"`
+	OldValue       []byte     `bson:"old_value"`
+	Superseded     bool       `bson:"superseded,omitempty"`
+	CompactedAt    *time.Time `bson:"compacted_at,omitempty"`
+}
+
+type counter struct {
+	Rev int64 `bson:"rev"`
+}
+
+// Mongo is a log stored in a MongoDB collection, with one document for each
+// revision. Revisions are allocated from a counter document in the same
+// transaction that inserts the revision, so that revisions are committed in
+// order and without gaps, and watches are driven by a change stream.
+type Mongo struct {
+	client      *mongo.Client
+	kine        *mongo.Collection
+	meta        *mongo.Collection
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	compactor   sync.Once
+	// watched is the last revision delivered to watchers
+	watched int64
+}
+
+// New connects to MongoDB. The endpoint is a MongoDB connection string, and the
+// database defaults to kubernetes. Transactions and change streams require a
+// replica set or sharded cluster.
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server.Backend, error) {
+	cs, err := connstring.ParseAndValidate(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	database := cs.Database
+	if database == "" {
+		database = defaultDatabase
+	}
+
+	opts := options.Client().ApplyURI(dataSourceName)
+	tlsConfig, err := tlsInfo.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	db := client.Database(database)
+	return logstructured.New(&Mongo{
+		client: client,
+		kine:   db.Collection("kine"),
+		meta:   db.Collection("kine_meta"),
+	}), nil
+}
+
+func (m *Mongo) Start(ctx context.Context) error {
+	m.ctx = ctx
+	if err := m.setup(ctx); err != nil {
+		return errors.Wrap(err, "setting up collections")
+	}
+	go func() {
+		<-ctx.Done()
+		m.client.Disconnect(context.Background())
+	}()
+	return nil
+}
+
+// setup creates the indexes of the kine collection and the counters. Compacted
+// revisions are removed by the TTL index on compacted_at.
+func (m *Mongo) setup(ctx context.Context) error {
+	logrus.Infof("Configuring collection indexes, this may take a moment...")
+	_, err := m.kine.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("kine_name_id_index"),
+		},
+		{
+			Keys:    bson.D{{Key: "name", Value: 1}, {Key: "prev_revision", Value: 1}},
+			Options: options.Index().SetName("kine_name_prev_revision_uindex").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "compacted_at", Value: 1}},
+			Options: options.Index().SetName("kine_compacted_at_index").SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range []string{revisionID, compactID} {
+		_, err := m.meta.UpdateOne(ctx,
+			bson.M{"_id": id},
+			bson.M{"$setOnInsert": bson.M{"rev": int64(0)}},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Collection indexes are up to date")
+	return nil
+}
+
+func (m *Mongo) counter(ctx context.Context, id string) (int64, error) {
+	var c counter
+	if err := m.meta.FindOne(ctx, bson.M{"_id": id}).Decode(&c); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return c.Rev, nil
+}
+
+func (m *Mongo) CurrentRevision(ctx context.Context) (int64, error) {
+	return m.counter(ctx, revisionID)
+}
+
+func (m *Mongo) CompactRevision(ctx context.Context) (int64, error) {
+	return m.counter(ctx, compactID)
+}
+
+// checkCompacted returns server.ErrCompacted if the revision has been compacted.
+func (m *Mongo) checkCompacted(ctx context.Context, revision int64) error {
+	if revision <= 0 {
+		return nil
+	}
+	compact, err := m.CompactRevision(ctx)
+	if err != nil {
+		return err
+	}
+	if revision < compact {
+		return server.ErrCompacted
+	}
+	return nil
+}
+
+// nameFilter matches the keys with a prefix ending in a slash, or otherwise the
+// key itself, as the SQL backends do.
+func nameFilter(prefix string) interface{} {
+	if strings.HasSuffix(prefix, "/") {
+		return bson.M{"$gte": prefix, "$lt": prefixEnd(prefix)}
+	}
+	return prefix
+}
+
+// prefixEnd returns the first key after all keys with the prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\xff"
+}
+
+func (m *Mongo) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	rev, err := m.CurrentRevision(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := m.checkCompacted(ctx, revision); err != nil {
+		return rev, nil, err
+	}
+	if revision > 0 {
+		rev = revision
+	}
+
+	match := bson.M{"name": nameFilter(prefix), "_id": bson.M{"$lte": rev}}
+	if strings.HasSuffix(prefix, "/") && startKey != "" && startKey != prefix {
+		match["name"] = bson.M{"$gte": startKey, "$lt": prefixEnd(prefix)}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$name", "doc": bson.M{"$first": "$$ROOT"}}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$doc"}}},
+	}
+	if !includeDeleted {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{"deleted": false}}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: bson.M{"name": 1}}})
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+
+	cursor, err := m.kine.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, nil, err
+	}
+	events, err := decodeAll(ctx, cursor)
+	return rev, events, err
+}
+
+func (m *Mongo) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	rev, err := m.CurrentRevision(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := m.checkCompacted(ctx, revision); err != nil {
+		return rev, nil, err
+	}
+
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cursor, err := m.kine.Find(ctx, bson.M{"name": nameFilter(prefix), "_id": bson.M{"$gt": revision}}, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	events, err := decodeAll(ctx, cursor)
+	if err != nil {
+		return 0, nil, err
+	}
+	// revisions committed after the counter was read may have been found, and
+	// are reported as covered so that watches do not send them twice
+	if n := len(events); n > 0 && events[n-1].KV.ModRevision > rev {
+		rev = events[n-1].KV.ModRevision
+	}
+	return rev, events, nil
+}
+
+func (m *Mongo) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	rev, err := m.CurrentRevision(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	cursor, err := m.kine.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"name": nameFilter(prefix), "_id": bson.M{"$lte": rev}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$name", "deleted": bson.M{"$first": "$deleted"}}}},
+		{{Key: "$match", Value: bson.M{"deleted": false}}},
+		{{Key: "$count", Value: "count"}},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var result struct {
+		Count int64 `bson:"count"`
+	}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&result); err != nil {
+			return 0, 0, err
+		}
+	}
+	return rev, result.Count, cursor.Err()
+}
+
+// Append writes an event at the next revision. The insert fails on the unique
+// index on name and previous revision if another write to the key won the
+// race, in which case the transaction is aborted and no revision is used.
+func (m *Mongo) Append(ctx context.Context, event *server.Event) (int64, error) {
+	e := *event
+	if e.KV == nil {
+		e.KV = &server.KeyValue{}
+	}
+	if e.PrevKV == nil {
+		e.PrevKV = &server.KeyValue{}
+	}
+
+	session, err := m.client.StartSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.EndSession(ctx)
+
+	rev, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		var c counter
+		err := m.meta.FindOneAndUpdate(sc,
+			bson.M{"_id": revisionID},
+			bson.M{"$inc": bson.M{"rev": int64(1)}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&c)
+		if err != nil {
+			return nil, err
+		}
+
+		r := record{
+			ID:             c.Rev,
+			Name:           e.KV.Key,
+			Created:        e.Create,
+			Deleted:        e.Delete,
+			CreateRevision: e.KV.CreateRevision,
+			PrevRevision:   e.PrevKV.ModRevision,
+			Lease:          e.KV.Lease,
+			Value:          e.KV.Value,
+			OldValue:       e.PrevKV.Value,
+		}
+		if _, err := m.kine.InsertOne(sc, r); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return nil, server.ErrKeyExists
+			}
+			return nil, err
+		}
+
+		if r.PrevRevision > 0 {
+			_, err := m.kine.UpdateOne(sc,
+				bson.M{"_id": r.PrevRevision, "name": r.Name},
+				bson.M{"$set": bson.M{"superseded": true}})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return r.ID, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rev.(int64), nil
+}
+
+func (m *Mongo) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	values, err := m.broadcaster.Subscribe(ctx, m.startWatch)
+	if err != nil {
+		return nil
+	}
+	res := make(chan []*server.Event, cap(values))
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			events, ok := filter(i, checkPrefix, prefix)
+			if ok {
+				res <- events
+			}
+		}
+	}()
+
+	return res
+}
+
+func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Event, bool) {
+	eventList := events.([]*server.Event)
+	filteredEventList := make([]*server.Event, 0, len(eventList))
+
+	for _, event := range eventList {
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+			filteredEventList = append(filteredEventList, event)
+		}
+	}
+
+	return filteredEventList, len(filteredEventList) > 0
+}
+
+// startWatch opens a change stream of the revisions inserted from now on. The
+// stream is open before returning, so that no revision committed after the
+// caller lists the current state is missed. If the stream fails, watches are
+// closed and clients are expected to re-watch.
+func (m *Mongo) startWatch() (chan interface{}, error) {
+	stream, err := m.kine.Watch(m.ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"operationType": "insert"}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.compactor.Do(func() {
+		go m.compact()
+	})
+
+	c := make(chan interface{})
+	go func() {
+		defer close(c)
+		defer stream.Close(context.Background())
+
+		for stream.Next(m.ctx) {
+			var change struct {
+				FullDocument record `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				logrus.Errorf("Failed to decode change: %v", err)
+				return
+			}
+			event := toEvent(&change.FullDocument)
+			atomic.StoreInt64(&m.watched, event.KV.ModRevision)
+			c <- []*server.Event{event}
+		}
+		if err := stream.Err(); err != nil && m.ctx.Err() == nil {
+			logrus.Errorf("Change stream failed, closing watches: %v", err)
+		}
+	}()
+	return c, nil
+}
+
+// WatchRevision returns the last revision delivered to watchers, or zero if no
+// watch has been started.
+func (m *Mongo) WatchRevision() int64 {
+	return atomic.LoadInt64(&m.watched)
+}
+
+// compact periodically advances the compact revision, keeping the most recent
+// revisions, and marks revisions up to it that have been superseded or deleted
+// as compacted. They are then removed in the background by the TTL index. The
+// compact revision only moves forward, so instances compacting concurrently do
+// not conflict.
+func (m *Mongo) compact() {
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		current, err := m.CurrentRevision(m.ctx)
+		if err != nil {
+			logrus.Errorf("Compact failed to get current revision: %v", err)
+			continue
+		}
+		target := current - compactMinRetain
+		if target <= 0 {
+			continue
+		}
+
+		_, err = m.meta.UpdateOne(m.ctx, bson.M{"_id": compactID}, bson.M{"$max": bson.M{"rev": target}})
+		if err != nil {
+			logrus.Errorf("Compact failed to set compact revision: %v", err)
+			continue
+		}
+		res, err := m.kine.UpdateMany(m.ctx,
+			bson.M{
+				"_id":          bson.M{"$lte": target},
+				"$or":          bson.A{bson.M{"superseded": true}, bson.M{"deleted": true}},
+				"compacted_at": bson.M{"$exists": false},
+			},
+			bson.M{"$currentDate": bson.M{"compacted_at": true}})
+		if err != nil {
+			logrus.Errorf("Compact failed to mark revisions: %v", err)
+			continue
+		}
+		logrus.Debugf("COMPACT marked %d revisions - compacted to %d/%d", res.ModifiedCount, target, current)
+	}
+}
+
+func (m *Mongo) DbSize(ctx context.Context) (int64, error) {
+	var stats struct {
+		StorageSize    int64 `bson:"storageSize"`
+		TotalIndexSize int64 `bson:"totalIndexSize"`
+	}
+	err := m.kine.Database().RunCommand(ctx, bson.D{{Key: "collStats", Value: m.kine.Name()}}).Decode(&stats)
+	return stats.StorageSize + stats.TotalIndexSize, err
+}
+
+func decodeAll(ctx context.Context, cursor *mongo.Cursor) ([]*server.Event, error) {
+	var records []record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	events := make([]*server.Event, 0, len(records))
+	for i := range records {
+		events = append(events, toEvent(&records[i]))
+	}
+	return events, nil
+}
+
+func toEvent(r *record) *server.Event {
+	event := &server.Event{
+		Create: r.Created,
+		Delete: r.Deleted,
+		KV: &server.KeyValue{
+			Key:            r.Name,
+			CreateRevision: r.CreateRevision,
+			ModRevision:    r.ID,
+			Value:          r.Value,
+			Lease:          r.Lease,
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: r.PrevRevision,
+			Value:       r.OldValue,
+		},
+	}
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event
+}
@@ -0,0 +1,102 @@
+//go:build mssql
+// +build mssql
+
+package mssql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/microsoft/go-mssqldb/msdsn"
+)
+
+const (
+	fedAuthParam = "fedauth"
+
+	// the fedauth values are those of the azuread driver of go-mssqldb
+	fedAuthMSI              = "ActiveDirectoryMSI"
+	fedAuthManagedIdentity  = "ActiveDirectoryManagedIdentity"
+	fedAuthServicePrincipal = "ActiveDirectoryServicePrincipal"
+	fedAuthDefault          = "ActiveDirectoryDefault"
+
+	azureSQLScope = "https://database.windows.net//.default"
+)
+
+// azureAD signs in to Azure SQL with a Microsoft Entra ID token instead of a
+// password. The credential is kept between connections so that it can cache
+// tokens, and is only replaced if the settings it was created from change.
+type azureAD struct {
+	mu         sync.Mutex
+	key        string
+	credential azcore.TokenCredential
+}
+
+// tokenProvider returns a function that gets tokens for the fedauth mode of the
+// connection settings:
+//
+//   - ActiveDirectoryMSI or ActiveDirectoryManagedIdentity use the managed
+//     identity of the host, or the user-assigned identity whose client id is the
+//     username, if set.
+//   - ActiveDirectoryServicePrincipal uses the service principal whose client
+//     id and tenant id are the username, as client-id@tenant-id, with the client
+//     secret as the password.
+//   - ActiveDirectoryDefault uses the credential chain of the Azure SDK, which
+//     reads the environment, workload identity and managed identity.
+func (a *azureAD) tokenProvider(config msdsn.Config, fedAuth string) (func(context.Context) (string, error), error) {
+	credential, err := a.getCredential(config, fedAuth)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) (string, error) {
+		token, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azureSQLScope}})
+		if err != nil {
+			return "", err
+		}
+		return token.Token, nil
+	}, nil
+}
+
+func (a *azureAD) getCredential(config msdsn.Config, fedAuth string) (azcore.TokenCredential, error) {
+	key := strings.Join([]string{fedAuth, config.User, config.Password}, "\x00")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.credential != nil && a.key == key {
+		return a.credential, nil
+	}
+
+	var (
+		credential azcore.TokenCredential
+		err        error
+	)
+	switch fedAuth {
+	case fedAuthMSI, fedAuthManagedIdentity:
+		options := &azidentity.ManagedIdentityCredentialOptions{}
+		if config.User != "" {
+			options.ID = azidentity.ClientID(config.User)
+		}
+		credential, err = azidentity.NewManagedIdentityCredential(options)
+	case fedAuthServicePrincipal:
+		i := strings.LastIndex(config.User, "@")
+		if i < 0 || config.Password == "" {
+			return nil, fmt.Errorf("%s requires the username to be client-id@tenant-id and the password to be the client secret", fedAuthServicePrincipal)
+		}
+		credential, err = azidentity.NewClientSecretCredential(config.User[i+1:], config.User[:i], config.Password, nil)
+	case fedAuthDefault:
+		credential, err = azidentity.NewDefaultAzureCredential(nil)
+	default:
+		return nil, fmt.Errorf("unsupported mssql fedauth %q, must be %s, %s, %s or %s", fedAuth, fedAuthMSI, fedAuthManagedIdentity, fedAuthServicePrincipal, fedAuthDefault)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a.key = key
+	a.credential = credential
+	return credential, nil
+}
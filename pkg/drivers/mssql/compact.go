@@ -0,0 +1,59 @@
+//go:build mssql
+// +build mssql
+
+package mssql
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	compactBatchParam = "compact_batch_size"
+	// defaultCompactBatch is below the 5000 locks at which SQL Server escalates
+	// the locks of a statement to a lock on the whole table, which would block
+	// writes until the compaction commits.
+	defaultCompactBatch = 4000
+)
+
+// compactSQL deletes the rows superseded or deleted before a revision in
+// batches of up to batch rows, so that each statement holds a bounded number of
+// locks and writes a bounded amount of log. The compactor commits every
+// compact batch of revisions, after which the log can be truncated.
+func compactSQL(batch int64) string {
+	return fmt.Sprintf(`
+		DECLARE @batch BIGINT = %d, @deleted BIGINT = 1;
+		WHILE @deleted > 0
+		BEGIN
+			DELETE TOP (@batch) kv FROM kine AS kv
+			INNER JOIN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= @p1
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= @p2
+			) AS ks
+			ON kv.id = ks.id;
+			SET @deleted = @@ROWCOUNT;
+		END;`, batch)
+}
+
+// parseCompactBatch returns the number of rows deleted by each statement of a
+// compaction, from the compact_batch_size parameter.
+func parseCompactBatch(value string) (int64, error) {
+	if value == "" {
+		return defaultCompactBatch, nil
+	}
+	batch, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || batch <= 0 {
+		return 0, fmt.Errorf("invalid mssql %s %q, must be a positive number of rows", compactBatchParam, value)
+	}
+	return batch, nil
+}
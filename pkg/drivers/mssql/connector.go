@@ -0,0 +1,86 @@
+//go:build mssql
+// +build mssql
+
+package mssql
+
+import (
+	"context"
+	cryptotls "crypto/tls"
+	"database/sql/driver"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/microsoft/go-mssqldb/msdsn"
+)
+
+// connector opens connections with the data source name returned by dsn, and
+// the TLS configuration from the kine flags, which cannot be expressed in a
+// data source name as the CAs and client certificate may be reloaded. If the
+// fedauth parameter is set, it signs in with a token from Azure AD.
+type connector struct {
+	dsn       generic.DSNFunc
+	tlsConfig *cryptotls.Config
+	azureAD   azureAD
+}
+
+// config returns the connection settings for a new connection.
+func (c *connector) config(ctx context.Context) (msdsn.Config, error) {
+	dataSourceName, err := c.dsn(ctx)
+	if err != nil {
+		return msdsn.Config{}, err
+	}
+	config, err := msdsn.Parse(dataSourceName)
+	if err != nil {
+		return msdsn.Config{}, err
+	}
+	if c.tlsConfig == nil || config.Encryption == msdsn.EncryptionDisabled {
+		return config, nil
+	}
+
+	tlsConfig := c.tlsConfig.Clone()
+	if config.TLSConfig != nil {
+		// the driver sets the server name from the host, or hostNameInCertificate
+		// if set, and skips verification if TrustServerCertificate is set
+		tlsConfig.ServerName = config.TLSConfig.ServerName
+		if config.TLSConfig.InsecureSkipVerify {
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyConnection = nil
+		}
+		// CAs from the certificate parameter are used if no CA flags are set
+		if tlsConfig.RootCAs == nil && tlsConfig.VerifyConnection == nil {
+			tlsConfig.RootCAs = config.TLSConfig.RootCAs
+		}
+	}
+	config.TLSConfig = tlsConfig
+	return config, nil
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	config, err := c.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := c.driverConnector(config)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+// driverConnector returns the connector of the driver for the connection
+// settings.
+func (c *connector) driverConnector(config msdsn.Config) (driver.Connector, error) {
+	fedAuth := config.Parameters[fedAuthParam]
+	if fedAuth == "" {
+		return mssql.NewConnectorConfig(config), nil
+	}
+	tokenProvider, err := c.azureAD.tokenProvider(config, fedAuth)
+	if err != nil {
+		return nil, err
+	}
+	return mssql.NewSecurityTokenConnector(config, tokenProvider)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return &mssql.Driver{}
+}
@@ -0,0 +1,521 @@
+//go:build mssql
+// +build mssql
+
+package mssql
+
+import (
+	"context"
+	cryptotls "crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/credentials"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/prometheus/client_golang/prometheus"
+
+	// Azure Key Vault provider for Always Encrypted column master keys
+	_ "github.com/microsoft/go-mssqldb/aecmk/akv"
+	// Kerberos provider for integrated authentication
+	_ "github.com/microsoft/go-mssqldb/integratedauth/krb5"
+)
+
+const (
+	defaultDSN       = "sqlserver://sa@localhost:1433"
+	defaultDatabase  = "kubernetes"
+	driverName       = "sqlserver"
+	paramCharacter   = "@p"
+	errDuplicateKey  = 2627
+	errDuplicateUniq = 2601
+
+	columnEncryptionKeyParam = "column_encryption_key"
+	replicaHostParam         = "replica_host"
+)
+
+var (
+	columns = "kv.id AS theid, kv.name, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value"
+	revSQL  = `
+		SELECT MAX(rkv.id) AS id
+		FROM kine AS rkv`
+
+	compactRevSQL = `
+		SELECT MAX(crkv.prev_revision) AS prev_revision
+		FROM kine AS crkv
+		WHERE crkv.name = 'compact_rev_key'`
+
+	idOfKey = `
+		AND
+		mkv.id <= ? AND
+		mkv.id > (
+			SELECT MAX(ikv.id) AS id
+			FROM kine AS ikv
+			WHERE
+				ikv.name = ? AND
+				ikv.id <= ?)`
+
+	// currentSQL differs from the generic statement in that the columns of the
+	// derived tables are all named, and the boolean parameter is compared, as
+	// T-SQL requires. It is not ordered, so that it can be counted.
+	currentSQL = fmt.Sprintf(`
+		SELECT (%s) AS rev, (%s) AS compact_rev, %s
+		FROM kine AS kv
+		JOIN (
+			SELECT MAX(mkv.id) AS id
+			FROM kine AS mkv
+			WHERE
+				mkv.name LIKE ?
+				%%s
+			GROUP BY mkv.name) AS maxkv
+			ON maxkv.id = kv.id
+		WHERE
+			kv.deleted = 0 OR
+			? = 1`, revSQL, compactRevSQL, columns)
+
+	listSQL = currentSQL + `
+		ORDER BY kv.id ASC`
+
+	insertColumns = "name, created, deleted, create_revision, prev_revision, lease, value, old_value"
+)
+
+// New connects to SQL Server or Azure SQL Database with the sqlserver driver.
+// The data source name is a sqlserver URL without the scheme, such as
+// user:password@host:1433?database=kubernetes.
+//
+// If any of the backend TLS flags are set, the connection is encrypted and the
+// server certificate verified with them, unless the encrypt parameter says
+// otherwise. The TrustServerCertificate and hostNameInCertificate parameters
+// of the driver still apply.
+//
+// The fedauth parameter signs in to Azure SQL with Azure AD instead of a
+// password, with the modes of the azuread driver of go-mssqldb:
+// ActiveDirectoryMSI, ActiveDirectoryServicePrincipal and ActiveDirectoryDefault.
+//
+// Integrated authentication signs in to SQL Server as a Windows or Active
+// Directory account. On Windows, kine signs in as the account it runs as if no
+// username is given. Elsewhere, the authenticator=krb5 parameter signs in with
+// Kerberos, as the principal in the username with the key in the keytab named
+// by krb5-keytabfile, or with the tickets in the cache named by
+// krb5-credcachefile. krb5-configfile names the Kerberos configuration, which
+// is /etc/krb5.conf by default, and krb5-realm the realm of the principal.
+//
+// The column_encryption_key parameter turns on Always Encrypted, and names the
+// column encryption key that the value columns of a new table are encrypted
+// with. The key and its column master key must already exist, and the column
+// master key must be held in Azure Key Vault, which is signed in to with the
+// credential chain of the Azure SDK.
+//
+// The replica_host parameter names the host and port of a readable secondary
+// of an availability group, or of the listener, which routes connections with
+// read-only intent to a secondary. Lists at past revisions and polls for
+// changes are read from it, so that they do not load the primary.
+//
+// The compact_batch_size parameter is the number of rows that compaction
+// deletes with each statement, 4000 by default.
+//
+// If the partition_size parameter is set, a new table is partitioned into
+// ranges of that many revisions, and compaction truncates each partition once
+// all of its revisions can be compacted, keeping the rows that survive, rather
+// than deleting rows one by one. Truncating a partition needs the ALTER
+// permission on the table, and blocks other statements on it briefly.
+//
+// Serverless Azure SQL databases are paused when idle, and fail connections
+// until they resume, so connections are retried for up to the resume timeout.
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, credsProvider credentials.Provider, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	if config.BinaryKeys {
+		return nil, errors.New("binary keys are not supported by the mssql driver, as SQL Server cannot match binary columns with LIKE")
+	}
+
+	tlsConfig, err := tlsInfo.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		tlsConfig.MinVersion = cryptotls.VersionTLS12
+	}
+
+	dataSourceName, columnEncryptionKey, err := cutColumnEncryptionKey(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	dataSourceName, replicaHost, err := cutParam(dataSourceName, replicaHostParam)
+	if err != nil {
+		return nil, err
+	}
+	dataSourceName, compactBatchValue, err := cutParam(dataSourceName, compactBatchParam)
+	if err != nil {
+		return nil, err
+	}
+	compactBatch, err := parseCompactBatch(compactBatchValue)
+	if err != nil {
+		return nil, err
+	}
+	dataSourceName, partitionSizeValue, err := cutParam(dataSourceName, partitionSizeParam)
+	if err != nil {
+		return nil, err
+	}
+	partitionSize, err := parsePartitionSize(partitionSizeValue)
+	if err != nil {
+		return nil, err
+	}
+	if partitionSize > 0 && columnEncryptionKey != "" {
+		return nil, fmt.Errorf("%s cannot be used with %s, as compaction copies the rows it keeps", partitionSizeParam, columnEncryptionKeyParam)
+	}
+	parsedDSN, err := prepareDSN(dataSourceName, tlsConfig != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	dsn := func(ctx context.Context) (string, error) {
+		if credsProvider == nil {
+			return parsedDSN, nil
+		}
+		creds, err := credsProvider.Get(ctx)
+		if err != nil {
+			return "", err
+		}
+		if creds.DataSourceName != "" {
+			dataSourceName, err := prepareDSN(creds.DataSourceName, tlsConfig != nil)
+			if err != nil {
+				return "", err
+			}
+			return withCredentials(dataSourceName, creds)
+		}
+		return withCredentials(parsedDSN, creds)
+	}
+
+	// serverless databases are paused when idle, and fail connections while
+	// they resume
+	connPoolConfig.Resuming = resuming
+	primary := &connector{dsn: dsn, tlsConfig: tlsConfig}
+
+	if !config.SkipDDL() {
+		if err := createDBIfNotExist(ctx, primary, connPoolConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if credsProvider != nil {
+		creds, err := credsProvider.Get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		connPoolConfig.MaxLifetime = creds.ConnMaxLifetime(connPoolConfig.MaxLifetime)
+	}
+	dialect, err := generic.OpenWithConnector(ctx, driverName, primary, connPoolConfig, paramCharacter, true, metricsRegisterer)
+	if err != nil {
+		return nil, err
+	}
+
+	dialect.ApplyConfig(config)
+	configure(dialect)
+	dialect.CompactSQL = compactSQL(compactBatch)
+
+	var replica *connector
+	switch {
+	case replicaHost != "" && connPoolConfig.ReaderDSN != "":
+		dialect.Close()
+		return nil, fmt.Errorf("%s cannot be used with a reader endpoint", replicaHostParam)
+	case replicaHost != "":
+		replica = &connector{dsn: replicaDSN(dsn, replicaHost), tlsConfig: tlsConfig}
+	case connPoolConfig.ReaderDSN != "":
+		// the reader connects with the credentials in its own data source
+		// name, as those from the provider are for the writer
+		readerDSN, err := prepareDSN(connPoolConfig.ReaderDSN, tlsConfig != nil)
+		if err != nil {
+			dialect.Close()
+			return nil, err
+		}
+		replica = &connector{dsn: func(context.Context) (string, error) { return readerDSN, nil }, tlsConfig: tlsConfig}
+	}
+	if replica != nil {
+		if err := dialect.OpenReplicaPoolWithConnector(driverName, replica, connPoolConfig, metricsRegisterer); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	}
+
+	if config.DryRun {
+		// setup only logs the schema migrations that would be applied
+		if err := setup(dialect.DB, config, columnEncryptionKey, partitionSize); err != nil && err != generic.ErrDDLDisabled {
+			dialect.Close()
+			return nil, err
+		}
+	}
+	if !config.SkipDDL() {
+		if err := setup(dialect.DB, config, columnEncryptionKey, partitionSize); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	}
+	if err := configurePartitions(ctx, dialect, config, partitionSize); err != nil {
+		dialect.Close()
+		return nil, err
+	}
+	if config.SkipDDL() {
+		if err := dialect.CheckSchema(ctx); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	}
+	if columnEncryptionKey != "" {
+		if err := checkEncryption(ctx, dialect.DB, config); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	}
+	go dialect.MonitorDrift(ctx, config.DriftCheckInterval)
+	return logstructured.New(sqllog.New(dialect)), nil
+}
+
+// configure replaces the statements of the dialect that are not valid T-SQL.
+func configure(dialect *generic.Generic) {
+	// index names are unique per table
+	dialect.Table().KeepIndexNames = true
+	dialect.GetCurrentSQL = q(fmt.Sprintf(listSQL, ""))
+	dialect.ListRevisionStartSQL = q(fmt.Sprintf(listSQL, "AND mkv.id <= ?"))
+	dialect.GetRevisionAfterSQL = q(fmt.Sprintf(listSQL, idOfKey))
+	if dialect.Checksums {
+		dialect.SelectChecksums()
+	}
+	// the revision is selected alongside the count rather than with it, as
+	// SQL Server does not allow subqueries next to aggregates
+	dialect.CountSQL = q(fmt.Sprintf(`
+		SELECT (%s), (
+			SELECT COUNT(c.theid)
+			FROM (
+				%s
+			) AS c)`, revSQL, fmt.Sprintf(currentSQL, "")))
+	dialect.DeleteSQL = q(`
+		DELETE FROM kine
+		WHERE id = ?`)
+
+	// rows are inserted with their id by turning on IDENTITY_INSERT for the
+	// statement only, as inserts without an id fail while it is on
+	names := dialect.InsertColumns()
+	params := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+	dialect.InsertSQL = q(fmt.Sprintf(`INSERT INTO kine(%s)
+			OUTPUT INSERTED.id
+			VALUES(%s)`, strings.Join(names, ", "), params))
+	dialect.FillSQL = q(`
+		SET IDENTITY_INSERT kine ON;
+		BEGIN TRY
+			INSERT INTO kine(id, ` + insertColumns + `)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?);
+		END TRY
+		BEGIN CATCH
+			SET IDENTITY_INSERT kine OFF;
+			THROW;
+		END CATCH;
+		SET IDENTITY_INSERT kine OFF;`)
+	dialect.LimitSQL = "%s OFFSET 0 ROWS FETCH NEXT %d ROWS ONLY"
+	// pages reserved for the table, its indexes and its out-of-row values,
+	// which needs the VIEW DATABASE STATE permission
+	dialect.GetSizeSQL = `
+		SELECT COALESCE(SUM(ps.reserved_page_count), 0) * 8192
+		FROM sys.dm_db_partition_stats AS ps
+		WHERE ps.object_id = OBJECT_ID(N'kine')`
+	// SQL Server returns plans for statements run after SET SHOWPLAN, rather
+	// than for a prefix, so plans are not explained
+	dialect.ExplainSQL = ""
+	dialect.ColumnsSQL = `
+		SELECT c.name
+		FROM sys.columns AS c
+		WHERE c.object_id = OBJECT_ID(N'kine')`
+	dialect.IndexesSQL = `
+		SELECT i.name, i.is_unique
+		FROM sys.indexes AS i
+		WHERE i.object_id = OBJECT_ID(N'kine') AND i.name IS NOT NULL`
+	dialect.CreateIndexSQL = `CREATE %sINDEX %s ON kine (%s)`
+	// statements that fail with transient errors are retried with a backoff
+	// that allows for failovers
+	dialect.RetryPolicy.Retryable = retryable
+	dialect.RetryPolicy.Backoff = retryBackoff
+	dialect.TranslateErr = func(err error) error {
+		if number, ok := errorNumber(err); ok && (number == errDuplicateKey || number == errDuplicateUniq || number == errDuplicatePrevRevision) {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		if number, ok := errorNumber(err); ok {
+			return fmt.Sprint(number)
+		}
+		return err.Error()
+	}
+}
+
+// errorNumber returns the number of a SQL Server error.
+func errorNumber(err error) (int32, bool) {
+	var sqlErr interface{ SQLErrorNumber() int32 }
+	if errors.As(err, &sqlErr) {
+		return sqlErr.SQLErrorNumber(), true
+	}
+	return 0, false
+}
+
+// q rewrites the placeholders in a statement to the numbered parameters of the
+// sqlserver driver.
+func q(sql string) string {
+	regex := regexp.MustCompile(`\?`)
+	n := 0
+	return regex.ReplaceAllStringFunc(sql, func(string) string {
+		n++
+		return paramCharacter + strconv.Itoa(n)
+	})
+}
+
+// cutParam removes a kine parameter from a data source name, and returns the
+// remaining data source name and the value of the parameter, which is empty if
+// it was not set.
+func cutParam(dataSourceName, name string) (string, string, error) {
+	i := strings.IndexRune(dataSourceName, '?')
+	if i < 0 {
+		return dataSourceName, "", nil
+	}
+	params, err := url.ParseQuery(dataSourceName[i+1:])
+	if err != nil {
+		return "", "", err
+	}
+	value := params.Get(name)
+	if value == "" {
+		return dataSourceName, "", nil
+	}
+
+	params.Del(name)
+	dataSourceName = dataSourceName[:i]
+	if len(params) > 0 {
+		dataSourceName += "?" + params.Encode()
+	}
+	return dataSourceName, value, nil
+}
+
+// cutColumnEncryptionKey removes the column_encryption_key parameter from a
+// data source name, and turns on the column encryption of the driver if it is
+// set. It returns the data source name and the name of the key.
+func cutColumnEncryptionKey(dataSourceName string) (string, string, error) {
+	dataSourceName, key, err := cutParam(dataSourceName, columnEncryptionKeyParam)
+	if err != nil || key == "" {
+		return dataSourceName, key, err
+	}
+	i := strings.IndexRune(dataSourceName, '?')
+	if i < 0 {
+		return dataSourceName + "?columnencryption=true", key, nil
+	}
+	params, err := url.ParseQuery(dataSourceName[i+1:])
+	if err != nil {
+		return "", "", err
+	}
+	if params.Get("columnencryption") == "" {
+		params.Set("columnencryption", "true")
+	}
+	return dataSourceName[:i] + "?" + params.Encode(), key, nil
+}
+
+// replicaDSN returns a function that returns the data source name for the
+// replica at host, which is connected to with read-only intent, so that an
+// availability group listener routes it to a readable secondary.
+func replicaDSN(dsn generic.DSNFunc, host string) generic.DSNFunc {
+	return func(ctx context.Context) (string, error) {
+		dataSourceName, err := dsn(ctx)
+		if err != nil {
+			return "", err
+		}
+		u, err := url.Parse(dataSourceName)
+		if err != nil {
+			return "", err
+		}
+		u.Host = host
+		params := u.Query()
+		for k := range params {
+			if strings.EqualFold(k, "applicationintent") {
+				params.Del(k)
+			}
+		}
+		params.Set("applicationintent", "ReadOnly")
+		u.RawQuery = params.Encode()
+		return u.String(), nil
+	}
+}
+
+// checkEncryption returns an error if the value columns are not encrypted, as
+// Always Encrypted cannot encrypt the columns of an existing table with T-SQL.
+func checkEncryption(ctx context.Context, db *sql.DB, config generic.Config) error {
+	table, err := config.Table()
+	if err != nil {
+		return err
+	}
+	var plaintext int
+	row := db.QueryRowContext(ctx, table.SQL(`
+		SELECT COUNT(*)
+		FROM sys.columns
+		WHERE
+			object_id = OBJECT_ID(N'kine') AND
+			name IN (N'value', N'old_value') AND
+			encryption_type IS NULL`))
+	if err := row.Scan(&plaintext); err != nil {
+		return err
+	}
+	if plaintext > 0 {
+		return errors.New("the value columns of the kine table are not encrypted; encrypt them with SQL Server Management Studio or the SqlServer PowerShell module, or remove the column_encryption_key parameter")
+	}
+	return nil
+}
+
+// quoteName returns a T-SQL identifier in brackets.
+func quoteName(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+// prepareDSN returns the data source name with the scheme and the default
+// database, and encryption required if TLS is configured, unless the encrypt
+// parameter is set.
+func prepareDSN(dataSourceName string, encrypt bool) (string, error) {
+	if len(dataSourceName) == 0 {
+		dataSourceName = defaultDSN
+	} else {
+		dataSourceName = "sqlserver://" + dataSourceName
+	}
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+	params := u.Query()
+	if params.Get("database") == "" {
+		params.Set("database", defaultDatabase)
+	}
+	if _, ok := params["encrypt"]; encrypt && !ok {
+		params.Set("encrypt", "true")
+	}
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+// withCredentials returns the data source name with the username and password
+// replaced by those in the provided credentials, if set.
+func withCredentials(dataSourceName string, creds credentials.Credentials) (string, error) {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+	username := u.User.Username()
+	password, _ := u.User.Password()
+	if creds.Username != "" {
+		username = creds.Username
+	}
+	if creds.Password != "" {
+		password = creds.Password
+	}
+	u.User = url.UserPassword(username, password)
+	return u.String(), nil
+}
@@ -0,0 +1,19 @@
+//go:build !mssql
+// +build !mssql
+
+package mssql
+
+import (
+	"context"
+	"errors"
+
+	"github.com/k3s-io/kine/pkg/credentials"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, credsProvider credentials.Provider, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	return nil, errors.New(`this binary is built without SQL Server support, compile with "-tags mssql"`)
+}
@@ -0,0 +1,19 @@
+//go:build mssql && noddl
+// +build mssql,noddl
+
+package mssql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+func setup(db *sql.DB, config generic.Config, columnEncryptionKey string, partitionSize int64) error {
+	return generic.ErrDDLDisabled
+}
+
+func createDBIfNotExist(ctx context.Context, c *connector, connPoolConfig generic.ConnectionPoolConfig) error {
+	return generic.ErrDDLDisabled
+}
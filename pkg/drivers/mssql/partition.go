@@ -0,0 +1,196 @@
+//go:build mssql
+// +build mssql
+
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	partitionSizeParam = "partition_size"
+	// errDuplicatePrevRevision is raised by the trigger that keeps the name
+	// and previous revision unique in a partitioned table.
+	errDuplicatePrevRevision = 50001
+)
+
+var (
+	// partitionFunctionSQL returns the partition function of the kine table, if
+	// it is partitioned.
+	partitionFunctionSQL = `
+		SELECT pf.name
+		FROM sys.indexes AS i
+		INNER JOIN sys.partition_schemes AS ps ON ps.data_space_id = i.data_space_id
+		INNER JOIN sys.partition_functions AS pf ON pf.function_id = ps.function_id
+		WHERE i.object_id = OBJECT_ID(N'kine') AND i.index_id <= 1`
+	// partitionedIndexesSQL reports the index on the name and previous revision
+	// as unique while the trigger that enforces it is enabled.
+	partitionedIndexesSQL = `
+		SELECT i.name, CAST(CASE
+			WHEN i.is_unique = 1 THEN 1
+			WHEN i.name = N'kine_name_prev_revision_uindex' AND EXISTS (
+				SELECT 1
+				FROM sys.triggers AS t
+				WHERE t.parent_id = i.object_id AND t.name = N'%s' AND t.is_disabled = 0) THEN 1
+			ELSE 0 END AS BIT)
+		FROM sys.indexes AS i
+		WHERE i.object_id = OBJECT_ID(N'kine') AND i.name IS NOT NULL`
+	// splitPartitionsSQL adds partitions of the same size as the last, until
+	// there are two empty partitions above the current revision. Splitting an
+	// empty partition only changes metadata.
+	splitPartitionsSQL = `
+		DECLARE @first BIGINT, @last BIGINT, @count BIGINT, @size BIGINT, @max BIGINT;
+		SELECT
+			@first = MIN(CONVERT(BIGINT, prv.value)),
+			@last = MAX(CONVERT(BIGINT, prv.value)),
+			@count = COUNT(*)
+		FROM sys.partition_range_values AS prv
+		INNER JOIN sys.partition_functions AS pf ON pf.function_id = prv.function_id
+		WHERE pf.name = N'%[1]s';
+		SET @size = CASE WHEN @count > 1 THEN (@last - @first) / (@count - 1) ELSE @last END;
+		SELECT @max = COALESCE(MAX(id), 0) FROM kine;
+		WHILE @last < @max + 2 * @size
+		BEGIN
+			SET @last = @last + @size;
+			ALTER PARTITION FUNCTION %[1]s() SPLIT RANGE (@last);
+		END;`
+)
+
+// parsePartitionSize returns the number of revisions in each partition of a new
+// table from the partition_size parameter, or zero if the table is not to be
+// partitioned.
+func parsePartitionSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid mssql %s %q, must be a positive number of revisions", partitionSizeParam, value)
+	}
+	return size, nil
+}
+
+// partitionNames returns the names of the partition function and scheme for a
+// new table. Both are database objects, so they are named after the schema as
+// well as the table.
+func partitionNames(table *generic.Table) (string, string) {
+	prefix := table.Name
+	if table.Schema != "" {
+		prefix = table.Schema + "_" + table.Name
+	}
+	return prefix + "_partition_function", prefix + "_partition_scheme"
+}
+
+// uniqueTrigger returns the name of the trigger that keeps the name and
+// previous revision unique in a partitioned table. Triggers are named within
+// the schema of their table, so it is named after the table.
+func uniqueTrigger(table *generic.Table) string {
+	return table.Name + "_name_prev_revision_trigger"
+}
+
+// partitionFunction returns the partition function of the kine table, or an
+// empty string if it is not partitioned.
+func partitionFunction(ctx context.Context, db *sql.DB, table *generic.Table) (string, error) {
+	var function string
+	err := db.QueryRowContext(ctx, table.SQL(partitionFunctionSQL)).Scan(&function)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return function, err
+}
+
+// partitionCompactSQL compacts each partition of revisions that is entirely
+// below the compact revision by copying the rows that survive compaction aside,
+// truncating the partition, and inserting them back with their ids. This is
+// much faster than deleting the rows of the partition one by one, but rows are
+// only removed once the whole of their partition can be compacted, so up to a
+// partition of revisions is kept beyond the compact revision. The id is cast
+// when the copy is created so that it does not have the identity property.
+func partitionCompactSQL(function string, columns []string) string {
+	return fmt.Sprintf(`
+		DECLARE @prev BIGINT, @partition INT, @truncate NVARCHAR(200);
+		SELECT @prev = COALESCE(MAX(prev_revision), 0) FROM kine WHERE name = 'compact_rev_key';
+		DROP TABLE IF EXISTS #kine_keep;
+		SELECT TOP (0) CAST(id AS BIGINT) AS id, %[2]s INTO #kine_keep FROM kine;
+		DECLARE partitions CURSOR LOCAL FAST_FORWARD FOR
+			SELECT prv.boundary_id
+			FROM sys.partition_range_values AS prv
+			INNER JOIN sys.partition_functions AS pf ON pf.function_id = prv.function_id
+			WHERE
+				pf.name = N'%[1]s' AND
+				CONVERT(BIGINT, prv.value) > @prev + 1 AND
+				CONVERT(BIGINT, prv.value) <= @p1 + 1
+			ORDER BY prv.boundary_id;
+		OPEN partitions;
+		FETCH NEXT FROM partitions INTO @partition;
+		WHILE @@FETCH_STATUS = 0
+		BEGIN
+			INSERT INTO #kine_keep (id, %[2]s)
+			SELECT kv.id, %[2]s
+			FROM kine AS kv
+			WHERE
+				$PARTITION.%[1]s(kv.id) = @partition AND
+				kv.deleted = 0 AND
+				NOT EXISTS (
+					SELECT 1
+					FROM kine AS kp
+					WHERE
+						kp.prev_revision = kv.id AND
+						kp.name != 'compact_rev_key' AND
+						kp.id <= @p2);
+			SET @truncate = N'TRUNCATE TABLE kine WITH (PARTITIONS (' + CONVERT(NVARCHAR(10), @partition) + N'))';
+			EXEC sp_executesql @truncate;
+			SET IDENTITY_INSERT kine ON;
+			BEGIN TRY
+				INSERT INTO kine (id, %[2]s)
+				SELECT id, %[2]s FROM #kine_keep;
+			END TRY
+			BEGIN CATCH
+				SET IDENTITY_INSERT kine OFF;
+				THROW;
+			END CATCH;
+			SET IDENTITY_INSERT kine OFF;
+			TRUNCATE TABLE #kine_keep;
+			FETCH NEXT FROM partitions INTO @partition;
+		END;
+		CLOSE partitions;
+		DROP TABLE #kine_keep;`, function, strings.Join(columns, ", "))
+}
+
+// configurePartitions compacts the kine table by partition if it is
+// partitioned, and adds partitions as the revision grows unless DDL is
+// disabled, in which case partitions must be added by the administrator.
+func configurePartitions(ctx context.Context, dialect *generic.Generic, config generic.Config, partitionSize int64) error {
+	table, err := config.Table()
+	if err != nil {
+		return err
+	}
+	function, err := partitionFunction(ctx, dialect.DB, table)
+	if err != nil {
+		return err
+	}
+	if function == "" {
+		if partitionSize > 0 {
+			logrus.Warnf("The kine table was created without partitions, %s is ignored", partitionSizeParam)
+		}
+		return nil
+	}
+
+	logrus.Infof("Compacting the partitions of the kine table with partition function %s", function)
+	dialect.CompactSQL = partitionCompactSQL(function, dialect.InsertColumns())
+	dialect.IndexesSQL = fmt.Sprintf(partitionedIndexesSQL, uniqueTrigger(table))
+	if config.SkipDDL() {
+		return nil
+	}
+	dialect.PostCompactSQL = fmt.Sprintf(splitPartitionsSQL, function)
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(dialect.PostCompactSQL))
+	return dialect.PostCompact(ctx)
+}
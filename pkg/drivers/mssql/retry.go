@@ -0,0 +1,67 @@
+//go:build mssql
+// +build mssql
+
+package mssql
+
+import (
+	"time"
+)
+
+const (
+	retryMinWait = 100 * time.Millisecond
+	retryMaxWait = 10 * time.Second
+)
+
+// transient are the errors that Azure SQL returns while a database is moved or
+// failed over, or is short of resources, which succeed if retried:
+//
+//	4060  cannot open the database requested by the login
+//	10928 resource limit reached
+//	10929 resource limit reached, the minimum guarantee is not available
+//	40197 error processing the request, usually a failover or upgrade
+//	40501 the service is busy
+//	40613 the database is not currently available
+var transient = map[int32]bool{
+	4060:  true,
+	10928: true,
+	10929: true,
+	40197: true,
+	40501: true,
+	40613: true,
+}
+
+// resuming returns true for the errors returned while a serverless Azure SQL
+// database resumes from an automatic pause, which takes up to a minute:
+//
+//	40613 the database is not currently available
+//	40197 error processing the request
+//	40501 the service is busy
+//
+// Other errors, such as a failed login, are not resolved by waiting.
+func resuming(err error) bool {
+	number, ok := errorNumber(err)
+	return ok && (number == 40613 || number == 40197 || number == 40501)
+}
+
+// errDeadlock is returned to the transaction chosen as the victim of a
+// deadlock, which has been rolled back and succeeds if retried.
+const errDeadlock = 1205
+
+// retryable returns true for errors that succeed if retried.
+func retryable(err error) bool {
+	number, ok := errorNumber(err)
+	return ok && (transient[number] || number == errDeadlock)
+}
+
+// retryBackoff returns a wait that doubles with each attempt, up to a limit, as
+// Azure SQL failovers take seconds to complete.
+func retryBackoff(attempt uint) time.Duration {
+	if attempt >= 16 {
+		return retryMaxWait
+	}
+	wait := retryMinWait << attempt
+	if wait > retryMaxWait {
+		return retryMaxWait
+	}
+	return wait
+}
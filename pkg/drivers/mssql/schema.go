@@ -0,0 +1,243 @@
+//go:build mssql && !noddl
+// +build mssql,!noddl
+
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// Keys are stored as UTF-8 with a binary collation, which needs SQL Server
+	// 2019 or Azure SQL Database, so that they are limited in bytes and sorted
+	// byte by byte as in the other drivers.
+	tableSchema = `IF OBJECT_ID(N'kine', N'U') IS NULL
+			CREATE TABLE kine
+				(
+					id BIGINT IDENTITY(1,1) NOT NULL,
+					name VARCHAR(%[1]d) COLLATE Latin1_General_100_BIN2_UTF8 NOT NULL,
+					created INT,
+					deleted INT,
+					create_revision BIGINT,
+					prev_revision BIGINT,
+					lease BIGINT,
+					value VARBINARY(MAX)%[2]s,
+					old_value VARBINARY(MAX)%[2]s,
+					PRIMARY KEY CLUSTERED (id)
+				)%[3]s`
+	schema = []string{
+		createIndex("kine_name_index", `CREATE INDEX kine_name_index ON kine (name)`),
+		createIndex("kine_name_id_index", `CREATE INDEX kine_name_id_index ON kine (name, id)`),
+		createIndex("kine_id_deleted_index", `CREATE INDEX kine_id_deleted_index ON kine (id, deleted)`),
+		createIndex("kine_prev_revision_index", `CREATE INDEX kine_prev_revision_index ON kine (prev_revision)`),
+	}
+	uniqueIndex = createIndex("kine_name_prev_revision_uindex", `CREATE UNIQUE INDEX kine_name_prev_revision_uindex ON kine (name, prev_revision)`)
+	// Partitions can only be truncated if every index is partitioned by id,
+	// and a unique index can only be partitioned by its own columns, so in a
+	// partitioned table the name and previous revision are kept unique by a
+	// trigger instead. The trigger reads the rows of concurrent inserts with
+	// locks, even if row versioning is on, so that of two inserts with the same
+	// name and previous revision one fails or is chosen as a deadlock victim,
+	// and fails when retried.
+	partitionedIndex = createIndex("kine_name_prev_revision_uindex", `CREATE INDEX kine_name_prev_revision_uindex ON kine (name, prev_revision)`)
+	uniqueTriggerSQL = `IF NOT EXISTS (
+			SELECT 1
+			FROM sys.triggers
+			WHERE parent_id = OBJECT_ID(N'kine') AND name = N'%[1]s')
+			EXEC(N'CREATE TRIGGER %[1]s ON kine AFTER INSERT AS
+				BEGIN
+					SET NOCOUNT ON;
+					IF EXISTS (
+						SELECT 1
+						FROM inserted AS i
+						INNER JOIN kine AS kv WITH (READCOMMITTEDLOCK)
+						ON kv.name = i.name AND kv.prev_revision = i.prev_revision AND kv.id != i.id)
+					BEGIN
+						THROW %[2]d, ''Duplicate name and prev_revision'', 1;
+					END;
+				END')`
+	// The columnstore index leaves out the values, which are only read by row.
+	// Columnstore indexes on partitioned tables are partitioned with them, so
+	// partitions can still be truncated.
+	columnstoreIndex = createIndex("kine_columnstore_index", `CREATE NONCLUSTERED COLUMNSTORE INDEX kine_columnstore_index
+			ON kine (id, name, created, deleted, create_revision, prev_revision, lease%s)`)
+	// new tables are partitioned into ranges of ids with a partition function
+	// of the given size, to which partitions are added as the revision grows
+	createPartitions = `IF OBJECT_ID(N'kine', N'U') IS NULL AND NOT EXISTS (
+			SELECT 1
+			FROM sys.partition_functions
+			WHERE name = N'%[1]s')
+		BEGIN
+			CREATE PARTITION FUNCTION %[1]s (BIGINT) AS RANGE RIGHT FOR VALUES (%[3]d);
+			CREATE PARTITION SCHEME %[2]s AS PARTITION %[1]s ALL TO ([PRIMARY]);
+		END`
+	expirySchema = []string{
+		`IF COL_LENGTH(N'kine', N'expires_at') IS NULL
+			ALTER TABLE kine ADD expires_at BIGINT`,
+		createIndex("kine_expires_at_index", `CREATE INDEX kine_expires_at_index ON kine (expires_at)`),
+	}
+	checksumSchema = `IF COL_LENGTH(N'kine', N'checksum') IS NULL
+			ALTER TABLE kine ADD checksum BIGINT`
+	// values are encrypted with randomized encryption, as they are never
+	// compared by the database
+	encryptedColumn = ` ENCRYPTED WITH (COLUMN_ENCRYPTION_KEY = %s, ENCRYPTION_TYPE = RANDOMIZED, ALGORITHM = 'AEAD_AES_256_CBC_HMAC_SHA_256')`
+	createSchema    = `IF SCHEMA_ID(N'%s') IS NULL EXEC('CREATE SCHEMA %s')`
+	versionTableSQL = `IF OBJECT_ID(N'kine_schema_version', N'U') IS NULL
+			CREATE TABLE kine_schema_version
+				(
+					version INT NOT NULL PRIMARY KEY,
+					description NVARCHAR(255),
+					applied_at BIGINT
+				)`
+	createDB = `IF DB_ID(@p1) IS NULL EXEC('CREATE DATABASE ' + QUOTENAME(@p1))`
+)
+
+// createIndex guards an index statement, as T-SQL has no CREATE INDEX IF NOT
+// EXISTS.
+func createIndex(name, stmt string) string {
+	return fmt.Sprintf(`IF NOT EXISTS (
+			SELECT 1
+			FROM sys.indexes
+			WHERE object_id = OBJECT_ID(N'kine') AND name = N'%s')
+			%s`, name, stmt)
+}
+
+// migrations returns the migrations of the kine table, in order. Migrations
+// that have been released must not be changed.
+func migrations(config generic.Config, encryption string, partitionSize int64) []generic.Migration {
+	return []generic.Migration{
+		{
+			Version:     1,
+			Description: "create the kine table and its indexes",
+			Apply: func(db *sql.DB, table *generic.Table) error {
+				return createTable(db, table, config, encryption, partitionSize)
+			},
+		},
+	}
+}
+
+// setup creates the kine table. If a column encryption key is given, the value
+// columns of a new table are encrypted with it, and if a partition size is
+// given, a new table is partitioned into ranges of that many revisions.
+func setup(db *sql.DB, config generic.Config, columnEncryptionKey string, partitionSize int64) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	encryption := ""
+	if columnEncryptionKey != "" {
+		encryption = fmt.Sprintf(encryptedColumn, quoteName(columnEncryptionKey))
+	}
+	table, err := config.Table()
+	if err != nil {
+		return err
+	}
+	table.KeepIndexNames = true
+	if table.Schema != "" && !config.DryRun {
+		stmt := fmt.Sprintf(createSchema, table.Schema, table.Schema)
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	migrator := &generic.Migrator{
+		DB:              db,
+		Table:           table,
+		Migrations:      migrations(config, encryption, partitionSize),
+		VersionTableSQL: versionTableSQL,
+		DryRun:          config.DryRun,
+	}
+	if err := migrator.Run(); err != nil || config.DryRun {
+		return err
+	}
+
+	var stmts []string
+	if config.TTLColumn {
+		stmts = append(stmts, expirySchema...)
+	}
+	if config.Checksums {
+		stmts = append(stmts, checksumSchema)
+	}
+	if config.Columnstore {
+		columns := ""
+		if config.TTLColumn {
+			columns = ", expires_at"
+		}
+		stmts = append(stmts, fmt.Sprintf(columnstoreIndex, columns))
+	}
+	for _, stmt := range stmts {
+		stmt = table.SQL(stmt)
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+// createTable creates the kine table and its indexes. A table created before
+// migrations were recorded is kept as it is, with or without partitions, and
+// missing indexes are added to it.
+func createTable(db *sql.DB, table *generic.Table, config generic.Config, encryption string, partitionSize int64) error {
+	partitions := ""
+	if partitionSize > 0 {
+		function, scheme := partitionNames(table)
+		stmt := table.SQL(fmt.Sprintf(createPartitions, function, scheme, partitionSize))
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+		partitions = fmt.Sprintf("\n\t\t\t\tON %s (id)", scheme)
+	}
+	stmt := table.SQL(fmt.Sprintf(tableSchema, config.KeyColumnLength(), encryption, partitions))
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+	if _, err := db.Exec(stmt); err != nil {
+		return err
+	}
+
+	// the table may have been created with or without partitions before
+	function, err := partitionFunction(context.Background(), db, table)
+	if err != nil {
+		return err
+	}
+	stmts := append(schema[:len(schema):len(schema)], uniqueIndex)
+	if function != "" {
+		stmts = append(schema[:len(schema):len(schema)], partitionedIndex, fmt.Sprintf(uniqueTriggerSQL, uniqueTrigger(table), errDuplicatePrevRevision))
+	}
+	for _, stmt := range stmts {
+		stmt = table.SQL(stmt)
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDBIfNotExist creates the database named in the data source, connecting
+// to the default database of the login to do so if it does not exist.
+func createDBIfNotExist(ctx context.Context, c *connector, connPoolConfig generic.ConnectionPoolConfig) error {
+	config, err := c.config(ctx)
+	if err != nil {
+		return err
+	}
+	dbName := config.Database
+	config.Database = ""
+
+	connector, err := c.driverConnector(config)
+	if err != nil {
+		return err
+	}
+	db := sql.OpenDB(connPoolConfig.WaitForResume(connector))
+	defer db.Close()
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(createDB))
+	_, err = db.ExecContext(ctx, createDB, dbName)
+	return err
+}
@@ -0,0 +1,35 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+// binaryCollation is used for text keys, so that keys that differ only in case
+// or accents are not treated as equal.
+const binaryCollation = "utf8mb4_bin"
+
+var nameColumnSQL = `
+	SELECT COLLATION_NAME, CHARACTER_MAXIMUM_LENGTH
+	FROM information_schema.COLUMNS
+	WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'kine' AND COLUMN_NAME = 'name'`
+
+// checkCollation returns the maximum length of the name column, and an error if
+// the column uses a collation that does not compare keys byte by byte.
+func checkCollation(db *sql.DB, table *generic.Table) (int64, error) {
+	var (
+		collation sql.NullString
+		length    sql.NullInt64
+	)
+	if err := db.QueryRow(table.SQL(nameColumnSQL)).Scan(&collation, &length); err != nil {
+		return 0, err
+	}
+	// binary strings have no collation
+	if collation.Valid && !strings.HasSuffix(collation.String, "_bin") {
+		return length.Int64, fmt.Errorf("the name column of the kine table uses collation %s, which may treat distinct keys as equal, instead of %s", collation.String, binaryCollation)
+	}
+	return length.Int64, nil
+}
@@ -0,0 +1,171 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// galeraNodesParam is the query parameter of the data source name that lists
+// the nodes of a Galera cluster, in order of priority for writes.
+const galeraNodesParam = "galera_nodes"
+
+// galeraRetryable are the errors that Galera returns for transactions that can
+// succeed if retried: deadlocks (1213), which is how certification failures
+// of conflicting writes on other nodes are reported, lock wait timeouts (1205),
+// and statements sent to a node that is not synced with the cluster (1047).
+var galeraRetryable = map[uint16]bool{
+	1047: true,
+	1205: true,
+	1213: true,
+}
+
+// parseGalera removes the Galera parameters from a data source name, and
+// returns the remaining data source name and the addresses of the nodes, if
+// any were listed.
+func parseGalera(dataSourceName string) (string, []string, error) {
+	dataSourceName, value, err := CutParam(dataSourceName, galeraNodesParam)
+	if err != nil || value == "" {
+		return dataSourceName, nil, err
+	}
+
+	var nodes []string
+	for _, node := range strings.Split(value, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return dataSourceName, nodes, nil
+}
+
+// isGalera returns true if the server is a node of a Galera cluster.
+func isGalera(ctx context.Context, db *sql.DB) (bool, error) {
+	var name, value string
+	err := db.QueryRowContext(ctx, "SHOW VARIABLES LIKE 'wsrep_on'").Scan(&name, &value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return strings.EqualFold(value, "ON"), err
+}
+
+// configureGalera adjusts the dialect for Galera.
+func configureGalera(dialect *generic.Generic) {
+	dialect.RetryPolicy.Retryable = func(err error) bool {
+		if err, ok := err.(*mysql.MySQLError); ok {
+			return galeraRetryable[err.Number]
+		}
+		return false
+	}
+}
+
+// openGalera opens the pools for a Galera cluster. Writes are sent to the first
+// node in the list that is synced with the cluster, so that concurrent writes
+// do not fail certification against each other, and reads are spread over all
+// the synced nodes. Reads wait for the node to apply the writes committed
+// before them, so that they are as consistent as reads from the write node.
+func openGalera(ctx context.Context, nodes []string, dsn generic.DSNFunc, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (*generic.Generic, error) {
+	writeConfig := connPoolConfig
+	writeConfig.ReadPool = false
+	dialect, err := generic.OpenWithConnector(ctx, "mysql", &galeraConnector{dsn: dsn, nodes: nodes}, writeConfig, "?", false, metricsRegisterer)
+	if err != nil {
+		return nil, err
+	}
+	if err := dialect.OpenReadPoolWithConnector("mysql", &galeraConnector{dsn: dsn, nodes: nodes, read: true}, connPoolConfig, metricsRegisterer); err != nil {
+		dialect.Close()
+		return nil, err
+	}
+	return dialect, nil
+}
+
+// galeraConnector connects to a node of a Galera cluster that is synced with
+// the cluster. Connections for writes go to the first such node in the list,
+// and connections for reads go to each node in turn.
+type galeraConnector struct {
+	dsn   generic.DSNFunc
+	nodes []string
+	read  bool
+	next  uint32
+}
+
+func (c *galeraConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	dataSourceName, err := c.dsn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config, err := mysql.ParseDSN(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if c.read {
+		start = int(atomic.AddUint32(&c.next, 1))
+	}
+	for i := range c.nodes {
+		node := c.nodes[(start+i)%len(c.nodes)]
+		nodeConfig := config.Clone()
+		nodeConfig.Addr = node
+		if c.read {
+			if nodeConfig.Params == nil {
+				nodeConfig.Params = map[string]string{}
+			}
+			if _, ok := nodeConfig.Params["wsrep_sync_wait"]; !ok {
+				nodeConfig.Params["wsrep_sync_wait"] = "1"
+			}
+		}
+
+		var conn driver.Conn
+		connector, err := mysql.NewConnector(nodeConfig)
+		if err == nil {
+			conn, err = connector.Connect(ctx)
+		}
+		if err == nil && !galeraNodeReady(ctx, conn) {
+			conn.Close()
+			err = fmt.Errorf("node is not synced with the cluster")
+		}
+		if err != nil {
+			logrus.Debugf("Failed to connect to galera node %s: %v", node, err)
+			continue
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("no galera node of %s is available", strings.Join(c.nodes, ","))
+}
+
+func (c *galeraConnector) Driver() driver.Driver {
+	return &mysql.MySQLDriver{}
+}
+
+// galeraNodeReady returns true if the node of a connection accepts queries,
+// which Galera nodes only do once they are synced with the cluster.
+func galeraNodeReady(ctx context.Context, conn driver.Conn) bool {
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return true
+	}
+	rows, err := queryer.QueryContext(ctx, "SHOW STATUS LIKE 'wsrep_ready'", nil)
+	if err != nil {
+		return false
+	}
+	defer rows.Close()
+
+	values := make([]driver.Value, len(rows.Columns()))
+	if err := rows.Next(values); err != nil || len(values) < 2 {
+		return false
+	}
+	switch value := values[1].(type) {
+	case []byte:
+		return strings.EqualFold(string(value), "ON")
+	case string:
+		return strings.EqualFold(value, "ON")
+	}
+	return false
+}
@@ -3,16 +3,19 @@ package mysql
 import (
 	"context"
 	cryptotls "crypto/tls"
-	"database/sql"
 	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/k3s-io/kine/pkg/credentials"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/logstructured"
 	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/tls"
-	"github.com/k3s-io/kine/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
@@ -22,55 +25,59 @@ const (
 	defaultHostDSN = "root@tcp(127.0.0.1)/"
 )
 
-var (
-	schema = []string{
-		`CREATE TABLE IF NOT EXISTS kine
-			(
-				id INTEGER AUTO_INCREMENT,
-				name VARCHAR(630),
-				created INTEGER,
-				deleted INTEGER,
-				create_revision INTEGER,
- 				prev_revision INTEGER,
-				lease INTEGER,
-				value MEDIUMBLOB,
-				old_value MEDIUMBLOB,
-				PRIMARY KEY (id)
-			);`,
-		`CREATE INDEX kine_name_index ON kine (name)`,
-		`CREATE INDEX kine_name_id_index ON kine (name,id)`,
-		`CREATE INDEX kine_id_deleted_index ON kine (id,deleted)`,
-		`CREATE INDEX kine_prev_revision_index ON kine (prev_revision)`,
-		`CREATE UNIQUE INDEX kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
-	}
-	createDB = "CREATE DATABASE IF NOT EXISTS "
-)
+// retryable are the errors that succeed if the statement is retried: deadlocks
+// (1213) and lock wait timeouts (1205).
+var retryable = map[uint16]bool{
+	1205: true,
+	1213: true,
+}
 
-func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
-	tlsConfig, err := tlsInfo.ClientConfig()
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, credsProvider credentials.Provider, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	dataSourceName, galeraNodes, err := parseGalera(dataSourceName)
 	if err != nil {
 		return nil, err
 	}
 
-	if tlsConfig != nil {
-		tlsConfig.MinVersion = cryptotls.VersionTLS11
+	parsedDSN, dsn, err := DSNFunc(dataSourceName, tlsInfo, credsProvider)
+	if err != nil {
+		return nil, err
 	}
 
-	parsedDSN, err := prepareDSN(dataSourceName, tlsConfig)
+	initialDSN, err := dsn(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := createDBIfNotExist(parsedDSN); err != nil {
-		return nil, err
+	if !config.SkipDDL() {
+		if err := createDBIfNotExist(initialDSN); err != nil {
+			return nil, err
+		}
 	}
 
-	dialect, err := generic.Open(ctx, "mysql", parsedDSN, connPoolConfig, "?", false, metricsRegisterer)
+	var dialect *generic.Generic
+	if credsProvider != nil {
+		var creds credentials.Credentials
+		if creds, err = credsProvider.Get(ctx); err != nil {
+			return nil, err
+		}
+		connPoolConfig.MaxLifetime = creds.ConnMaxLifetime(connPoolConfig.MaxLifetime)
+	}
+	switch {
+	case len(galeraNodes) > 0:
+		dialect, err = openGalera(ctx, galeraNodes, dsn, connPoolConfig, metricsRegisterer)
+	case credsProvider != nil:
+		dialect, err = generic.OpenWithDSNFunc(ctx, "mysql", dsn, connPoolConfig, "?", false, metricsRegisterer)
+	default:
+		dialect, err = generic.Open(ctx, "mysql", parsedDSN, connPoolConfig, "?", false, metricsRegisterer)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	dialect.ApplyConfig(config)
 	dialect.LastInsertID = true
+	// the access type is the fifth column of the plan, and is ALL for a full scan
+	dialect.FullScan = regexp.MustCompile(`^(?:[^|]*\|){2} [^<|][^|]*\|[^|]*\| ALL \|`).MatchString
 	dialect.GetSizeSQL = `
 		SELECT SUM(data_length + index_length)
 		FROM information_schema.TABLES
@@ -92,6 +99,22 @@ func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, connPoo
 				kd.id <= ?
 		) AS ks
 		ON kv.id = ks.id`
+	dialect.ColumnsSQL = `
+		SELECT COLUMN_NAME
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'kine'`
+	dialect.IndexesSQL = `
+		SELECT INDEX_NAME, MIN(NON_UNIQUE) = 0
+		FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'kine'
+		GROUP BY INDEX_NAME`
+	dialect.CreateIndexSQL = `CREATE %sINDEX %s ON kine (%s) ALGORITHM=INPLACE LOCK=NONE`
+	dialect.RetryPolicy.Retryable = func(err error) bool {
+		if err, ok := err.(*mysql.MySQLError); ok {
+			return retryable[err.Number]
+		}
+		return false
+	}
 	dialect.TranslateErr = func(err error) error {
 		if err, ok := err.(*mysql.MySQLError); ok && err.Number == 1062 {
 			return server.ErrKeyExists
@@ -107,58 +130,140 @@ func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, connPoo
 		}
 		return err.Error()
 	}
-	if err := setup(dialect.DB); err != nil {
+
+	tidb, err := isTiDB(ctx, dialect.DB)
+	if err != nil {
+		dialect.Close()
 		return nil, err
 	}
+	if tidb {
+		logrus.Infof("Detected TiDB, using TiDB table options, compaction batches and retries")
+		configureTiDB(dialect)
+	}
 
-	dialect.Migrate(context.Background())
-	return logstructured.New(sqllog.New(dialect)), nil
-}
-
-func setup(db *sql.DB) error {
-	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+	galera, err := isGalera(ctx, dialect.DB)
+	if err != nil {
+		dialect.Close()
+		return nil, err
+	}
+	if galera {
+		logrus.Infof("Detected Galera, retrying deadlocks and certification failures")
+		configureGalera(dialect)
+	} else if len(galeraNodes) > 0 {
+		logrus.Warnf("%s is set, but the server is not a Galera node", galeraNodesParam)
+	}
 
-	for _, stmt := range schema {
-		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
-		_, err := db.Exec(stmt)
+	// the reader connects with the credentials in its own data source name, as
+	// those from the provider are for the writer
+	if connPoolConfig.ReaderDSN != "" {
+		readerDSN, _, err := DSNFunc(connPoolConfig.ReaderDSN, tlsInfo, nil)
+		if err == nil {
+			err = dialect.OpenReplicaPool("mysql", readerDSN, connPoolConfig, metricsRegisterer)
+		}
 		if err != nil {
-			if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1061 {
-				return err
-			}
+			dialect.Close()
+			return nil, err
 		}
 	}
 
-	logrus.Infof("Database tables and indexes are up to date")
-	return nil
+	if config.SkipDDL() {
+		if config.DryRun {
+			// setup only logs the schema migrations that would be applied
+			if err := setup(dialect.DB, config, tidb); err != nil && err != generic.ErrDDLDisabled {
+				dialect.Close()
+				return nil, err
+			}
+		}
+		if err := dialect.CheckSchema(ctx); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+		if _, err := checkCollation(dialect.DB, dialect.Table()); err != nil {
+			logrus.Warnf("%v; run kine once without --datastore-no-ddl to convert it", err)
+		}
+	} else {
+		if err := setup(dialect.DB, config, tidb); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+		dialect.Migrate(context.Background())
+	}
+	go dialect.MonitorDrift(ctx, config.DriftCheckInterval)
+	return logstructured.New(sqllog.New(dialect)), nil
 }
 
-func createDBIfNotExist(dataSourceName string) error {
-	config, err := mysql.ParseDSN(dataSourceName)
+// DSNFunc parses a data source name for go-sql-driver/mysql, and returns it
+// along with a function that returns it with the current credentials from the
+// provider, if any. It is shared by drivers for databases that speak the MySQL
+// protocol.
+func DSNFunc(dataSourceName string, tlsInfo tls.Config, credsProvider credentials.Provider) (string, func(context.Context) (string, error), error) {
+	tlsConfig, err := tlsInfo.ClientConfig()
 	if err != nil {
-		return err
+		return "", nil, err
 	}
-	dbName := config.DBName
 
-	db, err := sql.Open("mysql", dataSourceName)
-	if err != nil {
-		return err
+	if tlsConfig != nil {
+		tlsConfig.MinVersion = cryptotls.VersionTLS11
 	}
-	_, err = db.Exec(createDB + dbName)
+
+	parsedDSN, err := prepareDSN(dataSourceName, tlsConfig)
 	if err != nil {
-		if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1049 {
-			return err
+		return "", nil, err
+	}
+	if credsProvider != nil {
+		if config, err := mysql.ParseDSN(parsedDSN); err == nil && config.Net == "tcp" {
+			if host, port, err := net.SplitHostPort(config.Addr); err == nil {
+				credentials.SetTarget(credsProvider, credentials.Target{Host: host, Port: port, User: config.User})
+			}
 		}
-		config.DBName = ""
-		db, err = sql.Open("mysql", config.FormatDSN())
-		if err != nil {
-			return err
+	}
+
+	dsn := func(ctx context.Context) (string, error) {
+		if credsProvider == nil {
+			return parsedDSN, nil
 		}
-		_, err = db.Exec(createDB + dbName)
+		creds, err := credsProvider.Get(ctx)
 		if err != nil {
-			return err
+			return "", err
+		}
+		if creds.DataSourceName != "" {
+			dataSourceName, err := prepareDSN(creds.DataSourceName, tlsConfig)
+			if err != nil {
+				return "", err
+			}
+			return withCredentials(dataSourceName, creds)
 		}
+		return withCredentials(parsedDSN, creds)
+	}
+	return parsedDSN, dsn, nil
+}
+
+// CutParam removes a query parameter from a data source name, and returns the
+// remaining data source name and the value of the parameter, which is empty if
+// it was not set. Parameters that go-sql-driver/mysql does not know are sent
+// to the server as session variables, so options for kine must be removed.
+func CutParam(dataSourceName, name string) (string, string, error) {
+	i := strings.LastIndex(dataSourceName, "/")
+	j := strings.IndexRune(dataSourceName[i+1:], '?')
+	if j < 0 {
+		return dataSourceName, "", nil
+	}
+	j += i + 1
+	params, err := url.ParseQuery(dataSourceName[j+1:])
+	if err != nil {
+		return "", "", err
+	}
+	value := params.Get(name)
+	if value == "" {
+		return dataSourceName, "", nil
 	}
-	return nil
+
+	params.Del(name)
+	dataSourceName = dataSourceName[:j]
+	if len(params) > 0 {
+		dataSourceName += "?" + params.Encode()
+	}
+	return dataSourceName, value, nil
 }
 
 func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, error) {
@@ -174,6 +279,15 @@ func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, err
 	}
 	// setting up tlsConfig
 	if tlsConfig != nil {
+		if tlsConfig.InsecureSkipVerify && tlsConfig.ServerName == "" && config.Net == "tcp" {
+			// the driver only fills in the server name when it is verifying the certificate
+			// itself, but the server name is still needed to verify against refreshed CAs
+			if host, _, err := net.SplitHostPort(config.Addr); err == nil {
+				tlsConfig.ServerName = host
+			} else {
+				tlsConfig.ServerName = config.Addr
+			}
+		}
 		if err := mysql.RegisterTLSConfig("kine", tlsConfig); err != nil {
 			return "", err
 		}
@@ -188,3 +302,23 @@ func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, err
 
 	return parsedDSN, nil
 }
+
+// withCredentials returns the data source name with the username and password
+// replaced by those in the provided credentials, if set.
+func withCredentials(dataSourceName string, creds credentials.Credentials) (string, error) {
+	config, err := mysql.ParseDSN(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+	if creds.Username != "" {
+		config.User = creds.Username
+	}
+	if creds.Password != "" {
+		config.Passwd = creds.Password
+	}
+	if creds.Token {
+		// authentication tokens are checked by a plugin that needs the token itself
+		config.AllowCleartextPasswords = true
+	}
+	return config.FormatDSN(), nil
+}
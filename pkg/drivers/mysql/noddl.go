@@ -0,0 +1,18 @@
+//go:build noddl
+// +build noddl
+
+package mysql
+
+import (
+	"database/sql"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+func setup(db *sql.DB, config generic.Config, tidb bool) error {
+	return generic.ErrDDLDisabled
+}
+
+func createDBIfNotExist(dataSourceName string) error {
+	return generic.ErrDDLDisabled
+}
@@ -0,0 +1,174 @@
+//go:build !noddl
+// +build !noddl
+
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	schema = []string{
+		`CREATE TABLE IF NOT EXISTS kine
+			(
+				id INTEGER AUTO_INCREMENT,
+				name %s,
+				created INTEGER,
+				deleted INTEGER,
+				create_revision INTEGER,
+ 				prev_revision INTEGER,
+				lease INTEGER,
+				value MEDIUMBLOB,
+				old_value MEDIUMBLOB,
+				PRIMARY KEY (id)%s
+			)%s;`,
+		`CREATE INDEX kine_name_index ON kine (name)`,
+		`CREATE INDEX kine_name_id_index ON kine (name,id)`,
+		`CREATE INDEX kine_id_deleted_index ON kine (id,deleted)`,
+		`CREATE INDEX kine_prev_revision_index ON kine (prev_revision)`,
+		`CREATE UNIQUE INDEX kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+	}
+	expirySchema = []string{
+		`ALTER TABLE kine ADD COLUMN expires_at BIGINT`,
+		`CREATE INDEX kine_expires_at_index ON kine (expires_at)`,
+	}
+	checksumSchema = `ALTER TABLE kine ADD COLUMN checksum BIGINT`
+	createDB       = "CREATE DATABASE IF NOT EXISTS "
+)
+
+// nameColumn returns the type of the name column.
+func nameColumn(config generic.Config) string {
+	if config.BinaryKeys {
+		return fmt.Sprintf("VARBINARY(%d)", config.KeyColumnLength())
+	}
+	return textColumn(int64(config.KeyColumnLength()))
+}
+
+func textColumn(length int64) string {
+	return fmt.Sprintf("VARCHAR(%d) CHARACTER SET utf8mb4 COLLATE %s", length, binaryCollation)
+}
+
+// migrations returns the migrations of the kine table, in order. Migrations
+// that have been released must not be changed.
+func migrations(config generic.Config, tidb bool) []generic.Migration {
+	table := fmt.Sprintf(schema[0], nameColumn(config), "", "")
+	if tidb {
+		table = fmt.Sprintf(schema[0], nameColumn(config), " NONCLUSTERED", tidbTableOptions)
+	}
+	return []generic.Migration{
+		{
+			Version:     1,
+			Description: "create the kine table and its indexes",
+			Statements:  append([]string{table}, schema[1:]...),
+			IgnoreErr:   duplicateKey,
+		},
+	}
+}
+
+// duplicateKey returns true for the error of creating an index that exists, as
+// the indexes of tables created before migrations were recorded do.
+func duplicateKey(err error) bool {
+	mysqlError, ok := err.(*mysql.MySQLError)
+	return ok && mysqlError.Number == 1061
+}
+
+func setup(db *sql.DB, config generic.Config, tidb bool) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	table, err := config.Table()
+	if err != nil {
+		return err
+	}
+
+	migrator := &generic.Migrator{
+		DB:         db,
+		Table:      table,
+		Migrations: migrations(config, tidb),
+		DryRun:     config.DryRun,
+	}
+	if err := migrator.Run(); err != nil || config.DryRun {
+		return err
+	}
+
+	if err := fixCollation(db, table); err != nil {
+		return err
+	}
+
+	if config.TTLColumn {
+		for _, stmt := range expirySchema {
+			stmt = table.SQL(stmt)
+			logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+			if _, err := db.Exec(stmt); err != nil {
+				// ignore duplicate column and index errors
+				if mysqlError, ok := err.(*mysql.MySQLError); !ok || (mysqlError.Number != 1060 && mysqlError.Number != 1061) {
+					return err
+				}
+			}
+		}
+	}
+
+	if config.Checksums {
+		stmt := table.SQL(checksumSchema)
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := db.Exec(stmt); err != nil {
+			// ignore duplicate column errors
+			if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1060 {
+				return err
+			}
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+// fixCollation converts the name column of a table created with the default
+// collation of the database, which is usually case-insensitive, to a binary
+// collation. Converting cannot merge keys, as a binary collation only
+// distinguishes keys that were equal before.
+func fixCollation(db *sql.DB, table *generic.Table) error {
+	length, err := checkCollation(db, table)
+	if err == nil {
+		return nil
+	}
+	logrus.Warnf("%v, converting it; this may take a moment...", err)
+	stmt := table.SQL("ALTER TABLE kine MODIFY name " + textColumn(length))
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+	_, err = db.Exec(stmt)
+	return err
+}
+
+func createDBIfNotExist(dataSourceName string) error {
+	config, err := mysql.ParseDSN(dataSourceName)
+	if err != nil {
+		return err
+	}
+	dbName := config.DBName
+
+	db, err := sql.Open("mysql", dataSourceName)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(createDB + dbName)
+	if err != nil {
+		if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1049 {
+			return err
+		}
+		config.DBName = ""
+		db, err = sql.Open("mysql", config.FormatDSN())
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(createDB + dbName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+// tidbCompactBatchSize is the number of revisions compacted in each transaction
+// on TiDB, so that the rows deleted stay well within its transaction size limit
+// even when values are large.
+const tidbCompactBatchSize = 100
+
+// tidbTableOptions keep ids increasing in insert order across TiDB servers, as
+// revisions must, while spreading rows over regions so that inserts do not all
+// land on the last region of the table. AUTO_RANDOM cannot be used, as it does
+// not allocate ids in order.
+const tidbTableOptions = ` AUTO_ID_CACHE 1 SHARD_ROW_ID_BITS = 4 PRE_SPLIT_REGIONS = 4`
+
+// tidbRetryable are the TiDB errors that are resolved by retrying: the schema
+// changed during the statement (8028), the transaction could not be retried
+// (8022), and write conflicts (9007).
+var tidbRetryable = map[uint16]bool{
+	8022: true,
+	8028: true,
+	9007: true,
+}
+
+// isTiDB returns true if the server is TiDB, which reports its version after
+// the MySQL version it is compatible with.
+func isTiDB(ctx context.Context, db *sql.DB) (bool, error) {
+	var version string
+	if err := db.QueryRowContext(ctx, "SELECT VERSION()").Scan(&version); err != nil {
+		return false, err
+	}
+	return strings.Contains(version, "TiDB"), nil
+}
+
+// configureTiDB adjusts the dialect for TiDB.
+func configureTiDB(dialect *generic.Generic) {
+	dialect.CompactBatchSize = tidbCompactBatchSize
+	dialect.FullScan = regexp.MustCompile(`\bTableFullScan\b`).MatchString
+	dialect.RetryPolicy.Retryable = func(err error) bool {
+		if err, ok := err.(*mysql.MySQLError); ok {
+			return tidbRetryable[err.Number]
+		}
+		return false
+	}
+}
@@ -0,0 +1,688 @@
+//go:build pebble
+// +build pebble
+
+package pebble
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPath = "./db/pebble"
+
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+	compactBatchSize = 1000
+	pollBatchSize    = 500
+
+	// suffixLen is the length of the separator and revision that end every key.
+	suffixLen = 9
+)
+
+var (
+	// logName holds the name of the key written at each revision, and
+	// compactName holds the compact revision at revision 0. They begin with a
+	// zero byte, so they never collide with the names of kine keys.
+	logName     = "\x00log"
+	compactName = "\x00compact"
+
+	errCorrupt = errors.New("corrupt event in pebble database")
+)
+
+// comparer orders keys by name and then by revision. Every key is a name, a
+// slash and the revision as 8 big endian bytes, and comparing the bytes would
+// not order keys by name when one name is a prefix of another followed by a
+// byte below the slash, which breaks listing from a start key. The comparer
+// name is stored in the database, and must not change.
+var comparer = &pebble.Comparer{
+	Name:    "kine.NameRevisionComparer",
+	Compare: compare,
+	Equal: func(a, b []byte) bool {
+		return compare(a, b) == 0
+	},
+	AbbreviatedKey: func(key []byte) uint64 {
+		name, _, _ := splitKey(key)
+		var buf [8]byte
+		copy(buf[:], name)
+		return binary.BigEndian.Uint64(buf[:])
+	},
+	Separator: func(dst, a, b []byte) []byte {
+		return append(dst, a...)
+	},
+	Successor: func(dst, a []byte) []byte {
+		return append(dst, a...)
+	},
+	// the prefix of a key is its name, which sorts before every revision
+	Split: func(key []byte) int {
+		name, _, _ := splitKey(key)
+		return len(name)
+	},
+}
+
+func compare(a, b []byte) int {
+	aName, aRev, aOK := splitKey(a)
+	bName, bRev, bOK := splitKey(b)
+	if c := bytes.Compare(aName, bName); c != 0 {
+		return c
+	}
+	switch {
+	case aOK != bOK:
+		if aOK {
+			return 1
+		}
+		return -1
+	case aRev < bRev:
+		return -1
+	case aRev > bRev:
+		return 1
+	}
+	return 0
+}
+
+// key returns the key of a revision of a name.
+func key(name string, rev int64) []byte {
+	k := make([]byte, len(name)+suffixLen)
+	copy(k, name)
+	k[len(name)] = '/'
+	binary.BigEndian.PutUint64(k[len(name)+1:], uint64(rev))
+	return k
+}
+
+// splitKey returns the name and revision of a key, and false if the key has no
+// revision, which is only the case for the prefix of a key.
+func splitKey(k []byte) ([]byte, uint64, bool) {
+	if len(k) < suffixLen || k[len(k)-suffixLen] != '/' {
+		return k, 0, false
+	}
+	return k[:len(k)-suffixLen], binary.BigEndian.Uint64(k[len(k)-8:]), true
+}
+
+// Pebble is a log stored in Pebble, a RocksDB style LSM tree, which gives
+// storage like etcd's without running etcd. Each revision of a key is stored
+// at its name and revision, so listing a prefix is an iteration over the keys
+// beginning with it, and reads are made from a snapshot, so that a list at a
+// revision sees the keys as they were. A second set of keys records the name
+// written at each revision, for watches. Writes are serialized in the process
+// to commit revisions in order.
+type Pebble struct {
+	db          *pebble.DB
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	notify      chan int64
+	compactor   sync.Once
+
+	// mu serializes writes, and guards advancing the revisions
+	mu       sync.Mutex
+	revision int64
+	compact  int64
+	// polled is the last revision delivered to watchers
+	polled int64
+}
+
+// New opens the pebble database in the directory in the endpoint, creating it
+// if it does not exist, for example pebble:///var/lib/kine/pebble.
+func New(ctx context.Context, dataSourceName string) (server.Backend, error) {
+	path := dataSourceName
+	if path == "" {
+		path = defaultPath
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := pebble.Open(path, &pebble.Options{Comparer: comparer})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pebble{
+		db:     db,
+		notify: make(chan int64, 1024),
+	}
+	if err := p.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return logstructured.New(p), nil
+}
+
+// load reads the current revision from the last entry in the log, which is
+// never compacted, and the compact revision.
+func (p *Pebble) load() error {
+	iter := p.db.NewIter(&pebble.IterOptions{
+		LowerBound: key(logName, 0),
+		UpperBound: key(logName, math.MaxInt64),
+	})
+	if iter.Last() {
+		_, rev, _ := splitKey(iter.Key())
+		p.revision = int64(rev)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	v, closer, err := p.db.Get(key(compactName, 0))
+	if err == pebble.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer closer.Close()
+	if len(v) != 8 {
+		return errCorrupt
+	}
+	p.compact = int64(binary.BigEndian.Uint64(v))
+	return nil
+}
+
+func (p *Pebble) Start(ctx context.Context) error {
+	p.ctx = ctx
+	go func() {
+		<-ctx.Done()
+		p.db.Close()
+	}()
+	return nil
+}
+
+func (p *Pebble) CurrentRevision(ctx context.Context) (int64, error) {
+	return atomic.LoadInt64(&p.revision), nil
+}
+
+func (p *Pebble) CompactRevision(ctx context.Context) (int64, error) {
+	return atomic.LoadInt64(&p.compact), nil
+}
+
+// snapshot returns a snapshot and the current revision it contains, or the
+// given revision if it is not compacted.
+func (p *Pebble) snapshot(revision int64) (*pebble.Snapshot, int64, error) {
+	// the revision is advanced after the write is committed, so it is loaded
+	// first and the snapshot contains at least that revision
+	rev := atomic.LoadInt64(&p.revision)
+	if revision > 0 {
+		if revision < atomic.LoadInt64(&p.compact) {
+			return nil, rev, server.ErrCompacted
+		}
+		rev = revision
+	}
+	return p.db.NewSnapshot(), rev, nil
+}
+
+func (p *Pebble) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	snapshot, rev, err := p.snapshot(revision)
+	if err != nil {
+		return rev, nil, err
+	}
+	defer snapshot.Close()
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+	seek := key(prefix, 0)
+	if checkPrefix && startKey != "" {
+		seek = key(startKey, 0)
+	}
+
+	iter := snapshot.NewIter(&pebble.IterOptions{LowerBound: seek})
+	defer iter.Close()
+
+	var (
+		events     []*server.Event
+		latestName []byte
+		latest     []byte
+		latestRev  int64
+	)
+	// flush adds the latest revision of the last name scanned, and returns
+	// true once the limit is reached
+	flush := func() (bool, error) {
+		if latest == nil {
+			return false, nil
+		}
+		event, err := decode(latestRev, latest)
+		latest = nil
+		if err != nil {
+			return false, err
+		}
+		if includeDeleted || !event.Delete {
+			events = append(events, event)
+		}
+		return limit > 0 && int64(len(events)) >= limit, nil
+	}
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		name, kRev, _ := splitKey(iter.Key())
+		if !bytes.HasPrefix(name, []byte(prefix)) || (!checkPrefix && string(name) != prefix) {
+			break
+		}
+		if !bytes.Equal(name, latestName) {
+			if done, err := flush(); err != nil || done {
+				return rev, events, err
+			}
+			latestName = append(latestName[:0], name...)
+		}
+		if int64(kRev) <= rev {
+			latest = append(latest[:0], iter.Value()...)
+			latestRev = int64(kRev)
+		}
+	}
+	_, err = flush()
+	return rev, events, err
+}
+
+func (p *Pebble) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	checkPrefix := strings.HasSuffix(prefix, "/")
+	return p.after(revision, limit, func(name string) bool {
+		return (checkPrefix && strings.HasPrefix(name, prefix)) || name == prefix
+	})
+}
+
+// after returns the current revision and the events after a revision that
+// match, up to a limit.
+func (p *Pebble) after(revision, limit int64, match func(name string) bool) (int64, []*server.Event, error) {
+	snapshot, rev, err := p.snapshot(0)
+	if err != nil {
+		return rev, nil, err
+	}
+	defer snapshot.Close()
+	if revision > 0 && revision < atomic.LoadInt64(&p.compact) {
+		return rev, nil, server.ErrCompacted
+	}
+
+	// the snapshot may contain revisions committed after the current revision
+	// was loaded, which are left for the next call
+	iter := snapshot.NewIter(&pebble.IterOptions{
+		LowerBound: key(logName, revision+1),
+		UpperBound: key(logName, rev+1),
+	})
+	defer iter.Close()
+
+	var events []*server.Event
+	for iter.First(); iter.Valid(); iter.Next() {
+		name := string(iter.Value())
+		if !match(name) {
+			continue
+		}
+		_, kRev, _ := splitKey(iter.Key())
+		v, closer, err := snapshot.Get(key(name, int64(kRev)))
+		if err != nil {
+			return rev, nil, err
+		}
+		event, err := decode(int64(kRev), v)
+		closer.Close()
+		if err != nil {
+			return rev, nil, err
+		}
+		events = append(events, event)
+		if limit > 0 && int64(len(events)) >= limit {
+			break
+		}
+	}
+	return rev, events, nil
+}
+
+func (p *Pebble) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	rev, events, err := p.List(ctx, prefix, "", 0, 0, false)
+	return rev, int64(len(events)), err
+}
+
+// Append writes an event at the next revision, if the latest revision of its
+// key is the previous revision of the event, or the event creates a key that
+// does not exist.
+func (p *Pebble) Append(ctx context.Context, event *server.Event) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var prevRevision int64
+	if event.PrevKV != nil {
+		prevRevision = event.PrevKV.ModRevision
+	}
+	latest, err := p.latestRevision(event.KV.Key)
+	if err != nil {
+		return 0, err
+	}
+	if (latest != 0 && latest != prevRevision) || (latest == 0 && !event.Create) {
+		return 0, server.ErrKeyExists
+	}
+
+	rev := p.revision + 1
+	batch := p.db.NewBatch()
+	defer batch.Close()
+	// store the actual previous revision of the key, as a create passes the
+	// current revision when the key has none, and compaction deletes it
+	if err := batch.Set(key(event.KV.Key, rev), encode(event, latest), nil); err != nil {
+		return 0, err
+	}
+	if err := batch.Set(key(logName, rev), []byte(event.KV.Key), nil); err != nil {
+		return 0, err
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&p.revision, rev)
+
+	select {
+	case p.notify <- rev:
+	default:
+	}
+	return rev, nil
+}
+
+// latestRevision returns the latest revision of a key, including a delete, or
+// 0 if it has none.
+func (p *Pebble) latestRevision(name string) (int64, error) {
+	iter := p.db.NewIter(&pebble.IterOptions{
+		LowerBound: key(name, 0),
+		UpperBound: key(name, math.MaxInt64),
+	})
+	var rev int64
+	if iter.Last() {
+		_, kRev, _ := splitKey(iter.Key())
+		rev = int64(kRev)
+	}
+	return rev, iter.Close()
+}
+
+func (p *Pebble) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	values, err := p.broadcaster.Subscribe(ctx, p.startWatch)
+	if err != nil {
+		return nil
+	}
+	res := make(chan []*server.Event, cap(values))
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			events, ok := filter(i, checkPrefix, prefix)
+			if ok {
+				res <- events
+			}
+		}
+	}()
+
+	return res
+}
+
+func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Event, bool) {
+	eventList := events.([]*server.Event)
+	filteredEventList := make([]*server.Event, 0, len(eventList))
+
+	for _, event := range eventList {
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+			filteredEventList = append(filteredEventList, event)
+		}
+	}
+
+	return filteredEventList, len(filteredEventList) > 0
+}
+
+func (p *Pebble) startWatch() (chan interface{}, error) {
+	pollStart, err := p.CompactRevision(p.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan interface{})
+	p.compactor.Do(func() {
+		go p.compactLoop()
+	})
+	go p.poll(ch, pollStart)
+	return ch, nil
+}
+
+// WatchRevision returns the last revision delivered to watchers, or zero if no
+// watch has been started.
+func (p *Pebble) WatchRevision() int64 {
+	return atomic.LoadInt64(&p.polled)
+}
+
+// poll reads new events from the log whenever an append notifies it, and every
+// second in case a notification was dropped because the channel was full.
+func (p *Pebble) poll(result chan interface{}, pollStart int64) {
+	wait := time.NewTicker(time.Second)
+	defer wait.Stop()
+	defer close(result)
+
+	last := pollStart
+	atomic.StoreInt64(&p.polled, last)
+	waitForMore := true
+	all := func(string) bool { return true }
+
+	for {
+		if waitForMore {
+			select {
+			case <-p.ctx.Done():
+				return
+			case check := <-p.notify:
+				if check <= last {
+					continue
+				}
+			case <-wait.C:
+			}
+		}
+
+		rev, events, err := p.after(last, pollBatchSize, all)
+		if err != nil {
+			logrus.Errorf("fail to list latest changes: %v", err)
+			waitForMore = true
+			continue
+		}
+		waitForMore = len(events) < pollBatchSize
+		if !waitForMore {
+			rev = events[len(events)-1].KV.ModRevision
+		}
+		if rev <= last {
+			continue
+		}
+		last = rev
+		atomic.StoreInt64(&p.polled, last)
+		if len(events) > 0 {
+			result <- events
+		}
+	}
+}
+
+// compactLoop periodically advances the compact revision, keeping the most
+// recent revisions, and removes the revisions up to it that have been
+// superseded, and deleted keys, in batches so that writes are not blocked for
+// long. Pebble reclaims the space as it compacts its LSM tree.
+func (p *Pebble) compactLoop() {
+	t := time.NewTicker(compactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		current := atomic.LoadInt64(&p.revision)
+		target := current - compactMinRetain
+		for {
+			done, err := p.compactBatch(target)
+			if err != nil {
+				logrus.Errorf("Compact failed: %v", err)
+				break
+			}
+			if done {
+				logrus.Debugf("COMPACT compacted to %d/%d", target, current)
+				break
+			}
+		}
+	}
+}
+
+// compactBatch compacts up to compactBatchSize revisions toward the target, and
+// returns true once the target is reached. The log entries up to the compact
+// revision are never read again, so they are all removed.
+func (p *Pebble) compactBatch(target int64) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	compact := p.compact
+	if compact >= target {
+		return true, nil
+	}
+	to, done := compact+compactBatchSize, false
+	if to >= target {
+		to, done = target, true
+	}
+
+	batch := p.db.NewBatch()
+	defer batch.Close()
+
+	iter := p.db.NewIter(&pebble.IterOptions{
+		LowerBound: key(logName, compact+1),
+		UpperBound: key(logName, to+1),
+	})
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, rev, _ := splitKey(iter.Key())
+		k := key(string(iter.Value()), int64(rev))
+		v, closer, err := p.db.Get(k)
+		if err == pebble.ErrNotFound {
+			continue
+		} else if err != nil {
+			iter.Close()
+			return false, err
+		}
+		event, err := decode(int64(rev), v)
+		closer.Close()
+		if err != nil {
+			iter.Close()
+			return false, err
+		}
+
+		if event.PrevKV != nil && event.PrevKV.ModRevision > 0 {
+			if err := batch.Delete(key(event.KV.Key, event.PrevKV.ModRevision), nil); err != nil {
+				iter.Close()
+				return false, err
+			}
+		}
+		if event.Delete {
+			if err := batch.Delete(k, nil); err != nil {
+				iter.Close()
+				return false, err
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return false, err
+	}
+
+	if err := batch.DeleteRange(key(logName, compact+1), key(logName, to+1), nil); err != nil {
+		return false, err
+	}
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], uint64(to))
+	if err := batch.Set(key(compactName, 0), v[:], nil); err != nil {
+		return false, err
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return false, err
+	}
+	atomic.StoreInt64(&p.compact, to)
+	return done, nil
+}
+
+// DbSize returns the disk space used by the database.
+func (p *Pebble) DbSize(ctx context.Context) (int64, error) {
+	return int64(p.db.Metrics().DiskSpaceUsage()), nil
+}
+
+// encode returns an event without its revision, as flags followed by the
+// create revision, previous revision and lease as varints, and the key, value
+// and previous value, each prefixed by its length.
+func encode(event *server.Event, prevRevision int64) []byte {
+	var (
+		flags    byte
+		oldValue []byte
+	)
+	if event.Create {
+		flags |= 1
+	}
+	if event.Delete {
+		flags |= 2
+	}
+	if event.PrevKV != nil {
+		oldValue = event.PrevKV.Value
+	}
+
+	buf := make([]byte, 1, 1+6*binary.MaxVarintLen64+len(event.KV.Key)+len(event.KV.Value)+len(oldValue))
+	buf[0] = flags
+	for _, n := range []int64{event.KV.CreateRevision, prevRevision, event.KV.Lease} {
+		buf = appendVarint(buf, n)
+	}
+	for _, b := range [][]byte{[]byte(event.KV.Key), event.KV.Value, oldValue} {
+		buf = appendVarint(buf, int64(len(b)))
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func appendVarint(buf []byte, n int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], n)]...)
+}
+
+func decode(rev int64, buf []byte) (*server.Event, error) {
+	if len(buf) == 0 {
+		return nil, errCorrupt
+	}
+	flags := buf[0]
+	buf = buf[1:]
+
+	var ints [3]int64
+	for i := range ints {
+		n, size := binary.Varint(buf)
+		if size <= 0 {
+			return nil, errCorrupt
+		}
+		ints[i], buf = n, buf[size:]
+	}
+	var fields [3][]byte
+	for i := range fields {
+		n, size := binary.Varint(buf)
+		if size <= 0 || int64(len(buf)-size) < n {
+			return nil, errCorrupt
+		}
+		buf = buf[size:]
+		// copy, as pebble's memory is only valid until the iterator moves
+		fields[i] = append([]byte(nil), buf[:n]...)
+		buf = buf[n:]
+	}
+
+	event := &server.Event{
+		Create: flags&1 != 0,
+		Delete: flags&2 != 0,
+		KV: &server.KeyValue{
+			Key:            string(fields[0]),
+			CreateRevision: ints[0],
+			ModRevision:    rev,
+			Value:          fields[1],
+			Lease:          ints[2],
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: ints[1],
+			Value:       fields[2],
+		},
+	}
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event, nil
+}
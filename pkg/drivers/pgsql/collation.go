@@ -0,0 +1,41 @@
+package pgsql
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+// binaryCollation is used for text keys, so that keys are ordered byte by byte
+// rather than by the rules of the locale of the database.
+const binaryCollation = "C"
+
+var nameColumnSQL = `
+	SELECT c.data_type, COALESCE(c.collation_name, d.datcollate), c.character_maximum_length
+	FROM information_schema.columns AS c, pg_database AS d
+	WHERE
+		d.datname = current_database() AND
+		c.table_schema = current_schema() AND
+		c.table_name = 'kine' AND
+		c.column_name = 'name'`
+
+// checkCollation returns the maximum length of the name column, and an error if
+// the column uses a collation that does not compare keys byte by byte.
+func checkCollation(db *sql.DB, table *generic.Table) (int64, error) {
+	var (
+		dataType  string
+		collation sql.NullString
+		length    sql.NullInt64
+	)
+	if err := db.QueryRow(table.SQL(nameColumnSQL)).Scan(&dataType, &collation, &length); err != nil {
+		return 0, err
+	}
+	if dataType == "bytea" {
+		return length.Int64, nil
+	}
+	if collation.String != "C" && collation.String != "POSIX" {
+		return length.Int64, fmt.Errorf("the name column of the kine table uses collation %q, which may order or compare keys by locale, instead of %q", collation.String, binaryCollation)
+	}
+	return length.Int64, nil
+}
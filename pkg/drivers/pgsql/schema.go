@@ -0,0 +1,170 @@
+//go:build !noddl
+// +build !noddl
+
+package pgsql
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	schema = []string{
+		`CREATE TABLE IF NOT EXISTS kine
+ 			(
+ 				id SERIAL PRIMARY KEY,
+				name %s,
+				created INTEGER,
+				deleted INTEGER,
+ 				create_revision INTEGER,
+ 				prev_revision INTEGER,
+ 				lease INTEGER,
+ 				value bytea,
+ 				old_value bytea
+ 			);`,
+		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_id_index ON kine (name,id)`,
+		`CREATE INDEX IF NOT EXISTS kine_id_deleted_index ON kine (id,deleted)`,
+		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+	}
+	expirySchema = []string{
+		`ALTER TABLE kine ADD COLUMN IF NOT EXISTS expires_at BIGINT`,
+		`CREATE INDEX IF NOT EXISTS kine_expires_at_index ON kine (expires_at)`,
+	}
+	checksumSchema = `ALTER TABLE kine ADD COLUMN IF NOT EXISTS checksum BIGINT`
+	createDB       = "CREATE DATABASE "
+)
+
+// nameColumn returns the type of the name column. BYTEA has no length, so the
+// limit is enforced with a check constraint.
+func nameColumn(config generic.Config) string {
+	if config.BinaryKeys {
+		return fmt.Sprintf("BYTEA CHECK (octet_length(name) <= %d)", config.KeyColumnLength())
+	}
+	return textColumn(int64(config.KeyColumnLength()))
+}
+
+func textColumn(length int64) string {
+	if length <= 0 {
+		return fmt.Sprintf(`VARCHAR COLLATE "%s"`, binaryCollation)
+	}
+	return fmt.Sprintf(`VARCHAR(%d) COLLATE "%s"`, length, binaryCollation)
+}
+
+// migrations returns the migrations of the kine table, in order. Migrations
+// that have been released must not be changed.
+func migrations(config generic.Config) []generic.Migration {
+	stmts := append([]string{fmt.Sprintf(schema[0], nameColumn(config))}, schema[1:]...)
+	return []generic.Migration{
+		{
+			Version:     1,
+			Description: "create the kine table and its indexes",
+			Statements:  stmts,
+		},
+	}
+}
+
+func setup(db *sql.DB, config generic.Config) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	table, err := config.Table()
+	if err != nil {
+		return err
+	}
+
+	migrator := &generic.Migrator{
+		DB:         db,
+		Table:      table,
+		Migrations: migrations(config),
+		DryRun:     config.DryRun,
+	}
+	if err := migrator.Run(); err != nil || config.DryRun {
+		return err
+	}
+
+	if err := fixCollation(db, table); err != nil {
+		return err
+	}
+
+	if config.TTLColumn {
+		for _, stmt := range expirySchema {
+			stmt = table.SQL(stmt)
+			logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+			if _, err := db.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	if config.Checksums {
+		stmt := table.SQL(checksumSchema)
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+// fixCollation converts the name column of a table created with the locale of
+// the database to the C collation. The indexes on the column are rebuilt.
+func fixCollation(db *sql.DB, table *generic.Table) error {
+	length, err := checkCollation(db, table)
+	if err == nil {
+		return nil
+	}
+	logrus.Warnf("%v, converting it; this may take a moment...", err)
+	stmt := table.SQL("ALTER TABLE kine ALTER COLUMN name TYPE " + textColumn(length))
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+	_, err = db.Exec(stmt)
+	return err
+}
+
+func createDBIfNotExist(dataSourceName string) error {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return err
+	}
+
+	dbName := strings.SplitN(u.Path, "/", 2)[1]
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = db.Ping()
+	// check if database already exists
+	if _, ok := err.(*pq.Error); !ok {
+		return err
+	}
+	if err := err.(*pq.Error); err.Code != "42P04" {
+		if err.Code != "3D000" {
+			return err
+		}
+		// database doesn't exit, will try to create it
+		u.Path = "/postgres"
+		db, err := sql.Open("postgres", u.String())
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		stmt := createDB + dbName + ";"
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		_, err = db.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !redis
+// +build !redis
+
+package redis
+
+import (
+	"context"
+	"errors"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+)
+
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config) (server.Backend, error) {
+	return nil, errors.New(`this binary is built without Redis support, compile with "-tags redis"`)
+}
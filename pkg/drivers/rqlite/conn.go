@@ -0,0 +1,357 @@
+package rqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Consistency levels for reads. With none, the node that receives a query
+// answers it from its own copy of the database, which may be stale. With weak,
+// the leader answers it, and with strong, the query goes through the Raft log.
+const (
+	levelNone   = "none"
+	levelWeak   = "weak"
+	levelStrong = "strong"
+)
+
+// Error is an error returned by rqlite, either for the whole request or for a
+// single statement in it.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return "rqlite: " + e.Message
+}
+
+// statement is a parameterized statement, as the SQL followed by its arguments.
+type statement []interface{}
+
+type result struct {
+	Columns      []string        `json:"columns"`
+	Types        []string        `json:"types"`
+	Values       [][]interface{} `json:"values"`
+	LastInsertID int64           `json:"last_insert_id"`
+	Affected     int64           `json:"rows_affected"`
+	Error        string          `json:"error"`
+}
+
+// connector makes database/sql connections to rqlite. rqlite is stateless over
+// HTTP, so a connection only carries the client and the consistency levels.
+type connector struct {
+	base    *url.URL
+	client  *http.Client
+	level   string
+	txLevel string
+}
+
+// newConnector returns a connector for an http or https URL of an rqlite node.
+// The level query parameter sets the consistency of reads, and tx_level the
+// consistency of reads in a transaction.
+func newConnector(dataSourceName string, client *http.Client) (*connector, error) {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported rqlite URL scheme %q", u.Scheme)
+	}
+
+	c := &connector{
+		client:  client,
+		level:   levelWeak,
+		txLevel: levelStrong,
+	}
+	query := u.Query()
+	for param, level := range map[string]*string{"level": &c.level, "tx_level": &c.txLevel} {
+		if v := query.Get(param); v != "" {
+			switch v {
+			case levelNone, levelWeak, levelStrong:
+				*level = v
+			default:
+				return nil, fmt.Errorf("invalid rqlite %s %q, must be one of none, weak or strong", param, v)
+			}
+		}
+	}
+	u.RawQuery = ""
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	c.base = u
+	if c.client == nil {
+		c.client = http.DefaultClient
+	}
+	return c, nil
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &conn{c: c}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return sqlDriver{}
+}
+
+// do sends statements to the execute or query endpoint, and returns their
+// results, or the first error.
+func (c *connector) do(ctx context.Context, path string, params url.Values, stmts []statement) ([]result, error) {
+	body, err := json.Marshal(stmts)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *c.base
+	u.User = nil
+	u.Path += path
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if user := c.base.User; user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+
+	var response struct {
+		Results []result `json:"results"`
+		Error   string   `json:"error"`
+	}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, &Error{StatusCode: resp.StatusCode, Message: response.Error}
+	}
+	if len(response.Results) != len(stmts) {
+		return nil, fmt.Errorf("rqlite returned %d results for %d statements", len(response.Results), len(stmts))
+	}
+	for _, r := range response.Results {
+		if r.Error != "" {
+			return nil, &Error{StatusCode: resp.StatusCode, Message: r.Error}
+		}
+	}
+	return response.Results, nil
+}
+
+// sqlDriver opens connections from a data source name, without TLS options.
+type sqlDriver struct{}
+
+func (sqlDriver) Open(dataSourceName string) (driver.Conn, error) {
+	c, err := newConnector(dataSourceName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
+}
+
+type conn struct {
+	c  *connector
+	tx *tx
+}
+
+func newStatement(query string, args []driver.NamedValue) statement {
+	stmt := make(statement, 0, len(args)+1)
+	stmt = append(stmt, query)
+	for _, arg := range args {
+		// values are sent as base64 text, as JSON has no type for bytes, and
+		// decoded when read from a BLOB column
+		if b, ok := arg.Value.([]byte); ok {
+			stmt = append(stmt, base64.StdEncoding.EncodeToString(b))
+		} else {
+			stmt = append(stmt, arg.Value)
+		}
+	}
+	return stmt
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	level := c.c.level
+	if c.tx != nil {
+		level = c.c.txLevel
+	}
+	results, err := c.c.do(ctx, "/db/query", url.Values{"level": {level}}, []statement{newStatement(query, args)})
+	if err != nil {
+		return nil, err
+	}
+	return &rows{result: results[0]}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	stmt := newStatement(query, args)
+	if c.tx != nil {
+		c.tx.stmts = append(c.tx.stmts, stmt)
+		return driver.RowsAffected(0), nil
+	}
+	results, err := c.c.do(ctx, "/db/execute", nil, []statement{stmt})
+	if err != nil {
+		return nil, err
+	}
+	return execResult(results[0]), nil
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	_, err := c.QueryContext(ctx, "SELECT 1", nil)
+	return err
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{conn: c, query: query}, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts a transaction. rqlite has no interactive transactions, so
+// reads in the transaction are made at the transaction consistency level, and
+// writes are held until commit and executed together in a single transaction.
+// Their results are not known until then, so they report no rows affected.
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, errors.New("rqlite: transaction already started")
+	}
+	c.tx = &tx{conn: c, ctx: ctx}
+	return c.tx, nil
+}
+
+type tx struct {
+	conn  *conn
+	ctx   context.Context
+	stmts []statement
+}
+
+func (t *tx) Commit() error {
+	t.conn.tx = nil
+	if len(t.stmts) == 0 {
+		return nil
+	}
+	_, err := t.conn.c.do(t.ctx, "/db/execute", url.Values{"transaction": {""}}, t.stmts)
+	return err
+}
+
+func (t *tx) Rollback() error {
+	t.conn.tx = nil
+	return nil
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, s.query, args)
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, s.query, args)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+type execResult result
+
+func (r execResult) LastInsertId() (int64, error) {
+	return r.LastInsertID, nil
+}
+
+func (r execResult) RowsAffected() (int64, error) {
+	return r.Affected, nil
+}
+
+type rows struct {
+	result result
+	next   int
+}
+
+func (r *rows) Columns() []string {
+	return r.result.Columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.Values) {
+		return io.EOF
+	}
+	row := r.result.Values[r.next]
+	r.next++
+
+	for i, v := range row {
+		switch v := v.(type) {
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				dest[i] = n
+			} else if f, err := v.Float64(); err == nil {
+				dest[i] = f
+			} else {
+				return err
+			}
+		case string:
+			if i < len(r.result.Types) && strings.EqualFold(r.result.Types[i], "blob") {
+				b, err := base64.StdEncoding.DecodeString(v)
+				if err != nil {
+					return err
+				}
+				dest[i] = b
+			} else {
+				dest[i] = v
+			}
+		default:
+			dest[i] = v
+		}
+	}
+	return nil
+}
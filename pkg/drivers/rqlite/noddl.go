@@ -0,0 +1,14 @@
+//go:build noddl
+// +build noddl
+
+package rqlite
+
+import (
+	"database/sql"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+func setup(db *sql.DB, config generic.Config) error {
+	return generic.ErrDDLDisabled
+}
@@ -0,0 +1,116 @@
+package rqlite
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultDSN = "http://localhost:4001"
+
+// New connects to rqlite over its HTTP API, for replicated SQLite without
+// dqlite. The data source name is the http or https URL of a node, with the
+// consistency of reads set by the level query parameter, which defaults to
+// weak, and of the reads made while compacting by tx_level, which defaults to
+// strong. Writes are always committed through the Raft log by the leader.
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	if dataSourceName == "" {
+		dataSourceName = defaultDSN
+	}
+
+	tlsConfig, err := tlsInfo.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	client := http.DefaultClient
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client = &http.Client{Transport: transport}
+	}
+	connector, err := newConnector(dataSourceName, client)
+	if err != nil {
+		return nil, err
+	}
+
+	dialect, err := generic.OpenWithConnector(ctx, "rqlite", connector, connPoolConfig, "?", false, metricsRegisterer)
+	if err != nil {
+		return nil, err
+	}
+	dialect.ApplyConfig(config)
+	dialect.LastInsertID = true
+	dialect.ExplainSQL = "EXPLAIN QUERY PLAN "
+	dialect.FullScan = regexp.MustCompile(`\| SCAN (TABLE )?\w+( AS \w+)?$`).MatchString
+	dialect.GetSizeSQL = `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`
+	dialect.CompactSQL = `
+		DELETE FROM kine AS kv
+		WHERE
+			kv.id IN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= ?
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= ?
+			)`
+	dialect.ColumnsSQL = `SELECT name FROM pragma_table_info('kine')`
+	dialect.IndexesSQL = `SELECT name, "unique" FROM pragma_index_list('kine')`
+	dialect.CreateIndexSQL = `CREATE %sINDEX IF NOT EXISTS %s ON kine (%s)`
+	// rqlite is unavailable while it elects a leader
+	dialect.RetryPolicy.Retryable = func(err error) bool {
+		if err, ok := err.(*Error); ok {
+			return err.StatusCode == http.StatusServiceUnavailable
+		}
+		return false
+	}
+	dialect.TranslateErr = func(err error) error {
+		if err, ok := err.(*Error); ok && strings.HasPrefix(err.Message, "UNIQUE constraint failed") {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		if err, ok := err.(*Error); ok && err.StatusCode != http.StatusOK {
+			return http.StatusText(err.StatusCode)
+		}
+		return err.Error()
+	}
+
+	if config.SkipDDL() {
+		if config.DryRun {
+			// setup only logs the schema migrations that would be applied
+			if err := setup(dialect.DB, config); err != nil && err != generic.ErrDDLDisabled {
+				dialect.Close()
+				return nil, err
+			}
+		}
+		if err := dialect.CheckSchema(ctx); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	} else {
+		if err := setup(dialect.DB, config); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	}
+	go dialect.MonitorDrift(ctx, config.DriftCheckInterval)
+	return logstructured.New(sqllog.New(dialect)), nil
+}
@@ -0,0 +1,97 @@
+//go:build !noddl
+// +build !noddl
+
+package rqlite
+
+import (
+	"database/sql"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	migrations = []generic.Migration{
+		{
+			Version:     1,
+			Description: "create the kine table and its indexes",
+			Statements:  schema,
+		},
+	}
+	schema = []string{
+		`CREATE TABLE IF NOT EXISTS kine
+			(
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name INTEGER,
+				created INTEGER,
+				deleted INTEGER,
+				create_revision INTEGER,
+				prev_revision INTEGER,
+				lease INTEGER,
+				value BLOB,
+				old_value BLOB
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_id_index ON kine (name,id)`,
+		`CREATE INDEX IF NOT EXISTS kine_id_deleted_index ON kine (id,deleted)`,
+		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+	}
+	expiryColumnSQL = `SELECT COUNT(*) FROM pragma_table_info('kine') WHERE name = 'expires_at'`
+	expirySchema    = []string{
+		`ALTER TABLE kine ADD COLUMN expires_at INTEGER`,
+		`CREATE INDEX IF NOT EXISTS kine_expires_at_index ON kine (expires_at)`,
+	}
+)
+
+// setup creates the kine table, as for SQLite. rqlite manages its own write
+// ahead log, so there is no checkpoint.
+func setup(db *sql.DB, config generic.Config) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	table, err := config.Table()
+	if err != nil {
+		return err
+	}
+
+	migrator := &generic.Migrator{
+		DB:         db,
+		Table:      table,
+		Migrations: migrations,
+		DryRun:     config.DryRun,
+	}
+	if err := migrator.Run(); err != nil || config.DryRun {
+		return err
+	}
+
+	if config.TTLColumn {
+		if err := addExpiryColumn(db, table); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+// addExpiryColumn adds the expires_at column, if it does not already exist, as
+// SQLite cannot add a column only if it is missing.
+func addExpiryColumn(db *sql.DB, table *generic.Table) error {
+	var n int
+	if err := db.QueryRow(table.SQL(expiryColumnSQL)).Scan(&n); err != nil {
+		return err
+	}
+	stmts := expirySchema
+	if n > 0 {
+		stmts = stmts[1:]
+	}
+	for _, stmt := range stmts {
+		stmt = table.SQL(stmt)
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
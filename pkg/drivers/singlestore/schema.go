@@ -0,0 +1,157 @@
+//go:build !noddl
+// +build !noddl
+
+package singlestore
+
+import (
+	"database/sql"
+	"fmt"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// Unique keys can only be declared when the table is created, so the keys
+	// are declared with it, and must contain the shard key. Rowstore tables are
+	// stored in id order within each key by the primary key, and columnstore
+	// tables are sorted by id, with hash keys for lookups.
+	rowstoreSchema = `
+		CREATE ROWSTORE TABLE IF NOT EXISTS kine
+			(
+				id BIGINT AUTO_INCREMENT,
+				name %s NOT NULL,
+				created INTEGER,
+				deleted INTEGER,
+				create_revision BIGINT,
+				prev_revision BIGINT,
+				lease BIGINT,
+				value LONGBLOB,
+				old_value LONGBLOB,%s
+				PRIMARY KEY (name, id),
+				SHARD KEY (name),
+				KEY kine_name_index (name),
+				KEY kine_name_id_index (name, id),
+				KEY kine_id_deleted_index (id, deleted),
+				KEY kine_prev_revision_index (prev_revision),
+				UNIQUE KEY kine_name_prev_revision_uindex (name, prev_revision)%s
+			)`
+	columnstoreSchema = `
+		CREATE TABLE IF NOT EXISTS kine
+			(
+				id BIGINT AUTO_INCREMENT,
+				name %s NOT NULL,
+				created INTEGER,
+				deleted INTEGER,
+				create_revision BIGINT,
+				prev_revision BIGINT,
+				lease BIGINT,
+				value LONGBLOB,
+				old_value LONGBLOB,%s
+				SORT KEY (id),
+				SHARD KEY (name),
+				KEY kine_name_index (name) USING HASH,
+				KEY kine_name_id_index (name, id) USING HASH,
+				KEY kine_id_deleted_index (id, deleted) USING HASH,
+				KEY kine_prev_revision_index (prev_revision) USING HASH,
+				UNIQUE KEY kine_name_prev_revision_uindex (name, prev_revision) USING HASH%s
+			)`
+	expiryColumn   = "\n\t\t\t\texpires_at BIGINT,"
+	expiryIndex    = ",\n\t\t\t\tKEY kine_expires_at_index (expires_at)"
+	expirySchema   = []string{`ALTER TABLE kine ADD COLUMN expires_at BIGINT`}
+	expiryIndexSQL = map[string]string{
+		tableRowstore:    `ALTER TABLE kine ADD KEY kine_expires_at_index (expires_at)`,
+		tableColumnstore: `ALTER TABLE kine ADD KEY kine_expires_at_index (expires_at) USING HASH`,
+	}
+	createDB = "CREATE DATABASE IF NOT EXISTS "
+)
+
+// nameColumn returns the type of the name column.
+func nameColumn(config generic.Config) string {
+	if config.BinaryKeys {
+		return fmt.Sprintf("VARBINARY(%d)", config.KeyColumnLength())
+	}
+	return fmt.Sprintf("VARCHAR(%d) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin", config.KeyColumnLength())
+}
+
+// migrations returns the migrations of the kine table, in order. Migrations
+// that have been released must not be changed.
+func migrations(config generic.Config, tableType string) []generic.Migration {
+	stmt, column, index := rowstoreSchema, "", ""
+	if tableType == tableColumnstore {
+		stmt = columnstoreSchema
+	}
+	if config.TTLColumn {
+		column = expiryColumn
+		index = expiryIndex
+		if tableType == tableColumnstore {
+			index += " USING HASH"
+		}
+	}
+	return []generic.Migration{
+		{
+			Version:     1,
+			Description: "create the kine table and its indexes",
+			Statements:  []string{fmt.Sprintf(stmt, nameColumn(config), column, index)},
+		},
+	}
+}
+
+func setup(db *sql.DB, config generic.Config, tableType string) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	table, err := config.Table()
+	if err != nil {
+		return err
+	}
+
+	migrator := &generic.Migrator{
+		DB:         db,
+		Table:      table,
+		Migrations: migrations(config, tableType),
+		DryRun:     config.DryRun,
+	}
+	if err := migrator.Run(); err != nil || config.DryRun {
+		return err
+	}
+
+	// tables created without the expiry column have it added
+	if config.TTLColumn {
+		for _, stmt := range append(expirySchema, expiryIndexSQL[tableType]) {
+			stmt = table.SQL(stmt)
+			logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+			if _, err := db.Exec(stmt); err != nil {
+				// ignore duplicate column and index errors
+				if mysqlError, ok := err.(*gomysql.MySQLError); !ok || (mysqlError.Number != 1060 && mysqlError.Number != 1061) {
+					return err
+				}
+			}
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+// createDBIfNotExist creates the database named in the data source, connecting
+// without a database to do so if it does not exist.
+func createDBIfNotExist(dataSourceName string) error {
+	config, err := gomysql.ParseDSN(dataSourceName)
+	if err != nil {
+		return err
+	}
+	dbName := config.DBName
+	config.DBName = ""
+
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	stmt := createDB + "`" + dbName + "`"
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+	_, err = db.Exec(stmt)
+	return err
+}
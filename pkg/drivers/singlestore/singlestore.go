@@ -0,0 +1,192 @@
+package singlestore
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/k3s-io/kine/pkg/credentials"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/drivers/mysql"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultDSN = "root@tcp(127.0.0.1:3306)/"
+
+	tableTypeParam   = "table_type"
+	tableRowstore    = "rowstore"
+	tableColumnstore = "columnstore"
+)
+
+// retryable are the errors that are resolved by retrying: deadlocks (1213) and
+// lock wait timeouts (1205).
+var retryable = map[uint16]bool{
+	1205: true,
+	1213: true,
+}
+
+// New connects to SingleStore over the MySQL protocol. The table_type parameter
+// of the data source name selects a rowstore table, the default, which keeps
+// rows and indexes in memory, or a columnstore table, which keeps them on disk.
+// The table is sharded on the name, as every unique key must contain the shard
+// key, so that each key and its history are held on one partition.
+//
+// Revisions must be allocated in order, and SingleStore only allocates
+// AUTO_INCREMENT ids in order within each aggregator, so kine must always
+// connect to the same aggregator.
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, credsProvider credentials.Provider, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	if dataSourceName == "" {
+		dataSourceName = defaultDSN
+	}
+	dataSourceName, tableType, err := mysql.CutParam(dataSourceName, tableTypeParam)
+	if err != nil {
+		return nil, err
+	}
+	switch tableType {
+	case "":
+		tableType = tableRowstore
+	case tableRowstore, tableColumnstore:
+	default:
+		return nil, fmt.Errorf("invalid singlestore table_type %q, must be rowstore or columnstore", tableType)
+	}
+
+	parsedDSN, dsn, err := mysql.DSNFunc(dataSourceName, tlsInfo, credsProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	initialDSN, err := dsn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.SkipDDL() {
+		if err := createDBIfNotExist(initialDSN); err != nil {
+			return nil, err
+		}
+	}
+
+	var dialect *generic.Generic
+	if credsProvider != nil {
+		var creds credentials.Credentials
+		if creds, err = credsProvider.Get(ctx); err != nil {
+			return nil, err
+		}
+		connPoolConfig.MaxLifetime = creds.ConnMaxLifetime(connPoolConfig.MaxLifetime)
+		dialect, err = generic.OpenWithDSNFunc(ctx, "mysql", dsn, connPoolConfig, "?", false, metricsRegisterer)
+	} else {
+		dialect, err = generic.Open(ctx, "mysql", parsedDSN, connPoolConfig, "?", false, metricsRegisterer)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dialect.ApplyConfig(config)
+	dialect.LastInsertID = true
+	if tableType == tableRowstore {
+		dialect.FullScan = regexp.MustCompile(`\bTableScan\b`).MatchString
+		dialect.GetSizeSQL = `
+			SELECT COALESCE(SUM(MEMORY_USE), 0)
+			FROM information_schema.TABLE_STATISTICS
+			WHERE DATABASE_NAME = DATABASE() AND TABLE_NAME = 'kine'`
+	} else {
+		// columnstore scans are reported as such whether or not they use an
+		// index, so full scans cannot be told apart in the plan
+		dialect.GetSizeSQL = `
+			SELECT (
+				SELECT COALESCE(SUM(MEMORY_USE), 0)
+				FROM information_schema.TABLE_STATISTICS
+				WHERE DATABASE_NAME = DATABASE() AND TABLE_NAME = 'kine'
+			) + (
+				SELECT COALESCE(SUM(COMPRESSED_SIZE), 0)
+				FROM information_schema.COLUMNAR_SEGMENTS
+				WHERE DATABASE_NAME = DATABASE() AND TABLE_NAME = 'kine'
+			)`
+	}
+	// SingleStore does not support deleting from a derived table of the same
+	// table, so superseded rows are found by joining each row to the row that
+	// replaced it, which is on the same partition as both are sharded on the
+	// name. The unique key on the name and previous revision means that each
+	// row joins at most one other.
+	dialect.CompactSQL = `
+		DELETE kv FROM kine AS kv
+		LEFT JOIN kine AS kp
+		ON
+			kp.name = kv.name AND
+			kp.prev_revision = kv.id AND
+			kp.id <= ?
+		WHERE
+			kv.name != 'compact_rev_key' AND
+			kv.id <= ? AND
+			(kp.id IS NOT NULL OR kv.deleted != 0)`
+	dialect.ColumnsSQL = `
+		SELECT COLUMN_NAME
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'kine'`
+	dialect.IndexesSQL = `
+		SELECT INDEX_NAME, MIN(NON_UNIQUE) = 0
+		FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'kine'
+		GROUP BY INDEX_NAME`
+	// CreateIndexSQL is not set, so missing indexes are reported but not
+	// created: unique keys can only be declared when the table is created
+	dialect.RetryPolicy.Retryable = func(err error) bool {
+		if err, ok := err.(*gomysql.MySQLError); ok {
+			return retryable[err.Number]
+		}
+		return false
+	}
+	dialect.TranslateErr = func(err error) error {
+		if isDuplicateKey(err) {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		if err, ok := err.(*gomysql.MySQLError); ok {
+			return fmt.Sprint(err.Number)
+		}
+		return err.Error()
+	}
+
+	if config.SkipDDL() {
+		if config.DryRun {
+			// setup only logs the schema migrations that would be applied
+			if err := setup(dialect.DB, config, tableType); err != nil && err != generic.ErrDDLDisabled {
+				dialect.Close()
+				return nil, err
+			}
+		}
+		if err := dialect.CheckSchema(ctx); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	} else {
+		if err := setup(dialect.DB, config, tableType); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	}
+	go dialect.MonitorDrift(ctx, config.DriftCheckInterval)
+	return logstructured.New(sqllog.New(dialect)), nil
+}
+
+// isDuplicateKey returns true for a duplicate key error. Errors raised on a leaf
+// are forwarded by the aggregator with the error code of the leaf in the
+// message, and a code of its own, so the message is checked as well as the code.
+func isDuplicateKey(err error) bool {
+	if err, ok := err.(*gomysql.MySQLError); ok {
+		return err.Number == 1062 || strings.Contains(err.Message, "Duplicate entry")
+	}
+	return false
+}
@@ -0,0 +1,18 @@
+//go:build cgo && noddl
+// +build cgo,noddl
+
+package sqlite
+
+import (
+	"database/sql"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+func setup(db *sql.DB, config generic.Config) error {
+	return generic.ErrDDLDisabled
+}
+
+func setupHeartbeat(db *sql.DB) error {
+	return generic.ErrDDLDisabled
+}
@@ -0,0 +1,243 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	replicationLitestream = "litestream"
+	replicationLiteFS     = "litefs"
+
+	heartbeatInterval = 5 * time.Second
+	heartbeatSQL      = `REPLACE INTO kine_replication (id, heartbeat) VALUES (1, ?)`
+	lastHeartbeatSQL  = `SELECT heartbeat FROM kine_replication WHERE id = 1`
+)
+
+var (
+	checkpointModes = map[string]bool{"none": true, "passive": true, "full": true, "restart": true, "truncate": true}
+
+	hookDriversLock sync.Mutex
+	hookDrivers     = map[int]string{}
+)
+
+// replication configures the driver for a database that is replicated by
+// Litestream or LiteFS, from the query parameters of the data source name:
+//
+//	replication     litestream or litefs
+//	follower        true to serve a read-only replicated copy of the database,
+//	                or auto to detect a LiteFS replica; defaults to auto for
+//	                LiteFS and false for Litestream
+//	checkpoint      the WAL checkpoint run after compaction, one of none,
+//	                passive, full, restart or truncate; defaults to none for
+//	                Litestream, which runs its own checkpoints, and full for LiteFS
+//	autocheckpoint  the WAL size in pages at which SQLite checkpoints after a
+//	                commit, or 0 to disable; defaults to 0 for Litestream
+type replication struct {
+	mode           string
+	follower       bool
+	checkpoint     string
+	autocheckpoint int
+}
+
+// parseReplication removes the replication parameters from a data source name,
+// and returns the remaining data source name and the replication settings.
+func parseReplication(dataSourceName string) (string, replication, error) {
+	repl := replication{autocheckpoint: -1}
+	path, rawQuery := dataSourceName, ""
+	if i := strings.IndexRune(dataSourceName, '?'); i >= 0 {
+		path, rawQuery = dataSourceName[:i], dataSourceName[i+1:]
+	}
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", repl, err
+	}
+	repl.mode = params.Get("replication")
+	if repl.mode == "" {
+		return dataSourceName, repl, nil
+	}
+	if path == "" || path == "file:" {
+		return "", repl, fmt.Errorf("sqlite replication requires the path of the database")
+	}
+
+	follower := params.Get("follower")
+	switch repl.mode {
+	case replicationLitestream:
+		repl.checkpoint = "none"
+		repl.autocheckpoint = 0
+		// Litestream only replicates databases in WAL mode
+		if params.Get("_journal") == "" && params.Get("_journal_mode") == "" {
+			params.Set("_journal", "WAL")
+		}
+	case replicationLiteFS:
+		repl.checkpoint = "full"
+		if follower == "" {
+			follower = "auto"
+		}
+	default:
+		return "", repl, fmt.Errorf("invalid sqlite replication %q, must be litestream or litefs", repl.mode)
+	}
+
+	switch follower {
+	case "", "false":
+	case "true":
+		repl.follower = true
+	case "auto":
+		if repl.mode != replicationLiteFS {
+			return "", repl, fmt.Errorf("sqlite follower auto is only supported with litefs replication")
+		}
+		// LiteFS exposes the address of the primary in the mount directory of
+		// replicas only
+		_, err := os.Stat(filepath.Join(filepath.Dir(strings.TrimPrefix(path, "file:")), ".primary"))
+		repl.follower = err == nil
+	default:
+		return "", repl, fmt.Errorf("invalid sqlite follower %q, must be true, false or auto", follower)
+	}
+
+	if v := params.Get("checkpoint"); v != "" {
+		if !checkpointModes[v] {
+			return "", repl, fmt.Errorf("invalid sqlite checkpoint %q, must be one of none, passive, full, restart or truncate", v)
+		}
+		repl.checkpoint = v
+	}
+	if v := params.Get("autocheckpoint"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return "", repl, fmt.Errorf("invalid sqlite autocheckpoint %q, must be a number of pages", v)
+		}
+		repl.autocheckpoint = n
+	}
+	if repl.follower {
+		params.Set("_query_only", "1")
+	}
+
+	for _, param := range []string{"replication", "follower", "checkpoint", "autocheckpoint"} {
+		params.Del(param)
+	}
+	return path + "?" + params.Encode(), repl, nil
+}
+
+// postCompactSQL returns the statement that checkpoints the WAL after
+// compaction, or an empty string for none.
+func (r replication) postCompactSQL() string {
+	if r.checkpoint == "none" {
+		return ""
+	}
+	return fmt.Sprintf("PRAGMA wal_checkpoint(%s)", strings.ToUpper(r.checkpoint))
+}
+
+// driverName returns the name of a database/sql driver that sets the WAL
+// autocheckpoint size of each connection, registering it if needed, or the
+// plain sqlite3 driver if the size is not set.
+func (r replication) driverName() string {
+	if r.autocheckpoint < 0 {
+		return "sqlite3"
+	}
+
+	hookDriversLock.Lock()
+	defer hookDriversLock.Unlock()
+	if name, ok := hookDrivers[r.autocheckpoint]; ok {
+		return name
+	}
+	name := fmt.Sprintf("sqlite3_autocheckpoint_%d", r.autocheckpoint)
+	stmt := fmt.Sprintf("PRAGMA wal_autocheckpoint = %d", r.autocheckpoint)
+	sql.Register(name, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec(stmt, nil)
+			return err
+		},
+	})
+	hookDrivers[r.autocheckpoint] = name
+	return name
+}
+
+// newReplicated returns a backend for a database replicated by Litestream or
+// LiteFS. The primary records a heartbeat in the database, which followers
+// compare to the current time to report how far behind their copy is.
+// Followers serve reads and watches from their copy, and reject writes;
+// promoting a follower requires restarting it without the follower setting.
+func newReplicated(ctx context.Context, dataSourceName string, repl replication, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	if repl.follower {
+		// the schema is created by the primary
+		config.NoDDL = true
+	}
+	backend, dialect, err := NewVariant(ctx, repl.driverName(), dataSourceName, connPoolConfig, config, metricsRegisterer)
+	if err != nil {
+		return nil, err
+	}
+	dialect.PostCompactSQL = repl.postCompactSQL()
+
+	if repl.follower {
+		logrus.Infof("Serving read-only %s replica of the database", repl.mode)
+		dialect.ReadOnly = true
+		go monitorLag(ctx, dialect.DB)
+		return backend, nil
+	}
+
+	if !config.SkipDDL() {
+		if err := setupHeartbeat(dialect.DB); err != nil {
+			return nil, err
+		}
+	}
+	go heartbeat(ctx, dialect.DB)
+	return backend, nil
+}
+
+// heartbeat records the current time in the database until the context is
+// cancelled.
+func heartbeat(ctx context.Context, db *sql.DB) {
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+
+	for {
+		if _, err := db.ExecContext(ctx, heartbeatSQL, time.Now().UnixNano()); err != nil && ctx.Err() == nil {
+			logrus.Errorf("Failed to record replication heartbeat: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// monitorLag reports the time since the last heartbeat of the primary that
+// has been replicated, until the context is cancelled.
+func monitorLag(ctx context.Context, db *sql.DB) {
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		var last int64
+		if err := db.QueryRowContext(ctx, lastHeartbeatSQL).Scan(&last); err != nil {
+			if ctx.Err() == nil {
+				logrus.Debugf("Failed to read replication heartbeat: %v", err)
+			}
+			continue
+		}
+		metrics.SQLiteReplicationLagSeconds.Set(time.Since(time.Unix(0, last)).Seconds())
+	}
+}
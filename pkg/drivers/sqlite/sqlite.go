@@ -5,16 +5,15 @@ package sqlite
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"os"
+	"regexp"
 	"time"
 
 	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/logstructured"
 	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
 	"github.com/k3s-io/kine/pkg/server"
-	"github.com/k3s-io/kine/pkg/util"
 	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,35 +23,22 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var (
-	schema = []string{
-		`CREATE TABLE IF NOT EXISTS kine
-			(
-				id INTEGER PRIMARY KEY AUTOINCREMENT,
-				name INTEGER,
-				created INTEGER,
-				deleted INTEGER,
-				create_revision INTEGER,
-				prev_revision INTEGER,
-				lease INTEGER,
-				value BLOB,
-				old_value BLOB
-			)`,
-		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
-		`CREATE INDEX IF NOT EXISTS kine_name_id_index ON kine (name,id)`,
-		`CREATE INDEX IF NOT EXISTS kine_id_deleted_index ON kine (id,deleted)`,
-		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision)`,
-		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
-		`PRAGMA wal_checkpoint(TRUNCATE)`,
+// New returns a backend for a SQLite database. If the replication parameter of
+// the data source name is set, the database is replicated by Litestream or
+// LiteFS, as described by replication.
+func New(ctx context.Context, dataSourceName string, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	dataSourceName, repl, err := parseReplication(dataSourceName)
+	if err != nil {
+		return nil, err
 	}
-)
-
-func New(ctx context.Context, dataSourceName string, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
-	backend, _, err := NewVariant(ctx, "sqlite3", dataSourceName, connPoolConfig, metricsRegisterer)
+	if repl.mode != "" {
+		return newReplicated(ctx, dataSourceName, repl, connPoolConfig, config, metricsRegisterer)
+	}
+	backend, _, err := NewVariant(ctx, "sqlite3", dataSourceName, connPoolConfig, config, metricsRegisterer)
 	return backend, err
 }
 
-func NewVariant(ctx context.Context, driverName, dataSourceName string, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (server.Backend, *generic.Generic, error) {
+func NewVariant(ctx context.Context, driverName, dataSourceName string, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, *generic.Generic, error) {
 	if dataSourceName == "" {
 		if err := os.MkdirAll("./db", 0700); err != nil {
 			return nil, nil, err
@@ -65,7 +51,10 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string, connPool
 		return nil, nil, err
 	}
 
+	dialect.ApplyConfig(config)
 	dialect.LastInsertID = true
+	dialect.ExplainSQL = "EXPLAIN QUERY PLAN "
+	dialect.FullScan = regexp.MustCompile(`\| SCAN (TABLE )?\w+( AS \w+)?$`).MatchString
 	dialect.GetSizeSQL = `SELECT SUM(pgsize) FROM dbstat`
 	dialect.CompactSQL = `
 		DELETE FROM kine AS kv
@@ -85,6 +74,9 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string, connPool
 					kd.id <= ?
 			)`
 	dialect.PostCompactSQL = `PRAGMA wal_checkpoint(FULL)`
+	dialect.ColumnsSQL = `SELECT name FROM pragma_table_info('kine')`
+	dialect.IndexesSQL = `SELECT name, "unique" FROM pragma_index_list('kine')`
+	dialect.CreateIndexSQL = `CREATE %sINDEX IF NOT EXISTS %s ON kine (%s)`
 	dialect.TranslateErr = func(err error) error {
 		if err, ok := err.(sqlite3.Error); ok && err.ExtendedCode == sqlite3.ErrConstraintUnique {
 			return server.ErrKeyExists
@@ -104,8 +96,18 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string, connPool
 	// this is the first SQL that will be executed on a new DB conn so
 	// loop on failure here because in the case of dqlite it could still be initializing
 	for i := 0; i < 300; i++ {
-		err = setup(dialect.DB)
-		if err == nil {
+		switch {
+		case config.DryRun:
+			// setup only logs the schema migrations that would be applied
+			if err = setup(dialect.DB, config); err == nil || err == generic.ErrDDLDisabled {
+				err = dialect.CheckSchema(ctx)
+			}
+		case config.SkipDDL():
+			err = dialect.CheckSchema(ctx)
+		default:
+			err = setup(dialect.DB, config)
+		}
+		if err == nil || err == generic.ErrDDLDisabled {
 			break
 		}
 		logrus.Errorf("failed to setup db: %v", err)
@@ -120,21 +122,9 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string, connPool
 		return nil, nil, errors.Wrap(err, "setup db")
 	}
 
-	dialect.Migrate(context.Background())
-	return logstructured.New(sqllog.New(dialect)), dialect, nil
-}
-
-func setup(db *sql.DB) error {
-	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
-
-	for _, stmt := range schema {
-		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
-		_, err := db.Exec(stmt)
-		if err != nil {
-			return err
-		}
+	if !config.SkipDDL() {
+		dialect.Migrate(context.Background())
 	}
-
-	logrus.Infof("Database tables and indexes are up to date")
-	return nil
+	go dialect.MonitorDrift(ctx, config.DriftCheckInterval)
+	return logstructured.New(sqllog.New(dialect)), dialect, nil
 }
@@ -0,0 +1,458 @@
+// Package testsuite exercises the server.Backend contract, so that drivers,
+// including those maintained outside of this repository, can verify that they
+// behave as kine and the apiserver expect with a single call from a test:
+//
+//	func TestConformance(t *testing.T) {
+//		testsuite.Run(t, func(t *testing.T) server.Backend {
+//			return newStartedBackend(t)
+//		})
+//	}
+package testsuite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+const (
+	watchTimeout = 10 * time.Second
+	ttlTimeout   = 30 * time.Second
+)
+
+var prefixCount int64
+
+// NewBackendFunc returns a started backend to test. Each test uses its own key
+// prefix, so the same backend may be returned for every test.
+type NewBackendFunc func(t *testing.T) server.Backend
+
+// Run runs all conformance tests as subtests of t. The TTL test waits for keys
+// to expire, and is skipped in short mode.
+func Run(t *testing.T, newBackend NewBackendFunc) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, b server.Backend, prefix string)
+	}{
+		{"Create", testCreate},
+		{"CreateExisting", testCreateExisting},
+		{"Update", testUpdate},
+		{"UpdateStale", testUpdateStale},
+		{"Delete", testDelete},
+		{"DeleteStale", testDeleteStale},
+		{"GetAtRevision", testGetAtRevision},
+		{"List", testList},
+		{"ListLimit", testListLimit},
+		{"ListAtRevision", testListAtRevision},
+		{"Count", testCount},
+		{"Watch", testWatch},
+		{"WatchFromRevision", testWatchFromRevision},
+		{"WatchPrefix", testWatchPrefix},
+		{"Compaction", testCompaction},
+		{"TTL", testTTL},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBackend(t)
+			prefix := fmt.Sprintf("/testsuite/%d-%d/", time.Now().UnixNano(), atomic.AddInt64(&prefixCount, 1))
+			tt.test(t, b, prefix)
+		})
+	}
+}
+
+func testCreate(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	rev := mustCreate(t, b, key, "v1")
+	_, kv, err := b.Get(ctx, key, 0)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	expectKV(t, kv, key, "v1", rev, rev)
+}
+
+func testCreateExisting(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	mustCreate(t, b, key, "v1")
+	if _, err := b.Create(ctx, key, []byte("v2"), 0); err != server.ErrKeyExists {
+		t.Fatalf("Create of existing key returned %v, expected %v", err, server.ErrKeyExists)
+	}
+}
+
+func testUpdate(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	createRev := mustCreate(t, b, key, "v1")
+	rev, kv, ok, err := b.Update(ctx, key, []byte("v2"), createRev, 0)
+	if err != nil || !ok {
+		t.Fatalf("Update failed: ok=%v, err=%v", ok, err)
+	}
+	if rev <= createRev {
+		t.Fatalf("Update returned revision %d, expected greater than %d", rev, createRev)
+	}
+	expectKV(t, kv, key, "v2", createRev, rev)
+
+	_, kv, err = b.Get(ctx, key, 0)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	expectKV(t, kv, key, "v2", createRev, rev)
+}
+
+func testUpdateStale(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	createRev := mustCreate(t, b, key, "v1")
+	rev, _, ok, err := b.Update(ctx, key, []byte("v2"), createRev, 0)
+	if err != nil || !ok {
+		t.Fatalf("Update failed: ok=%v, err=%v", ok, err)
+	}
+
+	_, kv, ok, err := b.Update(ctx, key, []byte("v3"), createRev, 0)
+	if err != nil {
+		t.Fatalf("Update with stale revision failed: %v", err)
+	}
+	if ok {
+		t.Fatalf("Update with stale revision %d succeeded", createRev)
+	}
+	expectKV(t, kv, key, "v2", createRev, rev)
+}
+
+func testDelete(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	createRev := mustCreate(t, b, key, "v1")
+	rev, kv, deleted, err := b.Delete(ctx, key, createRev)
+	if err != nil || !deleted {
+		t.Fatalf("Delete failed: deleted=%v, err=%v", deleted, err)
+	}
+	if rev <= createRev {
+		t.Fatalf("Delete returned revision %d, expected greater than %d", rev, createRev)
+	}
+	expectKV(t, kv, key, "v1", createRev, createRev)
+
+	_, kv, err = b.Get(ctx, key, 0)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if kv != nil {
+		t.Fatalf("Get of deleted key returned revision %d", kv.ModRevision)
+	}
+
+	// the key can be created again once deleted
+	mustCreate(t, b, key, "v2")
+}
+
+func testDeleteStale(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	createRev := mustCreate(t, b, key, "v1")
+	rev, _, ok, err := b.Update(ctx, key, []byte("v2"), createRev, 0)
+	if err != nil || !ok {
+		t.Fatalf("Update failed: ok=%v, err=%v", ok, err)
+	}
+
+	_, kv, deleted, err := b.Delete(ctx, key, createRev)
+	if err != nil {
+		t.Fatalf("Delete with stale revision failed: %v", err)
+	}
+	if deleted {
+		t.Fatalf("Delete with stale revision %d succeeded", createRev)
+	}
+	expectKV(t, kv, key, "v2", createRev, rev)
+}
+
+func testGetAtRevision(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+	key := prefix + "a"
+
+	createRev := mustCreate(t, b, key, "v1")
+	if _, _, ok, err := b.Update(ctx, key, []byte("v2"), createRev, 0); err != nil || !ok {
+		t.Fatalf("Update failed: ok=%v, err=%v", ok, err)
+	}
+
+	_, kv, err := b.Get(ctx, key, createRev)
+	if err != nil {
+		t.Fatalf("Get at revision %d failed: %v", createRev, err)
+	}
+	expectKV(t, kv, key, "v1", createRev, createRev)
+}
+
+func testList(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+
+	want := map[string]string{}
+	for _, name := range []string{"a", "b", "c"} {
+		mustCreate(t, b, prefix+name, name)
+		want[prefix+name] = name
+	}
+	// keys that share the prefix as a string, but not as a directory, are not listed
+	mustCreate(t, b, prefix[:len(prefix)-1]+"x/a", "x")
+
+	_, kvs, err := b.List(ctx, prefix, "", 0, 0)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	expectKeys(t, kvs, want)
+}
+
+func testListLimit(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+
+	for _, name := range []string{"a", "b", "c"} {
+		mustCreate(t, b, prefix+name, name)
+	}
+
+	_, kvs, err := b.List(ctx, prefix, "", 2, 0)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(kvs) != 2 {
+		t.Fatalf("List with limit 2 returned %d keys", len(kvs))
+	}
+}
+
+func testListAtRevision(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+
+	revA := mustCreate(t, b, prefix+"a", "a")
+	rev := mustCreate(t, b, prefix+"b", "b")
+	if _, _, ok, err := b.Update(ctx, prefix+"a", []byte("a2"), revA, 0); err != nil || !ok {
+		t.Fatalf("Update failed: ok=%v, err=%v", ok, err)
+	}
+	mustCreate(t, b, prefix+"c", "c")
+
+	_, kvs, err := b.List(ctx, prefix, "", 0, rev)
+	if err != nil {
+		t.Fatalf("List at revision %d failed: %v", rev, err)
+	}
+	expectKeys(t, kvs, map[string]string{
+		prefix + "a": "a",
+		prefix + "b": "b",
+	})
+}
+
+func testCount(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+
+	var last int64
+	for _, name := range []string{"a", "b", "c"} {
+		last = mustCreate(t, b, prefix+name, name)
+	}
+	if _, _, deleted, err := b.Delete(ctx, prefix+"c", last); err != nil || !deleted {
+		t.Fatalf("Delete failed: deleted=%v, err=%v", deleted, err)
+	}
+
+	rev, count, err := b.Count(ctx, prefix)
+	if err != nil {
+		t.Fatalf("Count failed: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("Count returned %d, expected 2", count)
+	}
+	if rev < last {
+		t.Fatalf("Count returned revision %d, expected at least %d", rev, last)
+	}
+}
+
+func testWatch(t *testing.T, b server.Backend, prefix string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key := prefix + "a"
+
+	events := b.Watch(ctx, prefix, 0)
+
+	createRev := mustCreate(t, b, key, "v1")
+	updateRev, _, ok, err := b.Update(ctx, key, []byte("v2"), createRev, 0)
+	if err != nil || !ok {
+		t.Fatalf("Update failed: ok=%v, err=%v", ok, err)
+	}
+	deleteRev, _, deleted, err := b.Delete(ctx, key, updateRev)
+	if err != nil || !deleted {
+		t.Fatalf("Delete failed: deleted=%v, err=%v", deleted, err)
+	}
+
+	got := readEvents(t, events, 3)
+	expectEvent(t, got[0], "create", key, createRev)
+	expectEvent(t, got[1], "update", key, updateRev)
+	expectEvent(t, got[2], "delete", key, deleteRev)
+}
+
+func testWatchFromRevision(t *testing.T, b server.Backend, prefix string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	revA := mustCreate(t, b, prefix+"a", "a")
+	revB := mustCreate(t, b, prefix+"b", "b")
+
+	// events at and after the start revision are replayed, followed by new events
+	events := b.Watch(ctx, prefix, revA)
+	revC := mustCreate(t, b, prefix+"c", "c")
+
+	got := readEvents(t, events, 3)
+	expectEvent(t, got[0], "create", prefix+"a", revA)
+	expectEvent(t, got[1], "create", prefix+"b", revB)
+	expectEvent(t, got[2], "create", prefix+"c", revC)
+}
+
+func testWatchPrefix(t *testing.T, b server.Backend, prefix string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := b.Watch(ctx, prefix+"a/", 0)
+	mustCreate(t, b, prefix+"b/1", "b")
+	rev := mustCreate(t, b, prefix+"a/1", "a")
+
+	got := readEvents(t, events, 1)
+	expectEvent(t, got[0], "create", prefix+"a/1", rev)
+}
+
+func testCompaction(t *testing.T, b server.Backend, prefix string) {
+	ctx := context.Background()
+
+	rev := mustCreate(t, b, prefix+"a", "a")
+	compactRev, err := b.CompactRevision(ctx)
+	if err != nil {
+		t.Fatalf("CompactRevision failed: %v", err)
+	}
+	if compactRev > rev {
+		t.Fatalf("CompactRevision returned %d, after the current revision %d", compactRev, rev)
+	}
+	if compactRev <= 1 {
+		t.Skip("backend has not been compacted")
+	}
+	if _, _, err := b.List(ctx, prefix, "", 0, compactRev-1); err != server.ErrCompacted {
+		t.Fatalf("List at compacted revision %d returned %v, expected %v", compactRev-1, err, server.ErrCompacted)
+	}
+}
+
+func testTTL(t *testing.T, b server.Backend, prefix string) {
+	if testing.Short() {
+		t.Skip("skipping TTL test in short mode")
+	}
+	ctx := context.Background()
+	key := prefix + "a"
+
+	if _, err := b.Create(ctx, key, []byte("v1"), 1); err != nil {
+		t.Fatalf("Create with lease failed: %v", err)
+	}
+	_, kv, err := b.Get(ctx, key, 0)
+	if err != nil || kv == nil {
+		t.Fatalf("Get of key with lease failed: kv=%v, err=%v", kv, err)
+	}
+	if kv.Lease != 1 {
+		t.Fatalf("Get returned lease %d, expected 1", kv.Lease)
+	}
+
+	deadline := time.Now().Add(ttlTimeout)
+	for time.Now().Before(deadline) {
+		if _, kv, err = b.Get(ctx, key, 0); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if kv == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("key with a 1s lease did not expire within %v", ttlTimeout)
+}
+
+func mustCreate(t *testing.T, b server.Backend, key, value string) int64 {
+	t.Helper()
+	rev, err := b.Create(context.Background(), key, []byte(value), 0)
+	if err != nil {
+		t.Fatalf("Create of %s failed: %v", key, err)
+	}
+	if rev <= 0 {
+		t.Fatalf("Create of %s returned revision %d", key, rev)
+	}
+	return rev
+}
+
+func expectKV(t *testing.T, kv *server.KeyValue, key, value string, createRev, modRev int64) {
+	t.Helper()
+	if kv == nil {
+		t.Fatalf("expected %s, got no key", key)
+	}
+	if kv.Key != key || !bytes.Equal(kv.Value, []byte(value)) || kv.CreateRevision != createRev || kv.ModRevision != modRev {
+		t.Fatalf("expected %s=%q createRev=%d modRev=%d, got %s=%q createRev=%d modRev=%d",
+			key, value, createRev, modRev, kv.Key, kv.Value, kv.CreateRevision, kv.ModRevision)
+	}
+}
+
+func expectKeys(t *testing.T, kvs []*server.KeyValue, want map[string]string) {
+	t.Helper()
+	got := map[string]string{}
+	var keys []string
+	for _, kv := range kvs {
+		got[kv.Key] = string(kv.Value)
+		keys = append(keys, kv.Key)
+	}
+	sort.Strings(keys)
+	if len(got) != len(want) || len(kvs) != len(want) {
+		t.Fatalf("expected %d keys, got %v", len(want), keys)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("expected %s=%q, got %q", k, v, got[k])
+		}
+	}
+}
+
+func readEvents(t *testing.T, events <-chan []*server.Event, n int) []*server.Event {
+	t.Helper()
+	var result []*server.Event
+	timeout := time.After(watchTimeout)
+	for len(result) < n {
+		select {
+		case batch, ok := <-events:
+			if !ok {
+				t.Fatalf("watch closed after %d of %d events", len(result), n)
+			}
+			result = append(result, batch...)
+		case <-timeout:
+			t.Fatalf("received %d of %d events within %v", len(result), n, watchTimeout)
+		}
+	}
+	if len(result) > n {
+		t.Fatalf("received %d events, expected %d", len(result), n)
+	}
+	for i := 1; i < len(result); i++ {
+		if result[i].KV.ModRevision <= result[i-1].KV.ModRevision {
+			t.Fatalf("events out of order: revision %d after %d", result[i].KV.ModRevision, result[i-1].KV.ModRevision)
+		}
+	}
+	return result
+}
+
+func expectEvent(t *testing.T, e *server.Event, kind, key string, rev int64) {
+	t.Helper()
+	var got string
+	switch {
+	case e.Create:
+		got = "create"
+	case e.Delete:
+		got = "delete"
+	default:
+		got = "update"
+	}
+	if got != kind || e.KV.Key != key || e.KV.ModRevision != rev {
+		t.Fatalf("expected %s event for %s at revision %d, got %s event for %s at revision %d", kind, key, rev, got, e.KV.Key, e.KV.ModRevision)
+	}
+	if kind != "create" && e.PrevKV == nil {
+		t.Fatalf("%s event for %s has no previous value", kind, key)
+	}
+}
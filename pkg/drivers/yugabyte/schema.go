@@ -0,0 +1,144 @@
+//go:build !noddl
+// +build !noddl
+
+package yugabyte
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// The table is hash sharded on the id, which is taken from a sequence that
+	// does not cache ids, as revisions must be dense and in order. The leading
+	// column of an index is hash sharded by default, so the indexes used for
+	// ordered scans of names and ids are declared ASC to be range sharded.
+	// Strings are compared byte by byte with the C collation.
+	schema = []string{
+		`CREATE SEQUENCE IF NOT EXISTS kine_id_seq CACHE 1`,
+		`CREATE TABLE IF NOT EXISTS kine
+			(
+				id BIGINT NOT NULL DEFAULT nextval('kine_id_seq'),
+				name %s,
+				created INTEGER,
+				deleted INTEGER,
+				create_revision BIGINT,
+				prev_revision BIGINT,
+				lease BIGINT,
+				value BYTEA,
+				old_value BYTEA,
+				PRIMARY KEY (id HASH)
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name ASC)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_id_index ON kine (name ASC, id ASC)`,
+		`CREATE INDEX IF NOT EXISTS kine_id_deleted_index ON kine (id ASC, deleted)`,
+		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision HASH)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine ((name, prev_revision) HASH)`,
+	}
+	expirySchema = []string{
+		`ALTER TABLE kine ADD COLUMN IF NOT EXISTS expires_at BIGINT`,
+		`CREATE INDEX IF NOT EXISTS kine_expires_at_index ON kine (expires_at ASC)`,
+	}
+	createDB = "CREATE DATABASE "
+)
+
+// nameColumn returns the type of the name column.
+func nameColumn(config generic.Config) string {
+	if config.BinaryKeys {
+		return fmt.Sprintf("BYTEA CHECK (octet_length(name) <= %d)", config.KeyColumnLength())
+	}
+	return fmt.Sprintf(`VARCHAR(%d) COLLATE "C"`, config.KeyColumnLength())
+}
+
+// migrations returns the migrations of the kine table, in order. Migrations
+// that have been released must not be changed.
+func migrations(config generic.Config) []generic.Migration {
+	stmts := make([]string, len(schema))
+	for i, stmt := range schema {
+		if strings.Contains(stmt, "%s") {
+			stmt = fmt.Sprintf(stmt, nameColumn(config))
+		}
+		stmts[i] = stmt
+	}
+	return []generic.Migration{
+		{
+			Version:     1,
+			Description: "create the kine table and its indexes",
+			Statements:  stmts,
+		},
+	}
+}
+
+func setup(db *sql.DB, config generic.Config) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	table, err := config.Table()
+	if err != nil {
+		return err
+	}
+
+	migrator := &generic.Migrator{
+		DB:         db,
+		Table:      table,
+		Migrations: migrations(config),
+		DryRun:     config.DryRun,
+	}
+	if err := migrator.Run(); err != nil || config.DryRun {
+		return err
+	}
+
+	var stmts []string
+	if config.TTLColumn {
+		stmts = append(stmts, expirySchema...)
+	}
+	for _, stmt := range stmts {
+		stmt = table.SQL(stmt)
+		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+// createDBIfNotExist creates the database named in the data source, connecting
+// to the yugabyte database to do so if it does not exist.
+func createDBIfNotExist(dataSourceName string) error {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return err
+	}
+	dbName := strings.TrimPrefix(u.Path, "/")
+
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// the database exists unless the connection is refused because it does not
+	err = db.Ping()
+	if pqErr, ok := err.(*pq.Error); !ok || pqErr.Code != "3D000" {
+		return err
+	}
+
+	u.Path = "/yugabyte"
+	db, err = sql.Open("postgres", u.String())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	stmt := createDB + pq.QuoteIdentifier(dbName)
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+	_, err = db.Exec(stmt)
+	return err
+}
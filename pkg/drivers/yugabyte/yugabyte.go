@@ -0,0 +1,156 @@
+package yugabyte
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/k3s-io/kine/pkg/credentials"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/drivers/pgsql"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultDSN = "yugabyte@localhost:5433/"
+
+	// serializationFailureCode is returned for transactions that conflicted
+	// with another transaction.
+	serializationFailureCode = "40001"
+	// internalErrorCode is returned for conflicts and read restarts that
+	// YugabyteDB does not map to a Postgres error code, among other errors.
+	internalErrorCode = "XX000"
+)
+
+// retryableInternalErrors match the messages of the internal errors that are
+// resolved by retrying.
+var retryableInternalErrors = regexp.MustCompile(`(?i)try again|restart read required|conflicts with (higher priority|committed) transaction`)
+
+// New connects to YugabyteDB over the Postgres protocol. The kine table is hash
+// sharded on the id, so that inserts of increasing revisions are spread over
+// tablets rather than all landing on the last one, and statements that fail
+// with transaction conflicts are retried by kine.
+//
+// Revisions must be allocated in order, so the tserver flag
+// ysql_sequence_cache_minval must be set to 1; otherwise each connection
+// caches 100 ids from the sequence and inserts out of order.
+func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, credsProvider credentials.Provider, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	if dataSourceName == "" {
+		dataSourceName = defaultDSN
+	}
+	parsedDSN, dsn, err := pgsql.DSNFunc(dataSourceName, tlsInfo, credsProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	initialDSN, err := dsn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.SkipDDL() {
+		if err := createDBIfNotExist(initialDSN); err != nil {
+			return nil, err
+		}
+	}
+
+	var dialect *generic.Generic
+	if credsProvider != nil {
+		var creds credentials.Credentials
+		if creds, err = credsProvider.Get(ctx); err != nil {
+			return nil, err
+		}
+		connPoolConfig.MaxLifetime = creds.ConnMaxLifetime(connPoolConfig.MaxLifetime)
+		dialect, err = generic.OpenWithDSNFunc(ctx, "postgres", dsn, connPoolConfig, "$", true, metricsRegisterer)
+	} else {
+		dialect, err = generic.Open(ctx, "postgres", parsedDSN, connPoolConfig, "$", true, metricsRegisterer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dialect.ApplyConfig(config)
+	dialect.GetSizeSQL = `SELECT pg_total_relation_size('kine')`
+	dialect.PromoteSQL = `SELECT setval('kine_id_seq', (SELECT MAX(id) FROM kine))`
+	dialect.CompactSQL = `
+		DELETE FROM kine AS kv
+		WHERE
+			kv.id IN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= $1
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= $2
+			)`
+	dialect.FullScan = regexp.MustCompile(`Seq Scan on ` + dialect.Table().Name + `\b`).MatchString
+	dialect.ColumnsSQL = `
+		SELECT column_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'kine'`
+	dialect.IndexesSQL = `
+		SELECT i.relname, ix.indisunique
+		FROM pg_index AS ix
+		JOIN pg_class AS i ON i.oid = ix.indexrelid
+		JOIN pg_class AS t ON t.oid = ix.indrelid
+		JOIN pg_namespace AS n ON n.oid = t.relnamespace
+		WHERE
+			t.relname = 'kine' AND
+			n.nspname = current_schema() AND
+			ix.indisvalid`
+	// CreateIndexSQL is not set, so missing indexes are reported but not
+	// created: the leading column of an index is hash sharded unless declared
+	// ASC, and ordered scans need range sharded indexes
+	dialect.RetryPolicy.Retryable = func(err error) bool {
+		if err, ok := err.(*pq.Error); ok {
+			return err.Code == serializationFailureCode ||
+				(err.Code == internalErrorCode && retryableInternalErrors.MatchString(err.Message))
+		}
+		return false
+	}
+	dialect.TranslateErr = func(err error) error {
+		if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		if err, ok := err.(*pq.Error); ok {
+			return string(err.Code)
+		}
+		return err.Error()
+	}
+
+	if config.SkipDDL() {
+		if config.DryRun {
+			// setup only logs the schema migrations that would be applied
+			if err := setup(dialect.DB, config); err != nil && err != generic.ErrDDLDisabled {
+				dialect.Close()
+				return nil, err
+			}
+		}
+		if err := dialect.CheckSchema(ctx); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	} else {
+		if err := setup(dialect.DB, config); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	}
+	go dialect.MonitorDrift(ctx, config.DriftCheckInterval)
+	return logstructured.New(sqllog.New(dialect)), nil
+}
@@ -0,0 +1,248 @@
+// Package encryption encrypts the values stored by SQL backends with envelope
+// encryption. Each value is encrypted with AES-GCM under a data encryption key
+// (DEK), which is stored with the value, itself encrypted under a key
+// encryption key (KEK) supplied by the operator. Values written before
+// encryption was enabled are read as they are.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// KeysEnv is the environment variable that holds the key encryption keys if no
+// key file is configured, separated by commas.
+const KeysEnv = "KINE_ENCRYPTION_KEYS"
+
+// dekUses is the number of values encrypted with a DEK before a new one is
+// generated, well below the number of random nonces that may safely be used
+// with a single AES-GCM key.
+const dekUses = 1 << 20
+
+// ErrNoKeys is returned when reading an encrypted value without keys.
+var ErrNoKeys = errors.New("value is encrypted, but no encryption keys are configured")
+
+// magic starts the header of encrypted values, which is followed by a version
+// byte.
+var magic = []byte{0, 'k', 'e'}
+
+const version byte = 1
+
+// Keyring encrypts values under the primary KEK, and decrypts values encrypted
+// under any of its KEKs, so that keys can be rotated by adding a new primary
+// KEK and keeping the old ones until every value has been rewritten. Values
+// are rewritten with the primary KEK whenever their key is written, as each
+// write stores a new row.
+type Keyring struct {
+	primary string
+	keks    map[string]cipher.AEAD
+
+	mu sync.Mutex
+	// dek encrypts values until it has been used dekUses times
+	dek        cipher.AEAD
+	wrappedDEK []byte
+	uses       int
+	// deks holds the DEKs of values read, by their wrapped form, so that each
+	// is only unwrapped once
+	deks map[string]cipher.AEAD
+}
+
+// Load returns a keyring with the keys in a file, or in KeysEnv if no file is
+// given, or nil if neither holds keys. Each key is a name, a colon, and a
+// base64 encoded AES key of 16, 24 or 32 bytes. The first key is the primary.
+func Load(path string) (*Keyring, error) {
+	var keys []string
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading encryption keys")
+		}
+		keys = strings.Split(string(b), "\n")
+	} else if env := os.Getenv(KeysEnv); env != "" {
+		keys = strings.Split(env, ",")
+	}
+
+	var k *Keyring
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		i := strings.IndexByte(key, ':')
+		if i <= 0 || i > 255 {
+			return nil, fmt.Errorf("invalid encryption key, must be a name of up to 255 bytes and a base64 encoded key separated by a colon")
+		}
+		name := key[:i]
+		raw, err := base64.StdEncoding.DecodeString(key[i+1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding encryption key %s", name)
+		}
+		kek, err := newAEAD(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encryption key %s", name)
+		}
+		if k == nil {
+			k = &Keyring{
+				primary: name,
+				keks:    map[string]cipher.AEAD{},
+				deks:    map[string]cipher.AEAD{},
+			}
+		}
+		if _, ok := k.keks[name]; ok {
+			return nil, fmt.Errorf("encryption key %s is defined more than once", name)
+		}
+		k.keks[name] = kek
+	}
+	return k, nil
+}
+
+// Primary returns the name of the KEK that new values are encrypted under.
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// Keys returns the number of KEKs that values can be decrypted with.
+func (k *Keyring) Keys() int {
+	return len(k.keks)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, and returns the nonce followed
+// by the ciphertext appended to dst.
+func seal(aead cipher.AEAD, dst, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(append(dst, nonce...), nonce, plaintext, nil), nil
+}
+
+// open decrypts the output of seal.
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is truncated")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// currentDEK returns the DEK to encrypt a value with and its wrapped form,
+// generating a new one if the current one has been used too often.
+func (k *Keyring) currentDEK() (cipher.AEAD, []byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.dek == nil || k.uses >= dekUses {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		dek, err := newAEAD(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		wrapped, err := seal(k.keks[k.primary], nil, raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		k.dek, k.wrappedDEK, k.uses = dek, wrapped, 0
+	}
+	k.uses++
+	return k.dek, k.wrappedDEK, nil
+}
+
+// Encrypt returns a value encrypted with a DEK wrapped by the primary KEK,
+// with a header that names the KEK and holds the wrapped DEK. Empty values are
+// returned as they are.
+func (k *Keyring) Encrypt(value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return value, nil
+	}
+	dek, wrapped, err := k.currentDEK()
+	if err != nil {
+		return nil, errors.Wrap(err, "generating data encryption key")
+	}
+
+	out := make([]byte, 0, len(magic)+3+len(k.primary)+len(wrapped)+dek.NonceSize()+len(value)+dek.Overhead())
+	out = append(out, magic...)
+	out = append(out, version, byte(len(k.primary)))
+	out = append(out, k.primary...)
+	out = append(out, byte(len(wrapped)))
+	out = append(out, wrapped...)
+	return seal(dek, out, value)
+}
+
+// IsEncrypted returns true if a value starts with the header of encrypted
+// values.
+func IsEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, magic)
+}
+
+// Decrypt returns a value as it was before it was encrypted. Values without a
+// header are returned as they are.
+func (k *Keyring) Decrypt(value []byte) ([]byte, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	rest := value[len(magic):]
+	if len(rest) < 2 || rest[0] != version {
+		return nil, fmt.Errorf("unsupported encrypted value")
+	}
+	nameLen := int(rest[1])
+	rest = rest[2:]
+	if len(rest) < nameLen+1 {
+		return nil, fmt.Errorf("encrypted value is truncated")
+	}
+	name := string(rest[:nameLen])
+	wrappedLen := int(rest[nameLen])
+	rest = rest[nameLen+1:]
+	if len(rest) < wrappedLen {
+		return nil, fmt.Errorf("encrypted value is truncated")
+	}
+
+	dek, err := k.unwrap(name, rest[:wrappedLen])
+	if err != nil {
+		return nil, err
+	}
+	return open(dek, rest[wrappedLen:])
+}
+
+// unwrap returns the DEK that a KEK wrapped.
+func (k *Keyring) unwrap(name string, wrapped []byte) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if dek, ok := k.deks[string(wrapped)]; ok {
+		return dek, nil
+	}
+	kek, ok := k.keks[name]
+	if !ok {
+		return nil, fmt.Errorf("value is encrypted with unknown key %s", name)
+	}
+	raw, err := open(kek, wrapped)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypting data encryption key with key %s", name)
+	}
+	dek, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	k.deks[string(wrapped)] = dek
+	return dek, nil
+}
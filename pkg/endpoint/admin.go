@@ -0,0 +1,168 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/clone"
+	"github.com/k3s-io/kine/pkg/credentials"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/restore"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/soak"
+	"github.com/k3s-io/kine/pkg/timetravel"
+	"github.com/pkg/errors"
+)
+
+// Repair connects to the configured datastore and detects, and unless dryRun is
+// set, fixes known forms of corruption. Only SQL backends are supported.
+func Repair(ctx context.Context, config Config, dryRun bool) ([]generic.RepairIssue, error) {
+	dialect, err := openDialect(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer dialect.Close()
+
+	return dialect.Repair(ctx, dryRun)
+}
+
+// openDialect connects to the configured datastore without starting it, and
+// returns the generic SQL dialect used by the backend.
+func openDialect(ctx context.Context, config Config) (*generic.Generic, error) {
+	driver, dsn := ParseStorageEndpoint(config.Endpoint)
+	_, backend, err := getKineStorageBackend(ctx, driver, dsn, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "building kine")
+	}
+
+	if dialect, ok := dialectOf(backend); ok {
+		return dialect, nil
+	}
+	return nil, fmt.Errorf("operation is not supported by the %s backend", driver)
+}
+
+// dialectOf returns the generic SQL dialect that underlies a backend, if any.
+func dialectOf(backend server.Backend) (*generic.Generic, bool) {
+	// look through backends that wrap another, such as the events router
+	for {
+		u, ok := backend.(interface{ Unwrap() server.Backend })
+		if !ok {
+			break
+		}
+		backend = u.Unwrap()
+	}
+	ls, ok := backend.(*logstructured.LogStructured)
+	if !ok {
+		return nil, false
+	}
+	sl, ok := ls.Log().(*sqllog.SQLLog)
+	if !ok {
+		return nil, false
+	}
+	d := sl.Dialect()
+	// look through dialects that wrap the generic dialect
+	for {
+		u, ok := d.(interface{ Unwrap() server.Dialect })
+		if !ok {
+			break
+		}
+		d = u.Unwrap()
+	}
+	dialect, ok := d.(*generic.Generic)
+	return dialect, ok
+}
+
+// overrideSQL replaces statements of the SQL dialect underlying a backend with
+// those in a file. Only SQL backends are supported.
+func overrideSQL(backend server.Backend, path string) error {
+	dialect, ok := dialectOf(backend)
+	if !ok {
+		return fmt.Errorf("SQL overrides are only supported by SQL backends")
+	}
+	overrides, err := generic.LoadSQLOverrides(path)
+	if err != nil {
+		return err
+	}
+	return dialect.OverrideSQL(overrides)
+}
+
+// Soak connects to the configured datastore, starts it, and runs a randomized
+// workload against it while verifying its consistency. Compaction is only
+// exercised for SQL backends.
+func Soak(ctx context.Context, config Config, soakConfig soak.Config) (*soak.Stats, error) {
+	driver, dsn := ParseStorageEndpoint(config.Endpoint)
+	_, backend, err := getKineStorageBackend(ctx, driver, dsn, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "building kine")
+	}
+	if err := backend.Start(ctx); err != nil {
+		return nil, errors.Wrap(err, "starting kine backend")
+	}
+
+	if ls, ok := backend.(*logstructured.LogStructured); ok {
+		if sl, ok := ls.Log().(*sqllog.SQLLog); ok {
+			soakConfig.Compact = sl.Compact
+		}
+	}
+	return soak.Run(ctx, backend, soakConfig)
+}
+
+// TimeTravel connects to the configured datastore and lists the keys with the
+// prefix as they were at time t.
+func TimeTravel(ctx context.Context, config Config, t time.Time, prefix string) (*timetravel.Resolution, []*server.KeyValue, error) {
+	driver, dsn := ParseStorageEndpoint(config.Endpoint)
+	_, backend, err := getKineStorageBackend(ctx, driver, dsn, config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "building kine")
+	}
+	return timetravel.List(ctx, backend, t, prefix)
+}
+
+// Restore connects to the configured datastore and plans the writes needed to
+// roll the keys with the prefix back to their state at revision. The writes
+// are applied only if confirm returns true for the plan.
+func Restore(ctx context.Context, config Config, revision int64, prefix string, confirm func(*restore.Plan) bool) (*restore.Plan, *restore.Result, error) {
+	driver, dsn := ParseStorageEndpoint(config.Endpoint)
+	_, backend, err := getKineStorageBackend(ctx, driver, dsn, config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "building kine")
+	}
+
+	plan, err := restore.NewPlan(ctx, backend, revision, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(plan.Changes) == 0 || !confirm(plan) {
+		return plan, nil, nil
+	}
+	result, err := plan.Apply(ctx, backend)
+	return plan, result, err
+}
+
+// Clone connects to the configured datastore and to the target endpoint, and
+// copies the keys with the prefix at revision to the target. The target uses
+// the same TLS and connection pool settings.
+func Clone(ctx context.Context, config Config, targetEndpoint string, revision int64, prefix string) (int64, int, error) {
+	driver, dsn := ParseStorageEndpoint(config.Endpoint)
+	_, source, err := getKineStorageBackend(ctx, driver, dsn, config)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "building kine")
+	}
+
+	// the target uses its own credentials from its endpoint, and does not
+	// register pool metrics
+	targetConfig := config
+	targetConfig.Endpoint = targetEndpoint
+	targetConfig.Credentials = credentials.Config{}
+	targetConfig.MetricsRegisterer = nil
+	driver, dsn = ParseStorageEndpoint(targetEndpoint)
+	_, target, err := getKineStorageBackend(ctx, driver, dsn, targetConfig)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "building kine for target")
+	}
+
+	return clone.Copy(ctx, source, target, revision, prefix)
+}
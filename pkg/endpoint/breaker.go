@@ -0,0 +1,26 @@
+package endpoint
+
+import (
+	"fmt"
+
+	"github.com/k3s-io/kine/pkg/breaker"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// wrapBreaker wraps the SQL dialect underlying a backend in a circuit breaker,
+// outside of any injected faults so that they can trip it. Only SQL backends
+// are supported.
+func wrapBreaker(backend server.Backend, config breaker.Config) error {
+	ls, ok := backend.(*logstructured.LogStructured)
+	if !ok {
+		return fmt.Errorf("the circuit breaker is only supported by SQL backends")
+	}
+	sl, ok := ls.Log().(*sqllog.SQLLog)
+	if !ok {
+		return fmt.Errorf("the circuit breaker is only supported by SQL backends")
+	}
+	sl.SetDialect(breaker.Wrap(sl.Dialect(), config))
+	return nil
+}
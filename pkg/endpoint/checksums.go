@@ -0,0 +1,40 @@
+package endpoint
+
+import (
+	"context"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+// checksumBackends are the backends that support row checksums.
+var checksumBackends = map[string]bool{
+	SQLiteBackend:   true,
+	MySQLBackend:    true,
+	PostgresBackend: true,
+	"cockroach":     true,
+	"mssql":         true,
+}
+
+// verifyChecksums verifies the checksums of all rows of the datastore. It runs
+// in the background, as the scan of a large datastore may take a long time;
+// rows are verified as they are read in the meantime.
+func verifyChecksums(ctx context.Context, backend server.Backend) {
+	dialect, ok := dialectOf(backend)
+	if !ok {
+		return
+	}
+	logrus.Infof("Verifying the checksums of all rows")
+	start := time.Now()
+	checked, mismatched, err := dialect.VerifyChecksums(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to verify checksums after checking %d rows: %v", checked, err)
+		return
+	}
+	if mismatched > 0 {
+		logrus.Errorf("Checksums of %d of %d rows do not match, the rows were modified outside of kine or are corrupt", mismatched, checked)
+		return
+	}
+	logrus.Infof("Verified the checksums of %d rows in %v", checked, time.Since(start).Round(time.Millisecond))
+}
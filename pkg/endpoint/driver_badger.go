@@ -0,0 +1,15 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/badger"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	RegisterBackend("badger", func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+		backend, err := badger.New(ctx, dsn)
+		return true, backend, err
+	})
+}
@@ -0,0 +1,18 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/cassandra"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	// ScyllaDB speaks the same protocol
+	for _, scheme := range []string{"cassandra", "scylla"} {
+		RegisterBackend(scheme, func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+			backend, err := cassandra.New(ctx, "cassandra://"+dsn, cfg.BackendTLSConfig)
+			return true, backend, err
+		})
+	}
+}
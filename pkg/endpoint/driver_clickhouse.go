@@ -0,0 +1,15 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/clickhouse"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	RegisterBackend("clickhouse", func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+		backend, err := clickhouse.New(ctx, "clickhouse://"+dsn, cfg.BackendTLSConfig)
+		return true, backend, err
+	})
+}
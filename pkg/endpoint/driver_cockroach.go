@@ -0,0 +1,20 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/credentials"
+	"github.com/k3s-io/kine/pkg/drivers/cockroach"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	RegisterBackend("cockroach", func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+		creds, err := credentials.New(ctx, cfg.Credentials)
+		if err != nil {
+			return false, nil, err
+		}
+		backend, err := cockroach.New(ctx, dsn, cfg.BackendTLSConfig, creds, cfg.ConnectionPoolConfig, cfg.DialectConfig, cfg.MetricsRegisterer)
+		return true, backend, err
+	})
+}
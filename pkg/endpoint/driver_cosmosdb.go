@@ -0,0 +1,15 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/cosmosdb"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	RegisterBackend("cosmosdb", func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+		backend, err := cosmosdb.New(ctx, "cosmosdb://"+dsn)
+		return true, backend, err
+	})
+}
@@ -0,0 +1,15 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/duckdb"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	RegisterBackend("duckdb", func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+		backend, err := duckdb.New(ctx, dsn, cfg.ConnectionPoolConfig, cfg.DialectConfig, cfg.MetricsRegisterer)
+		return true, backend, err
+	})
+}
@@ -0,0 +1,15 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/dynamodb"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	RegisterBackend("dynamodb", func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+		backend, err := dynamodb.New(ctx, "dynamodb://"+dsn)
+		return true, backend, err
+	})
+}
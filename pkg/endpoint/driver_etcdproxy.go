@@ -0,0 +1,52 @@
+package endpoint
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/etcdproxy"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	RegisterBackend("etcdproxy", newEtcdProxyBackend)
+}
+
+// newEtcdProxyBackend returns a backend that forwards to the etcd cluster at the
+// comma-separated endpoints, for example
+// etcdproxy://10.0.0.1:2379,10.0.0.2:2379?mirror=postgres%3A%2F%2F... The mirror
+// query parameter is an escaped datastore endpoint that writes are mirrored to,
+// and compact=false leaves compaction of the cluster to etcd.
+func newEtcdProxyBackend(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+	addresses, rawQuery := dsn, ""
+	if i := strings.IndexRune(dsn, '?'); i >= 0 {
+		addresses, rawQuery = dsn[:i], dsn[i+1:]
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return false, nil, err
+	}
+
+	config := etcdproxy.Config{
+		Endpoints: strings.Split(addresses, ","),
+		TLS:       cfg.BackendTLSConfig,
+		Compact:   query.Get("compact") != "false",
+	}
+	if mirror := query.Get("mirror"); mirror != "" {
+		driver, mirrorDSN := ParseStorageEndpoint(mirror)
+		if driver == ETCDBackend {
+			return false, nil, errors.New("etcd proxy cannot mirror writes to etcd")
+		}
+		// the mirror uses its own credentials from its endpoint
+		mirrorConfig := cfg
+		mirrorConfig.Endpoint = mirror
+		if _, config.Mirror, err = getKineStorageBackend(ctx, driver, mirrorDSN, mirrorConfig); err != nil {
+			return false, nil, errors.Wrap(err, "building mirror")
+		}
+	}
+
+	backend, err := etcdproxy.New(ctx, config)
+	return true, backend, err
+}
@@ -0,0 +1,15 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/foundationdb"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	RegisterBackend("foundationdb", func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+		backend, err := foundationdb.New(ctx, "foundationdb://"+dsn, cfg.BackendTLSConfig)
+		return true, backend, err
+	})
+}
@@ -0,0 +1,15 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/memory"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	// the data is local to the process, so instances never share it
+	RegisterBackend("memory", func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+		return false, memory.New(ctx), nil
+	})
+}
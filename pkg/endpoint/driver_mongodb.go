@@ -0,0 +1,19 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/mongodb"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	// the MongoDB connection string includes its scheme
+	for _, scheme := range []string{"mongodb", "mongodb+srv"} {
+		scheme := scheme
+		RegisterBackend(scheme, func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+			backend, err := mongodb.New(ctx, scheme+"://"+dsn, cfg.BackendTLSConfig)
+			return true, backend, err
+		})
+	}
+}
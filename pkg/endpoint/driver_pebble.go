@@ -0,0 +1,15 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/pebble"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	RegisterBackend("pebble", func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+		backend, err := pebble.New(ctx, dsn)
+		return true, backend, err
+	})
+}
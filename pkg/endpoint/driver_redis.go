@@ -0,0 +1,24 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/redis"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	// Valkey speaks the same protocol, and rediss enables TLS
+	for scheme, redisScheme := range map[string]string{
+		"redis":   "redis",
+		"rediss":  "rediss",
+		"valkey":  "redis",
+		"valkeys": "rediss",
+	} {
+		redisScheme := redisScheme
+		RegisterBackend(scheme, func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+			backend, err := redis.New(ctx, redisScheme+"://"+dsn, cfg.BackendTLSConfig)
+			return true, backend, err
+		})
+	}
+}
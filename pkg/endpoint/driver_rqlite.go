@@ -0,0 +1,25 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/rqlite"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	// rqlites connects to the HTTP API over TLS
+	for scheme, httpScheme := range map[string]string{
+		"rqlite":  "http",
+		"rqlites": "https",
+	} {
+		httpScheme := httpScheme
+		RegisterBackend(scheme, func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+			if dsn != "" {
+				dsn = httpScheme + "://" + dsn
+			}
+			backend, err := rqlite.New(ctx, dsn, cfg.BackendTLSConfig, cfg.ConnectionPoolConfig, cfg.DialectConfig, cfg.MetricsRegisterer)
+			return true, backend, err
+		})
+	}
+}
@@ -6,15 +6,31 @@ import (
 	"net"
 	"os"
 	"strings"
-
+	"time"
+
+	"github.com/k3s-io/kine/pkg/auth"
+	"github.com/k3s-io/kine/pkg/breaker"
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/cdc"
+	"github.com/k3s-io/kine/pkg/compression"
+	"github.com/k3s-io/kine/pkg/credentials"
 	"github.com/k3s-io/kine/pkg/drivers/dqlite"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/drivers/jetstream"
 	"github.com/k3s-io/kine/pkg/drivers/mysql"
 	"github.com/k3s-io/kine/pkg/drivers/pgsql"
 	"github.com/k3s-io/kine/pkg/drivers/sqlite"
+	"github.com/k3s-io/kine/pkg/encryption"
+	"github.com/k3s-io/kine/pkg/events"
+	"github.com/k3s-io/kine/pkg/faultinject"
+	"github.com/k3s-io/kine/pkg/health"
+	"github.com/k3s-io/kine/pkg/leader"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
 	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/priority"
+	"github.com/k3s-io/kine/pkg/ratelimit"
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/timetravel"
 	"github.com/k3s-io/kine/pkg/tls"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -22,7 +38,7 @@ import (
 	"github.com/soheilhy/cmux"
 	"go.etcd.io/etcd/server/v3/embed"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
+	grpccredentials "google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 )
 
@@ -34,6 +50,8 @@ const (
 	JetStreamBackend = "jetstream"
 	MySQLBackend     = "mysql"
 	PostgresBackend  = "postgres"
+
+	maxStartupBackoff = 30 * time.Second
 )
 
 type Config struct {
@@ -41,9 +59,50 @@ type Config struct {
 	Listener             string
 	Endpoint             string
 	ConnectionPoolConfig generic.ConnectionPoolConfig
+	DialectConfig        generic.Config
 	ServerTLSConfig      tls.Config
 	BackendTLSConfig     tls.Config
+	Credentials          credentials.Config
 	MetricsRegisterer    prometheus.Registerer
+	LeaderElection       leader.Config
+	StartupTimeout       time.Duration
+	Features             server.Features
+	Auth                 auth.Config
+	CDC                  cdc.Config
+	// EtcdCompatMetrics exposes metrics under the names used by etcd, in
+	// addition to kine's own names.
+	EtcdCompatMetrics bool
+	EventRateLimit    ratelimit.Config
+	// ReplicaEndpoint is a secondary SQL datastore that all changes are
+	// asynchronously copied to, for use as a warm standby.
+	ReplicaEndpoint string
+	// ReaderEndpoint is a read replica of the SQL datastore, which serves
+	// serializable reads, counts and polls for changes.
+	ReaderEndpoint string
+	// Breaker fails datastore calls fast while the datastore is down.
+	Breaker breaker.Config
+	// FaultInjection adds latency and errors to datastore calls, in binaries
+	// built with the faultinject tag.
+	FaultInjection faultinject.Config
+	// RevisionClockInterval is how often the current time is recorded, to
+	// resolve times to revisions. If zero, the time is not recorded.
+	RevisionClockInterval time.Duration
+	// Priority admits requests by priority class when too many are in flight.
+	Priority priority.Config
+	// Watch configures the buffering of events sent to watchers by SQL backends.
+	Watch broadcaster.Config
+	// WriteBatch configures the batching of concurrent writes to SQL backends.
+	WriteBatch sqllog.BatchConfig
+	// Warmup prepares the backend to serve traffic before reporting ready.
+	Warmup bool
+	// WarmupTimeout is how long warm-up may take before kine starts anyway.
+	WarmupTimeout time.Duration
+	// VerifyChecksums verifies the checksums of all rows of SQL backends in
+	// the background at startup.
+	VerifyChecksums bool
+	// Events stores Kubernetes events in a SQL table of their own, with its
+	// own compaction and TTL.
+	Events events.Config
 }
 
 type ETCDConfig struct {
@@ -62,33 +121,97 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 		}, nil
 	}
 
-	leaderelect, backend, err := getKineStorageBackend(ctx, driver, dsn, config)
+	health.SetReady(false)
+	leaderelect, backend, err := startKineStorageBackend(ctx, driver, dsn, config)
 	if err != nil {
-		return ETCDConfig{}, errors.Wrap(err, "building kine")
+		return ETCDConfig{}, err
+	}
+
+	if config.Warmup {
+		warmup(ctx, backend, config)
+	}
+
+	if config.VerifyChecksums {
+		go verifyChecksums(ctx, backend)
 	}
 
 	if config.MetricsRegisterer != nil {
 		config.MetricsRegisterer.MustRegister(
 			metrics.SQLTotal,
 			metrics.SQLTime,
+			metrics.SQLStatementTime,
 			metrics.CompactTotal,
+			metrics.RangeTotal,
+			metrics.ConsistencyCheckTotal,
+			metrics.ConsistencyAnomalyTotal,
+			metrics.LeaderGauge,
+			metrics.CDCEventsTotal,
+			metrics.CDCCheckpointRevision,
+			metrics.CDCLagRevisions,
+			metrics.ReplicaLagRevisions,
+			metrics.SQLiteReplicationLagSeconds,
+			metrics.BreakerOpen,
+			metrics.ChecksumMismatchTotal,
+			metrics.EtcdProxyRequestsTotal,
+			metrics.EtcdProxyRequestSeconds,
+			metrics.EtcdProxyMirrorTotal,
+			metrics.EventWritesDroppedTotal,
+			metrics.WatchBufferUsage,
+			metrics.WatchSubscribersDroppedTotal,
+			metrics.WatchBlockedSeconds,
+			metrics.SchemaDrift,
+			metrics.PriorityQueueDepth,
+			metrics.PriorityWaitSeconds,
 		)
 	}
 
-	if err := backend.Start(ctx); err != nil {
-		return ETCDConfig{}, errors.Wrap(err, "starting kine backend")
+	if config.ReplicaEndpoint != "" {
+		if err := startReplication(ctx, backend, config); err != nil {
+			return ETCDConfig{}, errors.Wrap(err, "starting replication")
+		}
+	}
+
+	// in active-passive mode, only accept writes while holding the leader lease
+	compat := &metrics.EtcdCompatCollector{DBSize: backend.DbSize}
+	if config.LeaderElection.Enabled {
+		lb := leader.Wrap(ctx, backend, config.LeaderElection)
+		compat.IsLeader = lb.IsLeader
+		backend = lb
+	}
+
+	// drop event writes in excess of the configured limits
+	if config.EventRateLimit.Enabled() {
+		backend = ratelimit.Wrap(ctx, backend, config.EventRateLimit)
+	}
+
+	// admit requests by priority once the backend is saturated
+	if config.Priority.Enabled() {
+		backend = priority.Wrap(backend, config.Priority)
+	}
+
+	if config.MetricsRegisterer != nil && config.EtcdCompatMetrics {
+		config.MetricsRegisterer.MustRegister(compat)
+	}
+
+	if err := cdc.Start(ctx, backend, config.CDC); err != nil {
+		return ETCDConfig{}, errors.Wrap(err, "starting change-data-capture")
+	}
+
+	if config.RevisionClockInterval > 0 {
+		timetravel.Start(ctx, backend, config.RevisionClockInterval)
 	}
 
 	// set up GRPC server and register services
-	b := server.New(backend, endpointScheme(config))
+	b := server.New(backend, endpointScheme(config), config.Features)
 	grpcServer, err := grpcServer(config)
 	if err != nil {
 		return ETCDConfig{}, errors.Wrap(err, "creating GRPC server")
 	}
 	b.Register(grpcServer)
+	b.MonitorHealth(ctx)
 
 	// set up HTTP server with basic mux
-	httpServer := httpServer()
+	httpServer := httpServer(backend, config.Features)
 
 	// Create raw listener and wrap in cmux for protocol switching
 	listener, err := createListener(config)
@@ -97,12 +220,16 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 	}
 	m := cmux.New(listener)
 
-	if config.ServerTLSConfig.CertFile != "" && config.ServerTLSConfig.KeyFile != "" {
+	if config.ServerTLSConfig.HasKeyPair() {
 		// If using TLS, wrap handler in GRPC/HTTP switching handler and serve TLS
 		httpServer.Handler = grpcHandlerFunc(grpcServer, httpServer.Handler)
+		httpServer.TLSConfig, err = config.ServerTLSConfig.ServerConfig()
+		if err != nil {
+			return ETCDConfig{}, errors.Wrap(err, "loading server certificate")
+		}
 		anyl := m.Match(cmux.Any())
 		go func() {
-			if err := httpServer.ServeTLS(anyl, config.ServerTLSConfig.CertFile, config.ServerTLSConfig.KeyFile); err != nil {
+			if err := httpServer.ServeTLS(anyl, "", ""); err != nil {
 				logrus.Errorf("Kine TLS server shutdown: %v", err)
 			}
 		}()
@@ -131,6 +258,7 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 
 	endpoint := endpointURL(config, listener)
 	logrus.Infof("Kine available at %s", endpoint)
+	health.SetReady(true)
 
 	return ETCDConfig{
 		LeaderElect: leaderelect,
@@ -144,7 +272,7 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 func endpointURL(config Config, listener net.Listener) string {
 	scheme := endpointScheme(config)
 	address := listener.Addr().String()
-	if !strings.HasPrefix(scheme, "unix") {
+	if !strings.HasPrefix(scheme, "unix") && !strings.HasPrefix(scheme, "npipe") {
 		_, port, err := net.SplitHostPort(address)
 		if err != nil {
 			logrus.Warnf("failed to get listener port: %v", err)
@@ -163,11 +291,11 @@ func endpointScheme(config Config) string {
 	}
 
 	network, _ := networkAndAddress(config.Listener)
-	if network != "unix" {
+	if network != "unix" && network != "npipe" {
 		network = "http"
 	}
 
-	if config.ServerTLSConfig.CertFile != "" && config.ServerTLSConfig.KeyFile != "" {
+	if config.ServerTLSConfig.HasKeyPair() {
 		// yes, etcd supports the "unixs" scheme for TLS over unix sockets
 		network += "s"
 	}
@@ -182,6 +310,10 @@ func createListener(config Config) (ret net.Listener, rerr error) {
 	}
 	network, address := networkAndAddress(config.Listener)
 
+	if network == "npipe" {
+		return listenPipe(address)
+	}
+
 	if network == "unix" {
 		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
 			logrus.Warnf("failed to remove socket %s: %v", address, err)
@@ -216,17 +348,90 @@ func grpcServer(config Config) (*grpc.Server, error) {
 		}),
 	}
 
-	if config.ServerTLSConfig.CertFile != "" && config.ServerTLSConfig.KeyFile != "" {
-		creds, err := credentials.NewServerTLSFromFile(config.ServerTLSConfig.CertFile, config.ServerTLSConfig.KeyFile)
+	if config.ServerTLSConfig.HasKeyPair() {
+		tlsConfig, err := config.ServerTLSConfig.ServerConfig()
+		if err != nil {
+			return nil, err
+		}
+		gopts = append(gopts, grpc.Creds(grpccredentials.NewTLS(tlsConfig)))
+	}
+
+	if config.Auth.Enabled() {
+		authenticator, err := auth.New(config.Auth)
 		if err != nil {
 			return nil, err
 		}
-		gopts = append(gopts, grpc.Creds(creds))
+		gopts = append(gopts,
+			grpc.UnaryInterceptor(authenticator.UnaryServerInterceptor()),
+			grpc.StreamInterceptor(authenticator.StreamServerInterceptor()))
 	}
 
 	return grpc.NewServer(gopts...), nil
 }
 
+// startKineStorageBackend builds and starts the storage backend. If a startup timeout
+// is configured, failures are retried with exponential backoff until the timeout
+// expires, so that kine may be started before the datastore is available.
+func startKineStorageBackend(ctx context.Context, driver, dsn string, cfg Config) (bool, server.Backend, error) {
+	deadline := time.Now().Add(cfg.StartupTimeout)
+	delay := time.Second
+
+	for {
+		leaderElect, backend, err := getKineStorageBackend(ctx, driver, dsn, cfg)
+		if err != nil {
+			err = errors.Wrap(err, "building kine")
+		} else if err = backend.Start(ctx); err != nil {
+			err = errors.Wrap(err, "starting kine backend")
+		} else {
+			return leaderElect, backend, nil
+		}
+
+		if cfg.StartupTimeout <= 0 || time.Now().Add(delay).After(deadline) {
+			return false, nil, err
+		}
+
+		logrus.Errorf("Datastore is not ready, retrying in %s: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return false, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxStartupBackoff {
+			delay = maxStartupBackoff
+		}
+	}
+}
+
+// readerBackends are the backends that support a reader endpoint.
+var readerBackends = map[string]bool{
+	MySQLBackend:    true,
+	PostgresBackend: true,
+	"mssql":         true,
+}
+
+// tableBackends are the backends that support a configured table name, which
+// are those built on the generic SQL dialect.
+var tableBackends = map[string]bool{
+	SQLiteBackend:   true,
+	DQLiteBackend:   true,
+	MySQLBackend:    true,
+	PostgresBackend: true,
+	"cockroach":     true,
+	"yugabytedb":    true,
+	"singlestore":   true,
+	"duckdb":        true,
+	"rqlite":        true,
+	"rqlites":       true,
+	"mssql":         true,
+}
+
+// schemaBackends are the backends that support a configured schema name.
+var schemaBackends = map[string]bool{
+	"mssql": true,
+}
+
 // getKineStorageBackend parses the driver string, and returns a bool
 // indicating whether the backend requires leader election, and a suitable
 // backend datastore connection.
@@ -236,25 +441,122 @@ func getKineStorageBackend(ctx context.Context, driver, dsn string, cfg Config)
 		leaderElect = true
 		err         error
 	)
+	table, err := cfg.DialectConfig.Table()
+	if err != nil {
+		return false, nil, err
+	}
+	if cfg.DialectConfig.ClusterID != "" && !tableBackends[driver] {
+		return false, nil, fmt.Errorf("a cluster ID cannot be used with the %s backend", driver)
+	}
+	if table.Name != generic.DefaultTableName && !tableBackends[driver] {
+		return false, nil, fmt.Errorf("the table name cannot be configured for the %s backend", driver)
+	}
+	if cfg.DialectConfig.ClusterID != "" {
+		logrus.Infof("Storing cluster %s in table %s", cfg.DialectConfig.ClusterID, table.QualifiedName())
+	}
+	if table.Schema != "" && !schemaBackends[driver] {
+		return false, nil, fmt.Errorf("the schema name cannot be configured for the %s backend", driver)
+	}
+	if j := cfg.DialectConfig.RetryJitter; j < 0 || j > 1 {
+		return false, nil, fmt.Errorf("invalid retry jitter %v, must be between 0 and 1", j)
+	}
+	if _, err := compression.Parse(cfg.DialectConfig.Compression); err != nil {
+		return false, nil, err
+	}
+	keyring, err := encryption.Load(cfg.DialectConfig.EncryptionKeyFile)
+	if err != nil {
+		return false, nil, err
+	}
+	if cfg.ReaderEndpoint != "" {
+		readerDriver, readerDSN := ParseStorageEndpoint(cfg.ReaderEndpoint)
+		if !readerBackends[driver] {
+			return false, nil, fmt.Errorf("a reader endpoint cannot be used with the %s backend", driver)
+		}
+		if readerDriver != driver {
+			return false, nil, fmt.Errorf("the reader endpoint must use the %s backend, not %s", driver, readerDriver)
+		}
+		cfg.ConnectionPoolConfig.ReaderDSN = readerDSN
+	}
+	if (cfg.DialectConfig.Checksums || cfg.VerifyChecksums) && !checksumBackends[driver] {
+		return false, nil, fmt.Errorf("checksums are not supported by the %s backend", driver)
+	}
+	if cfg.Events.Enabled() && !tableBackends[driver] {
+		return false, nil, fmt.Errorf("a separate events table cannot be used with the %s backend", driver)
+	}
+	if cfg.DialectConfig.Columnstore && driver != "mssql" {
+		return false, nil, fmt.Errorf("a columnstore index cannot be used with the %s backend", driver)
+	}
 	switch driver {
 	case SQLiteBackend:
 		leaderElect = false
-		backend, err = sqlite.New(ctx, dsn, cfg.ConnectionPoolConfig, cfg.MetricsRegisterer)
+		backend, err = sqlite.New(ctx, dsn, cfg.ConnectionPoolConfig, cfg.DialectConfig, cfg.MetricsRegisterer)
 	case DQLiteBackend:
-		backend, err = dqlite.New(ctx, dsn, cfg.ConnectionPoolConfig, cfg.MetricsRegisterer)
+		backend, err = dqlite.New(ctx, dsn, cfg.ConnectionPoolConfig, cfg.DialectConfig, cfg.MetricsRegisterer)
 	case PostgresBackend:
-		backend, err = pgsql.New(ctx, dsn, cfg.BackendTLSConfig, cfg.ConnectionPoolConfig, cfg.MetricsRegisterer)
+		var creds credentials.Provider
+		if creds, err = credentials.New(ctx, cfg.Credentials); err == nil {
+			backend, err = pgsql.New(ctx, dsn, cfg.BackendTLSConfig, creds, cfg.ConnectionPoolConfig, cfg.DialectConfig, cfg.MetricsRegisterer)
+		}
 	case MySQLBackend:
-		backend, err = mysql.New(ctx, dsn, cfg.BackendTLSConfig, cfg.ConnectionPoolConfig, cfg.MetricsRegisterer)
+		var creds credentials.Provider
+		if creds, err = credentials.New(ctx, cfg.Credentials); err == nil {
+			backend, err = mysql.New(ctx, dsn, cfg.BackendTLSConfig, creds, cfg.ConnectionPoolConfig, cfg.DialectConfig, cfg.MetricsRegisterer)
+		}
 	case JetStreamBackend:
 		backend, err = jetstream.New(ctx, dsn, cfg.BackendTLSConfig)
 	default:
-		return false, nil, fmt.Errorf("storage backend is not defined")
+		newBackend, ok := backends[driver]
+		if !ok {
+			return false, nil, fmt.Errorf("storage backend is not defined")
+		}
+		leaderElect, backend, err = newBackend(ctx, dsn, cfg)
+	}
+	if err == nil {
+		configureWatch(backend, cfg.Watch)
+		configureWriteBatch(backend, cfg.WriteBatch)
+	}
+	if err == nil && cfg.DialectConfig.Compression != "" {
+		if _, ok := dialectOf(backend); !ok {
+			err = fmt.Errorf("compression is not supported by the %s backend", driver)
+		}
+	}
+	if err == nil && keyring != nil {
+		if _, ok := dialectOf(backend); !ok {
+			err = fmt.Errorf("encryption is not supported by the %s backend", driver)
+		}
+	}
+	if err == nil && cfg.DialectConfig.SQLOverridesFile != "" {
+		err = overrideSQL(backend, cfg.DialectConfig.SQLOverridesFile)
+	}
+	if err == nil && cfg.FaultInjection.Enabled() {
+		err = injectFaults(backend, cfg.FaultInjection)
+	}
+	if err == nil && cfg.Breaker.Enabled() {
+		err = wrapBreaker(backend, cfg.Breaker)
+	}
+	if err == nil && cfg.Events.Enabled() {
+		backend, err = withEventsBackend(ctx, driver, dsn, backend, cfg)
 	}
 
 	return leaderElect, backend, err
 }
 
+// NewBackendFunc creates a backend from the address part of a datastore endpoint
+// URL. It returns true if leader election is required when multiple instances
+// share the datastore.
+type NewBackendFunc func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error)
+
+var backends = map[string]NewBackendFunc{}
+
+// RegisterBackend registers a driver for endpoints with the given URL scheme,
+// for drivers that are not built in. It must be called during initialization.
+func RegisterBackend(scheme string, newBackend NewBackendFunc) {
+	if _, ok := backends[scheme]; ok {
+		panic(fmt.Sprintf("storage backend %s is already registered", scheme))
+	}
+	backends[scheme] = newBackend
+}
+
 // ParseStorageEndpoint returns the driver name and endpoint string from a datastore endpoint URL.
 func ParseStorageEndpoint(storageEndpoint string) (string, string) {
 	network, address := networkAndAddress(storageEndpoint)
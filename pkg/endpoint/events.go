@@ -0,0 +1,45 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/k3s-io/kine/pkg/events"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// withEventsBackend creates a backend for the configured events table in the
+// same datastore, and returns a backend that routes events to it and all other
+// keys to the given backend.
+func withEventsBackend(ctx context.Context, driver, dsn string, backend server.Backend, cfg Config) (server.Backend, error) {
+	// the events backend is configured as the main one, but for its table, and
+	// does not register pool metrics, which would replace those of the main
+	// backend
+	eventsConfig := cfg
+	eventsConfig.Events = events.Config{}
+	eventsConfig.DialectConfig.TableName = cfg.Events.Table
+	eventsConfig.MetricsRegisterer = nil
+
+	table, err := cfg.DialectConfig.Table()
+	if err != nil {
+		return nil, err
+	}
+	eventsTable, err := eventsConfig.DialectConfig.Table()
+	if err != nil {
+		return nil, errors.Wrap(err, "events table")
+	}
+	if eventsTable.Name == table.Name {
+		return nil, fmt.Errorf("the events table must not be the %s table", table.Name)
+	}
+
+	_, eventsBackend, err := getKineStorageBackend(ctx, driver, dsn, eventsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "building events backend")
+	}
+	configureCompact(eventsBackend, cfg.Events.Compact)
+
+	logrus.Infof("Storing events in table %s", eventsTable.QualifiedName())
+	return events.Wrap(backend, eventsBackend, cfg.Events), nil
+}
@@ -0,0 +1,29 @@
+package endpoint
+
+import (
+	"fmt"
+
+	"github.com/k3s-io/kine/pkg/faultinject"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// injectFaults wraps the SQL dialect underlying a backend to inject the
+// configured latency and errors. Only SQL backends are supported.
+func injectFaults(backend server.Backend, config faultinject.Config) error {
+	ls, ok := backend.(*logstructured.LogStructured)
+	if !ok {
+		return fmt.Errorf("fault injection is only supported by SQL backends")
+	}
+	sl, ok := ls.Log().(*sqllog.SQLLog)
+	if !ok {
+		return fmt.Errorf("fault injection is only supported by SQL backends")
+	}
+	d, err := faultinject.Wrap(sl.Dialect(), config)
+	if err != nil {
+		return err
+	}
+	sl.SetDialect(d)
+	return nil
+}
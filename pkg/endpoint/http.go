@@ -1,24 +1,33 @@
 package endpoint
 
 import (
+	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/k3s-io/kine/pkg/health"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 )
 
 var (
-	etcdVersion = []byte(`{"etcdserver":"3.5.0","etcdcluster":"3.5.0"}`)
 	versionPath = "/version"
+	healthPath  = "/health"
+
+	// healthTimeout bounds the datastore read made by a health check.
+	healthTimeout = 5 * time.Second
 )
 
 // httpServer returns a HTTP server with the basic mux handler.
-func httpServer() *http.Server {
+func httpServer(backend server.Backend, features server.Features) *http.Server {
 	// Set up root HTTP mux with basic response handlers
 	mux := http.NewServeMux()
-	handleBasic(mux)
+	handleBasic(mux, backend, features)
 
 	return &http.Server{
 		Handler:  mux,
@@ -26,18 +35,65 @@ func httpServer() *http.Server {
 	}
 }
 
-// handleBasic binds basic HTTP response handlers to a mux.
-func handleBasic(mux *http.ServeMux) {
-	mux.HandleFunc(versionPath, serveVersion)
+// handleBasic binds basic HTTP response handlers to a mux. These are the
+// endpoints that etcd serves on its client port, which load balancers and
+// probes written for etcd expect to find.
+func handleBasic(mux *http.ServeMux, backend server.Backend, features server.Features) {
+	mux.HandleFunc(versionPath, serveVersion(features))
+	mux.HandleFunc(healthPath, serveHealth(backend))
+	mux.HandleFunc(health.ReadyzPath, health.ServeReadyz)
+	mux.Handle(metrics.MetricsPath, metrics.Handler())
 }
 
-// serveVersion responds with a canned JSON version response.
-func serveVersion(w http.ResponseWriter, r *http.Request) {
-	if !allowMethod(w, r, http.MethodGet) {
-		return
+// serveVersion returns a handler that responds with the advertised etcd versions.
+func serveVersion(features server.Features) http.HandlerFunc {
+	version, clusterVersion := features.Versions()
+	body, _ := json.Marshal(map[string]string{
+		"etcdserver":  version,
+		"etcdcluster": clusterVersion,
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// healthResponse matches the body of the etcd /health endpoint.
+type healthResponse struct {
+	Health string `json:"health"`
+	Reason string `json:"reason"`
+}
+
+// serveHealth returns a handler that responds with 200 OK if kine is ready and
+// the datastore can be read, or 503 Service Unavailable if not. Like etcd, the
+// datastore is checked by reading a key.
+func serveHealth(backend server.Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		resp := healthResponse{Health: "true"}
+		if !health.Ready() {
+			resp = healthResponse{Health: "false", Reason: "NOT_READY"}
+		} else {
+			ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+			defer cancel()
+			if _, _, err := backend.Get(ctx, "health", 0); err != nil {
+				logrus.Warnf("Health check failed: %v", err)
+				resp = healthResponse{Health: "false", Reason: "QGET ERROR:" + err.Error()}
+			}
+		}
+
+		body, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		if resp.Health != "true" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(body)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(etcdVersion)
 }
 
 // allowMethod returns true if a method is allowed, or false (after sending a
@@ -0,0 +1,17 @@
+//go:build !windows || !namedpipe
+// +build !windows !namedpipe
+
+package endpoint
+
+import (
+	"errors"
+	"net"
+	"runtime"
+)
+
+func listenPipe(address string) (net.Listener, error) {
+	if runtime.GOOS != "windows" {
+		return nil, errors.New("named pipes are only supported on Windows")
+	}
+	return nil, errors.New(`this binary is built without named pipe support, compile with "-tags namedpipe"`)
+}
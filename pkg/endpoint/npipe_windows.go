@@ -0,0 +1,25 @@
+//go:build windows && namedpipe
+// +build windows,namedpipe
+
+package endpoint
+
+// Named pipe support requires github.com/Microsoft/go-winio, which is not a
+// dependency of default builds; add it with `go get github.com/Microsoft/go-winio`.
+
+import (
+	"net"
+	"strings"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// pipeSecurityDescriptor grants access to the pipe only to administrators and
+// the local system account, as the permissions on the unix socket do.
+const pipeSecurityDescriptor = "D:P(A;;GA;;;BA)(A;;GA;;;SY)"
+
+// listenPipe listens on a named pipe, given as //./pipe/<name> or \\.\pipe\<name>.
+func listenPipe(address string) (net.Listener, error) {
+	return winio.ListenPipe(strings.ReplaceAll(address, "/", `\`), &winio.PipeConfig{
+		SecurityDescriptor: pipeSecurityDescriptor,
+	})
+}
@@ -0,0 +1,53 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/k3s-io/kine/pkg/credentials"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+)
+
+// startReplication connects to the configured secondary datastore and copies
+// all changes from the primary backend to it in the background. Only SQL
+// backends are supported for both.
+func startReplication(ctx context.Context, backend server.Backend, config Config) error {
+	primary, ok := dialectOf(backend)
+	if !ok {
+		return fmt.Errorf("replication is not supported by the %s backend", config.Endpoint)
+	}
+
+	// the secondary uses its own credentials from its endpoint, has no reader,
+	// and does not register pool metrics, which would replace those of the
+	// primary
+	secondaryConfig := config
+	secondaryConfig.Endpoint = config.ReplicaEndpoint
+	secondaryConfig.ReaderEndpoint = ""
+	secondaryConfig.Credentials = credentials.Config{}
+	secondaryConfig.MetricsRegisterer = nil
+	secondary, err := openDialect(ctx, secondaryConfig)
+	if err != nil {
+		return errors.Wrap(err, "connecting to secondary datastore")
+	}
+
+	go func() {
+		defer secondary.Close()
+		generic.Replicate(ctx, primary, secondary)
+	}()
+	return nil
+}
+
+// Promote prepares the configured datastore, which must have been populated as
+// a secondary by replication, to be used as the primary. Replication to it must
+// be stopped first. It returns the current revision of the datastore.
+func Promote(ctx context.Context, config Config) (int64, error) {
+	dialect, err := openDialect(ctx, config)
+	if err != nil {
+		return 0, err
+	}
+	defer dialect.Close()
+
+	return dialect.Promote(ctx)
+}
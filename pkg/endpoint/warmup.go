@@ -0,0 +1,75 @@
+package endpoint
+
+import (
+	"context"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultWarmupConnections is the number of connections opened during warm-up
+// when the idle pool size is not configured, matching the database/sql default.
+const defaultWarmupConnections = 2
+
+// warmup prepares a started backend to serve traffic, so that the first requests
+// after a restart do not time out: it opens the connection pools of SQL
+// backends, checks that the queries used to list keys use their indexes, and
+// starts polling for events so that watches begin from the current revision.
+// Failures are logged and do not prevent kine from starting.
+func warmup(ctx context.Context, backend server.Backend, config Config) {
+	ctx, cancel := context.WithTimeout(ctx, config.WarmupTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if dialect, ok := dialectOf(backend); ok {
+		if err := dialect.Warmup(ctx, warmupConnections(config.ConnectionPoolConfig.MaxIdle)); err != nil {
+			logrus.Warnf("Failed to warm up datastore: %v", err)
+		}
+	}
+	if err := primeWatch(ctx, backend); err != nil {
+		logrus.Warnf("Failed to warm up watch: %v", err)
+	}
+	logrus.Infof("Warm-up completed in %s", time.Since(start))
+}
+
+// warmupConnections returns the number of connections to open, which is the
+// number the pool keeps idle.
+func warmupConnections(maxIdle int) int {
+	if maxIdle == 0 {
+		return defaultWarmupConnections
+	}
+	if maxIdle < 0 {
+		return 0
+	}
+	return maxIdle
+}
+
+// primeWatch starts a watch from the current revision and waits until the
+// backend has caught up to it, for backends that report their watch progress.
+func primeWatch(ctx context.Context, backend server.Backend) error {
+	wr, ok := backend.(interface{ WatchRevision() int64 })
+	if !ok {
+		return nil
+	}
+	rev, _, err := backend.Get(ctx, "/registry/health", 0)
+	if err != nil {
+		return errors.Wrap(err, "getting current revision")
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	backend.Watch(watchCtx, "/registry/health", rev+1)
+
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for wr.WatchRevision() < rev {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package endpoint
+
+import (
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// configureWatch sets how events are buffered for watchers by SQL backends.
+// Other backends do not buffer events in the same way, and are left as they are.
+func configureWatch(backend server.Backend, config broadcaster.Config) {
+	if ls, ok := backend.(*logstructured.LogStructured); ok {
+		if sl, ok := ls.Log().(*sqllog.SQLLog); ok {
+			sl.SetWatchConfig(config)
+		}
+	}
+}
+
+// configureWriteBatch sets how concurrent writes are batched by SQL backends.
+func configureWriteBatch(backend server.Backend, config sqllog.BatchConfig) {
+	if ls, ok := backend.(*logstructured.LogStructured); ok {
+		if sl, ok := ls.Log().(*sqllog.SQLLog); ok {
+			sl.SetBatchConfig(config)
+		}
+	}
+}
+
+// configureCompact sets how often and how far old revisions are compacted by
+// SQL backends.
+func configureCompact(backend server.Backend, config sqllog.CompactConfig) {
+	if ls, ok := backend.(*logstructured.LogStructured); ok {
+		if sl, ok := ls.Log().(*sqllog.SQLLog); ok {
+			sl.SetCompactConfig(config)
+		}
+	}
+}
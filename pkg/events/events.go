@@ -0,0 +1,206 @@
+package events
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+const DefaultPrefix = "/registry/events/"
+
+// explicit interface checks
+var (
+	_ server.Backend      = (*Backend)(nil)
+	_ server.ListStreamer = (*Backend)(nil)
+)
+
+type Config struct {
+	// Table is the SQL table that events are stored in. If empty, events are
+	// stored with all other keys.
+	Table string
+	// Prefix is the prefix of the event keys.
+	Prefix string
+	// TTL is the longest time that an event is kept. Events written with a
+	// longer lease, or none, are given a lease of TTL. Zero keeps the lease
+	// requested by the client.
+	TTL time.Duration
+	// Compact configures the compaction of the events table, which may run
+	// more often and retain fewer revisions than that of the main table.
+	Compact sqllog.CompactConfig
+}
+
+// Enabled returns true if events are stored in a table of their own.
+func (c Config) Enabled() bool {
+	return c.Table != ""
+}
+
+// Backend routes keys under the event prefix to a backend of their own, so
+// that event churn neither bloats nor slows down the table holding all other
+// keys, and events can be compacted and expired more aggressively.
+//
+// The two backends have separate revisions, as when the apiserver stores
+// events in a separate etcd cluster with --etcd-servers-overrides. Reads and
+// watches of a prefix that spans both backends are served as follows: lists
+// and counts include the events at their current revision and report the
+// revision of the main backend, and watches only see changes to the main
+// backend.
+type Backend struct {
+	server.Backend
+	events server.Backend
+	prefix string
+	lease  int64
+}
+
+// Wrap returns a backend that stores events in the events backend and all
+// other keys in the main backend.
+func Wrap(backend, events server.Backend, config Config) *Backend {
+	if config.Prefix == "" {
+		config.Prefix = DefaultPrefix
+	}
+	return &Backend{
+		Backend: backend,
+		events:  events,
+		prefix:  config.Prefix,
+		lease:   int64(config.TTL / time.Second),
+	}
+}
+
+// Unwrap returns the main backend.
+func (b *Backend) Unwrap() server.Backend {
+	return b.Backend
+}
+
+// Events returns the backend that events are stored in.
+func (b *Backend) Events() server.Backend {
+	return b.events
+}
+
+// Start starts the events backend and then the main backend.
+func (b *Backend) Start(ctx context.Context) error {
+	if err := b.events.Start(ctx); err != nil {
+		return err
+	}
+	return b.Backend.Start(ctx)
+}
+
+// backendFor returns the backend that stores a key, or that holds all keys
+// with a prefix under the event prefix.
+func (b *Backend) backendFor(key string) server.Backend {
+	if strings.HasPrefix(key, b.prefix) {
+		return b.events
+	}
+	return b.Backend
+}
+
+// spans returns true if keys with a prefix are stored in both backends.
+func (b *Backend) spans(prefix string) bool {
+	return len(prefix) < len(b.prefix) && strings.HasPrefix(b.prefix, prefix)
+}
+
+// leaseFor caps the lease of an event at the configured TTL. Kine lease IDs
+// are their TTL in seconds.
+func (b *Backend) leaseFor(key string, lease int64) int64 {
+	if b.lease > 0 && strings.HasPrefix(key, b.prefix) && (lease <= 0 || lease > b.lease) {
+		return b.lease
+	}
+	return lease
+}
+
+func (b *Backend) Get(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, error) {
+	return b.backendFor(key).Get(ctx, key, revision)
+}
+
+func (b *Backend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	return b.backendFor(key).Create(ctx, key, value, b.leaseFor(key, lease))
+}
+
+func (b *Backend) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *server.KeyValue, bool, error) {
+	return b.backendFor(key).Update(ctx, key, value, revision, b.leaseFor(key, lease))
+}
+
+func (b *Backend) Delete(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, bool, error) {
+	return b.backendFor(key).Delete(ctx, key, revision)
+}
+
+func (b *Backend) List(ctx context.Context, prefix, startKey string, limit, revision int64) (int64, []*server.KeyValue, error) {
+	if !b.spans(prefix) {
+		return b.backendFor(prefix).List(ctx, prefix, startKey, limit, revision)
+	}
+	rev, kvs, err := b.Backend.List(ctx, prefix, startKey, limit, revision)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, events, err := b.events.List(ctx, b.prefix, startKey, limit, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	return rev, merge(kvs, events, limit), nil
+}
+
+func (b *Backend) ListStream(ctx context.Context, prefix, startKey string, limit, revision int64, fn func(kvs []*server.KeyValue) error) (int64, error) {
+	if !b.spans(prefix) {
+		return server.ListStream(ctx, b.backendFor(prefix), prefix, startKey, limit, revision, fn)
+	}
+	rev, kvs, err := b.List(ctx, prefix, startKey, limit, revision)
+	if err != nil {
+		return 0, err
+	}
+	return rev, fn(kvs)
+}
+
+func (b *Backend) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	if !b.spans(prefix) {
+		return b.backendFor(prefix).Count(ctx, prefix)
+	}
+	rev, count, err := b.Backend.Count(ctx, prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, events, err := b.events.Count(ctx, b.prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	return rev, count + events, nil
+}
+
+func (b *Backend) Watch(ctx context.Context, key string, revision int64) <-chan []*server.Event {
+	if !b.spans(key) {
+		return b.backendFor(key).Watch(ctx, key, revision)
+	}
+	return b.Backend.Watch(ctx, key, revision)
+}
+
+// DbSize returns the total size of both backends.
+func (b *Backend) DbSize(ctx context.Context) (int64, error) {
+	size, err := b.Backend.DbSize(ctx)
+	if err != nil {
+		return 0, err
+	}
+	events, err := b.events.DbSize(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return size + events, nil
+}
+
+// merge returns the keys of both lists in order, up to the limit. Keys are
+// never in both lists, as each key is stored in only one backend.
+func merge(kvs, events []*server.KeyValue, limit int64) []*server.KeyValue {
+	if len(events) == 0 {
+		return kvs
+	}
+	result := make([]*server.KeyValue, 0, len(kvs)+len(events))
+	result = append(result, kvs...)
+	result = append(result, events...)
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	if limit > 0 && int64(len(result)) > limit {
+		result = result[:limit]
+	}
+	return result
+}
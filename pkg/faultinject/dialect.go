@@ -0,0 +1,175 @@
+//go:build faultinject
+// +build faultinject
+
+package faultinject
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+// Wrap returns a dialect that injects the configured faults into calls to d.
+func Wrap(d server.Dialect, config Config) (server.Dialect, error) {
+	if !config.Enabled() {
+		return d, nil
+	}
+	if config.ErrorRate < 0 || config.ErrorRate > 1 {
+		return nil, fmt.Errorf("fault injection error rate %v must be between 0 and 1", config.ErrorRate)
+	}
+	logrus.Warnf("Injecting datastore faults: latency=%v jitter=%v errorRate=%v seed=%d", config.Latency, config.LatencyJitter, config.ErrorRate, config.Seed)
+	return &dialect{
+		Dialect: d,
+		config:  config,
+		rand:    rand.New(rand.NewSource(config.Seed)),
+	}, nil
+}
+
+type dialect struct {
+	server.Dialect
+	config Config
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// Unwrap returns the dialect that faults are injected into.
+func (d *dialect) Unwrap() server.Dialect {
+	return d.Dialect
+}
+
+// inject waits for the configured latency, and returns ErrInjected at the
+// configured rate.
+func (d *dialect) inject(ctx context.Context, op string) error {
+	d.mu.Lock()
+	latency := d.config.Latency
+	if d.config.LatencyJitter > 0 {
+		latency += time.Duration(d.rand.Int63n(int64(d.config.LatencyJitter)))
+	}
+	fail := d.config.ErrorRate > 0 && d.rand.Float64() < d.config.ErrorRate
+	d.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(latency):
+		}
+	}
+	if fail {
+		logrus.Debugf("Injecting fault into %s after %v", op, latency)
+		return ErrInjected
+	}
+	return nil
+}
+
+func (d *dialect) ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted bool) (*sql.Rows, error) {
+	if err := d.inject(ctx, "ListCurrent"); err != nil {
+		return nil, err
+	}
+	return d.Dialect.ListCurrent(ctx, prefix, limit, includeDeleted)
+}
+
+func (d *dialect) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (*sql.Rows, error) {
+	if err := d.inject(ctx, "List"); err != nil {
+		return nil, err
+	}
+	return d.Dialect.List(ctx, prefix, startKey, limit, revision, includeDeleted)
+}
+
+func (d *dialect) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	if err := d.inject(ctx, "Count"); err != nil {
+		return 0, 0, err
+	}
+	return d.Dialect.Count(ctx, prefix)
+}
+
+func (d *dialect) CurrentRevision(ctx context.Context) (int64, error) {
+	if err := d.inject(ctx, "CurrentRevision"); err != nil {
+		return 0, err
+	}
+	return d.Dialect.CurrentRevision(ctx)
+}
+
+func (d *dialect) After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error) {
+	if err := d.inject(ctx, "After"); err != nil {
+		return nil, err
+	}
+	return d.Dialect.After(ctx, prefix, rev, limit)
+}
+
+func (d *dialect) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error) {
+	if err := d.inject(ctx, "Insert"); err != nil {
+		return 0, err
+	}
+	return d.Dialect.Insert(ctx, key, create, delete, createRevision, previousRevision, ttl, value, prevValue)
+}
+
+func (d *dialect) GetRevision(ctx context.Context, revision int64) (*sql.Rows, error) {
+	if err := d.inject(ctx, "GetRevision"); err != nil {
+		return nil, err
+	}
+	return d.Dialect.GetRevision(ctx, revision)
+}
+
+func (d *dialect) DeleteRevision(ctx context.Context, revision int64) error {
+	if err := d.inject(ctx, "DeleteRevision"); err != nil {
+		return err
+	}
+	return d.Dialect.DeleteRevision(ctx, revision)
+}
+
+func (d *dialect) GetCompactRevision(ctx context.Context) (int64, error) {
+	if err := d.inject(ctx, "GetCompactRevision"); err != nil {
+		return 0, err
+	}
+	return d.Dialect.GetCompactRevision(ctx)
+}
+
+func (d *dialect) SetCompactRevision(ctx context.Context, revision int64) error {
+	if err := d.inject(ctx, "SetCompactRevision"); err != nil {
+		return err
+	}
+	return d.Dialect.SetCompactRevision(ctx, revision)
+}
+
+func (d *dialect) Compact(ctx context.Context, revision int64) (int64, error) {
+	if err := d.inject(ctx, "Compact"); err != nil {
+		return 0, err
+	}
+	return d.Dialect.Compact(ctx, revision)
+}
+
+func (d *dialect) PostCompact(ctx context.Context) error {
+	if err := d.inject(ctx, "PostCompact"); err != nil {
+		return err
+	}
+	return d.Dialect.PostCompact(ctx)
+}
+
+func (d *dialect) Fill(ctx context.Context, revision int64) error {
+	if err := d.inject(ctx, "Fill"); err != nil {
+		return err
+	}
+	return d.Dialect.Fill(ctx, revision)
+}
+
+func (d *dialect) BeginTx(ctx context.Context, opts *sql.TxOptions) (server.Transaction, error) {
+	if err := d.inject(ctx, "BeginTx"); err != nil {
+		return nil, err
+	}
+	return d.Dialect.BeginTx(ctx, opts)
+}
+
+func (d *dialect) GetSize(ctx context.Context) (int64, error) {
+	if err := d.inject(ctx, "GetSize"); err != nil {
+		return 0, err
+	}
+	return d.Dialect.GetSize(ctx)
+}
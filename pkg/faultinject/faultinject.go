@@ -0,0 +1,32 @@
+// Package faultinject adds latency and errors to calls from kine to the SQL
+// dialect, to rehearse datastore brownouts in staging. It is only functional in
+// binaries built with the faultinject tag, so that it cannot be enabled in
+// production builds.
+package faultinject
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInjected is returned by dialect calls that fail due to an injected fault.
+var ErrInjected = errors.New("injected datastore fault")
+
+type Config struct {
+	// Latency is added to every dialect call.
+	Latency time.Duration
+	// LatencyJitter is the upper bound of a random latency added to every
+	// dialect call, in addition to Latency.
+	LatencyJitter time.Duration
+	// ErrorRate is the fraction of dialect calls, between 0 and 1, that fail
+	// with ErrInjected after the latency has elapsed.
+	ErrorRate float64
+	// Seed seeds the random jitter and errors, so that a sequence of faults can
+	// be reproduced.
+	Seed int64
+}
+
+// Enabled returns true if any fault is configured.
+func (c Config) Enabled() bool {
+	return c.Latency > 0 || c.LatencyJitter > 0 || c.ErrorRate > 0
+}
@@ -0,0 +1,17 @@
+//go:build !faultinject
+// +build !faultinject
+
+package faultinject
+
+import (
+	"errors"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func Wrap(d server.Dialect, config Config) (server.Dialect, error) {
+	if config.Enabled() {
+		return nil, errors.New(`this binary is built without fault injection support, compile with "-tags faultinject"`)
+	}
+	return d, nil
+}
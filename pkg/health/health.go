@@ -0,0 +1,36 @@
+package health
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+const ReadyzPath = "/readyz"
+
+var ready int32
+
+// SetReady records whether kine has finished starting up and is ready to serve requests.
+func SetReady(r bool) {
+	var v int32
+	if r {
+		v = 1
+	}
+	atomic.StoreInt32(&ready, v)
+}
+
+// Ready returns true if kine is ready to serve requests.
+func Ready() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// ServeReadyz responds with 200 OK if kine is ready to serve requests, or 503
+// Service Unavailable if it is still waiting for the datastore.
+func ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
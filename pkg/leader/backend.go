@@ -0,0 +1,60 @@
+package leader
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// explicit interface check
+var _ server.Backend = (*Backend)(nil)
+
+// Backend wraps another backend, rejecting writes unless the elector holds the
+// leader lease. Reads and watches are served regardless, as all instances share
+// the same datastore.
+type Backend struct {
+	server.Backend
+	elector *Elector
+}
+
+// Wrap returns a backend that only accepts writes while holding the leader lease.
+// Leader election runs in the background until the context is cancelled.
+func Wrap(ctx context.Context, backend server.Backend, config Config) *Backend {
+	elector := NewElector(backend, config)
+	go elector.Run(ctx)
+	return &Backend{
+		Backend: backend,
+		elector: elector,
+	}
+}
+
+// Unwrap returns the backend that writes are forwarded to.
+func (b *Backend) Unwrap() server.Backend {
+	return b.Backend
+}
+
+// IsLeader returns true if this instance currently holds the leader lease.
+func (b *Backend) IsLeader() bool {
+	return b.elector.IsLeader()
+}
+
+func (b *Backend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	if !b.elector.IsLeader() {
+		return 0, ErrNotLeader
+	}
+	return b.Backend.Create(ctx, key, value, lease)
+}
+
+func (b *Backend) Delete(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, bool, error) {
+	if !b.elector.IsLeader() {
+		return 0, nil, false, ErrNotLeader
+	}
+	return b.Backend.Delete(ctx, key, revision)
+}
+
+func (b *Backend) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *server.KeyValue, bool, error) {
+	if !b.elector.IsLeader() {
+		return 0, nil, false, ErrNotLeader
+	}
+	return b.Backend.Update(ctx, key, value, revision, lease)
+}
@@ -0,0 +1,163 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+const (
+	leaderKey            = "kine_leader_key"
+	defaultLeaseDuration = 15 * time.Second
+)
+
+// ErrNotLeader is returned for writes to an instance that does not hold the leader lease.
+var ErrNotLeader = rpctypes.ErrGRPCNoLeader
+
+type Config struct {
+	Enabled       bool
+	Identity      string
+	LeaseDuration time.Duration
+}
+
+type record struct {
+	Holder        string `json:"holder"`
+	LeaseDuration int64  `json:"leaseDurationSeconds"`
+}
+
+// Elector implements leader election on top of a kine backend. The lease is a
+// single key holding the identity of the current leader, which the leader
+// rewrites periodically. Candidates consider the lease expired if the key has
+// not been rewritten for the lease duration, as measured by their own clock, so
+// no clock synchronization between instances is required.
+type Elector struct {
+	sync.Mutex
+	backend server.Backend
+	config  Config
+
+	leading      bool
+	renewTime    time.Time
+	observedRev  int64
+	observedTime time.Time
+}
+
+func NewElector(backend server.Backend, config Config) *Elector {
+	if config.Identity == "" {
+		config.Identity, _ = os.Hostname()
+	}
+	if config.LeaseDuration <= 0 {
+		config.LeaseDuration = defaultLeaseDuration
+	}
+	return &Elector{
+		backend: backend,
+		config:  config,
+	}
+}
+
+// IsLeader returns true if the lease was held as of the most recent successful renewal,
+// and that renewal is recent enough that no other instance can have acquired the lease.
+func (e *Elector) IsLeader() bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.leading && time.Since(e.renewTime) < e.config.LeaseDuration
+}
+
+// Run attempts to acquire or renew the lease until the context is cancelled.
+func (e *Elector) Run(ctx context.Context) {
+	t := time.NewTicker(e.config.LeaseDuration / 3)
+	defer t.Stop()
+
+	for {
+		leading, err := e.tryAcquireOrRenew(ctx)
+		if err != nil {
+			logrus.Errorf("Failed to acquire or renew leader lease: %v", err)
+		}
+		e.setLeading(leading)
+
+		select {
+		case <-ctx.Done():
+			e.setLeading(false)
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (e *Elector) setLeading(leading bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	if leading {
+		e.renewTime = time.Now()
+	}
+	if leading != e.leading {
+		if leading {
+			logrus.Infof("Acquired leader lease as %s", e.config.Identity)
+		} else {
+			logrus.Infof("Lost leader lease as %s", e.config.Identity)
+		}
+		e.leading = leading
+	}
+	if leading {
+		metrics.LeaderGauge.Set(1)
+	} else {
+		metrics.LeaderGauge.Set(0)
+	}
+}
+
+func (e *Elector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	value, err := json.Marshal(record{
+		Holder:        e.config.Identity,
+		LeaseDuration: int64(e.config.LeaseDuration / time.Second),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	_, kv, err := e.backend.Get(ctx, leaderKey, 0)
+	if err != nil {
+		return false, err
+	}
+
+	if kv == nil {
+		if _, err := e.backend.Create(ctx, leaderKey, value, 0); err != nil {
+			if err == server.ErrKeyExists {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+
+	current := record{}
+	if err := json.Unmarshal(kv.Value, &current); err != nil {
+		logrus.Warnf("Failed to decode leader lease, taking over: %v", err)
+	}
+
+	now := time.Now()
+	if kv.ModRevision != e.observedRev {
+		e.observedRev = kv.ModRevision
+		e.observedTime = now
+	}
+
+	if current.Holder != e.config.Identity {
+		leaseDuration := time.Duration(current.LeaseDuration) * time.Second
+		if leaseDuration <= 0 {
+			leaseDuration = e.config.LeaseDuration
+		}
+		if now.Before(e.observedTime.Add(leaseDuration)) {
+			return false, nil
+		}
+		logrus.Infof("Leader lease held by %s has expired", current.Holder)
+	}
+
+	_, _, ok, err := e.backend.Update(ctx, leaderKey, value, kv.ModRevision, 0)
+	return ok, err
+}
@@ -0,0 +1,151 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	leaseCheckpointKey      = "lease_checkpoint_key"
+	leaseCheckpointInterval = 5 * time.Minute
+)
+
+// leaseCheckpoint records the remaining TTL for a specific revision of a key.
+// As with etcd's lease checkpoints, the remaining time is persisted rather than
+// an absolute deadline, so that countdowns resume where they left off after a
+// restart instead of either resetting or all expiring at once.
+type leaseCheckpoint struct {
+	ModRevision int64 `json:"modRevision"`
+	Remaining   int64 `json:"remaining"`
+}
+
+type leaseDeadline struct {
+	modRevision int64
+	deadline    time.Time
+}
+
+// leaseTracker tracks the expiration deadline of the latest revision of each key with a lease.
+type leaseTracker struct {
+	sync.Mutex
+	deadlines map[string]leaseDeadline
+}
+
+func newLeaseTracker() *leaseTracker {
+	return &leaseTracker{
+		deadlines: map[string]leaseDeadline{},
+	}
+}
+
+func (t *leaseTracker) add(key string, modRevision int64, deadline time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	if current, ok := t.deadlines[key]; ok && current.modRevision > modRevision {
+		return
+	}
+	t.deadlines[key] = leaseDeadline{modRevision: modRevision, deadline: deadline}
+}
+
+func (t *leaseTracker) remove(key string, modRevision int64) {
+	t.Lock()
+	defer t.Unlock()
+	if current, ok := t.deadlines[key]; ok && current.modRevision == modRevision {
+		delete(t.deadlines, key)
+	}
+}
+
+// checkpoints returns the remaining TTL, rounded up to the nearest second, of all tracked keys.
+func (t *leaseTracker) checkpoints() map[string]leaseCheckpoint {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	result := make(map[string]leaseCheckpoint, len(t.deadlines))
+	for key, d := range t.deadlines {
+		remaining := int64((d.deadline.Sub(now) + time.Second - 1) / time.Second)
+		if remaining < 1 {
+			remaining = 1
+		}
+		result[key] = leaseCheckpoint{ModRevision: d.modRevision, Remaining: remaining}
+	}
+	return result
+}
+
+// leaseTTL returns the time remaining until the given revision of a key should be
+// expired, taking into account any persisted checkpoint.
+func leaseTTL(checkpoints map[string]leaseCheckpoint, kv *server.KeyValue) time.Duration {
+	if cp, ok := checkpoints[kv.Key]; ok && cp.ModRevision == kv.ModRevision && cp.Remaining < kv.Lease {
+		return time.Duration(cp.Remaining) * time.Second
+	}
+	return time.Duration(kv.Lease) * time.Second
+}
+
+// loadLeaseCheckpoints reads the last persisted lease checkpoint, if any.
+func (l *LogStructured) loadLeaseCheckpoints(ctx context.Context) map[string]leaseCheckpoint {
+	checkpoints := map[string]leaseCheckpoint{}
+	_, event, err := l.get(ctx, leaseCheckpointKey, 0, false)
+	if err != nil {
+		logrus.Errorf("Failed to read lease checkpoint: %v", err)
+		return checkpoints
+	}
+	if event == nil || len(event.KV.Value) == 0 {
+		return checkpoints
+	}
+	if err := json.Unmarshal(event.KV.Value, &checkpoints); err != nil {
+		logrus.Errorf("Failed to decode lease checkpoint: %v", err)
+	}
+	logrus.Debugf("Loaded lease checkpoint with %d keys", len(checkpoints))
+	return checkpoints
+}
+
+// leaseCheckpointer periodically persists the remaining TTL of all tracked keys.
+func (l *LogStructured) leaseCheckpointer(ctx context.Context, tracker *leaseTracker) {
+	t := time.NewTicker(leaseCheckpointInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := l.saveLeaseCheckpoints(ctx, tracker.checkpoints()); err != nil {
+			logrus.Errorf("Failed to save lease checkpoint: %v", err)
+		}
+	}
+}
+
+func (l *LogStructured) saveLeaseCheckpoints(ctx context.Context, checkpoints map[string]leaseCheckpoint) error {
+	_, event, err := l.get(ctx, leaseCheckpointKey, 0, false)
+	if err != nil {
+		return err
+	}
+
+	if event == nil {
+		if len(checkpoints) == 0 {
+			return nil
+		}
+		value, err := json.Marshal(checkpoints)
+		if err != nil {
+			return err
+		}
+		_, err = l.Create(ctx, leaseCheckpointKey, value, 0)
+		return err
+	}
+
+	value, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(value, event.KV.Value) {
+		return nil
+	}
+	// Another kine instance sharing the datastore may have updated the
+	// checkpoint since it was read; that is fine, as theirs is just as current.
+	_, _, _, err = l.Update(ctx, leaseCheckpointKey, value, event.KV.ModRevision, 0)
+	return err
+}
@@ -18,8 +18,36 @@ type Log interface {
 	Count(ctx context.Context, prefix string) (int64, int64, error)
 	Append(ctx context.Context, event *server.Event) (int64, error)
 	DbSize(ctx context.Context) (int64, error)
+	CompactRevision(ctx context.Context) (int64, error)
 }
 
+// ExpiringLog is implemented by logs that can record when keys with a lease
+// expire, so that expired keys are found by querying the log rather than by
+// tracking every key with a lease in memory.
+type ExpiringLog interface {
+	TracksExpiry() bool
+	Expired(ctx context.Context, limit int64) ([]*server.Event, error)
+}
+
+// StreamingLog is implemented by logs that can pass the events of a list to a
+// callback in chunks as they are read, so that a large list is never held in
+// memory all at once.
+type StreamingLog interface {
+	ListStream(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeletes bool, fn func(events []*server.Event) error) (int64, error)
+}
+
+// ReadOnlyLog is implemented by logs that can be read-only copies of a log that
+// is written by another instance, which also creates the health check key and
+// deletes expired keys.
+type ReadOnlyLog interface {
+	ReadOnly() bool
+}
+
+const (
+	expirySweepInterval  = time.Second
+	expirySweepBatchSize = 500
+)
+
 type LogStructured struct {
 	log Log
 }
@@ -30,17 +58,29 @@ func New(log Log) *LogStructured {
 	}
 }
 
+// Log returns the underlying log.
+func (l *LogStructured) Log() Log {
+	return l.log
+}
+
 func (l *LogStructured) Start(ctx context.Context) error {
 	if err := l.log.Start(ctx); err != nil {
 		return err
 	}
+	if rl, ok := l.log.(ReadOnlyLog); ok && rl.ReadOnly() {
+		return nil
+	}
 	// See https://github.com/kubernetes/kubernetes/blob/442a69c3bdf6fe8e525b05887e57d89db1e2f3a5/staging/src/k8s.io/apiserver/pkg/storage/storagebackend/factory/etcd3.go#L97
 	if _, err := l.Create(ctx, "/registry/health", []byte(`{"health":"true"}`), 0); err != nil {
 		if err != server.ErrKeyExists {
 			logrus.Errorf("Failed to create health check key: %v", err)
 		}
 	}
-	go l.ttl(ctx)
+	if el, ok := l.log.(ExpiringLog); ok && el.TracksExpiry() {
+		go l.sweepExpired(ctx, el)
+	} else {
+		go l.ttl(ctx)
+	}
 	return nil
 }
 
@@ -189,6 +229,49 @@ func (l *LogStructured) List(ctx context.Context, prefix, startKey string, limit
 	return rev, kvs, nil
 }
 
+// ListStream lists keys as List does, passing them to fn in chunks as they are
+// read if the log can stream them.
+func (l *LogStructured) ListStream(ctx context.Context, prefix, startKey string, limit, revision int64, fn func(kvs []*server.KeyValue) error) (revRet int64, errRet error) {
+	sl, ok := l.log.(StreamingLog)
+	if !ok {
+		rev, kvs, err := l.List(ctx, prefix, startKey, limit, revision)
+		if err != nil {
+			return 0, err
+		}
+		return rev, fn(kvs)
+	}
+
+	var count int
+	defer func() {
+		logrus.Tracef("LIST STREAM %s, start=%s, limit=%d, rev=%d => rev=%d, kvs=%d, err=%v", prefix, startKey, limit, revision, revRet, count, errRet)
+	}()
+
+	rev, err := sl.ListStream(ctx, prefix, startKey, limit, revision, false, func(events []*server.Event) error {
+		// only the keys are passed on, so that the previous values of the
+		// chunk are released as soon as it is handled
+		kvs := make([]*server.KeyValue, 0, len(events))
+		for _, event := range events {
+			kvs = append(kvs, event.KV)
+		}
+		count += len(kvs)
+		return fn(kvs)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if revision == 0 && count == 0 {
+		// relist at the current revision, as List does
+		currentRev, err := l.log.CurrentRevision(ctx)
+		if err != nil {
+			return 0, err
+		}
+		return l.ListStream(ctx, prefix, startKey, limit, currentRev, fn)
+	} else if revision != 0 {
+		rev = revision
+	}
+	return rev, nil
+}
+
 func (l *LogStructured) Count(ctx context.Context, prefix string) (revRet int64, count int64, err error) {
 	defer func() {
 		logrus.Tracef("COUNT %s => rev=%d, count=%d, err=%v", prefix, revRet, count, err)
@@ -302,19 +385,57 @@ func (l *LogStructured) ttlEvents(ctx context.Context) chan *server.Event {
 func (l *LogStructured) ttl(ctx context.Context) {
 	// vary naive TTL support
 	mutex := &sync.Mutex{}
+	checkpoints := l.loadLeaseCheckpoints(ctx)
+	tracker := newLeaseTracker()
+	go l.leaseCheckpointer(ctx, tracker)
+
 	for event := range l.ttlEvents(ctx) {
-		go func(event *server.Event) {
+		ttl := leaseTTL(checkpoints, event.KV)
+		tracker.add(event.KV.Key, event.KV.ModRevision, time.Now().Add(ttl))
+		go func(event *server.Event, ttl time.Duration) {
+			defer tracker.remove(event.KV.Key, event.KV.ModRevision)
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(time.Duration(event.KV.Lease) * time.Second):
+			case <-time.After(ttl):
 			}
 			mutex.Lock()
 			if _, _, _, err := l.Delete(ctx, event.KV.Key, event.KV.ModRevision); err != nil {
 				logrus.Errorf("failed to delete expired key: %v", err)
 			}
 			mutex.Unlock()
-		}(event)
+		}(event, ttl)
+	}
+}
+
+// sweepExpired deletes keys whose recorded expiry has passed, emitting delete
+// events for them, until the context is cancelled.
+func (l *LogStructured) sweepExpired(ctx context.Context, el ExpiringLog) {
+	t := time.NewTicker(expirySweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for {
+			events, err := el.Expired(ctx, expirySweepBatchSize)
+			if err != nil {
+				logrus.Errorf("Failed to list expired keys: %v", err)
+				break
+			}
+			for _, event := range events {
+				if _, _, _, err = l.Delete(ctx, event.KV.Key, event.KV.ModRevision); err != nil {
+					logrus.Errorf("failed to delete expired key: %v", err)
+					break
+				}
+			}
+			// retry failed deletes on the next tick
+			if err != nil || len(events) < expirySweepBatchSize {
+				break
+			}
+		}
 	}
 }
 
@@ -372,3 +493,16 @@ func filter(events []*server.Event, rev int64) []*server.Event {
 func (l *LogStructured) DbSize(ctx context.Context) (int64, error) {
 	return l.log.DbSize(ctx)
 }
+
+func (l *LogStructured) CompactRevision(ctx context.Context) (int64, error) {
+	return l.log.CompactRevision(ctx)
+}
+
+// WatchRevision returns the last revision delivered to watchers by the log, if
+// the log tracks it.
+func (l *LogStructured) WatchRevision() int64 {
+	if w, ok := l.log.(interface{ WatchRevision() int64 }); ok {
+		return w.WatchRevision()
+	}
+	return 0
+}
@@ -0,0 +1,199 @@
+package sqllog
+
+import (
+	"context"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+// BatchConfig holds the settings of the write batcher, which inserts
+// concurrent appends in a single transaction so that they are committed, and
+// flushed to disk, together.
+type BatchConfig struct {
+	// MaxSize is the largest number of appends inserted in one transaction.
+	// Batching is disabled if it is less than two.
+	MaxSize int
+	// MaxLatency is how long an append waits for others to join its batch. If
+	// zero, a batch holds the appends that arrived while the previous batch was
+	// committed, so appends are only delayed when the datastore is busy.
+	MaxLatency time.Duration
+}
+
+// Enabled returns true if appends are batched.
+func (c BatchConfig) Enabled() bool {
+	return c.MaxSize > 1
+}
+
+type appendResult struct {
+	rev int64
+	err error
+}
+
+type appendRequest struct {
+	ctx    context.Context
+	event  *server.Event
+	result chan appendResult
+}
+
+// batcher collects appends and inserts them in batches. Batches are inserted
+// one at a time, in the order the appends arrived.
+type batcher struct {
+	s        *SQLLog
+	config   BatchConfig
+	requests chan *appendRequest
+}
+
+func newBatcher(s *SQLLog, config BatchConfig) *batcher {
+	return &batcher{
+		s:        s,
+		config:   config,
+		requests: make(chan *appendRequest, config.MaxSize),
+	}
+}
+
+// append queues an event to be inserted with the next batch, and waits for
+// its revision.
+func (b *batcher) append(ctx context.Context, event *server.Event) (int64, error) {
+	req := &appendRequest{
+		ctx:    ctx,
+		event:  event,
+		result: make(chan appendResult, 1),
+	}
+	select {
+	case b.requests <- req:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	// once queued, the append is inserted or failed even if the context is
+	// cancelled, so its outcome is always known
+	result := <-req.result
+	return result.rev, result.err
+}
+
+// run inserts batches of appends until the context is cancelled.
+func (b *batcher) run(ctx context.Context) {
+	for {
+		var batch []*appendRequest
+		select {
+		case <-ctx.Done():
+			b.drain(ctx.Err())
+			return
+		case req := <-b.requests:
+			batch = append(batch, req)
+		}
+		batch = b.collect(ctx, batch)
+		b.insert(ctx, batch)
+	}
+}
+
+// collect adds appends to a batch until it is full, or until the maximum
+// latency has passed or no more appends are queued.
+func (b *batcher) collect(ctx context.Context, batch []*appendRequest) []*appendRequest {
+	var timeout <-chan time.Time
+	if b.config.MaxLatency > 0 {
+		t := time.NewTimer(b.config.MaxLatency)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for len(batch) < b.config.MaxSize {
+		if timeout == nil {
+			select {
+			case req := <-b.requests:
+				batch = append(batch, req)
+				continue
+			default:
+				return batch
+			}
+		}
+		select {
+		case req := <-b.requests:
+			batch = append(batch, req)
+		case <-timeout:
+			return batch
+		case <-ctx.Done():
+			return batch
+		}
+	}
+	return batch
+}
+
+// drain fails the appends that are still queued.
+func (b *batcher) drain(err error) {
+	for {
+		select {
+		case req := <-b.requests:
+			req.result <- appendResult{err: err}
+		default:
+			return
+		}
+	}
+}
+
+// insert inserts a batch of appends in a single transaction. If the
+// transaction fails, for example because one of the appends conflicts with a
+// concurrent write, the appends are inserted one by one so that each gets its
+// own result.
+func (b *batcher) insert(ctx context.Context, batch []*appendRequest) {
+	pending := batch[:0]
+	for _, req := range batch {
+		if err := req.ctx.Err(); err != nil {
+			req.result <- appendResult{err: err}
+			continue
+		}
+		pending = append(pending, req)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	if len(pending) > 1 {
+		revs, err := b.insertTx(ctx, pending)
+		if err == nil {
+			for i, req := range pending {
+				req.result <- appendResult{rev: revs[i]}
+			}
+			b.s.notifyRevision(revs[len(revs)-1])
+			return
+		}
+		logrus.Debugf("Failed to insert batch of %d appends, inserting them one by one: %v", len(pending), err)
+	}
+
+	for _, req := range pending {
+		rev, err := b.s.insert(req.ctx, req.event)
+		if err == nil {
+			b.s.notifyRevision(rev)
+		}
+		req.result <- appendResult{rev: rev, err: err}
+	}
+}
+
+// insertTx inserts appends in a single transaction, and returns their
+// revisions.
+func (b *batcher) insertTx(ctx context.Context, batch []*appendRequest) ([]int64, error) {
+	t, err := b.s.d.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer t.MustRollback()
+
+	revs := make([]int64, 0, len(batch))
+	for _, req := range batch {
+		e := req.event
+		rev, err := t.Insert(ctx, e.KV.Key,
+			e.Create,
+			e.Delete,
+			e.KV.CreateRevision,
+			e.PrevKV.ModRevision,
+			e.KV.Lease,
+			e.KV.Value,
+			e.PrevKV.Value,
+		)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	return revs, t.Commit()
+}
@@ -0,0 +1,211 @@
+package sqllog
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	checkInterval   = 10 * time.Minute
+	checkTimeout    = 30 * time.Second
+	checkSampleSize = 200
+
+	checkContinuity    = "continuity"
+	checkChain         = "chain"
+	checkFlags         = "flags"
+	checkCompactMarker = "compact_marker"
+)
+
+// checkRow holds the subset of row fields needed for consistency checks.
+type checkRow struct {
+	id           int64
+	name         string
+	created      bool
+	deleted      bool
+	prevRevision int64
+}
+
+// checker periodically verifies a sample of the log for anomalies that would
+// otherwise only surface as apiserver errors: revision gaps that were never filled,
+// rows whose prev_revision points at a missing or mismatched row, create/update
+// rows whose predecessor has the wrong deleted flag, and a missing or duplicated
+// compact_rev_key marker. Anomalies are logged and counted; nothing is modified.
+func (s *SQLLog) checker(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	// Only revisions that existed at the previous check are examined, so that
+	// in-flight gaps which the poll loop has not had a chance to fill are not
+	// reported as anomalies.
+	var lastRev int64
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		currentRev, err := s.check(lastRev)
+		if err != nil {
+			logrus.Errorf("Consistency check failed: %v", err)
+			metrics.ConsistencyCheckTotal.WithLabelValues(metrics.ResultError).Inc()
+			continue
+		}
+		lastRev = currentRev
+		metrics.ConsistencyCheckTotal.WithLabelValues(metrics.ResultSuccess).Inc()
+	}
+}
+
+// check examines up to checkSampleSize revisions ending at endRev, and returns the
+// current revision to be used as the end of the window for the next check.
+func (s *SQLLog) check(endRev int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, checkTimeout)
+	defer cancel()
+
+	currentRev, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	compactRev, err := s.checkCompactMarker(ctx, currentRev)
+	if err != nil {
+		return 0, err
+	}
+
+	startRev := endRev - checkSampleSize
+	if startRev < compactRev {
+		startRev = compactRev
+	}
+	if endRev <= startRev {
+		return currentRev, nil
+	}
+
+	rows, err := s.d.After(ctx, "%", startRev, endRev-startRev)
+	if err != nil {
+		return 0, err
+	}
+	sample, err := scanCheckRows(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	next := startRev + 1
+	for _, row := range sample {
+		if row.id > endRev {
+			break
+		}
+		if row.id != next {
+			s.anomaly(checkContinuity, "revisions %d-%d are missing", next, row.id-1)
+		}
+		next = row.id + 1
+
+		if row.prevRevision <= compactRev || row.name == "compact_rev_key" || s.d.IsFill(row.name) {
+			continue
+		}
+		if err := s.checkPrevious(ctx, row); err != nil {
+			return 0, err
+		}
+	}
+
+	logrus.Tracef("CHECK examined %d rows between revisions %d and %d", len(sample), startRev, endRev)
+	return currentRev, nil
+}
+
+// checkCompactMarker ensures that there is exactly one compact_rev_key row, and
+// that the compact revision it records is not ahead of the current revision.
+func (s *SQLLog) checkCompactMarker(ctx context.Context, currentRev int64) (int64, error) {
+	rows, err := s.d.After(ctx, "compact_rev_key", 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	markers, err := scanCheckRows(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(markers) != 1 {
+		s.anomaly(checkCompactMarker, "found %d compact_rev_key rows, expected 1", len(markers))
+	}
+
+	compactRev, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if compactRev > currentRev {
+		s.anomaly(checkCompactMarker, "compact revision %d is ahead of current revision %d", compactRev, currentRev)
+	}
+	return compactRev, nil
+}
+
+// checkPrevious ensures that the row referenced by prev_revision exists, is for the
+// same key, and has a deleted flag consistent with the row that replaced it. Rows
+// that create a key for the first time record the then-current revision as their
+// prev_revision, so for creates a reference to a different key is expected.
+func (s *SQLLog) checkPrevious(ctx context.Context, row checkRow) error {
+	rows, err := s.d.GetRevision(ctx, row.prevRevision)
+	if err != nil {
+		return err
+	}
+	prev, err := scanCheckRows(rows)
+	if err != nil {
+		return err
+	}
+
+	if row.created {
+		if len(prev) > 0 && prev[0].name == row.name && !prev[0].deleted {
+			s.anomaly(checkFlags, "revision %d creates key %s but previous revision %d is not a delete", row.id, row.name, row.prevRevision)
+		}
+		return nil
+	}
+
+	switch {
+	case len(prev) == 0:
+		s.anomaly(checkChain, "revision %d for key %s references missing revision %d", row.id, row.name, row.prevRevision)
+	case prev[0].name != row.name:
+		s.anomaly(checkChain, "revision %d for key %s references revision %d for key %s", row.id, row.name, row.prevRevision, prev[0].name)
+	case prev[0].deleted:
+		s.anomaly(checkFlags, "revision %d modifies key %s but previous revision %d is a delete", row.id, row.name, row.prevRevision)
+	}
+	return nil
+}
+
+func (s *SQLLog) anomaly(check, format string, args ...interface{}) {
+	metrics.ConsistencyAnomalyTotal.WithLabelValues(check).Inc()
+	logrus.Warnf("Consistency check ("+check+"): "+format, args...)
+}
+
+// scanCheckRows reads rows in the standard column layout, discarding the values
+// and the checksum, if any.
+func scanCheckRows(rows *sql.Rows) ([]checkRow, error) {
+	var result []checkRow
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var (
+			row                                      checkRow
+			rev                                      int64
+			compact, createRevision, lease, checksum sql.NullInt64
+			value, oldValue                          sql.RawBytes
+		)
+		dest := []interface{}{&rev, &compact, &row.id, &row.name, &row.created, &row.deleted, &createRevision, &row.prevRevision, &lease, &value, &oldValue}
+		if len(columns) > len(dest) {
+			dest = append(dest, &checksum)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,30 @@
+package sqllog
+
+import (
+	"github.com/k3s-io/kine/pkg/checksum"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// verifyChecksum verifies the checksum of a row as it was scanned, before its
+// values are decoded.
+func verifyChecksum(event *server.Event, sum int64) error {
+	row := checksum.Row{
+		Name:           event.KV.Key,
+		Created:        event.Create,
+		Deleted:        event.Delete,
+		CreateRevision: event.KV.CreateRevision,
+		PrevRevision:   event.PrevKV.ModRevision,
+		Lease:          event.KV.Lease,
+		Value:          event.KV.Value,
+		OldValue:       event.PrevKV.Value,
+	}
+	if err := row.Verify(sum); err != nil {
+		metrics.ChecksumMismatchTotal.WithLabelValues(metrics.ChecksumSourceRead).Inc()
+		logrus.Errorf("Checksum of revision %d for key %s does not match, the row was modified outside of kine or is corrupt", event.KV.ModRevision, event.KV.Key)
+		return errors.Wrapf(err, "revision %d for key %s", event.KV.ModRevision, event.KV.Key)
+	}
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/k3s-io/kine/pkg/broadcaster"
@@ -19,13 +21,43 @@ const (
 	compactMinRetain = 1000
 	compactBatchSize = 1000
 	pollBatchSize    = 500
+	listBatchSize    = 1000
 )
 
+// CompactConfig configures the compaction of old revisions.
+type CompactConfig struct {
+	// Interval is the time between compactions. Zero means every five minutes.
+	Interval time.Duration
+	// MinRetain is the number of most recent revisions that are never
+	// compacted. Zero means 1000.
+	MinRetain int64
+}
+
+func (c CompactConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return compactInterval
+	}
+	return c.Interval
+}
+
+func (c CompactConfig) minRetain() int64 {
+	if c.MinRetain <= 0 {
+		return compactMinRetain
+	}
+	return c.MinRetain
+}
+
 type SQLLog struct {
-	d           server.Dialect
-	broadcaster broadcaster.Broadcaster
-	ctx         context.Context
-	notify      chan int64
+	d             server.Dialect
+	broadcaster   broadcaster.Broadcaster
+	ctx           context.Context
+	notify        chan int64
+	batchConfig   BatchConfig
+	batcher       *batcher
+	compactConfig CompactConfig
+	maintenance   sync.Once
+	// polled is the last revision delivered to watchers
+	polled int64
 }
 
 func New(d server.Dialect) *SQLLog {
@@ -36,9 +68,111 @@ func New(d server.Dialect) *SQLLog {
 	return l
 }
 
+// Dialect returns the underlying SQL dialect.
+func (s *SQLLog) Dialect() server.Dialect {
+	return s.d
+}
+
+// base returns the dialect underneath any dialects that wrap it, such as the
+// circuit breaker, which only wrap the methods of server.Dialect and so hide
+// the optional interfaces it implements.
+func (s *SQLLog) base() server.Dialect {
+	d := s.d
+	for {
+		u, ok := d.(interface{ Unwrap() server.Dialect })
+		if !ok {
+			return d
+		}
+		d = u.Unwrap()
+	}
+}
+
+// SetDialect replaces the underlying SQL dialect, for example with one that
+// wraps it. It must be called before the log is started.
+func (s *SQLLog) SetDialect(d server.Dialect) {
+	s.d = d
+}
+
 func (s *SQLLog) Start(ctx context.Context) error {
 	s.ctx = ctx
-	return s.compactStart(s.ctx)
+	if s.ReadOnly() {
+		return nil
+	}
+	if err := s.compactStart(s.ctx); err != nil {
+		return err
+	}
+	if s.batchConfig.Enabled() {
+		s.batcher = newBatcher(s, s.batchConfig)
+		go s.batcher.run(s.ctx)
+	}
+	if d, ok := s.base().(expiringDialect); ok && d.TracksExpiry() {
+		if n, err := d.BackfillExpiry(s.ctx, time.Now()); err != nil {
+			logrus.Errorf("Failed to record expiry of keys with a lease: %v", err)
+		} else if n > 0 {
+			logrus.Infof("Recorded expiry of %d keys with a lease", n)
+		}
+	}
+	return nil
+}
+
+// seedingDialect is implemented by dialects that can start an empty datastore
+// at a configured revision.
+type seedingDialect interface {
+	Seed(ctx context.Context) (bool, error)
+}
+
+// batchingDialect is implemented by dialects that limit the number of revisions
+// compacted in each transaction, for databases with transaction size limits.
+type batchingDialect interface {
+	GetCompactBatchSize() int64
+}
+
+// expiringDialect is implemented by dialects that can record when keys with a
+// lease expire.
+type expiringDialect interface {
+	TracksExpiry() bool
+	Expired(ctx context.Context, now time.Time, limit int64) (*sql.Rows, error)
+	BackfillExpiry(ctx context.Context, now time.Time) (int64, error)
+}
+
+// decodingDialect is implemented by dialects that encode values before they
+// are stored, for example by compressing or encrypting them.
+type decodingDialect interface {
+	DecodeValue(value []byte) ([]byte, error)
+}
+
+// readOnlyDialect is implemented by dialects that can serve a read-only copy of
+// a datastore, which is written and compacted by another instance.
+type readOnlyDialect interface {
+	IsReadOnly() bool
+}
+
+// ReadOnly returns true if the datastore is a read-only copy, so that it is
+// neither written to nor compacted.
+func (s *SQLLog) ReadOnly() bool {
+	d, ok := s.base().(readOnlyDialect)
+	return ok && d.IsReadOnly()
+}
+
+// TracksExpiry returns true if the datastore records when keys with a lease
+// expire.
+func (s *SQLLog) TracksExpiry() bool {
+	d, ok := s.base().(expiringDialect)
+	return ok && d.TracksExpiry()
+}
+
+// Expired returns the current events of keys that have expired.
+func (s *SQLLog) Expired(ctx context.Context, limit int64) ([]*server.Event, error) {
+	d, ok := s.base().(expiringDialect)
+	if !ok || !d.TracksExpiry() {
+		return nil, nil
+	}
+	rows, err := d.Expired(ctx, time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	_, _, events, err := s.rowsToEvents(rows)
+	return events, err
 }
 
 func (s *SQLLog) compactStart(ctx context.Context) error {
@@ -49,7 +183,7 @@ func (s *SQLLog) compactStart(ctx context.Context) error {
 		return err
 	}
 
-	_, _, events, err := RowsToEvents(rows)
+	_, _, events, err := s.rowsToEvents(rows)
 	if err != nil {
 		return err
 	}
@@ -57,6 +191,11 @@ func (s *SQLLog) compactStart(ctx context.Context) error {
 	logrus.Tracef("COMPACTSTART len(events)=%v", len(events))
 
 	if len(events) == 0 {
+		if d, ok := s.base().(seedingDialect); ok {
+			if seeded, err := d.Seed(ctx); err != nil || seeded {
+				return err
+			}
+		}
 		_, err := s.Append(ctx, &server.Event{
 			Create: true,
 			KV: &server.KeyValue{
@@ -111,6 +250,11 @@ func (s *SQLLog) compactor(interval time.Duration) {
 	targetCompactRev, _ := s.d.CurrentRevision(s.ctx)
 	logrus.Tracef("COMPACT starting compactRev=%d targetCompactRev=%d", compactRev, targetCompactRev)
 
+	batchSize := int64(compactBatchSize)
+	if d, ok := s.base().(batchingDialect); ok && d.GetCompactBatchSize() > 0 {
+		batchSize = d.GetCompactBatchSize()
+	}
+
 outer:
 	for {
 		select {
@@ -135,10 +279,10 @@ outer:
 		compactedRev = compactRev
 
 		for iterCompactRev < targetCompactRev {
-			// Set move iteration target compactBatchSize revisions forward, or
+			// Set move iteration target batchSize revisions forward, or
 			// just as far as we need to hit the compaction target if that would
 			// overshoot it.
-			iterCompactRev += compactBatchSize
+			iterCompactRev += batchSize
 			if iterCompactRev > targetCompactRev {
 				iterCompactRev = targetCompactRev
 			}
@@ -199,8 +343,8 @@ func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64
 		return dbCompactRev, currentRev, server.ErrCompacted
 	}
 
-	// Ensure that we never compact the most recent 1000 revisions
-	targetCompactRev = safeCompactRev(targetCompactRev, currentRev)
+	// Ensure that we never compact the most recent revisions
+	targetCompactRev = safeCompactRev(targetCompactRev, currentRev, s.compactConfig.minRetain())
 
 	// Don't bother compacting to a revision that has already been compacted
 	if targetCompactRev <= compactRev {
@@ -226,6 +370,24 @@ func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64
 	return targetCompactRev, currentRev, nil
 }
 
+// Compact compacts to the target revision immediately, rather than waiting for
+// the compactor. As with the compactor, the most recent revisions are never
+// compacted. It returns the revision compacted to.
+func (s *SQLLog) Compact(ctx context.Context, targetCompactRev int64) (int64, error) {
+	compactRev, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	compactRev, _, err = s.compact(compactRev, targetCompactRev)
+	if err == server.ErrCompacted {
+		err = nil
+	}
+	if err != nil {
+		return compactRev, err
+	}
+	return compactRev, s.postCompact()
+}
+
 // postCompact executes any post-compact database cleanup - vacuuming, WAL truncate, etc.
 func (s *SQLLog) postCompact() error {
 	return s.d.PostCompact(s.ctx)
@@ -235,6 +397,10 @@ func (s *SQLLog) CurrentRevision(ctx context.Context) (int64, error) {
 	return s.d.CurrentRevision(ctx)
 }
 
+func (s *SQLLog) CompactRevision(ctx context.Context) (int64, error) {
+	return s.d.GetCompactRevision(ctx)
+}
+
 func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
 	if strings.HasSuffix(prefix, "/") {
 		prefix += "%"
@@ -245,7 +411,7 @@ func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64
 		return 0, nil, err
 	}
 
-	rev, compact, result, err := RowsToEvents(rows)
+	rev, compact, result, err := s.rowsToEvents(rows)
 	if revision > 0 && revision < compact {
 		return rev, result, server.ErrCompacted
 	}
@@ -254,11 +420,29 @@ func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64
 }
 
 func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
-	var (
-		rows *sql.Rows
-		err  error
-	)
+	prefix, startKey = listRange(prefix, startKey)
+	if limit > 0 && limit <= listBatchSize {
+		return s.list(ctx, prefix, startKey, limit, revision, includeDeleted)
+	}
 
+	var result []*server.Event
+	rev, err := s.listBatches(ctx, prefix, startKey, limit, revision, includeDeleted, func(events []*server.Event) error {
+		result = append(result, events...)
+		return nil
+	})
+	return rev, result, err
+}
+
+// ListStream lists a prefix as List does, passing the events to fn one batch
+// at a time as they are read.
+func (s *SQLLog) ListStream(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool, fn func(events []*server.Event) error) (int64, error) {
+	prefix, startKey = listRange(prefix, startKey)
+	return s.listBatches(ctx, prefix, startKey, limit, revision, includeDeleted, fn)
+}
+
+// listRange returns the pattern that matches the keys of a prefix, and the key
+// the list starts after.
+func listRange(prefix, startKey string) (string, string) {
 	// It's assumed that when there is a start key that that key exists.
 	if strings.HasSuffix(prefix, "/") {
 		// In the situation of a list start the startKey will not exist so set to ""
@@ -270,7 +454,54 @@ func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revis
 		// Also if this isn't a list there is no reason to pass startKey
 		startKey = ""
 	}
+	return prefix, startKey
+}
 
+// listBatches lists a prefix in batches of at most listBatchSize rows, so that
+// the datastore does not return a large prefix in one result set. Rows are
+// listed in the order of their revision, so each batch starts after the last
+// key of the previous one, at the revision of the first batch. Each batch is
+// passed to fn as soon as it is read.
+func (s *SQLLog) listBatches(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool, fn func(events []*server.Event) error) (int64, error) {
+	var (
+		listRev int64
+		count   int64
+	)
+	for {
+		batchSize := int64(listBatchSize)
+		if limit > 0 && limit-count < batchSize {
+			batchSize = limit - count
+		}
+		rev, events, err := s.list(ctx, prefix, startKey, batchSize, revision, includeDeleted)
+		if err != nil {
+			return rev, err
+		}
+		if err := fn(events); err != nil {
+			return rev, err
+		}
+		count += int64(len(events))
+		if listRev == 0 {
+			listRev = rev
+		}
+		if revision == 0 {
+			if len(events) == 0 {
+				return rev, nil
+			}
+			revision = rev
+		}
+		if int64(len(events)) < batchSize || (limit > 0 && count >= limit) {
+			return listRev, nil
+		}
+		startKey = events[len(events)-1].KV.Key
+	}
+}
+
+// list lists a prefix in a single query.
+func (s *SQLLog) list(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
 	if revision == 0 {
 		rows, err = s.d.ListCurrent(ctx, prefix, limit, includeDeleted)
 	} else {
@@ -280,7 +511,7 @@ func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revis
 		return 0, nil, err
 	}
 
-	rev, compact, result, err := RowsToEvents(rows)
+	rev, compact, result, err := s.rowsToEvents(rows)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -313,9 +544,17 @@ func RowsToEvents(rows *sql.Rows) (int64, int64, []*server.Event, error) {
 	)
 	defer rows.Close()
 
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	// rows of dialects that record checksums have a checksum column after
+	// the values
+	checksums := len(columns) > 11
+
 	for rows.Next() {
 		event := &server.Event{}
-		if err := scan(rows, &rev, &compact, event); err != nil {
+		if err := scan(rows, checksums, &rev, &compact, event); err != nil {
 			return 0, 0, nil, err
 		}
 		result = append(result, event)
@@ -324,12 +563,37 @@ func RowsToEvents(rows *sql.Rows) (int64, int64, []*server.Event, error) {
 	return rev, compact, result, nil
 }
 
+// rowsToEvents converts rows to events as RowsToEvents does, and decodes their
+// values if the dialect encodes them.
+func (s *SQLLog) rowsToEvents(rows *sql.Rows) (int64, int64, []*server.Event, error) {
+	rev, compact, result, err := RowsToEvents(rows)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	d, ok := s.base().(decodingDialect)
+	if !ok {
+		return rev, compact, result, nil
+	}
+	for _, event := range result {
+		if event.KV.Value, err = d.DecodeValue(event.KV.Value); err != nil {
+			return 0, 0, nil, err
+		}
+		if event.PrevKV == nil {
+			continue
+		}
+		if event.PrevKV.Value, err = d.DecodeValue(event.PrevKV.Value); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	return rev, compact, result, nil
+}
+
 func (s *SQLLog) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
-	res := make(chan []*server.Event, 100)
 	values, err := s.broadcaster.Subscribe(ctx, s.startWatch)
 	if err != nil {
 		return nil
 	}
+	res := make(chan []*server.Event, cap(values))
 
 	checkPrefix := strings.HasSuffix(prefix, "/")
 
@@ -368,22 +632,54 @@ func (s *SQLLog) startWatch() (chan interface{}, error) {
 	c := make(chan interface{})
 	// start compaction and polling at the same time to watch starts
 	// at the oldest revision, but compaction doesn't create gaps
-	go s.compactor(compactInterval)
+	// the watch is restarted if polling cannot be resumed, but maintenance only needs to run once
+	s.maintenance.Do(func() {
+		if !s.ReadOnly() {
+			go s.compactor(s.compactConfig.interval())
+		}
+		go s.checker(checkInterval)
+	})
 	go s.poll(c, pollStart)
 	return c, nil
 }
 
+// SetWatchConfig sets how events are buffered for watchers. It must be called
+// before the log is started.
+func (s *SQLLog) SetWatchConfig(config broadcaster.Config) {
+	s.broadcaster.Config = config
+}
+
+// SetBatchConfig sets how concurrent appends are batched. It must be called
+// before the log is started.
+func (s *SQLLog) SetBatchConfig(config BatchConfig) {
+	s.batchConfig = config
+}
+
+// SetCompactConfig sets how often and how far old revisions are compacted. It
+// must be called before the log is started.
+func (s *SQLLog) SetCompactConfig(config CompactConfig) {
+	s.compactConfig = config
+}
+
+// WatchRevision returns the last revision delivered to watchers, or zero if no
+// watch has been started.
+func (s *SQLLog) WatchRevision() int64 {
+	return atomic.LoadInt64(&s.polled)
+}
+
 func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 	var (
-		last        = pollStart
-		skip        int64
-		skipTime    time.Time
-		waitForMore = true
+		last         = pollStart
+		skip         int64
+		skipTime     time.Time
+		waitForMore  = true
+		disconnected time.Time
 	)
 
 	wait := time.NewTicker(time.Second)
 	defer wait.Stop()
 	defer close(result)
+	atomic.StoreInt64(&s.polled, last)
 
 	for {
 		if waitForMore {
@@ -401,11 +697,35 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 
 		rows, err := s.d.After(s.ctx, "%", last, pollBatchSize)
 		if err != nil {
+			if disconnected.IsZero() {
+				disconnected = time.Now()
+			}
 			logrus.Errorf("fail to list latest changes: %v", err)
 			continue
 		}
 
-		_, _, events, err := RowsToEvents(rows)
+		// After losing the connection to the datastore, watchers can be resumed from
+		// the last delivered revision as long as it has not been compacted in the
+		// meantime, possibly by another node. Otherwise, filling the gaps would
+		// fabricate history, so end the stream and let clients re-list instead.
+		if !disconnected.IsZero() {
+			rows.Close()
+			compactRev, err := s.d.GetCompactRevision(s.ctx)
+			if err != nil {
+				logrus.Errorf("fail to get compact revision after reconnect: %v", err)
+				continue
+			}
+			if compactRev > last {
+				logrus.Errorf("Watch resumption failed after %v: revision %d has been compacted to %d, closing watches", time.Since(disconnected).Round(time.Second), last, compactRev)
+				return
+			}
+			logrus.Infof("Resuming watches from revision %d after %v", last, time.Since(disconnected).Round(time.Second))
+			disconnected = time.Time{}
+			waitForMore = false
+			continue
+		}
+
+		_, _, events, err := s.rowsToEvents(rows)
 		if err != nil {
 			logrus.Errorf("fail to convert rows changes: %v", err)
 			continue
@@ -474,6 +794,7 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 
 		if saveLast {
 			last = rev
+			atomic.StoreInt64(&s.polled, last)
 			if len(sequential) > 0 {
 				result <- sequential
 			}
@@ -500,8 +821,20 @@ func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error)
 	if e.PrevKV == nil {
 		e.PrevKV = &server.KeyValue{}
 	}
+	if s.batcher != nil {
+		return s.batcher.append(ctx, &e)
+	}
+
+	rev, err := s.insert(ctx, &e)
+	if err != nil {
+		return 0, err
+	}
+	s.notifyRevision(rev)
+	return rev, nil
+}
 
-	rev, err := s.d.Insert(ctx, e.KV.Key,
+func (s *SQLLog) insert(ctx context.Context, e *server.Event) (int64, error) {
+	return s.d.Insert(ctx, e.KV.Key,
 		e.Create,
 		e.Delete,
 		e.KV.CreateRevision,
@@ -510,23 +843,24 @@ func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error)
 		e.KV.Value,
 		e.PrevKV.Value,
 	)
-	if err != nil {
-		return 0, err
-	}
+}
+
+// notifyRevision wakes the poll loop after a revision is inserted.
+func (s *SQLLog) notifyRevision(rev int64) {
 	select {
 	case s.notify <- rev:
 	default:
 	}
-	return rev, nil
 }
 
-func scan(rows *sql.Rows, rev *int64, compact *int64, event *server.Event) error {
+func scan(rows *sql.Rows, checksums bool, rev *int64, compact *int64, event *server.Event) error {
 	event.KV = &server.KeyValue{}
 	event.PrevKV = &server.KeyValue{}
 
 	c := &sql.NullInt64{}
+	sum := &sql.NullInt64{}
 
-	err := rows.Scan(
+	dest := []interface{}{
 		rev,
 		c,
 		&event.KV.ModRevision,
@@ -538,11 +872,21 @@ func scan(rows *sql.Rows, rev *int64, compact *int64, event *server.Event) error
 		&event.KV.Lease,
 		&event.KV.Value,
 		&event.PrevKV.Value,
-	)
-	if err != nil {
+	}
+	if checksums {
+		dest = append(dest, sum)
+	}
+	if err := rows.Scan(dest...); err != nil {
 		return err
 	}
 
+	// rows without a checksum were written before checksums were enabled
+	if sum.Valid {
+		if err := verifyChecksum(event, sum.Int64); err != nil {
+			return err
+		}
+	}
+
 	if event.Create {
 		event.KV.CreateRevision = event.KV.ModRevision
 		event.PrevKV = nil
@@ -552,9 +896,9 @@ func scan(rows *sql.Rows, rev *int64, compact *int64, event *server.Event) error
 	return nil
 }
 
-// safeCompactRev ensures that we never compact the most recent 1000 revisions.
-func safeCompactRev(targetCompactRev int64, currentRev int64) int64 {
-	safeRev := currentRev - compactMinRetain
+// safeCompactRev ensures that we never compact the most recent minRetain revisions.
+func safeCompactRev(targetCompactRev int64, currentRev int64, minRetain int64) int64 {
+	safeRev := currentRev - minRetain
 	if targetCompactRev < safeRev {
 		safeRev = targetCompactRev
 	}
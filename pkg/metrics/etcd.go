@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+const dbSizeTimeout = 5 * time.Second
+
+var (
+	etcdRangeTotalDesc = prometheus.NewDesc(
+		"etcd_mvcc_range_total",
+		"Total number of ranges seen by this member.",
+		nil, nil)
+	etcdIsLeaderDesc = prometheus.NewDesc(
+		"etcd_server_is_leader",
+		"Whether or not this member is a leader. 1 if is, 0 otherwise.",
+		nil, nil)
+	etcdHasLeaderDesc = prometheus.NewDesc(
+		"etcd_server_has_leader",
+		"Whether or not a leader exists. 1 is existence, 0 is not.",
+		nil, nil)
+	etcdBackendCommitDurationDesc = prometheus.NewDesc(
+		"etcd_disk_backend_commit_duration_seconds",
+		"The latency distributions of commit called by backend.",
+		nil, nil)
+	etcdDBTotalSizeDesc = prometheus.NewDesc(
+		"etcd_mvcc_db_total_size_in_bytes",
+		"Total size of the underlying database physically allocated in bytes.",
+		nil, nil)
+	etcdDBTotalSizeInUseDesc = prometheus.NewDesc(
+		"etcd_mvcc_db_total_size_in_use_in_bytes",
+		"Total size of the underlying database logically in use in bytes.",
+		nil, nil)
+	etcdDebuggingDBTotalSizeDesc = prometheus.NewDesc(
+		"etcd_debugging_mvcc_db_total_size_in_bytes",
+		"Total size of the underlying database physically allocated in bytes.",
+		nil, nil)
+)
+
+// EtcdCompatCollector exposes kine's metrics under the names used by etcd, so
+// that dashboards and alerts written for etcd work unmodified. The values are
+// read from kine's own metrics at collection time, so enabling it does not
+// change them; it should not be enabled if queries sum across both names.
+type EtcdCompatCollector struct {
+	// DBSize returns the size of the datastore, as reported by the backend.
+	DBSize func(ctx context.Context) (int64, error)
+	// IsLeader returns true if this instance holds the leader lease. If not set,
+	// the instance is always reported as the leader.
+	IsLeader func() bool
+}
+
+func (c *EtcdCompatCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- etcdRangeTotalDesc
+	ch <- etcdIsLeaderDesc
+	ch <- etcdHasLeaderDesc
+	ch <- etcdBackendCommitDurationDesc
+	ch <- etcdDBTotalSizeDesc
+	ch <- etcdDBTotalSizeInUseDesc
+	ch <- etcdDebuggingDBTotalSizeDesc
+}
+
+func (c *EtcdCompatCollector) Collect(ch chan<- prometheus.Metric) {
+	var ranges float64
+	for _, m := range gather(RangeTotal) {
+		ranges += m.GetCounter().GetValue()
+	}
+	ch <- prometheus.MustNewConstMetric(etcdRangeTotalDesc, prometheus.CounterValue, ranges)
+
+	var isLeader float64 = 1
+	if c.IsLeader != nil && !c.IsLeader() {
+		isLeader = 0
+	}
+	ch <- prometheus.MustNewConstMetric(etcdIsLeaderDesc, prometheus.GaugeValue, isLeader)
+	// the datastore is always available to serve requests, regardless of which
+	// instance holds the leader lease
+	ch <- prometheus.MustNewConstMetric(etcdHasLeaderDesc, prometheus.GaugeValue, 1)
+
+	// SQL operations are the closest equivalent to backend commits
+	var (
+		count   uint64
+		sum     float64
+		buckets = map[float64]uint64{}
+	)
+	for _, m := range gather(SQLTime) {
+		h := m.GetHistogram()
+		count += h.GetSampleCount()
+		sum += h.GetSampleSum()
+		for _, b := range h.GetBucket() {
+			buckets[b.GetUpperBound()] += b.GetCumulativeCount()
+		}
+	}
+	ch <- prometheus.MustNewConstHistogram(etcdBackendCommitDurationDesc, count, sum, buckets)
+
+	if c.DBSize != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), dbSizeTimeout)
+		defer cancel()
+		size, err := c.DBSize(ctx)
+		if err != nil {
+			logrus.Debugf("Failed to get datastore size for etcd metrics: %v", err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(etcdDBTotalSizeDesc, prometheus.GaugeValue, float64(size))
+		ch <- prometheus.MustNewConstMetric(etcdDBTotalSizeInUseDesc, prometheus.GaugeValue, float64(size))
+		ch <- prometheus.MustNewConstMetric(etcdDebuggingDBTotalSizeDesc, prometheus.GaugeValue, float64(size))
+	}
+}
+
+// gather returns the current values of all series of a collector.
+func gather(c prometheus.Collector) []*dto.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var result []*dto.Metric
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err == nil {
+			result = append(result, pb)
+		}
+	}
+	return result
+}
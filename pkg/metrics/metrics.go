@@ -3,16 +3,23 @@ package metrics
 import (
 	"time"
 
-	"github.com/k3s-io/kine/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/sirupsen/logrus"
 )
 
 const (
 	ResultSuccess = "success"
 	ResultError   = "error"
+
+	ConsistencyLinearizable = "linearizable"
+	ConsistencySerializable = "serializable"
+
+	ChecksumSourceRead = "read"
+	ChecksumSourceScan = "scan"
 )
 
+var sqlTimeBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.15, 0.2, 0.25, 0.3, 0.35, 0.4, 0.45, 0.5, 0.6, 0.7, 0.8, 0.9, 1.0,
+	1.5, 2.0, 2.5, 3.0, 3.5, 4.0, 4.5, 5, 6, 7, 8, 9, 10, 15, 20, 25, 30}
+
 var (
 	SQLTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kine_sql_total",
@@ -20,16 +27,129 @@ var (
 	}, []string{"error_code"})
 
 	SQLTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "kine_sql_time_seconds",
-		Help: "Length of time per SQL operation",
-		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.15, 0.2, 0.25, 0.3, 0.35, 0.4, 0.45, 0.5, 0.6, 0.7, 0.8, 0.9, 1.0,
-			1.5, 2.0, 2.5, 3.0, 3.5, 4.0, 4.5, 5, 6, 7, 8, 9, 10, 15, 20, 25, 30},
+		Name:    "kine_sql_time_seconds",
+		Help:    "Length of time per SQL operation",
+		Buckets: sqlTimeBuckets,
 	}, []string{"error_code"})
 
+	SQLStatementTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kine_sql_statement_time_seconds",
+		Help:    "Length of time per SQL statement, by the kind of statement",
+		Buckets: sqlTimeBuckets,
+	}, []string{"kind"})
+
 	CompactTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kine_compact_total",
 		Help: "Total number of compactions",
 	}, []string{"result"})
+
+	RangeTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_range_total",
+		Help: "Total number of range requests by read consistency",
+	}, []string{"consistency"})
+
+	LeaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_is_leader",
+		Help: "Whether this instance holds the leader lease (1) or is on standby (0)",
+	})
+
+	ConsistencyCheckTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_consistency_check_total",
+		Help: "Total number of background consistency checks",
+	}, []string{"result"})
+
+	ConsistencyAnomalyTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_consistency_anomaly_total",
+		Help: "Total number of anomalies found by background consistency checks",
+	}, []string{"check"})
+
+	EventWritesDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_event_writes_dropped_total",
+		Help: "Total number of event writes dropped by the event rate limiter",
+	}, []string{"reason"})
+
+	ReplicaLagRevisions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_replica_lag_revisions",
+		Help: "Number of revisions the secondary datastore is behind the primary",
+	})
+
+	BreakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_datastore_breaker_open",
+		Help: "Whether calls to the datastore fail fast because the circuit breaker is open (1) or not (0)",
+	})
+
+	ChecksumMismatchTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_checksum_mismatch_total",
+		Help: "Total number of rows read whose stored checksum does not match their columns",
+	}, []string{"source"})
+
+	SQLiteReplicationLagSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_sqlite_replication_lag_seconds",
+		Help: "Seconds since the last heartbeat of the primary was replicated to this read-only SQLite follower",
+	})
+
+	EtcdProxyRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_etcd_proxy_requests_total",
+		Help: "Total number of requests forwarded to etcd by operation and result",
+	}, []string{"operation", "result"})
+
+	EtcdProxyRequestSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kine_etcd_proxy_request_seconds",
+		Help:    "Length of time per request forwarded to etcd",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	EtcdProxyMirrorTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_etcd_proxy_mirror_total",
+		Help: "Total number of writes forwarded to etcd that were mirrored to another backend, by result",
+	}, []string{"result"})
+
+	CDCEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_cdc_events_total",
+		Help: "Total number of change events published to change-data-capture sinks",
+	}, []string{"sink", "result"})
+
+	CDCCheckpointRevision = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kine_cdc_checkpoint_revision",
+		Help: "Revision of the last change event published to each change-data-capture sink",
+	}, []string{"sink"})
+
+	CDCLagRevisions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kine_cdc_lag_revisions",
+		Help: "Number of revisions each change-data-capture sink is behind the datastore",
+	}, []string{"sink"})
+
+	WatchBufferUsage = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kine_watch_buffer_usage_ratio",
+		Help:    "Fraction of the fullest watch subscriber buffer in use when events are broadcast",
+		Buckets: []float64{0, 0.1, 0.25, 0.5, 0.75, 0.9, 1},
+	})
+
+	WatchSubscribersDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_watch_subscribers_dropped_total",
+		Help: "Total number of watch subscribers closed because their buffer was full",
+	}, []string{"policy"})
+
+	WatchBlockedSeconds = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_watch_blocked_seconds_total",
+		Help: "Total time spent waiting for watch subscribers with full buffers",
+	})
+
+	SchemaDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kine_schema_drift",
+		Help: "Columns and indexes of the kine table that differ from the expected schema, by kind of difference",
+	}, []string{"kind", "name"})
+
+	PriorityQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kine_priority_queue_depth",
+		Help: "Number of requests waiting to be admitted, by priority class",
+	}, []string{"class"})
+
+	PriorityWaitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kine_priority_wait_seconds",
+		Help:    "Time requests waited to be admitted, by priority class",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"class"})
 )
 
 var (
@@ -38,11 +158,10 @@ var (
 	SlowSQLThreshold = time.Second
 )
 
-func ObserveSQL(start time.Time, errCode string, sql util.Stripped, args ...interface{}) {
+// ObserveSQL records the outcome and duration of a SQL statement of the given
+// kind. Slow statements are logged by the caller, which knows more about them.
+func ObserveSQL(duration time.Duration, errCode, kind string) {
 	SQLTotal.WithLabelValues(errCode).Inc()
-	duration := time.Since(start)
 	SQLTime.WithLabelValues(errCode).Observe(duration.Seconds())
-	if SlowSQLThreshold > 0 && duration >= SlowSQLThreshold {
-		logrus.Infof("Slow SQL (started: %v) (total time: %v): %s : %v", start, duration, sql, args)
-	}
+	SQLStatementTime.WithLabelValues(kind).Observe(duration.Seconds())
 }
@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 
+	"github.com/k3s-io/kine/pkg/health"
 	"github.com/k3s-io/kine/pkg/tls"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
@@ -15,11 +16,21 @@ type Config struct {
 	ServerTLSConfig tls.Config
 }
 
+// MetricsPath is the path metrics are served at.
+const MetricsPath = "/metrics"
+
 const (
 	defaultBindAddress = ":8080"
-	metricsPath        = "/metrics"
+	metricsPath        = MetricsPath
 )
 
+// Handler returns a handler that serves the metrics in the registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.HTTPErrorOnError,
+	})
+}
+
 func Serve(ctx context.Context, config Config) {
 	if config.ServerAddress == "" {
 		config.ServerAddress = defaultBindAddress
@@ -34,11 +45,9 @@ func Serve(ctx context.Context, config Config) {
 		logrus.Fatalf("error creating the metrics listener: %v", err)
 	}
 
-	handler := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{
-		ErrorHandling: promhttp.HTTPErrorOnError,
-	})
 	mux := http.NewServeMux()
-	mux.Handle(metricsPath, handler)
+	mux.Handle(metricsPath, Handler())
+	mux.HandleFunc(health.ReadyzPath, health.ServeReadyz)
 	server := http.Server{
 		Handler: mux,
 	}
@@ -46,8 +55,10 @@ func Serve(ctx context.Context, config Config) {
 	go func() {
 		logrus.Infof("starting metrics server path %s", metricsPath)
 		var err error
-		if config.ServerTLSConfig.CertFile != "" && config.ServerTLSConfig.KeyFile != "" {
-			err = server.ServeTLS(listener, config.ServerTLSConfig.CertFile, config.ServerTLSConfig.KeyFile)
+		if config.ServerTLSConfig.HasKeyPair() {
+			if server.TLSConfig, err = config.ServerTLSConfig.ServerConfig(); err == nil {
+				err = server.ServeTLS(listener, "", "")
+			}
 		} else {
 			err = server.Serve(listener)
 		}
@@ -0,0 +1,244 @@
+// Package priority admits backend requests in priority order when the number of
+// requests in flight reaches a limit, so that requests the control plane needs
+// to stay live, such as lease renewals, are not starved by bulk lists and event
+// writes while the datastore is saturated.
+package priority
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// Class is the priority class of a request. Lower classes are admitted first.
+type Class int
+
+const (
+	Critical Class = iota
+	Normal
+	Bulk
+	numClasses
+)
+
+func (c Class) String() string {
+	switch c {
+	case Critical:
+		return "critical"
+	case Bulk:
+		return "bulk"
+	default:
+		return "normal"
+	}
+}
+
+var (
+	// DefaultCriticalPrefixes are the prefixes of node and control plane leases,
+	// and of the apiserver health check key.
+	DefaultCriticalPrefixes = []string{"/registry/leases/", "/registry/masterleases/", "/registry/health"}
+	// DefaultBulkPrefixes are the prefixes of Kubernetes events.
+	DefaultBulkPrefixes = []string{"/registry/events/"}
+)
+
+// explicit interface check
+var _ server.Backend = (*Backend)(nil)
+
+type Config struct {
+	// MaxInFlight is the number of requests that may be in flight before
+	// requests are queued by priority. Zero disables prioritization.
+	MaxInFlight int
+	// CriticalPrefixes are the key prefixes of requests admitted first.
+	CriticalPrefixes []string
+	// BulkPrefixes are the key prefixes of writes admitted last, along with
+	// lists and counts that are not under a critical prefix.
+	BulkPrefixes []string
+}
+
+// Enabled returns true if prioritization is configured.
+func (c Config) Enabled() bool {
+	return c.MaxInFlight > 0
+}
+
+// Backend wraps another backend, limiting the requests in flight and admitting
+// queued requests by priority class, then in the order they arrived. Watches
+// are not limited.
+type Backend struct {
+	server.Backend
+	config Config
+
+	lock     sync.Mutex
+	inFlight int
+	queues   [numClasses][]chan struct{}
+}
+
+// Wrap returns a backend that admits requests by priority.
+func Wrap(backend server.Backend, config Config) *Backend {
+	if config.CriticalPrefixes == nil {
+		config.CriticalPrefixes = DefaultCriticalPrefixes
+	}
+	if config.BulkPrefixes == nil {
+		config.BulkPrefixes = DefaultBulkPrefixes
+	}
+	return &Backend{
+		Backend: backend,
+		config:  config,
+	}
+}
+
+// Unwrap returns the backend that requests are forwarded to.
+func (b *Backend) Unwrap() server.Backend {
+	return b.Backend
+}
+
+// classify returns the class of a request for a key; bulk is true for requests
+// that read many keys.
+func (b *Backend) classify(key string, bulk bool) Class {
+	for _, prefix := range b.config.CriticalPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return Critical
+		}
+	}
+	if bulk {
+		return Bulk
+	}
+	for _, prefix := range b.config.BulkPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return Bulk
+		}
+	}
+	return Normal
+}
+
+// admit waits until a request of a class may proceed, and returns a function
+// that must be called when it is done.
+func (b *Backend) admit(ctx context.Context, class Class) (func(), error) {
+	b.lock.Lock()
+	if b.inFlight < b.config.MaxInFlight {
+		b.inFlight++
+		b.lock.Unlock()
+		return b.release, nil
+	}
+	ready := make(chan struct{})
+	b.queues[class] = append(b.queues[class], ready)
+	metrics.PriorityQueueDepth.WithLabelValues(class.String()).Inc()
+	b.lock.Unlock()
+
+	start := time.Now()
+	defer func() {
+		metrics.PriorityWaitSeconds.WithLabelValues(class.String()).Observe(time.Since(start).Seconds())
+	}()
+	select {
+	case <-ready:
+		return b.release, nil
+	case <-ctx.Done():
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		select {
+		case <-ready:
+			// admitted while giving up, so pass the slot on
+			b.releaseLocked()
+		default:
+			b.remove(class, ready)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (b *Backend) remove(class Class, ready chan struct{}) {
+	q := b.queues[class]
+	for i, c := range q {
+		if c == ready {
+			b.queues[class] = append(q[:i], q[i+1:]...)
+			metrics.PriorityQueueDepth.WithLabelValues(class.String()).Dec()
+			return
+		}
+	}
+}
+
+func (b *Backend) release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.releaseLocked()
+}
+
+// releaseLocked hands the slot of a finished request to the first queued
+// request of the highest priority class, if any.
+func (b *Backend) releaseLocked() {
+	for class := Critical; class < numClasses; class++ {
+		if q := b.queues[class]; len(q) > 0 {
+			b.queues[class] = q[1:]
+			metrics.PriorityQueueDepth.WithLabelValues(class.String()).Dec()
+			close(q[0])
+			return
+		}
+	}
+	b.inFlight--
+}
+
+func (b *Backend) Get(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, error) {
+	done, err := b.admit(ctx, b.classify(key, false))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer done()
+	return b.Backend.Get(ctx, key, revision)
+}
+
+func (b *Backend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	done, err := b.admit(ctx, b.classify(key, false))
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return b.Backend.Create(ctx, key, value, lease)
+}
+
+func (b *Backend) Delete(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, bool, error) {
+	done, err := b.admit(ctx, b.classify(key, false))
+	if err != nil {
+		return 0, nil, false, err
+	}
+	defer done()
+	return b.Backend.Delete(ctx, key, revision)
+}
+
+func (b *Backend) List(ctx context.Context, prefix, startKey string, limit, revision int64) (int64, []*server.KeyValue, error) {
+	done, err := b.admit(ctx, b.classify(prefix, true))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer done()
+	return b.Backend.List(ctx, prefix, startKey, limit, revision)
+}
+
+// ListStream admits a list as List does, and streams it from the wrapped
+// backend if it can.
+func (b *Backend) ListStream(ctx context.Context, prefix, startKey string, limit, revision int64, fn func(kvs []*server.KeyValue) error) (int64, error) {
+	done, err := b.admit(ctx, b.classify(prefix, true))
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return server.ListStream(ctx, b.Backend, prefix, startKey, limit, revision, fn)
+}
+
+func (b *Backend) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	done, err := b.admit(ctx, b.classify(prefix, true))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer done()
+	return b.Backend.Count(ctx, prefix)
+}
+
+func (b *Backend) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *server.KeyValue, bool, error) {
+	done, err := b.admit(ctx, b.classify(key, false))
+	if err != nil {
+		return 0, nil, false, err
+	}
+	defer done()
+	return b.Backend.Update(ctx, key, value, revision, lease)
+}
@@ -0,0 +1,165 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"golang.org/x/time/rate"
+)
+
+const (
+	DefaultEventPrefix = "/registry/events/"
+
+	ReasonRateLimited = "rate_limited"
+	ReasonCoalesced   = "coalesced"
+
+	idleTimeout = 5 * time.Minute
+)
+
+// ErrTooManyRequests is returned for dropped writes. The apiserver reports it to
+// clients as a retryable 429 error.
+var ErrTooManyRequests = rpctypes.ErrGRPCTooManyRequests
+
+// explicit interface check
+var _ server.Backend = (*Backend)(nil)
+
+type Config struct {
+	// Prefix is the prefix of the event keys to limit.
+	Prefix string
+	// QPS and Burst limit the rate of event creation per source object. Zero
+	// QPS disables the limit.
+	QPS   float64
+	Burst int
+	// CoalesceInterval is the minimum time between updates to the same event,
+	// which are made as duplicate events are aggregated. Updates within the
+	// interval are dropped, and the recorder includes the count in a later
+	// update. Zero disables coalescing.
+	CoalesceInterval time.Duration
+}
+
+// Enabled returns true if any limit is configured.
+func (c Config) Enabled() bool {
+	return c.QPS > 0 || c.CoalesceInterval > 0
+}
+
+// Backend wraps another backend, dropping writes of events that exceed the
+// configured limits, to protect the datastore during event storms. Dropped
+// events are counted in the kine_event_writes_dropped_total metric.
+type Backend struct {
+	server.Backend
+	config Config
+
+	lock     sync.Mutex
+	sources  map[string]*source
+	coalesce map[string]time.Time
+}
+
+type source struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Wrap returns a backend that limits event writes. Idle limiter state is
+// cleaned up in the background until the context is cancelled.
+func Wrap(ctx context.Context, backend server.Backend, config Config) *Backend {
+	if config.Prefix == "" {
+		config.Prefix = DefaultEventPrefix
+	}
+	if config.Burst <= 0 {
+		config.Burst = 1
+	}
+	b := &Backend{
+		Backend:  backend,
+		config:   config,
+		sources:  map[string]*source{},
+		coalesce: map[string]time.Time{},
+	}
+	go b.cleanup(ctx)
+	return b
+}
+
+// Unwrap returns the backend that writes are forwarded to.
+func (b *Backend) Unwrap() server.Backend {
+	return b.Backend
+}
+
+func (b *Backend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	if b.config.QPS > 0 && strings.HasPrefix(key, b.config.Prefix) && !b.allowCreate(key) {
+		metrics.EventWritesDroppedTotal.WithLabelValues(ReasonRateLimited).Inc()
+		return 0, ErrTooManyRequests
+	}
+	return b.Backend.Create(ctx, key, value, lease)
+}
+
+func (b *Backend) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *server.KeyValue, bool, error) {
+	if b.config.CoalesceInterval > 0 && strings.HasPrefix(key, b.config.Prefix) && !b.allowUpdate(key) {
+		metrics.EventWritesDroppedTotal.WithLabelValues(ReasonCoalesced).Inc()
+		return 0, nil, false, ErrTooManyRequests
+	}
+	return b.Backend.Update(ctx, key, value, revision, lease)
+}
+
+func (b *Backend) allowCreate(key string) bool {
+	name := sourceOf(strings.TrimPrefix(key, b.config.Prefix))
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, ok := b.sources[name]
+	if !ok {
+		s = &source{limiter: rate.NewLimiter(rate.Limit(b.config.QPS), b.config.Burst)}
+		b.sources[name] = s
+	}
+	s.lastSeen = time.Now()
+	return s.limiter.Allow()
+}
+
+func (b *Backend) allowUpdate(key string) bool {
+	now := time.Now()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if last, ok := b.coalesce[key]; ok && now.Sub(last) < b.config.CoalesceInterval {
+		return false
+	}
+	b.coalesce[key] = now
+	return true
+}
+
+// sourceOf returns the object that an event is about, from the event key
+// relative to the prefix. Event names are generated as <object-name>.<suffix>,
+// so all events for an object in a namespace share a source.
+func sourceOf(key string) string {
+	if i := strings.LastIndex(key, "."); i > strings.LastIndex(key, "/") {
+		return key[:i]
+	}
+	return key
+}
+
+func (b *Backend) cleanup(ctx context.Context) {
+	t := time.NewTicker(idleTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			b.lock.Lock()
+			for name, s := range b.sources {
+				if now.Sub(s.lastSeen) > idleTimeout {
+					delete(b.sources, name)
+				}
+			}
+			for key, last := range b.coalesce {
+				if now.Sub(last) > b.config.CoalesceInterval {
+					delete(b.coalesce, key)
+				}
+			}
+			b.lock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Package restore rolls the keyspace back to its state at an earlier revision.
+// History is never truncated, as clients rely on revisions only increasing;
+// instead, each key that changed since the target revision is written again
+// with its value at that revision, so that watchers observe the rollback as
+// ordinary changes.
+package restore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// Change is a write needed to restore a key to its value at the target revision.
+type Change struct {
+	Action string
+	Key    string
+	// Current is the key as it is now, if it exists.
+	Current *server.KeyValue
+	// Target is the key as it was at the target revision, if it existed.
+	Target *server.KeyValue
+}
+
+func (c Change) String() string {
+	switch c.Action {
+	case ActionCreate:
+		return fmt.Sprintf("create %s from revision %d", c.Key, c.Target.ModRevision)
+	case ActionDelete:
+		return fmt.Sprintf("delete %s at revision %d", c.Key, c.Current.ModRevision)
+	default:
+		return fmt.Sprintf("update %s at revision %d to its value from revision %d", c.Key, c.Current.ModRevision, c.Target.ModRevision)
+	}
+}
+
+// Plan is the set of writes that restores the keys with a prefix to a revision.
+type Plan struct {
+	Prefix   string
+	Revision int64
+	// CurrentRevision is the revision the plan was computed at.
+	CurrentRevision int64
+	Changes         []Change
+}
+
+// NewPlan compares the keys with the prefix at revision to their current
+// values. It returns server.ErrCompacted if the revision has been compacted.
+func NewPlan(ctx context.Context, backend server.Backend, revision int64, prefix string) (*Plan, error) {
+	currentRev, current, err := backend.List(ctx, prefix, "", 0, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing current keys")
+	}
+	if revision <= 0 || revision > currentRev {
+		return nil, fmt.Errorf("revision %d is not between 1 and the current revision %d", revision, currentRev)
+	}
+	_, target, err := backend.List(ctx, prefix, "", 0, revision)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing keys at revision %d", revision)
+	}
+
+	plan := &Plan{
+		Prefix:          prefix,
+		Revision:        revision,
+		CurrentRevision: currentRev,
+	}
+	targets := map[string]*server.KeyValue{}
+	for _, kv := range target {
+		targets[kv.Key] = kv
+	}
+	for _, kv := range current {
+		t, ok := targets[kv.Key]
+		delete(targets, kv.Key)
+		switch {
+		case !ok:
+			plan.Changes = append(plan.Changes, Change{Action: ActionDelete, Key: kv.Key, Current: kv})
+		case t.ModRevision != kv.ModRevision:
+			plan.Changes = append(plan.Changes, Change{Action: ActionUpdate, Key: kv.Key, Current: kv, Target: t})
+		}
+	}
+	for key, t := range targets {
+		plan.Changes = append(plan.Changes, Change{Action: ActionCreate, Key: key, Target: t})
+	}
+	sort.Slice(plan.Changes, func(i, j int) bool {
+		return plan.Changes[i].Key < plan.Changes[j].Key
+	})
+	return plan, nil
+}
+
+// Result counts the changes applied from a plan.
+type Result struct {
+	Applied int
+	// Conflicts are changes that were not applied, as the key was written
+	// after the plan was computed.
+	Conflicts []Change
+}
+
+// Apply writes the changes in the plan. A key that has been written since the
+// plan was computed is left as it is, and returned as a conflict.
+func (p *Plan) Apply(ctx context.Context, backend server.Backend) (*Result, error) {
+	result := &Result{}
+	for _, c := range p.Changes {
+		var (
+			ok  bool
+			err error
+		)
+		switch c.Action {
+		case ActionCreate:
+			_, err = backend.Create(ctx, c.Key, c.Target.Value, c.Target.Lease)
+			if err == server.ErrKeyExists {
+				ok, err = false, nil
+			} else {
+				ok = err == nil
+			}
+		case ActionUpdate:
+			_, _, ok, err = backend.Update(ctx, c.Key, c.Target.Value, c.Current.ModRevision, c.Target.Lease)
+		case ActionDelete:
+			_, _, ok, err = backend.Delete(ctx, c.Key, c.Current.ModRevision)
+		}
+		if err != nil {
+			return result, errors.Wrapf(err, "failed to %s", c)
+		}
+		if !ok {
+			logrus.Warnf("Not restoring %s, as it was written after the restore was planned", c.Key)
+			result.Conflicts = append(result.Conflicts, c)
+			continue
+		}
+		result.Applied++
+	}
+	return result, nil
+}
@@ -0,0 +1,302 @@
+// Package scaffold generates the skeleton of a new SQL driver, so that new
+// backends start from the generic dialect rather than a copy of an existing
+// driver and its database-specific SQL.
+package scaffold
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+var validName = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+type driver struct {
+	Name string
+	Env  string
+}
+
+type file struct {
+	path     string
+	template *template.Template
+}
+
+var funcs = template.FuncMap{
+	// bt returns a backtick, which cannot appear in the raw strings holding the templates
+	"bt": func() string { return "`" },
+}
+
+// Driver generates a driver package named name under root, which must be the
+// root of the kine source tree, and registers it with the endpoint for URLs
+// with name as the scheme. It returns the paths of the files created. Existing
+// files are never overwritten.
+func Driver(root, name string) ([]string, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("driver name %q must be lowercase letters and digits, starting with a letter", name)
+	}
+	if _, err := os.Stat(filepath.Join(root, "pkg", "endpoint", "endpoint.go")); err != nil {
+		return nil, fmt.Errorf("%s is not the root of the kine source tree: %v", root, err)
+	}
+
+	d := driver{
+		Name: name,
+		Env:  "KINE_" + strings.ToUpper(name) + "_TEST_ENDPOINT",
+	}
+	dir := filepath.Join(root, "pkg", "drivers", name)
+	files := []file{
+		{filepath.Join(dir, name+".go"), driverTemplate},
+		{filepath.Join(dir, "schema.go"), schemaTemplate},
+		{filepath.Join(dir, "noddl.go"), noDDLTemplate},
+		{filepath.Join(dir, name+"_test.go"), testTemplate},
+		{filepath.Join(root, "pkg", "endpoint", "driver_"+name+".go"), endpointTemplate},
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f.path); err == nil {
+			return nil, fmt.Errorf("%s already exists", f.path)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var created []string
+	for _, f := range files {
+		var buf bytes.Buffer
+		if err := f.template.Execute(&buf, d); err != nil {
+			return created, err
+		}
+		src, err := format.Source(buf.Bytes())
+		if err != nil {
+			return created, fmt.Errorf("formatting %s: %v", f.path, err)
+		}
+		if err := os.WriteFile(f.path, src, 0644); err != nil {
+			return created, err
+		}
+		created = append(created, f.path)
+	}
+	return created, nil
+}
+
+var driverTemplate = template.Must(template.New("driver").Funcs(funcs).Parse(`package {{.Name}}
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TODO: import the database/sql driver, and set the name it registers.
+const driverName = "{{.Name}}"
+
+func New(ctx context.Context, dataSourceName string, connPoolConfig generic.ConnectionPoolConfig, config generic.Config, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
+	if !config.SkipDDL() {
+		if err := createDBIfNotExist(dataSourceName); err != nil {
+			return nil, err
+		}
+	}
+
+	// TODO: set the placeholder style of the driver, for example "$" and true
+	// for numbered placeholders such as $1.
+	dialect, err := generic.Open(ctx, driverName, dataSourceName, connPoolConfig, "?", false, metricsRegisterer)
+	if err != nil {
+		return nil, err
+	}
+	dialect.ApplyConfig(config)
+
+	// The generic dialect uses portable SQL. Override only the statements that
+	// the database does not support, for example:
+	//
+	//	dialect.LastInsertID = true // if INSERT ... RETURNING is not supported
+	//	dialect.CompactSQL = {{bt}}DELETE ...{{bt}}
+	//	dialect.PostCompactSQL = {{bt}}VACUUM ...{{bt}}
+	//	dialect.ExplainSQL = "EXPLAIN "
+	//
+	// TODO: set GetSizeSQL to report the size of the kine table.
+	dialect.TranslateErr = func(err error) error {
+		// TODO: return server.ErrKeyExists for unique constraint violations
+		return err
+	}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		// TODO: return the database error code, for the SQL error metrics
+		return err.Error()
+	}
+
+	if config.SkipDDL() {
+		if config.DryRun {
+			// setup only logs the schema migrations that would be applied
+			if err := setup(dialect.DB, config); err != nil && err != generic.ErrDDLDisabled {
+				dialect.Close()
+				return nil, err
+			}
+		}
+		if err := dialect.CheckSchema(ctx); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	} else {
+		if err := setup(dialect.DB, config); err != nil {
+			dialect.Close()
+			return nil, err
+		}
+	}
+	return logstructured.New(sqllog.New(dialect)), nil
+}
+`))
+
+var schemaTemplate = template.Must(template.New("schema").Funcs(funcs).Parse(`//go:build !noddl
+// +build !noddl
+
+package {{.Name}}
+
+import (
+	"database/sql"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/sirupsen/logrus"
+)
+
+// migrations are applied in order to create and then change the kine table.
+// Changes are made by adding a migration with the next version; migrations
+// that have been released must not be changed.
+var migrations = []generic.Migration{
+	{
+		Version:     1,
+		Description: "create the kine table and its indexes",
+		Statements:  schema,
+	},
+}
+
+// TODO: adjust the column types to the database. The name column must use a
+// binary collation, so that keys differing only in case are distinct.
+var schema = []string{
+	{{bt}}CREATE TABLE IF NOT EXISTS kine
+		(
+			id INTEGER PRIMARY KEY,
+			name VARCHAR(630),
+			created INTEGER,
+			deleted INTEGER,
+			create_revision INTEGER,
+			prev_revision INTEGER,
+			lease INTEGER,
+			value BLOB,
+			old_value BLOB
+		){{bt}},
+	{{bt}}CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name){{bt}},
+	{{bt}}CREATE INDEX IF NOT EXISTS kine_name_id_index ON kine (name,id){{bt}},
+	{{bt}}CREATE INDEX IF NOT EXISTS kine_id_deleted_index ON kine (id,deleted){{bt}},
+	{{bt}}CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision){{bt}},
+	{{bt}}CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision){{bt}},
+}
+
+func setup(db *sql.DB, config generic.Config) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	table, err := config.Table()
+	if err != nil {
+		return err
+	}
+	migrator := &generic.Migrator{
+		DB:         db,
+		Table:      table,
+		Migrations: migrations,
+		DryRun:     config.DryRun,
+	}
+	if err := migrator.Run(); err != nil || config.DryRun {
+		return err
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+func createDBIfNotExist(dataSourceName string) error {
+	// TODO: create the database named in the data source, if the database
+	// server supports more than one.
+	return nil
+}
+`))
+
+var noDDLTemplate = template.Must(template.New("noddl").Parse(`//go:build noddl
+// +build noddl
+
+package {{.Name}}
+
+import (
+	"database/sql"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+func setup(db *sql.DB, config generic.Config) error {
+	return generic.ErrDDLDisabled
+}
+
+func createDBIfNotExist(dataSourceName string) error {
+	return generic.ErrDDLDisabled
+}
+`))
+
+var testTemplate = template.Must(template.New("test").Parse(`package {{.Name}}
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/drivers/testsuite"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// TestConformance runs the backend conformance tests against the datastore
+// given by {{.Env}}.
+func TestConformance(t *testing.T) {
+	dsn := os.Getenv("{{.Env}}")
+	if dsn == "" {
+		t.Skip("{{.Env}} is not set")
+	}
+
+	testsuite.Run(t, func(t *testing.T) server.Backend {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		backend, err := New(ctx, dsn, generic.ConnectionPoolConfig{}, generic.Config{}, nil)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		if err := backend.Start(ctx); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		return backend
+	})
+}
+`))
+
+var endpointTemplate = template.Must(template.New("endpoint").Parse(`package endpoint
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/drivers/{{.Name}}"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func init() {
+	RegisterBackend("{{.Name}}", func(ctx context.Context, dsn string, cfg Config) (bool, server.Backend, error) {
+		backend, err := {{.Name}}.New(ctx, dsn, cfg.ConnectionPoolConfig, cfg.DialectConfig, cfg.MetricsRegisterer)
+		return true, backend, err
+	})
+}
+`))
@@ -0,0 +1,19 @@
+package server
+
+import "context"
+
+type serializableKey struct{}
+
+// WithSerializable returns a context that marks a read as serializable. As in etcd,
+// a serializable read may be served from state that lags behind the most recent
+// write, such as a cache or read replica. Reads without this mark are linearizable,
+// and backends must serve them from the primary datastore.
+func WithSerializable(ctx context.Context) context.Context {
+	return context.WithValue(ctx, serializableKey{}, true)
+}
+
+// IsSerializable returns true if the context is for a read that may be served from stale state.
+func IsSerializable(ctx context.Context) bool {
+	serializable, _ := ctx.Value(serializableKey{}).(bool)
+	return serializable
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultEtcdVersion                 = "3.5.0"
+	DefaultWatchProgressNotifyInterval = 10 * time.Minute
+
+	// FeatureWatchProgressNotify enables periodic progress notifications for watches
+	// that request them, which the apiserver uses as watch bookmarks.
+	FeatureWatchProgressNotify = "WatchProgressNotify"
+	// FeatureWatchProgressRequest enables responses to on-demand watch progress
+	// requests, which newer apiservers use to serve consistent reads from cache.
+	FeatureWatchProgressRequest = "WatchProgressRequest"
+)
+
+// Features controls the etcd version that kine advertises to clients, and
+// optional behaviors that clients only expect from some etcd versions.
+type Features struct {
+	EtcdVersion                 string
+	ClusterVersion              string
+	WatchProgressNotify         bool
+	WatchProgressNotifyInterval time.Duration
+	WatchProgressRequest        bool
+}
+
+// ParseFeatureGates enables or disables features from a comma-separated list of
+// Name=bool pairs, such as "WatchProgressNotify=true,WatchProgressRequest=false".
+func (f *Features) ParseFeatureGates(gates string) error {
+	for _, gate := range strings.Split(gates, ",") {
+		gate = strings.TrimSpace(gate)
+		if gate == "" {
+			continue
+		}
+		parts := strings.SplitN(gate, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid feature gate %q, expected Name=bool", gate)
+		}
+		enabled, err := strconv.ParseBool(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid value for feature gate %s: %v", parts[0], err)
+		}
+		switch parts[0] {
+		case FeatureWatchProgressNotify:
+			f.WatchProgressNotify = enabled
+		case FeatureWatchProgressRequest:
+			f.WatchProgressRequest = enabled
+		default:
+			return fmt.Errorf("unknown feature gate %s", parts[0])
+		}
+	}
+	return nil
+}
+
+// Versions returns the advertised etcd server and cluster versions, with defaults applied.
+func (f Features) Versions() (string, string) {
+	version := f.EtcdVersion
+	if version == "" {
+		version = DefaultEtcdVersion
+	}
+	clusterVersion := f.ClusterVersion
+	if clusterVersion == "" {
+		clusterVersion = version
+	}
+	return version, clusterVersion
+}
+
+func (f Features) progressNotifyInterval() time.Duration {
+	if f.WatchProgressNotifyInterval <= 0 {
+		return DefaultWatchProgressNotifyInterval
+	}
+	return f.WatchProgressNotifyInterval
+}
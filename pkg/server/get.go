@@ -21,7 +21,7 @@ func (l *LimitedServer) get(ctx context.Context, r *etcdserverpb.RangeRequest) (
 		Header: txnHeader(rev),
 	}
 	if kv != nil {
-		resp.Kvs = []*KeyValue{kv}
+		resp.Kvs = toKVs(kv)
 	}
 	return resp, nil
 }
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	kvService          = "etcdserverpb.KV"
+	watchService       = "etcdserverpb.Watch"
+	leaseService       = "etcdserverpb.Lease"
+	maintenanceService = "etcdserverpb.Maintenance"
+
+	healthCheckInterval = 5 * time.Second
+	healthCheckTimeout  = 5 * time.Second
+	// watchStallTimeout is how long watchers may go without receiving a revision
+	// that has been written before the Watch service is reported as not serving.
+	watchStallTimeout = 30 * time.Second
+)
+
+// watchProgress is implemented by backends that track the last revision
+// delivered to watchers.
+type watchProgress interface {
+	WatchRevision() int64
+}
+
+// watchRevisionOf returns the last revision delivered to watchers by a backend,
+// unwrapping backends that wrap another.
+func watchRevisionOf(b Backend) (int64, bool) {
+	for {
+		if w, ok := b.(watchProgress); ok {
+			return w.WatchRevision(), true
+		}
+		u, ok := b.(interface{ Unwrap() Backend })
+		if !ok {
+			return 0, false
+		}
+		b = u.Unwrap()
+	}
+}
+
+// healthMonitor sets the gRPC health status of each etcd service from the
+// connectivity of the backend and the progress of watches.
+type healthMonitor struct {
+	backend Backend
+	hsrv    *health.Server
+
+	statuses     map[string]healthpb.HealthCheckResponse_ServingStatus
+	watchRev     int64
+	watchStalled time.Time
+}
+
+func newHealthMonitor(backend Backend, hsrv *health.Server) *healthMonitor {
+	h := &healthMonitor{
+		backend:  backend,
+		hsrv:     hsrv,
+		statuses: map[string]healthpb.HealthCheckResponse_ServingStatus{},
+	}
+	for _, service := range []string{"", kvService, watchService, leaseService, maintenanceService} {
+		h.set(service, healthpb.HealthCheckResponse_SERVING)
+	}
+	return h
+}
+
+// run checks the backend every interval until the context is cancelled, after
+// which all services are reported as not serving.
+func (h *healthMonitor) run(ctx context.Context) {
+	t := time.NewTicker(healthCheckInterval)
+	defer t.Stop()
+	for {
+		h.check(ctx)
+		select {
+		case <-ctx.Done():
+			h.hsrv.Shutdown()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (h *healthMonitor) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	currentRev, _, kvErr := h.backend.Get(ctx, "health", 0)
+	if kvErr != nil && ctx.Err() == nil {
+		logrus.Warnf("Health check failed to read from backend: %v", kvErr)
+	}
+	_, sizeErr := h.backend.DbSize(ctx)
+
+	kv := servingStatus(kvErr == nil)
+	watch := servingStatus(kvErr == nil && !h.watchStalledAt(currentRev))
+	h.set(kvService, kv)
+	h.set(leaseService, kv)
+	h.set(watchService, watch)
+	h.set(maintenanceService, servingStatus(sizeErr == nil))
+	h.set("", servingStatus(kv == healthpb.HealthCheckResponse_SERVING && watch == healthpb.HealthCheckResponse_SERVING))
+}
+
+// watchStalledAt returns true if watchers have not been delivered a revision
+// for longer than watchStallTimeout, while later revisions are available.
+func (h *healthMonitor) watchStalledAt(currentRev int64) bool {
+	watchRev, ok := watchRevisionOf(h.backend)
+	if !ok || watchRev == 0 || currentRev == 0 {
+		return false
+	}
+	if watchRev >= currentRev || watchRev != h.watchRev {
+		h.watchRev = watchRev
+		h.watchStalled = time.Time{}
+		return false
+	}
+	if h.watchStalled.IsZero() {
+		h.watchStalled = time.Now()
+	}
+	return time.Since(h.watchStalled) > watchStallTimeout
+}
+
+func (h *healthMonitor) set(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	if prev, ok := h.statuses[service]; ok && prev != status {
+		name := service
+		if name == "" {
+			name = "server"
+		}
+		logrus.Infof("gRPC health status of %s changed from %s to %s", name, prev, status)
+	}
+	h.statuses[service] = status
+	h.hsrv.SetServingStatus(service, status)
+}
+
+func servingStatus(ok bool) healthpb.HealthCheckResponse_ServingStatus {
+	if ok {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/sirupsen/logrus"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/mvccpb"
@@ -29,10 +30,6 @@ func (k *KVServerBridge) Range(ctx context.Context, r *etcdserverpb.RangeRequest
 		return nil, unsupported("sortTarget")
 	}
 
-	if r.Serializable {
-		return nil, unsupported("serializable")
-	}
-
 	if r.KeysOnly {
 		return nil, unsupported("keysOnly")
 	}
@@ -53,6 +50,13 @@ func (k *KVServerBridge) Range(ctx context.Context, r *etcdserverpb.RangeRequest
 		return nil, unsupported("maxModRevision")
 	}
 
+	consistency := metrics.ConsistencyLinearizable
+	if r.Serializable {
+		ctx = WithSerializable(ctx)
+		consistency = metrics.ConsistencySerializable
+	}
+	metrics.RangeTotal.WithLabelValues(consistency).Inc()
+
 	resp, err := k.limited.Range(ctx, r)
 	if err != nil {
 		logrus.Errorf("error while range on %s %s: %v", r.Key, r.RangeEnd, err)
@@ -63,7 +67,7 @@ func (k *KVServerBridge) Range(ctx context.Context, r *etcdserverpb.RangeRequest
 		More:   resp.More,
 		Count:  resp.Count,
 		Header: resp.Header,
-		Kvs:    toKVs(resp.Kvs...),
+		Kvs:    resp.Kvs,
 	}
 
 	return rangeResponse, nil
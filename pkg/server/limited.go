@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 )
 
 type LimitedServer struct {
@@ -47,7 +48,7 @@ type ResponseHeader struct {
 
 type RangeResponse struct {
 	Header *etcdserverpb.ResponseHeader
-	Kvs    []*KeyValue
+	Kvs    []*mvccpb.KeyValue
 	More   bool
 	Count  int64
 }
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 )
 
 func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
@@ -15,6 +16,12 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 	}
 
 	prefix := string(append(r.RangeEnd[:len(r.RangeEnd)-1], r.RangeEnd[len(r.RangeEnd)-1]-1))
+	if bytes.Equal(r.RangeEnd, []byte{0}) {
+		// a range over the entire keyspace, as used by mirroring tools, is a
+		// list of the root prefix, as all keys visible through the etcd API start
+		// with a slash
+		prefix = "/"
+	}
 	if !strings.HasSuffix(prefix, "/") {
 		prefix = prefix + "/"
 	}
@@ -36,7 +43,13 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 		limit++
 	}
 
-	rev, kvs, err := l.backend.List(ctx, prefix, start, limit, r.Revision)
+	// keys are converted to the response as each chunk is read, so that the
+	// backend does not hold the whole list in memory alongside the response
+	var kvs []*mvccpb.KeyValue
+	rev, err := ListStream(ctx, l.backend, prefix, start, limit, r.Revision, func(chunk []*KeyValue) error {
+		kvs = append(kvs, toKVs(chunk...)...)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -54,3 +67,32 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 
 	return resp, nil
 }
+
+// ListStreamer is implemented by backends that can pass the keys of a list to
+// a callback in chunks as they are read, rather than returning them all at
+// once. Backends that wrap another and intercept List must implement it too,
+// or lists bypass them.
+type ListStreamer interface {
+	ListStream(ctx context.Context, prefix, startKey string, limit, revision int64, fn func(kvs []*KeyValue) error) (int64, error)
+}
+
+// ListStream lists keys with the first backend that can stream them,
+// unwrapping backends that wrap another, and otherwise lists them all at once
+// and passes them to fn as a single chunk.
+func ListStream(ctx context.Context, backend Backend, prefix, startKey string, limit, revision int64, fn func(kvs []*KeyValue) error) (int64, error) {
+	for b := backend; ; {
+		if s, ok := b.(ListStreamer); ok {
+			return s.ListStream(ctx, prefix, startKey, limit, revision, fn)
+		}
+		u, ok := b.(interface{ Unwrap() Backend })
+		if !ok {
+			break
+		}
+		b = u.Unwrap()
+	}
+	rev, kvs, err := backend.List(ctx, prefix, startKey, limit, revision)
+	if err != nil {
+		return 0, err
+	}
+	return rev, fn(kvs)
+}
@@ -14,15 +14,63 @@ func (s *KVServerBridge) Alarm(context.Context, *etcdserverpb.AlarmRequest) (*et
 	return nil, fmt.Errorf("alarm is not supported")
 }
 
+// ClusterStatus is the state of the cluster of a replicated backend.
+type ClusterStatus struct {
+	// MemberID is the ID of this member, if it is a member of the cluster
+	MemberID uint64
+	// Leader is the ID of the leader, or zero if there is none
+	Leader    uint64
+	RaftIndex uint64
+	RaftTerm  uint64
+	// Errors lists problems with the cluster, such as unreachable members
+	Errors []string
+}
+
+// clusterStatusReporter is implemented by backends that are replicated, to
+// report the state of their cluster.
+type clusterStatusReporter interface {
+	ClusterStatus(ctx context.Context) (*ClusterStatus, error)
+}
+
+// clusterStatusReporterOf returns the cluster status reporter of a backend,
+// unwrapping backends that wrap another.
+func clusterStatusReporterOf(b Backend) (clusterStatusReporter, bool) {
+	for {
+		if r, ok := b.(clusterStatusReporter); ok {
+			return r, true
+		}
+		u, ok := b.(interface{ Unwrap() Backend })
+		if !ok {
+			return nil, false
+		}
+		b = u.Unwrap()
+	}
+}
+
 func (s *KVServerBridge) Status(ctx context.Context, r *etcdserverpb.StatusRequest) (*etcdserverpb.StatusResponse, error) {
 	size, err := s.limited.dbSize(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return &etcdserverpb.StatusResponse{
-		Header: &etcdserverpb.ResponseHeader{},
-		DbSize: size,
-	}, nil
+	version, _ := s.features.Versions()
+	resp := &etcdserverpb.StatusResponse{
+		Header:  &etcdserverpb.ResponseHeader{},
+		Version: version,
+		DbSize:  size,
+	}
+	if reporter, ok := clusterStatusReporterOf(s.limited.backend); ok {
+		status, err := reporter.ClusterStatus(ctx)
+		if err != nil {
+			resp.Errors = []string{err.Error()}
+			return resp, nil
+		}
+		resp.Header.MemberId = status.MemberID
+		resp.Leader = status.Leader
+		resp.RaftIndex = status.RaftIndex
+		resp.RaftTerm = status.RaftTerm
+		resp.Errors = status.Errors
+	}
+	return resp, nil
 }
 
 func (s *KVServerBridge) Defragment(context.Context, *etcdserverpb.DefragmentRequest) (*etcdserverpb.DefragmentResponse, error) {
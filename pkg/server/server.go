@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health"
@@ -8,15 +10,18 @@ import (
 )
 
 type KVServerBridge struct {
-	limited *LimitedServer
+	limited  *LimitedServer
+	features Features
+	health   *healthMonitor
 }
 
-func New(backend Backend, scheme string) *KVServerBridge {
+func New(backend Backend, scheme string, features Features) *KVServerBridge {
 	return &KVServerBridge{
 		limited: &LimitedServer{
 			backend: backend,
 			scheme:  scheme,
 		},
+		features: features,
 	}
 }
 
@@ -28,6 +33,12 @@ func (k *KVServerBridge) Register(server *grpc.Server) {
 	etcdserverpb.RegisterMaintenanceServer(server, k)
 
 	hsrv := health.NewServer()
-	hsrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	k.health = newHealthMonitor(k.limited.backend, hsrv)
 	healthpb.RegisterHealthServer(server, hsrv)
 }
+
+// MonitorHealth updates the gRPC health status of each service from the state of
+// the backend until the context is cancelled. Register must be called first.
+func (k *KVServerBridge) MonitorHealth(ctx context.Context) {
+	go k.health.run(ctx)
+}
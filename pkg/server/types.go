@@ -22,6 +22,9 @@ type Backend interface {
 	Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *KeyValue, bool, error)
 	Watch(ctx context.Context, key string, revision int64) <-chan []*Event
 	DbSize(ctx context.Context) (int64, error)
+	// CompactRevision returns the latest compacted revision. Watches must start
+	// after it, as the events at and before it may have been removed.
+	CompactRevision(ctx context.Context) (int64, error)
 }
 
 type Dialect interface {
@@ -54,6 +57,7 @@ type Transaction interface {
 	GetRevision(ctx context.Context, revision int64) (*sql.Rows, error)
 	DeleteRevision(ctx context.Context, revision int64) error
 	CurrentRevision(ctx context.Context) (int64, error)
+	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error)
 }
 
 type KeyValue struct {
@@ -1,9 +1,12 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
@@ -12,14 +15,30 @@ import (
 
 var watchID int64
 
+const (
+	// progressWatchID is the watch ID used for responses to watch progress requests,
+	// which apply to all watches on the stream rather than a single watch.
+	progressWatchID = -1
+
+	// maxWatchFragmentBytes is the maximum size of the events in a watch response
+	// for watches that allow fragmentation, matching the etcd default request limit.
+	maxWatchFragmentBytes = 1536 * 1024
+)
+
+// ErrDuplicateWatchID is the reason given when a watch is created with an ID that
+// is already in use on the stream, matching etcd.
+var ErrDuplicateWatchID = errors.New("mvcc: duplicate watch ID provided on the WatchStream")
+
 // explicit interface check
 var _ etcdserverpb.WatchServer = (*KVServerBridge)(nil)
 
 func (s *KVServerBridge) Watch(ws etcdserverpb.Watch_WatchServer) error {
 	w := watcher{
-		server:  ws,
-		backend: s.limited.backend,
-		watches: map[int64]func(){},
+		server:   ws,
+		backend:  s.limited.backend,
+		features: s.features,
+		watches:  map[int64]func(){},
+		progress: map[int64]int64{},
 	}
 	defer w.Close()
 
@@ -34,6 +53,9 @@ func (s *KVServerBridge) Watch(ws etcdserverpb.Watch_WatchServer) error {
 		} else if msg.GetCancelRequest() != nil {
 			logrus.Tracef("WATCH CANCEL REQ id=%d", msg.GetCancelRequest().GetWatchId())
 			w.Cancel(msg.GetCancelRequest().WatchId, nil)
+		} else if msg.GetProgressRequest() != nil && w.features.WatchProgressRequest {
+			logrus.Tracef("WATCH PROGRESS REQ")
+			w.Progress()
 		}
 	}
 }
@@ -41,38 +63,110 @@ func (s *KVServerBridge) Watch(ws etcdserverpb.Watch_WatchServer) error {
 type watcher struct {
 	sync.Mutex
 
-	wg      sync.WaitGroup
-	backend Backend
-	server  etcdserverpb.Watch_WatchServer
-	watches map[int64]func()
+	// sendLock serializes responses, as watches on a stream send concurrently
+	sendLock sync.Mutex
+	wg       sync.WaitGroup
+	backend  Backend
+	server   etcdserverpb.Watch_WatchServer
+	features Features
+	watches  map[int64]func()
+	progress map[int64]int64
 }
 
+// Start creates a watch, using the ID requested by the client if set. Clients
+// match created responses to requests in order, so the response is sent before
+// returning.
 func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest) {
 	w.Lock()
-	defer w.Unlock()
+	id := r.WatchId
+	if id > 0 {
+		if _, ok := w.watches[id]; ok {
+			w.Unlock()
+			logrus.Tracef("WATCH DUPLICATE id=%d", id)
+			if err := w.sendResponse(&etcdserverpb.WatchResponse{
+				Header:       &etcdserverpb.ResponseHeader{},
+				Created:      true,
+				Canceled:     true,
+				CancelReason: ErrDuplicateWatchID.Error(),
+				WatchId:      id,
+			}); err != nil {
+				logrus.Errorf("WATCH Failed to send duplicate ID response for watchID %d: %v", id, err)
+			}
+			return
+		}
+	} else {
+		// skip IDs requested by the client for other watches on the stream
+		for {
+			id = atomic.AddInt64(&watchID, 1)
+			if _, ok := w.watches[id]; !ok {
+				break
+			}
+		}
+	}
 
 	ctx, cancel := context.WithCancel(ctx)
-
-	id := atomic.AddInt64(&watchID, 1)
 	w.watches[id] = cancel
 	w.wg.Add(1)
 
-	key := string(r.Key)
+	// until events are sent, the watch is known to be synced up to the revision before the start revision
+	if r.StartRevision > 0 {
+		w.progress[id] = r.StartRevision - 1
+	}
+
+	key := watchKey(r)
 
 	logrus.Tracef("WATCH START id=%d, count=%d, key=%s, revision=%d", id, len(w.watches), key, r.StartRevision)
+	w.Unlock()
+
+	if err := w.sendResponse(&etcdserverpb.WatchResponse{
+		Header:  &etcdserverpb.ResponseHeader{},
+		Created: true,
+		WatchId: id,
+	}); err != nil {
+		w.Cancel(id, err)
+		w.wg.Done()
+		return
+	}
 
 	go func() {
 		defer w.wg.Done()
-		if err := w.server.Send(&etcdserverpb.WatchResponse{
-			Header:  &etcdserverpb.ResponseHeader{},
-			Created: true,
-			WatchId: id,
-		}); err != nil {
-			w.Cancel(id, err)
-			return
+
+		if r.StartRevision > 0 {
+			compactRev, err := w.backend.CompactRevision(ctx)
+			if err != nil {
+				logrus.Errorf("WATCH Failed to get compact revision for watch id=%d: %v", id, err)
+			} else if r.StartRevision <= compactRev {
+				w.Compacted(id, compactRev)
+				return
+			}
+		}
+
+		var notify <-chan time.Time
+		if r.ProgressNotify && w.features.WatchProgressNotify {
+			t := time.NewTicker(w.features.progressNotifyInterval())
+			defer t.Stop()
+			notify = t.C
 		}
 
-		for events := range w.backend.Watch(ctx, key, r.StartRevision) {
+		var sent bool
+		watchCh := w.backend.Watch(ctx, key, r.StartRevision)
+	loop:
+		for {
+			var events []*Event
+			select {
+			case <-notify:
+				// only notify watches that have been idle for the whole interval
+				if !sent {
+					w.notifyProgress(id)
+				}
+				sent = false
+				continue
+			case e, ok := <-watchCh:
+				if !ok {
+					break loop
+				}
+				events = e
+			}
 			if len(events) == 0 {
 				continue
 			}
@@ -83,20 +177,59 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 				}
 			}
 
-			if err := w.server.Send(&etcdserverpb.WatchResponse{
-				Header:  txnHeader(events[len(events)-1].KV.ModRevision),
-				WatchId: id,
-				Events:  toEvents(events...),
-			}); err != nil {
+			if err := w.send(id, toEvents(events...), r.Fragment, events[len(events)-1].KV.ModRevision); err != nil {
 				w.Cancel(id, err)
 				continue
 			}
+			sent = true
+			w.setProgress(id, events[len(events)-1].KV.ModRevision)
 		}
 		w.Cancel(id, nil)
 		logrus.Tracef("WATCH CLOSE id=%d, key=%s", id, key)
 	}()
 }
 
+// watchKey returns the key or prefix to watch. A watch of the entire keyspace,
+// as used by mirroring tools, is a watch of the root prefix, as all keys
+// visible through the etcd API start with a slash.
+func watchKey(r *etcdserverpb.WatchCreateRequest) string {
+	if len(r.Key) == 0 || bytes.Equal(r.RangeEnd, []byte{0}) {
+		return "/"
+	}
+	return string(r.Key)
+}
+
+// send sends events on a watch. If the watch allows fragmentation, responses
+// that would exceed the size limit are split across several, all but the last
+// of which are marked as fragments, so that large batches, such as those sent
+// when resuming a watch from an old revision, can be received by clients with
+// the default message size limit.
+func (w *watcher) send(watchID int64, events []*mvccpb.Event, fragment bool, revision int64) error {
+	for {
+		n := len(events)
+		if fragment {
+			size := 0
+			for i, e := range events {
+				if size += e.Size(); size > maxWatchFragmentBytes && i > 0 {
+					n = i
+					break
+				}
+			}
+		}
+		if err := w.sendResponse(&etcdserverpb.WatchResponse{
+			Header:   txnHeader(revision),
+			WatchId:  watchID,
+			Events:   events[:n],
+			Fragment: n < len(events),
+		}); err != nil {
+			return err
+		}
+		if events = events[n:]; len(events) == 0 {
+			return nil
+		}
+	}
+}
+
 func toEvents(events ...*Event) []*mvccpb.Event {
 	ret := make([]*mvccpb.Event, 0, len(events))
 	for _, e := range events {
@@ -119,20 +252,34 @@ func toEvent(event *Event) *mvccpb.Event {
 	return e
 }
 
+// sendResponse sends a response on the stream.
+func (w *watcher) sendResponse(resp *etcdserverpb.WatchResponse) error {
+	w.sendLock.Lock()
+	defer w.sendLock.Unlock()
+	return w.server.Send(resp)
+}
+
+// Cancel cancels a watch, and sends a canceled response if the watch exists, so
+// that a watch is only reported as canceled once.
 func (w *watcher) Cancel(watchID int64, err error) {
 	w.Lock()
-	if cancel, ok := w.watches[watchID]; ok {
+	cancel, ok := w.watches[watchID]
+	if ok {
 		cancel()
 		delete(w.watches, watchID)
+		delete(w.progress, watchID)
 	}
 	w.Unlock()
+	if !ok {
+		return
+	}
 
 	reason := ""
 	if err != nil {
 		reason = err.Error()
 	}
 	logrus.Tracef("WATCH CANCEL id=%d reason=%s", watchID, reason)
-	serr := w.server.Send(&etcdserverpb.WatchResponse{
+	serr := w.sendResponse(&etcdserverpb.WatchResponse{
 		Header:       &etcdserverpb.ResponseHeader{},
 		Canceled:     true,
 		CancelReason: "watch closed",
@@ -143,6 +290,87 @@ func (w *watcher) Cancel(watchID int64, err error) {
 	}
 }
 
+// Compacted cancels a watch whose start revision has been compacted, reporting
+// the compact revision so that clients can distinguish this from other failures
+// and restart from a more recent revision.
+func (w *watcher) Compacted(watchID, compactRev int64) {
+	w.Lock()
+	cancel, ok := w.watches[watchID]
+	if ok {
+		cancel()
+		delete(w.watches, watchID)
+		delete(w.progress, watchID)
+	}
+	w.Unlock()
+	if !ok {
+		return
+	}
+
+	logrus.Tracef("WATCH COMPACTED id=%d compactRev=%d", watchID, compactRev)
+	if err := w.sendResponse(&etcdserverpb.WatchResponse{
+		Header:          &etcdserverpb.ResponseHeader{},
+		Canceled:        true,
+		CancelReason:    "required revision has been compacted",
+		CompactRevision: compactRev,
+		WatchId:         watchID,
+	}); err != nil {
+		logrus.Errorf("WATCH Failed to send compacted response for watchID %d: %v", watchID, err)
+	}
+}
+
+// setProgress records the revision that a watch has been synced up to.
+func (w *watcher) setProgress(watchID, revision int64) {
+	w.Lock()
+	defer w.Unlock()
+	if _, ok := w.watches[watchID]; ok {
+		w.progress[watchID] = revision
+	}
+}
+
+// notifyProgress sends a progress notification for an idle watch. The revision is
+// that of the last event sent on the watch, so clients may see it lag behind the
+// current revision, but it never claims events that have not yet been sent.
+func (w *watcher) notifyProgress(watchID int64) {
+	w.Lock()
+	revision := w.progress[watchID]
+	w.Unlock()
+	if revision <= 0 {
+		return
+	}
+
+	logrus.Tracef("WATCH PROGRESS id=%d, revision=%d", watchID, revision)
+	if err := w.sendResponse(&etcdserverpb.WatchResponse{
+		Header:  txnHeader(revision),
+		WatchId: watchID,
+	}); err != nil {
+		w.Cancel(watchID, err)
+	}
+}
+
+// Progress responds to a watch progress request with the lowest revision that
+// all watches on the stream have been synced up to.
+func (w *watcher) Progress() {
+	w.Lock()
+	var revision int64
+	for _, rev := range w.progress {
+		if revision == 0 || rev < revision {
+			revision = rev
+		}
+	}
+	w.Unlock()
+	if revision <= 0 {
+		return
+	}
+
+	logrus.Tracef("WATCH PROGRESS revision=%d", revision)
+	if err := w.sendResponse(&etcdserverpb.WatchResponse{
+		Header:  txnHeader(revision),
+		WatchId: progressWatchID,
+	}); err != nil {
+		logrus.Errorf("WATCH Failed to send progress response: %v", err)
+	}
+}
+
 func (w *watcher) Close() {
 	w.Lock()
 	for _, v := range w.watches {
@@ -0,0 +1,422 @@
+// Package servertest provides an in-memory server.Backend and a manually
+// advanced clock, so that applications embedding kine can write deterministic
+// unit tests without a datastore. Lease expiry and compaction are driven by the
+// clock rather than by wall time.
+package servertest
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+var _ server.Backend = (*Backend)(nil)
+
+type Config struct {
+	// CompactInterval is how often history is compacted once the backend is
+	// started. Compaction is disabled if zero; Compact may be called directly.
+	CompactInterval time.Duration
+	// CompactMinRetain is the number of revisions retained by periodic compaction.
+	CompactMinRetain int64
+}
+
+// Backend is an in-memory implementation of the revision, compaction, watch and
+// lease semantics of the SQL backends. It is safe for concurrent use.
+type Backend struct {
+	clock  *Clock
+	config Config
+
+	mu         sync.Mutex
+	rev        int64
+	compactRev int64
+	history    []*server.Event
+	watchers   map[*watcher]struct{}
+}
+
+// NewBackend returns an empty backend using clock for lease expiry and
+// compaction. If clock is nil, a clock set to the current time is used.
+func NewBackend(clock *Clock, config Config) *Backend {
+	if clock == nil {
+		clock = NewClock(time.Now())
+	}
+	return &Backend{
+		clock:    clock,
+		config:   config,
+		watchers: map[*watcher]struct{}{},
+	}
+}
+
+// Clock returns the clock used by the backend.
+func (b *Backend) Clock() *Clock {
+	return b.clock
+}
+
+func (b *Backend) Start(ctx context.Context) error {
+	if b.config.CompactInterval > 0 {
+		b.scheduleCompact(ctx)
+	}
+	return nil
+}
+
+func (b *Backend) scheduleCompact(ctx context.Context) {
+	b.clock.AfterFunc(b.config.CompactInterval, func() {
+		if ctx.Err() != nil {
+			return
+		}
+		b.mu.Lock()
+		target := b.rev - b.config.CompactMinRetain
+		b.mu.Unlock()
+		if target > 0 {
+			b.Compact(target)
+		}
+		b.scheduleCompact(ctx)
+	})
+}
+
+func (b *Backend) Get(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rev := b.rev
+	if revision != 0 {
+		rev = revision
+	}
+	// compaction is ignored when getting by revision, as in the SQL backends
+	event := b.latest(key, rev)
+	if event == nil || event.Delete {
+		return rev, nil, nil
+	}
+	return rev, event.KV, nil
+}
+
+func (b *Backend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	prev := b.latest(key, b.rev)
+	event := &server.Event{
+		Create: true,
+		KV: &server.KeyValue{
+			Key:   key,
+			Value: value,
+			Lease: lease,
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: b.rev,
+		},
+	}
+	if prev != nil {
+		if !prev.Delete {
+			return 0, server.ErrKeyExists
+		}
+		event.PrevKV = prev.KV
+	}
+	return b.append(event), nil
+}
+
+func (b *Backend) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *server.KeyValue, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	prev := b.latest(key, b.rev)
+	if prev == nil || prev.Delete {
+		return 0, nil, false, nil
+	}
+	if prev.KV.ModRevision != revision {
+		return b.rev, prev.KV, false, nil
+	}
+
+	event := &server.Event{
+		KV: &server.KeyValue{
+			Key:            key,
+			CreateRevision: prev.KV.CreateRevision,
+			Value:          value,
+			Lease:          lease,
+		},
+		PrevKV: prev.KV,
+	}
+	rev := b.append(event)
+	return rev, event.KV, true, nil
+}
+
+func (b *Backend) Delete(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.delete(key, revision)
+}
+
+func (b *Backend) delete(key string, revision int64) (int64, *server.KeyValue, bool, error) {
+	prev := b.latest(key, b.rev)
+	if prev == nil {
+		return b.rev, nil, true, nil
+	}
+	if prev.Delete {
+		return b.rev, prev.KV, true, nil
+	}
+	if revision != 0 && prev.KV.ModRevision != revision {
+		return b.rev, prev.KV, false, nil
+	}
+
+	rev := b.append(&server.Event{
+		Delete: true,
+		KV:     prev.KV,
+		PrevKV: prev.KV,
+	})
+	return rev, prev.KV, true, nil
+}
+
+func (b *Backend) List(ctx context.Context, prefix, startKey string, limit, revision int64) (int64, []*server.KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if revision > 0 && revision < b.compactRev {
+		return 0, nil, server.ErrCompacted
+	}
+	rev := b.rev
+	if revision != 0 {
+		rev = revision
+	}
+
+	events := b.current(prefix, rev)
+	// as in the SQL backends, results are ordered by revision, and continue after
+	// the revision of the start key
+	if startKey != "" && startKey != prefix && strings.HasSuffix(prefix, "/") {
+		if start := b.latest(startKey, rev); start != nil {
+			for len(events) > 0 && events[0].KV.ModRevision <= start.KV.ModRevision {
+				events = events[1:]
+			}
+		}
+	}
+	if limit > 0 && int64(len(events)) > limit {
+		events = events[:limit]
+	}
+
+	kvs := make([]*server.KeyValue, 0, len(events))
+	for _, event := range events {
+		kvs = append(kvs, event.KV)
+	}
+	return rev, kvs, nil
+}
+
+func (b *Backend) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rev, int64(len(b.current(prefix, b.rev))), nil
+}
+
+func (b *Backend) Watch(ctx context.Context, prefix string, revision int64) <-chan []*server.Event {
+	w := &watcher{
+		prefix: prefix,
+		ch:     make(chan []*server.Event, 100),
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	b.mu.Lock()
+	var replay []*server.Event
+	if revision > 0 {
+		for _, event := range b.history {
+			if event.KV.ModRevision >= revision && matches(prefix, event.KV.Key) {
+				replay = append(replay, event)
+			}
+		}
+	}
+	if len(replay) > 0 {
+		w.queue = append(w.queue, replay)
+	}
+	b.watchers[w] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.watchers, w)
+		b.mu.Unlock()
+		w.close()
+	}()
+	go w.run(ctx)
+
+	return w.ch
+}
+
+func (b *Backend) DbSize(ctx context.Context) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var size int64
+	for _, event := range b.history {
+		size += int64(len(event.KV.Key) + len(event.KV.Value))
+	}
+	return size, nil
+}
+
+func (b *Backend) CompactRevision(ctx context.Context) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.compactRev, nil
+}
+
+// Compact removes history that is not needed to serve reads at or after
+// revision, and returns the new compact revision.
+func (b *Backend) Compact(revision int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if revision > b.rev {
+		return b.compactRev, rpctypes.ErrGRPCFutureRev
+	}
+	if revision <= b.compactRev {
+		return b.compactRev, nil
+	}
+
+	// keep the latest event at or before the compact revision for each key,
+	// unless it is a delete
+	latest := map[string]*server.Event{}
+	for _, event := range b.history {
+		if event.KV.ModRevision > revision {
+			break
+		}
+		latest[event.KV.Key] = event
+	}
+	history := make([]*server.Event, 0, len(b.history))
+	for _, event := range b.history {
+		if event.KV.ModRevision <= revision && (latest[event.KV.Key] != event || event.Delete) {
+			continue
+		}
+		history = append(history, event)
+	}
+	b.history = history
+	b.compactRev = revision
+	return revision, nil
+}
+
+// append records an event at the next revision, notifies matching watchers, and
+// schedules expiry of the key if it has a lease. It must be called with the
+// lock held.
+func (b *Backend) append(event *server.Event) int64 {
+	b.rev++
+	kv := *event.KV
+	kv.ModRevision = b.rev
+	if event.Create {
+		kv.CreateRevision = b.rev
+	}
+	event.KV = &kv
+	b.history = append(b.history, event)
+
+	for w := range b.watchers {
+		if matches(w.prefix, kv.Key) {
+			w.send([]*server.Event{event})
+		}
+	}
+
+	if !event.Delete && kv.Lease > 0 {
+		key, rev := kv.Key, kv.ModRevision
+		b.clock.AfterFunc(time.Duration(kv.Lease)*time.Second, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.delete(key, rev)
+		})
+	}
+	return b.rev
+}
+
+// latest returns the latest event for key at or before revision, or nil if
+// there is none.
+func (b *Backend) latest(key string, revision int64) *server.Event {
+	for i := len(b.history) - 1; i >= 0; i-- {
+		event := b.history[i]
+		if event.KV.ModRevision <= revision && event.KV.Key == key {
+			return event
+		}
+	}
+	return nil
+}
+
+// current returns the latest event of each key matching prefix at revision,
+// excluding deleted keys, ordered by revision.
+func (b *Backend) current(prefix string, revision int64) []*server.Event {
+	latest := map[string]*server.Event{}
+	for _, event := range b.history {
+		if event.KV.ModRevision > revision {
+			break
+		}
+		if matches(prefix, event.KV.Key) {
+			latest[event.KV.Key] = event
+		}
+	}
+
+	result := make([]*server.Event, 0, len(latest))
+	for _, event := range latest {
+		if !event.Delete {
+			result = append(result, event)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].KV.ModRevision < result[j].KV.ModRevision
+	})
+	return result
+}
+
+// matches returns true if key is within prefix; a prefix ending in a slash
+// matches all keys under it, while any other prefix matches only itself.
+func matches(prefix, key string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(key, prefix)
+	}
+	return key == prefix
+}
+
+// watcher queues events for a watch, so that writes are not blocked by slow
+// readers and events are delivered in revision order.
+type watcher struct {
+	prefix string
+	ch     chan []*server.Event
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]*server.Event
+	closed bool
+}
+
+func (w *watcher) send(events []*server.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.queue = append(w.queue, events)
+		w.cond.Signal()
+	}
+}
+
+func (w *watcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.cond.Signal()
+}
+
+func (w *watcher) run(ctx context.Context) {
+	defer close(w.ch)
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		events := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		select {
+		case w.ch <- events:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package servertest
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a manually advanced clock. Functions scheduled with AfterFunc run
+// synchronously, in order of their due time, from the call to Advance that
+// passes it.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    int64
+	timers []*clockTimer
+}
+
+type clockTimer struct {
+	due time.Time
+	seq int64
+	f   func()
+}
+
+// NewClock returns a clock set to now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc schedules f to run once the clock has been advanced by d. The
+// returned function cancels it, if it has not yet run.
+func (c *Clock) AfterFunc(d time.Duration, f func()) (stop func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &clockTimer{due: c.now.Add(d), seq: c.seq, f: f}
+	c.timers = append(c.timers, t)
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, ct := range c.timers {
+			if ct == t {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Advance moves the clock forward by d, running all functions that become due.
+// Functions may schedule further functions, which also run if they are due
+// before the new time.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		sort.Slice(c.timers, func(i, j int) bool {
+			if c.timers[i].due.Equal(c.timers[j].due) {
+				return c.timers[i].seq < c.timers[j].seq
+			}
+			return c.timers[i].due.Before(c.timers[j].due)
+		})
+		if len(c.timers) == 0 || c.timers[0].due.After(target) {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.due.After(c.now) {
+			c.now = t.due
+		}
+		c.mu.Unlock()
+
+		t.f()
+	}
+}
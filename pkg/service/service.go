@@ -0,0 +1,8 @@
+// Package service integrates kine with the service manager of the host, so that
+// it can run natively as a Windows service.
+package service
+
+import "context"
+
+// RunFunc runs kine until the context is cancelled.
+type RunFunc func(ctx context.Context) error
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package service
+
+// Run returns false, as kine is never run by a Windows service manager on this
+// platform; the caller should run in the foreground.
+func Run(name string, run RunFunc) (bool, error) {
+	return false, nil
+}
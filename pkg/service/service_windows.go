@@ -0,0 +1,105 @@
+//go:build windows
+// +build windows
+
+package service
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// Run runs kine as the named Windows service, if the process was started by
+// the service control manager, and returns true once the service has stopped.
+// Logs are also written to the Windows event log under the service name, if it
+// is registered as an event source. Run returns false if the process was not
+// started as a service.
+func Run(name string, run RunFunc) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+
+	if elog, err := eventlog.Open(name); err != nil {
+		logrus.Warnf("Failed to open event log for %s, logging to stderr only: %v", name, err)
+	} else {
+		defer elog.Close()
+		logrus.AddHook(&eventLogHook{elog: elog})
+	}
+
+	h := &handler{run: run}
+	if err := svc.Run(name, h); err != nil {
+		return true, err
+	}
+	return true, h.err
+}
+
+type handler struct {
+	run RunFunc
+	err error
+}
+
+// Execute implements svc.Handler. It runs kine until it exits or the service
+// control manager requests that it stop.
+func (h *handler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.run(ctx)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil && err != context.Canceled {
+				logrus.Errorf("Service failed: %v", err)
+				h.err = err
+				status <- svc.Status{State: svc.StopPending}
+				return true, 1
+			}
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				logrus.Infof("Stopping on request of the service control manager")
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
+
+// eventLogHook writes log entries to the Windows event log.
+type eventLogHook struct {
+	elog *eventlog.Log
+}
+
+func (h *eventLogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}
+}
+
+func (h *eventLogHook) Fire(entry *logrus.Entry) error {
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return h.elog.Error(1, msg)
+	case logrus.WarnLevel:
+		return h.elog.Warning(1, msg)
+	default:
+		return h.elog.Info(1, msg)
+	}
+}
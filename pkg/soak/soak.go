@@ -0,0 +1,506 @@
+// Package soak runs randomized workloads against a backend for extended periods,
+// continuously verifying the invariants that the apiserver relies on, to qualify
+// new drivers and datastore configurations.
+package soak
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// watchGracePeriod is how long an acknowledged write may take to be
+	// delivered to the watch before it is considered missing.
+	watchGracePeriod = 30 * time.Second
+	reportInterval   = 10 * time.Second
+)
+
+type Config struct {
+	// Prefix is the key prefix used by the workload. Keys under it are created
+	// and deleted, and must not be used by anything else.
+	Prefix string
+	// Duration is how long to run for; zero runs until the context is cancelled.
+	Duration time.Duration
+	// Workers is the number of concurrent writers. Each writer owns its own keys.
+	Workers int
+	// Keys is the number of keys written by each worker.
+	Keys int
+	// Seed seeds the random workload, so that failures can be reproduced.
+	Seed int64
+	// CompactInterval is how often to compact to the revision last seen by the
+	// watch. Compaction is disabled if zero or Compact is not set.
+	CompactInterval time.Duration
+	// Compact compacts the backend to a revision.
+	Compact func(ctx context.Context, revision int64) (int64, error)
+	// ResubscribeInterval is how often to cancel the watch and resume it from
+	// the revision after the last event received.
+	ResubscribeInterval time.Duration
+}
+
+// Stats counts the operations performed by a soak run.
+type Stats struct {
+	Writes        int64
+	Reads         int64
+	Lists         int64
+	Events        int64
+	Compactions   int64
+	Resubscribes  int64
+	LastRevision  int64
+	CompactedTo   int64
+	StaleConflict int64
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("writes=%d reads=%d lists=%d events=%d compactions=%d resubscribes=%d conflicts=%d revision=%d compacted=%d",
+		atomic.LoadInt64(&s.Writes), atomic.LoadInt64(&s.Reads), atomic.LoadInt64(&s.Lists), atomic.LoadInt64(&s.Events),
+		atomic.LoadInt64(&s.Compactions), atomic.LoadInt64(&s.Resubscribes), atomic.LoadInt64(&s.StaleConflict),
+		atomic.LoadInt64(&s.LastRevision), atomic.LoadInt64(&s.CompactedTo))
+}
+
+// Run runs the workload against a started backend until the duration elapses
+// or the context is cancelled, and returns an error describing the first
+// invariant violation found. The invariants are:
+//   - every write returns a revision greater than any previously acknowledged
+//   - reads and lists return exactly the value and revision last written
+//   - the watch delivers every acknowledged write once, in revision order,
+//     across resubscriptions and compactions
+func Run(ctx context.Context, backend server.Backend, config Config) (*Stats, error) {
+	if config.Prefix == "" {
+		config.Prefix = "/soak/"
+	}
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.Keys <= 0 {
+		config.Keys = 1
+	}
+	if config.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Duration)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s := &soak{
+		backend: backend,
+		config:  config,
+		pending: map[int64]pendingWrite{},
+		early:   map[int64]string{},
+		stats:   &Stats{},
+	}
+
+	startRev, _, err := backend.Count(ctx, config.Prefix)
+	if err != nil {
+		return s.stats, errors.Wrap(err, "getting starting revision")
+	}
+	s.watchRev = startRev
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		fail error
+	)
+	failed := func(err error) {
+		once.Do(func() {
+			fail = err
+			cancel()
+		})
+	}
+	start := func(f func(ctx context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(ctx); err != nil && ctx.Err() == nil {
+				failed(err)
+			}
+		}()
+	}
+
+	start(s.watch)
+	start(s.report)
+	if config.Compact != nil && config.CompactInterval > 0 {
+		start(s.compact)
+	}
+	for i := 0; i < config.Workers; i++ {
+		w := &worker{
+			soak:   s,
+			prefix: fmt.Sprintf("%s%d/", config.Prefix, i),
+			rand:   rand.New(rand.NewSource(config.Seed + int64(i))),
+			keys:   map[string]*server.KeyValue{},
+		}
+		start(w.run)
+	}
+	wg.Wait()
+
+	if fail != nil {
+		return s.stats, fail
+	}
+	// the run ended normally, so all writes should be delivered once the
+	// watch catches up
+	return s.stats, s.checkPending(time.Now())
+}
+
+type pendingWrite struct {
+	key   string
+	acked time.Time
+}
+
+type soak struct {
+	backend server.Backend
+	config  Config
+	stats   *Stats
+
+	mu       sync.Mutex
+	lastRev  int64
+	watchRev int64
+	pending  map[int64]pendingWrite
+	// early holds the keys of events delivered before their write was acknowledged
+	early map[int64]string
+}
+
+// acked records a write acknowledged at revision, verifying that it is after all
+// previously acknowledged writes that completed before it started.
+func (s *soak) acked(key string, rev, floor int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rev <= floor {
+		return fmt.Errorf("write to %s returned revision %d, not after revision %d acknowledged before it started", key, rev, floor)
+	}
+	if earlyKey, ok := s.early[rev]; ok {
+		delete(s.early, rev)
+		if earlyKey != key {
+			return fmt.Errorf("write to %s returned revision %d, which the watch delivered as a write to %s", key, rev, earlyKey)
+		}
+	} else if _, ok := s.pending[rev]; ok || rev <= s.watchRev {
+		return fmt.Errorf("write to %s returned revision %d, which was already used", key, rev)
+	} else {
+		s.pending[rev] = pendingWrite{key: key, acked: time.Now()}
+	}
+	if rev > s.lastRev {
+		s.lastRev = rev
+		atomic.StoreInt64(&s.stats.LastRevision, rev)
+	}
+	atomic.AddInt64(&s.stats.Writes, 1)
+	return nil
+}
+
+func (s *soak) floor() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastRev
+}
+
+// observed records an event received by the watch.
+func (s *soak) observed(e *server.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rev := e.KV.ModRevision
+	if rev <= s.watchRev {
+		return fmt.Errorf("watch delivered %s at revision %d after revision %d", e.KV.Key, rev, s.watchRev)
+	}
+	// writes are acknowledged after they are committed, so an event may arrive
+	// before its write is recorded; it is only an error if a later write was
+	// delivered while an earlier acknowledged one is missing
+	for pendingRev, w := range s.pending {
+		if pendingRev < rev {
+			return fmt.Errorf("watch skipped write to %s at revision %d, delivering %s at revision %d", w.key, pendingRev, e.KV.Key, rev)
+		}
+	}
+	if w, ok := s.pending[rev]; !ok {
+		s.early[rev] = e.KV.Key
+	} else if w.key != e.KV.Key {
+		return fmt.Errorf("watch delivered %s at revision %d, which was acknowledged as a write to %s", e.KV.Key, rev, w.key)
+	}
+	delete(s.pending, rev)
+	s.watchRev = rev
+	atomic.AddInt64(&s.stats.Events, 1)
+	return nil
+}
+
+// checkPending returns an error if any write acknowledged before the grace
+// period has not been delivered by the watch.
+func (s *soak) checkPending(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var missing []int64
+	for rev, w := range s.pending {
+		if rev <= s.watchRev || now.Sub(w.acked) > watchGracePeriod {
+			missing = append(missing, rev)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	w := s.pending[missing[0]]
+	return fmt.Errorf("watch did not deliver %d acknowledged writes, the first to %s at revision %d", len(missing), w.key, missing[0])
+}
+
+// watch follows all events under the prefix, resubscribing periodically from
+// the revision after the last event received.
+func (s *soak) watch(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		from := s.watchRev + 1
+		s.mu.Unlock()
+
+		compactRev, err := s.backend.CompactRevision(ctx)
+		if err != nil {
+			return errors.Wrap(err, "getting compact revision")
+		}
+		if from <= compactRev {
+			return fmt.Errorf("compacted to revision %d past the watch at revision %d", compactRev, from-1)
+		}
+
+		if err := s.follow(ctx, from); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		atomic.AddInt64(&s.stats.Resubscribes, 1)
+	}
+}
+
+func (s *soak) follow(ctx context.Context, from int64) error {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var resubscribe <-chan time.Time
+	if s.config.ResubscribeInterval > 0 {
+		t := time.NewTimer(s.config.ResubscribeInterval)
+		defer t.Stop()
+		resubscribe = t.C
+	}
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+
+	events := s.backend.Watch(wctx, s.config.Prefix, from)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-resubscribe:
+			return nil
+		case <-check.C:
+			if err := s.checkPending(time.Now()); err != nil {
+				return err
+			}
+		case batch, ok := <-events:
+			if !ok {
+				// the backend closed the watch; resume it
+				return nil
+			}
+			for _, e := range batch {
+				if err := s.observed(e); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// compact periodically compacts up to the last revision seen by the watch, so
+// that resubscriptions are never compacted.
+func (s *soak) compact(ctx context.Context) error {
+	t := time.NewTicker(s.config.CompactInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+		s.mu.Lock()
+		target := s.watchRev
+		s.mu.Unlock()
+
+		rev, err := s.config.Compact(ctx, target)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrapf(err, "compacting to revision %d", target)
+		}
+		atomic.AddInt64(&s.stats.Compactions, 1)
+		atomic.StoreInt64(&s.stats.CompactedTo, rev)
+	}
+}
+
+func (s *soak) report(ctx context.Context) error {
+	t := time.NewTicker(reportInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			logrus.Infof("Soak progress: %s", s.stats)
+		}
+	}
+}
+
+// worker writes its own keys, so that it can predict the exact result of every
+// read of them.
+type worker struct {
+	soak   *soak
+	prefix string
+	rand   *rand.Rand
+	keys   map[string]*server.KeyValue
+}
+
+func (w *worker) run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		key := w.prefix + strconv.Itoa(w.rand.Intn(w.soak.config.Keys))
+		var err error
+		switch n := w.rand.Intn(100); {
+		case n < 40:
+			err = w.write(ctx, key)
+		case n < 55:
+			err = w.delete(ctx, key)
+		case n < 60:
+			err = w.staleUpdate(ctx, key)
+		case n < 90:
+			err = w.get(ctx, key)
+		default:
+			err = w.list(ctx)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *worker) value() []byte {
+	return []byte(strconv.FormatInt(w.rand.Int63(), 36))
+}
+
+func (w *worker) write(ctx context.Context, key string) error {
+	value := w.value()
+	floor := w.soak.floor()
+	prev := w.keys[key]
+	if prev == nil {
+		rev, err := w.soak.backend.Create(ctx, key, value, 0)
+		if err != nil {
+			return errors.Wrapf(err, "creating %s", key)
+		}
+		w.keys[key] = &server.KeyValue{Key: key, Value: value, CreateRevision: rev, ModRevision: rev}
+		return w.soak.acked(key, rev, floor)
+	}
+
+	rev, kv, ok, err := w.soak.backend.Update(ctx, key, value, prev.ModRevision, 0)
+	if err != nil {
+		return errors.Wrapf(err, "updating %s", key)
+	}
+	if !ok {
+		return fmt.Errorf("update of %s at its current revision %d failed, got revision %d", key, prev.ModRevision, modRevision(kv))
+	}
+	w.keys[key] = &server.KeyValue{Key: key, Value: value, CreateRevision: prev.CreateRevision, ModRevision: rev}
+	return w.soak.acked(key, rev, floor)
+}
+
+func (w *worker) delete(ctx context.Context, key string) error {
+	prev := w.keys[key]
+	if prev == nil {
+		return nil
+	}
+	floor := w.soak.floor()
+	rev, _, deleted, err := w.soak.backend.Delete(ctx, key, prev.ModRevision)
+	if err != nil {
+		return errors.Wrapf(err, "deleting %s", key)
+	}
+	if !deleted {
+		return fmt.Errorf("delete of %s at its current revision %d failed", key, prev.ModRevision)
+	}
+	delete(w.keys, key)
+	return w.soak.acked(key, rev, floor)
+}
+
+// staleUpdate verifies that an update conditional on an old revision fails.
+func (w *worker) staleUpdate(ctx context.Context, key string) error {
+	prev := w.keys[key]
+	if prev == nil || prev.ModRevision == prev.CreateRevision {
+		return nil
+	}
+	_, kv, ok, err := w.soak.backend.Update(ctx, key, w.value(), prev.CreateRevision, 0)
+	if err != nil {
+		return errors.Wrapf(err, "updating %s", key)
+	}
+	if ok {
+		return fmt.Errorf("update of %s at stale revision %d succeeded", key, prev.CreateRevision)
+	}
+	if modRevision(kv) != prev.ModRevision {
+		return fmt.Errorf("stale update of %s returned revision %d, expected %d", key, modRevision(kv), prev.ModRevision)
+	}
+	atomic.AddInt64(&w.soak.stats.StaleConflict, 1)
+	return nil
+}
+
+func (w *worker) get(ctx context.Context, key string) error {
+	_, kv, err := w.soak.backend.Get(ctx, key, 0)
+	if err != nil {
+		return errors.Wrapf(err, "getting %s", key)
+	}
+	atomic.AddInt64(&w.soak.stats.Reads, 1)
+	return expect(key, w.keys[key], kv)
+}
+
+func (w *worker) list(ctx context.Context) error {
+	_, kvs, err := w.soak.backend.List(ctx, w.prefix, "", 0, 0)
+	if err != nil {
+		return errors.Wrapf(err, "listing %s", w.prefix)
+	}
+	atomic.AddInt64(&w.soak.stats.Lists, 1)
+
+	seen := map[string]bool{}
+	for _, kv := range kvs {
+		if seen[kv.Key] {
+			return fmt.Errorf("list of %s returned %s more than once", w.prefix, kv.Key)
+		}
+		seen[kv.Key] = true
+		if err := expect(kv.Key, w.keys[kv.Key], kv); err != nil {
+			return errors.Wrapf(err, "listing %s", w.prefix)
+		}
+	}
+	if len(seen) != len(w.keys) {
+		return fmt.Errorf("list of %s returned %d keys, expected %d", w.prefix, len(seen), len(w.keys))
+	}
+	return nil
+}
+
+func expect(key string, want, got *server.KeyValue) error {
+	switch {
+	case want == nil && got == nil:
+		return nil
+	case want == nil:
+		return fmt.Errorf("read deleted key %s at revision %d", key, got.ModRevision)
+	case got == nil:
+		return fmt.Errorf("key %s written at revision %d is missing", key, want.ModRevision)
+	case got.ModRevision != want.ModRevision || got.CreateRevision != want.CreateRevision || string(got.Value) != string(want.Value):
+		return fmt.Errorf("read %s at revision %d (created %d), expected revision %d (created %d)",
+			key, got.ModRevision, got.CreateRevision, want.ModRevision, want.CreateRevision)
+	}
+	return nil
+}
+
+func modRevision(kv *server.KeyValue) int64 {
+	if kv == nil {
+		return 0
+	}
+	return kv.ModRevision
+}
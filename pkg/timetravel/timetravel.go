@@ -0,0 +1,153 @@
+// Package timetravel maps wall-clock times to revisions, so that the keyspace can
+// be read as it was at a point in time. The datastore does not record when each
+// revision was written, so a clock key outside of the etcd keyspace is updated
+// with the current time at a regular interval; the history of the clock key
+// brackets the time of every revision between its updates, for as long as that
+// history is retained by compaction.
+package timetravel
+
+import (
+	"context"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ClockKey holds the time at which it was last updated.
+	ClockKey = "kine_revision_clock"
+
+	DefaultInterval = time.Minute
+)
+
+// leaderBackend is implemented by backends that only accept writes on one
+// instance; the clock is only updated by that instance.
+type leaderBackend interface {
+	IsLeader() bool
+}
+
+// Start updates the clock key every interval until the context is cancelled.
+func Start(ctx context.Context, backend server.Backend, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			if lb, ok := backend.(leaderBackend); !ok || lb.IsLeader() {
+				if err := tick(ctx, backend); err != nil && ctx.Err() == nil {
+					logrus.Errorf("Failed to update revision clock: %v", err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+func tick(ctx context.Context, backend server.Backend) error {
+	value := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	_, kv, err := backend.Get(ctx, ClockKey, 0)
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		_, err = backend.Create(ctx, ClockKey, value, 0)
+		return err
+	}
+	_, _, _, err = backend.Update(ctx, ClockKey, value, kv.ModRevision, 0)
+	return err
+}
+
+// Resolution is the revision resolved for a point in time.
+type Resolution struct {
+	// Revision is the latest revision known to have been written at or before
+	// the requested time.
+	Revision int64
+	// Time is when Revision was written, to within the clock interval.
+	Time time.Time
+	// UpperRevision is the latest revision that may have been written at or
+	// before the requested time; revisions between Revision and UpperRevision
+	// were written between clock updates either side of the requested time.
+	UpperRevision int64
+}
+
+// Resolve returns the revision of the keyspace at time t. It returns
+// server.ErrCompacted if the history at t has been compacted, or was written
+// before the clock was started.
+func Resolve(ctx context.Context, backend server.Backend, t time.Time) (*Resolution, error) {
+	compactRev, err := backend.CompactRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	currentRev, _, err := backend.Get(ctx, ClockKey, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// find the first revision at which the clock reads after t; the clock
+	// reading at a revision never decreases as the revision increases
+	lo, hi := compactRev+1, currentRev+1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		clock, _, err := clockAt(ctx, backend, mid)
+		if err != nil {
+			return nil, err
+		}
+		if clock.IsZero() || !clock.After(t) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	upper := lo - 1
+	clock, rev, err := clockAt(ctx, backend, upper)
+	if err != nil {
+		return nil, err
+	}
+	if clock.IsZero() || rev <= compactRev {
+		return nil, server.ErrCompacted
+	}
+	return &Resolution{
+		Revision:      rev,
+		Time:          clock,
+		UpperRevision: upper,
+	}, nil
+}
+
+// clockAt returns the clock reading at a revision, and the revision at which it
+// was written, or a zero time if the clock had not been written by then.
+func clockAt(ctx context.Context, backend server.Backend, revision int64) (time.Time, int64, error) {
+	if revision <= 0 {
+		return time.Time{}, 0, nil
+	}
+	_, kv, err := backend.Get(ctx, ClockKey, revision)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if kv == nil {
+		return time.Time{}, 0, nil
+	}
+	clock, err := time.Parse(time.RFC3339Nano, string(kv.Value))
+	if err != nil {
+		return time.Time{}, 0, errors.Wrapf(err, "parsing revision clock at revision %d", kv.ModRevision)
+	}
+	return clock, kv.ModRevision, nil
+}
+
+// List resolves t to a revision and lists the keys with the prefix at it.
+func List(ctx context.Context, backend server.Backend, t time.Time, prefix string) (*Resolution, []*server.KeyValue, error) {
+	res, err := Resolve(ctx, backend, t)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "resolving %s to a revision", t.Format(time.RFC3339))
+	}
+	_, kvs, err := backend.List(ctx, prefix, "", 0, res.Revision)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, kvs, nil
+}
@@ -0,0 +1,240 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultCARefreshInterval = time.Hour
+
+	caURLTimeout   = 30 * time.Second
+	maxCABundleLen = 16 << 20
+)
+
+var (
+	caPoolsLock sync.Mutex
+	caPools     = map[string]*caPool{}
+)
+
+// caPool is a set of trusted CAs loaded from a file, a directory of PEM files,
+// and/or an HTTPS URL, which is reloaded periodically so that CA and
+// intermediate rotation does not require restarting kine.
+type caPool struct {
+	sync.RWMutex
+	file string
+	dir  string
+	url  string
+
+	pool       *x509.CertPool
+	bundle     []byte
+	bundleFile string
+}
+
+// dynamicCA returns true if trusted CAs are loaded from a source that is
+// refreshed periodically.
+func (c Config) dynamicCA() bool {
+	return c.CADir != "" || c.CAURL != ""
+}
+
+// caPool returns the shared, periodically refreshed CA pool for the configured sources.
+func (c Config) caPool() (*caPool, error) {
+	caPoolsLock.Lock()
+	defer caPoolsLock.Unlock()
+
+	key := strings.Join([]string{c.CAFile, c.CADir, c.CAURL}, "\x00")
+	if p, ok := caPools[key]; ok {
+		return p, nil
+	}
+
+	p := &caPool{
+		file: c.CAFile,
+		dir:  c.CADir,
+		url:  c.CAURL,
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+
+	interval := c.CARefreshInterval
+	if interval <= 0 {
+		interval = DefaultCARefreshInterval
+	}
+	go p.refresh(interval)
+
+	caPools[key] = p
+	return p, nil
+}
+
+func (p *caPool) refresh(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		if err := p.load(); err != nil {
+			logrus.Errorf("Failed to refresh trusted CAs, continuing to use existing CAs: %v", err)
+		}
+	}
+}
+
+func (p *caPool) load() error {
+	var bundle bytes.Buffer
+
+	if p.file != "" {
+		b, err := ioutil.ReadFile(p.file)
+		if err != nil {
+			return err
+		}
+		bundle.Write(b)
+		bundle.WriteString("\n")
+	}
+
+	if p.dir != "" {
+		entries, err := ioutil.ReadDir(p.dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if entry.IsDir() || (ext != ".pem" && ext != ".crt") {
+				continue
+			}
+			b, err := ioutil.ReadFile(filepath.Join(p.dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+			bundle.Write(b)
+			bundle.WriteString("\n")
+		}
+	}
+
+	if p.url != "" {
+		b, err := fetchCABundle(p.url)
+		if err != nil {
+			return err
+		}
+		bundle.Write(b)
+		bundle.WriteString("\n")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle.Bytes()) {
+		return errors.New("no certificates found in trusted CA sources")
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	changed := !bytes.Equal(p.bundle, bundle.Bytes())
+	p.pool = pool
+	p.bundle = bundle.Bytes()
+	if changed && p.bundleFile != "" {
+		if err := writeFileAtomic(p.bundleFile, p.bundle); err != nil {
+			return err
+		}
+	}
+	if changed {
+		logrus.Infof("Loaded trusted CAs from %s", p.sources())
+	}
+	return nil
+}
+
+func (p *caPool) sources() string {
+	var sources []string
+	for _, s := range []string{p.file, p.dir, p.url} {
+		if s != "" {
+			sources = append(sources, s)
+		}
+	}
+	return strings.Join(sources, ", ")
+}
+
+// Pool returns the current set of trusted CAs.
+func (p *caPool) Pool() *x509.CertPool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.pool
+}
+
+// BundleFile returns the path of a file that is kept up to date with the
+// current trusted CAs, for clients that only accept a CA file path and re-read
+// it for each connection.
+func (p *caPool) BundleFile() (string, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.bundleFile != "" {
+		return p.bundleFile, nil
+	}
+
+	f, err := ioutil.TempFile("", "kine-ca-*.pem")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	if err := writeFileAtomic(f.Name(), p.bundle); err != nil {
+		return "", err
+	}
+	p.bundleFile = f.Name()
+	return p.bundleFile, nil
+}
+
+// verifyConnection verifies the server certificate chain and hostname against
+// the current trusted CAs. It is used in place of the standard verification,
+// which can only use a fixed set of CAs.
+func (p *caPool) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+	if cs.ServerName == "" {
+		return errors.New("server name is required to verify the server certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         p.Pool(),
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func fetchCABundle(url string) ([]byte, error) {
+	if !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("trusted CA URL %s must use https", url)
+	}
+	client := &http.Client{Timeout: caURLTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching trusted CAs from %s returned %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxCABundleLen))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
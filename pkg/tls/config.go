@@ -2,6 +2,13 @@ package tls
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
 
 	"go.etcd.io/etcd/client/pkg/v3/transport"
 )
@@ -10,10 +17,37 @@ type Config struct {
 	CAFile   string
 	CertFile string
 	KeyFile  string
+	// CADir and CAURL are additional sources of trusted CAs: a directory of PEM
+	// files, and an HTTPS URL serving a PEM bundle. If either is set, all CA
+	// sources are reloaded every CARefreshInterval.
+	CADir             string
+	CAURL             string
+	CARefreshInterval time.Duration
+	// KeyPassphrase and KeyPassphraseFile supply the passphrase for an encrypted
+	// KeyFile. If both are set, the file takes precedence.
+	KeyPassphrase     string
+	KeyPassphraseFile string
+	// PKCS11 configures a private key held in an HSM or TPM, which is used
+	// instead of KeyFile when a module is set.
+	PKCS11 PKCS11Config
+}
+
+type PKCS11Config struct {
+	Module     string
+	TokenLabel string
+	Slot       int
+	PIN        string
+	PINFile    string
+	KeyLabel   string
+}
+
+// HasKeyPair returns true if both a certificate and private key are configured.
+func (c Config) HasKeyPair() bool {
+	return c.CertFile != "" && (c.KeyFile != "" || c.PKCS11.Module != "")
 }
 
 func (c Config) ClientConfig() (*tls.Config, error) {
-	if c.CertFile == "" && c.KeyFile == "" && c.CAFile == "" {
+	if c.CertFile == "" && c.KeyFile == "" && c.CAFile == "" && !c.dynamicCA() {
 		return nil, nil
 	}
 
@@ -22,10 +56,133 @@ func (c Config) ClientConfig() (*tls.Config, error) {
 		KeyFile:       c.KeyFile,
 		TrustedCAFile: c.CAFile,
 	}
+	if c.encrypted() {
+		// the etcd transport can only load plaintext keys, so the decrypted keypair is added afterwards
+		info.CertFile = ""
+		info.KeyFile = ""
+	}
+	if c.dynamicCA() {
+		// the etcd transport can only load a fixed CA file, so the server certificate is verified afterwards
+		info.TrustedCAFile = ""
+	}
+
 	tlsConfig, err := info.ClientConfig()
 	if err != nil {
 		return nil, err
 	}
 
+	if c.encrypted() {
+		cert, err := c.Certificate()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.dynamicCA() {
+		pool, err := c.caPool()
+		if err != nil {
+			return nil, err
+		}
+		// Standard verification is skipped as it cannot use a changing set of CAs;
+		// VerifyConnection performs equivalent chain and hostname verification.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = pool.verifyConnection
+	}
+
 	return tlsConfig, nil
 }
+
+// CABundleFile returns the path of a file containing the trusted CAs, for clients
+// that only accept a file path. If CAs are loaded from a directory or URL, the
+// file is kept up to date as they are refreshed.
+func (c Config) CABundleFile() (string, error) {
+	if !c.dynamicCA() {
+		return c.CAFile, nil
+	}
+	pool, err := c.caPool()
+	if err != nil {
+		return "", err
+	}
+	return pool.BundleFile()
+}
+
+// ServerConfig returns a TLS config for serving with the configured certificate
+// and key, or nil if either is not set.
+func (c Config) ServerConfig() (*tls.Config, error) {
+	if !c.HasKeyPair() {
+		return nil, nil
+	}
+	cert, err := c.Certificate()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// Certificate loads the configured certificate and key, decrypting the key if a
+// passphrase is configured. Only keys encrypted with the legacy PEM encryption
+// used by "openssl rsa -aes256 -traditional" and similar are supported.
+func (c Config) Certificate() (tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(c.CertFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if c.PKCS11.Module != "" {
+		return pkcs11Certificate(certPEM, c.PKCS11)
+	}
+
+	keyPEM, err := ioutil.ReadFile(c.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if c.encrypted() {
+		passphrase, err := c.passphrase()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if keyPEM, err = decryptKey(keyPEM, passphrase); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to decrypt key file %s: %v", c.KeyFile, err)
+		}
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// encrypted returns true if a passphrase was provided for the key.
+func (c Config) encrypted() bool {
+	return c.KeyPassphrase != "" || c.KeyPassphraseFile != ""
+}
+
+func (c Config) passphrase() ([]byte, error) {
+	if c.KeyPassphraseFile != "" {
+		b, err := ioutil.ReadFile(c.KeyPassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(b), "\r\n")), nil
+	}
+	return []byte(c.KeyPassphrase), nil
+}
+
+func decryptKey(keyPEM, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, errors.New("encrypted PKCS#8 keys are not supported, convert the key to the traditional format with openssl")
+	}
+	if !x509.IsEncryptedPEMBlock(block) {
+		return keyPEM, nil
+	}
+	der, err := x509.DecryptPEMBlock(block, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+}
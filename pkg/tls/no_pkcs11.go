@@ -0,0 +1,13 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package tls
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+func pkcs11Certificate(certPEM []byte, config PKCS11Config) (tls.Certificate, error) {
+	return tls.Certificate{}, errors.New(`this binary is built without PKCS#11 support, compile with "-tags pkcs11"`)
+}
@@ -0,0 +1,98 @@
+//go:build pkcs11
+// +build pkcs11
+
+package tls
+
+// Building with PKCS#11 support requires cgo and the crypto11 module, which is
+// not a default dependency: go get github.com/ThalesIgnite/crypto11
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+type pkcs11Key struct {
+	PKCS11Config
+	certPEM string
+}
+
+var (
+	pkcs11Lock  sync.Mutex
+	pkcs11Certs = map[pkcs11Key]tls.Certificate{}
+)
+
+// pkcs11Certificate returns a certificate whose private key operations are
+// performed by a PKCS#11 module. The key never leaves the token; the module and
+// session remain open for the life of the process, and are shared by all
+// servers using the same configuration.
+func pkcs11Certificate(certPEM []byte, config PKCS11Config) (tls.Certificate, error) {
+	pkcs11Lock.Lock()
+	defer pkcs11Lock.Unlock()
+
+	key := pkcs11Key{PKCS11Config: config, certPEM: string(certPEM)}
+	if cert, ok := pkcs11Certs[key]; ok {
+		return cert, nil
+	}
+	cert, err := loadPKCS11Certificate(certPEM, config)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pkcs11Certs[key] = cert
+	return cert, nil
+}
+
+func loadPKCS11Certificate(certPEM []byte, config PKCS11Config) (tls.Certificate, error) {
+	pin := config.PIN
+	if config.PINFile != "" {
+		b, err := ioutil.ReadFile(config.PINFile)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		pin = strings.TrimRight(string(b), "\r\n")
+	}
+
+	c11config := &crypto11.Config{
+		Path:       config.Module,
+		TokenLabel: config.TokenLabel,
+		Pin:        pin,
+	}
+	if config.TokenLabel == "" {
+		slot := config.Slot
+		c11config.SlotNumber = &slot
+	}
+
+	ctx, err := crypto11.Configure(c11config)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to open PKCS#11 module %s: %v", config.Module, err)
+	}
+
+	signer, err := ctx.FindKeyPair(nil, []byte(config.KeyLabel))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to find PKCS#11 key %s: %v", config.KeyLabel, err)
+	}
+	if signer == nil {
+		return tls.Certificate{}, fmt.Errorf("PKCS#11 key %s not found", config.KeyLabel)
+	}
+
+	cert := tls.Certificate{PrivateKey: signer}
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, errors.New("no certificates found in certificate file")
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return tls.Certificate{}, err
+	}
+	return cert, nil
+}